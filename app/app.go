@@ -10,6 +10,7 @@ import (
 	"mime"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func MainApplication(request *core.HttpRequest) ([]byte, error) {
@@ -18,7 +19,7 @@ func MainApplication(request *core.HttpRequest) ([]byte, error) {
 	}
 	if request.Method == "OPTIONS" {
 		response := core.HTTP200.Copy()
-		allowedOrigins := strings.Join(core.ALLOWED_HOSTS, ", ")
+		allowedOrigins := strings.Join(config.Server.AllowedHosts, ", ")
 		allowedMethods := strings.Join(core.ALLOWED_METHODS, ", ")
 		allowedContentTypes := strings.Join(core.SUPPORTED_MEDIA_TYPES, ", ")
 		response.SetHeader("Access-Control-Allow-Origin", allowedOrigins)
@@ -37,17 +38,34 @@ func MainApplication(request *core.HttpRequest) ([]byte, error) {
 			return core.HTTP400.Copy().ToBytes(), nil
 		}
 	}
-	view := router(request.Url)
-	if view == nil {
+	start := time.Now()
+	_, routeSpan := core.StartSpan(request.Context(), "router", core.SpanKindInternal)
+	route, ok := router(request.Url)
+	routeName := route.name
+	routeSpan.SetAttribute("http.route", routeName)
+	routeSpan.Finish()
+	if !ok {
+		observeRequest("not_found", request.Method, 404, start)
 		return core.HTTP404.Copy().ToBytes(), nil
 	}
+	core.SpanFromContext(request.Context()).SetName(request.Method + " " + routeName)
 
 	CheckAuth(request)
-
-	response := view(*request)
+	var response core.HttpResponse
+	switch authorize(request, route) {
+	case 401:
+		response = *core.HTTP401.Copy()
+		response.Body = `{"Message": "Authorization required"}`
+	case 403:
+		response = *core.HTTP403.Copy()
+		response.Body = `{"Message": "Insufficient permissions"}`
+	default:
+		response = route.HandlerFunc(*request)
+	}
 	if response.Body != "" {
 		response.SetHeader("Content-Length", strconv.Itoa(len(response.Body)))
 	}
+	observeRequest(routeName, request.Method, response.Status, start)
 
 	return response.ToBytes(), nil
 }
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"RestAPI/core"
+	"RestAPI/user"
+	"testing"
+)
+
+/*
+Test routing.go
+Права на роуты проверяются только здесь, обработчики их не повторяют и берут пользователя без проверки на nil
+*/
+func TestAuthorize(t *testing.T) {
+	RegisterRoutes()
+
+	member := &core.Principal{UserID: 1, Roles: []string{"user"}, Permissions: []string{user.PermissionImagesGenerate, user.PermissionImagesRead}}
+	admin := &core.Principal{UserID: 2, Roles: []string{"admin"}, Permissions: []string{"*"}}
+	apiKey := &core.Principal{UserID: 2, Permissions: []string{"*"}, Scopes: []string{user.PermissionImagesGenerate}}
+	// Клиентский сертификат администратора: все права, но без пользователя
+	certificate := &core.Principal{Roles: []string{"admin"}, Permissions: []string{"*"}}
+
+	testCases := []struct {
+		url       string
+		principal *core.Principal
+		expected  int
+	}{
+		{"/admin/users", nil, 401},
+		{"/admin/users", member, 403},
+		{"/admin/users", admin, 0},
+		{"/admin/users", apiKey, 403},
+		{"/admin/users", certificate, 0},
+		{"/admin/users/5/ban", member, 403},
+		{"/admin/users/5/ban", &core.Principal{Permissions: []string{user.PermissionUsersRead}}, 403},
+		{"/admin/users/5/ban", &core.Principal{Permissions: []string{user.PermissionUsersManage}}, 0},
+		{"/admin/users/5/impersonate", &core.Principal{Permissions: []string{user.PermissionUsersManage}}, 403},
+		{"/admin/audit", member, 403},
+		{"/admin/audit", &core.Principal{Permissions: []string{user.PermissionAuditRead}}, 0},
+		{"/admin/diagnostics", nil, 401},
+		{"/admin/diagnostics", member, 403},
+		{"/admin/diagnostics/pprof/heap", member, 403},
+		{"/admin/diagnostics/pprof/heap", &core.Principal{Permissions: []string{user.PermissionDiagnosticsRead}}, 0},
+		{"/user/me", nil, 401},
+		{"/user/me", member, 0},
+		{"/user/me", apiKey, 403},
+		{"/user/me", certificate, 403},
+		{"/image/generate", apiKey, 0},
+		{"/image/generate", certificate, 403},
+		{"/image/get", apiKey, 403},
+		{"/user/auth", nil, 0},
+	}
+	for _, tc := range testCases {
+		info, ok := router(tc.url)
+		if !ok {
+			t.Fatalf("No route for %s", tc.url)
+		}
+		request := &core.HttpRequest{Url: tc.url, Principal: tc.principal}
+		if status := authorize(request, info); status != tc.expected {
+			t.Errorf("%s with %+v: expected %d, got %d", tc.url, tc.principal, tc.expected, status)
+		}
+	}
+}
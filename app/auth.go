@@ -4,39 +4,67 @@ import (
 	"RestAPI/core"
 	"RestAPI/db"
 	"RestAPI/user"
+	"errors"
 	"fmt"
 	"strings"
 )
 
+/*
+Авторизация запроса: JWT access токен сессии, API ключ (заголовок X-API-Key или Bearer с префиксом ключа)
+или клиентский сертификат администратора. В запрос записываются пользователь и его права (request.Principal)
+*/
 func CheckAuth(req *core.HttpRequest) {
-	token, ok := req.Headers["Authorization"]
-	if !ok || !strings.HasPrefix(token, "Bearer ") {
-		return
-	}
-	token = strings.TrimPrefix(token, "Bearer ")
+	ctx, span := core.StartSpan(req.Context(), "auth.CheckAuth", core.SpanKindInternal)
+	defer span.Finish()
 
-	tokenRecord := new(db.Token)
-	result := db.DB.Where("access_token = ?", token).First(tokenRecord)
-	if result.Error != nil {
-		return
+	token := req.Header("X-API-Key")
+	if token == "" {
+		if auth, ok := req.Headers["Authorization"]; ok && strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+	} else if !user.IsAPIKey(token) {
+		token = ""
 	}
 
-	userDB := new(db.User)
-	result = db.DB.First(userDB, tokenRecord.UserID)
-	if result.Error != nil {
+	var (
+		userDB  *db.User
+		session *db.Session
+		scopes  []string
+		err     error
+	)
+	switch {
+	case token == "":
+		principal, err := user.CertificatePrincipal(ctx, *req)
+		if err != nil {
+			fmt.Println("Error loading certificate permissions:", err)
+		}
+		req.Principal = principal
 		return
+	case user.IsAPIKey(token):
+		var apiKey *db.APIKey
+		userDB, apiKey, err = user.AuthenticateAPIKey(ctx, token, req.RemoteAddr)
+		if err == nil {
+			scopes = apiKey.Scopes
+		}
+	default:
+		userDB, session, err = user.Authenticate(ctx, token)
 	}
-	if !userDB.IsActive {
+	if err != nil {
+		if !errors.Is(err, db.ErrNotFound) {
+			fmt.Println("Error validating token:", err)
+		}
 		return
 	}
 
-	claims, err := user.ValidateToken(token)
+	principal, err := user.LoadPrincipal(ctx, userDB, scopes)
 	if err != nil {
-		fmt.Println("Error validating token:", err)
-		return
-	}
-	if claims["token_type"] != "access" {
+		fmt.Println("Error loading user permissions:", err)
 		return
 	}
+	span.SetAttribute("enduser.id", userDB.Identity())
 	req.User = userDB
+	req.Principal = principal
+	if session != nil {
+		req.SetContext(user.ContextWithSession(req.Context(), session))
+	}
 }
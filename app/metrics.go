@@ -0,0 +1,30 @@
+package app
+
+import (
+	"RestAPI/core"
+	"strconv"
+	"time"
+)
+
+var (
+	requestDuration = core.NewHistogramVec(
+		"imagolab_http_request_duration_seconds",
+		"Duration of HTTP requests by route name",
+		core.DefaultBuckets,
+		"route", "method", "status",
+	)
+	requestsTotal = core.NewCounterVec(
+		"imagolab_http_requests_total",
+		"Total number of HTTP requests by route name",
+		"route", "method", "status",
+	)
+)
+
+func observeRequest(route string, method string, status int, start time.Time) {
+	if route == "" {
+		route = "unnamed"
+	}
+	statusStr := strconv.Itoa(status)
+	requestDuration.Observe(time.Since(start).Seconds(), route, method, statusStr)
+	requestsTotal.Inc(route, method, statusStr)
+}
@@ -1,8 +1,11 @@
 package app
 
 import (
+	"RestAPI/core"
+	"RestAPI/db"
 	"RestAPI/docs"
 	"RestAPI/media"
+	"RestAPI/monitoring"
 	pg "RestAPI/pictureGeneration"
 	"RestAPI/user"
 )
@@ -11,27 +14,87 @@ import (
 	Функция InitHandler() - инициализация списка представлений
 	После создания представлений их необходимо зарегистрировать в этой функции, чтобы они были доступны для обработки запросов
 	Для регистрации нужно передать url, по которому будет доступно представление, указатель на функцию-обработчик и имя предсталвения(оно должно совпадать с именем в документации для корректной работы)
+	После имени указываются требования доступа: authRequired() - только для авторизованных пользователей, requirePermission(...) - нужны права
+	(их можно совмещать: роут для пользователей с правами, например генерация изображений по API ключу)
+	Требования проверяются до вызова обработчика и выводятся в документации
 	При регистрации роута можно использовать плейсхолдеры вида {int:<int>} или {<string>} для передачи параметров в запросе
 	Роутер выдаст указатель на функцию, которая будет обрабатывать запрос или nil, если функции не нашлось
+	Перед регистрацией в пакеты приложений передаются их настройки из конфигурации и репозитории
+	RegisterRoutes() - только регистрация роутов, без настроек (используется командой routes)
 */
 
-func InitHandlers() {
+var (
+	config = core.DefaultConfig()
+	repos  *db.Repositories
+)
+
+func InitHandlers(cfg *core.Config, repositories *db.Repositories) error {
+	if err := user.Init(cfg, repositories); err != nil {
+		return err
+	}
+	media.Init(cfg.Media)
+	pg.Init(cfg.Runware, repositories)
+	monitoring.Init(cfg)
+	config = cfg
+	repos = repositories
+
+	RegisterRoutes()
+	return nil
+}
+
+func RegisterRoutes() {
 	registerHandler("/api/docs", docs.GetDocs, "docs")
 	registerHandler("/api/docs/templates/css/styles.css", docs.GetDocsCSS, "docs")
 	registerHandler("/api/docs/templates/js/script.js", docs.GetDocsJS, "docs")
 	registerHandler("/images/{string:filename}", media.ImageHandler, "images")
+	registerHandler("/metrics", monitoring.MetricsHandler, "metrics")
+	registerHandler("/healthz", monitoring.HealthzHandler, "healthz")
+	registerHandler("/readyz", monitoring.ReadyzHandler, "readyz")
+	registerHandler("/version", monitoring.VersionHandler, "version")
+	registerHandler("/admin/diagnostics", monitoring.DiagnosticsHandler, "diagnostics", requirePermission(user.PermissionDiagnosticsRead))
+	registerHandler("/admin/diagnostics/pprof/{string:profile}", monitoring.PprofHandler, "pprof", requirePermission(user.PermissionDiagnosticsRead))
 
 	registerHandler("/user/create", user.CreateUserHandler, "createUser")
 	registerHandler("/user/send_otp", user.SendOtpHandler, "sendOtp")
 	registerHandler("/user/activate", user.ActivateAccountHandler, "activateUser")
 	registerHandler("/user/auth", user.AuthUserHandler, "verifyUser")
+	registerHandler("/user/auth/mfa", user.VerifyMfaHandler, "verifyMfa")
+	registerHandler("/user/oidc/providers", user.OIDCProvidersHandler, "oidcProviders")
+	registerHandler("/user/oidc/{string:provider}/start", user.OIDCStartHandler, "oidcStart")
+	registerHandler("/user/oidc/{string:provider}/callback", user.OIDCCallbackHandler, "oidcCallback")
 	registerHandler("/user/get/{int:ID}", user.GetUserHandler, "getUser")
-	registerHandler("/user/me", user.GetMeHandler, "deleteUser")
-	registerHandler("/user/update", user.UpdateUserHandler, "updateUser")
+	registerHandler("/user/me", user.MeHandler, "me", authRequired())
+	registerHandler("/user/restore", user.RestoreAccountHandler, "restoreAccount")
+	registerHandler("/user/update", user.UpdateUserHandler, "updateUser", authRequired())
+	registerHandler("/user/confirm_email", user.ConfirmEmailHandler, "confirmEmail", authRequired())
 	registerHandler("/user/reset_password", user.ResetPasswordHandler, "resetPassword")
 	registerHandler("/user/send_reset_password_mail", user.SendResetPasswordMailHandler, "sendReset")
 	registerHandler("/user/refresh", user.RefreshTokenHandler, "refreshToken")
+	registerHandler("/user/logout", user.LogoutHandler, "logout", authRequired())
+	registerHandler("/user/logout_all", user.LogoutAllHandler, "logoutAll", authRequired())
+	registerHandler("/user/sessions", user.SessionsHandler, "sessions", authRequired())
+	registerHandler("/user/sessions/{int:ID}", user.RevokeSessionHandler, "revokeSession", authRequired())
+	registerHandler("/user/api_keys", user.APIKeysHandler, "apiKeys", authRequired())
+	registerHandler("/user/api_keys/{int:ID}", user.RevokeAPIKeyHandler, "revokeAPIKey", authRequired())
+	registerHandler("/user/mfa", user.MfaStatusHandler, "mfa", authRequired())
+	registerHandler("/user/mfa/totp", user.TotpHandler, "totp", authRequired())
+	registerHandler("/user/mfa/totp/confirm", user.ConfirmTotpHandler, "confirmTotp", authRequired())
+	registerHandler("/user/mfa/recovery_codes", user.RenewRecoveryCodesHandler, "recoveryCodes", authRequired())
+	registerHandler("/user/audit", user.GetMyAuditHandler, "getMyAudit", authRequired())
+	registerHandler("/.well-known/jwks.json", user.JWKSHandler, "jwks")
+	registerHandler("/admin/audit", user.AdminAuditHandler, "adminAudit", requirePermission(user.PermissionAuditRead))
+	registerHandler("/admin/users", user.AdminListUsersHandler, "adminUsers", requirePermission(user.PermissionUsersRead))
+	registerHandler("/admin/users/{int:ID}", user.AdminGetUserHandler, "adminUser", requirePermission(user.PermissionUsersRead))
+	registerHandler("/admin/users/{int:ID}/images", user.AdminUserImagesHandler, "adminUserImages", requirePermission(user.PermissionUsersRead))
+	registerHandler("/admin/users/{int:ID}/sessions", user.AdminUserSessionsHandler, "adminUserSessions", requirePermission(user.PermissionUsersRead))
+	registerHandler("/admin/users/{int:ID}/activate", user.AdminActivateUserHandler, "adminActivateUser", requirePermission(user.PermissionUsersManage))
+	registerHandler("/admin/users/{int:ID}/deactivate", user.AdminDeactivateUserHandler, "adminDeactivateUser", requirePermission(user.PermissionUsersManage))
+	registerHandler("/admin/users/{int:ID}/ban", user.AdminBanUserHandler, "adminBanUser", requirePermission(user.PermissionUsersManage))
+	registerHandler("/admin/users/{int:ID}/unban", user.AdminUnbanUserHandler, "adminUnbanUser", requirePermission(user.PermissionUsersManage))
+	registerHandler("/admin/users/{int:ID}/clear_lockout", user.AdminClearLockoutHandler, "adminClearLockout", requirePermission(user.PermissionUsersManage))
+	registerHandler("/admin/users/{int:ID}/reset_password", user.AdminResetPasswordHandler, "adminResetPassword", requirePermission(user.PermissionUsersManage))
+	registerHandler("/admin/users/{int:ID}/impersonate", user.AdminImpersonateHandler, "adminImpersonate", requirePermission(user.PermissionUsersImpersonate))
 
-	registerHandler("/image/generate", pg.GenerateImageHandler, "generateImage")
-	registerHandler("/image/get", pg.GetImagesHandler, "getImage")
+	registerHandler("/image/generate", pg.GenerateImageHandler, "generateImage", authRequired(), requirePermission(user.PermissionImagesGenerate))
+	registerHandler("/image/get", pg.GetImagesHandler, "getImage", authRequired(), requirePermission(user.PermissionImagesRead))
 }
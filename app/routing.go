@@ -3,6 +3,7 @@ package app
 import (
 	"RestAPI/core"
 	"regexp"
+	"sort"
 	"strings"
 )
 
@@ -11,15 +12,45 @@ type HandlerFunc func(core.HttpRequest) core.HttpResponse
 type funcInfo struct {
 	HandlerFunc
 	name string
+	url  string
+	// Роут только для авторизованных запросов
+	auth bool
+	// Обработчику нужен пользователь запроса (request.User), сертификата администратора недостаточно
+	user bool
+	// Права, все из которых нужны для доступа к роуту (см. user.Permission*)
+	permissions []string
 }
 
-var HandlersList = make(map[*regexp.Regexp]funcInfo)
+/*
+Настройки доступа к роуту, передаются в registerHandler после имени
+*/
+type routeOption func(info *funcInfo)
+
+/*
+Роут доступен только авторизованным пользователям, но не клиентскому сертификату администратора
+API ключам - только вместе с requirePermission, без прав роут для ключей закрыт
+*/
+func authRequired() routeOption {
+	return func(info *funcInfo) {
+		info.auth = true
+		info.user = true
+	}
+}
 
-func registerHandler(url string, f HandlerFunc, name ...string) {
-	var handlerName string
-	if len(name) > 0 {
-		handlerName = name[0]
+/*
+Для роута нужны права permissions (и авторизация). API ключ допускается, если у него есть эти права
+*/
+func requirePermission(permissions ...string) routeOption {
+	return func(info *funcInfo) {
+		info.auth = true
+		info.permissions = append(info.permissions, permissions...)
 	}
+}
+
+var HandlersList = make(map[*regexp.Regexp]funcInfo)
+
+func registerHandler(url string, f HandlerFunc, name string, options ...routeOption) {
+	routeUrl := url
 	pattern := regexp.MustCompile(`\{[a-zA-Z0-9:.!,?\-_]+\}`)
 	matches := pattern.FindAllString(url, -1)
 	if len(matches) > 0 {
@@ -34,14 +65,77 @@ func registerHandler(url string, f HandlerFunc, name ...string) {
 
 	regex := regexp.MustCompile("^" + url + "$")
 
-	HandlersList[regex] = funcInfo{f, handlerName}
+	info := funcInfo{HandlerFunc: f, name: name, url: routeUrl}
+	for _, option := range options {
+		option(&info)
+	}
+	HandlersList[regex] = info
 }
 
-func router(url string) HandlerFunc {
+func router(url string) (funcInfo, bool) {
 	for pattern, info := range HandlersList {
 		if pattern.MatchString(url) {
-			return info.HandlerFunc
+			return info, true
+		}
+	}
+	return funcInfo{}, false
+}
+
+/*
+Проверка прав запроса на роут: 0, если доступ разрешен, иначе статус ответа (401 или 403)
+На роуты authRequired() проходят только запросы с пользователем, обработчики берут его через user.RequestUser без проверки на nil
+Запросы с API ключом допускаются только к публичным роутам и роутам с правами, которые есть у ключа
+*/
+func authorize(request *core.HttpRequest, info funcInfo) int {
+	if !info.auth {
+		return 0
+	}
+	if request.Principal == nil {
+		return 401
+	}
+	if info.user && !request.Principal.IsUser() {
+		return 403
+	}
+	if request.Principal.IsAPIKey() && len(info.permissions) == 0 {
+		return 403
+	}
+	for _, permission := range info.permissions {
+		if !request.Principal.Can(permission) {
+			return 403
+		}
+	}
+	return 0
+}
+
+type Route struct {
+	Url         string
+	Name        string
+	Auth        bool
+	Permissions []string
+}
+
+/*
+Список зарегистрированных роутов, отсортированный по url
+*/
+func Routes() []Route {
+	routes := make([]Route, 0, len(HandlersList))
+	for _, info := range HandlersList {
+		routes = append(routes, Route{Url: info.url, Name: info.name, Auth: info.auth, Permissions: info.permissions})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		return routes[i].Url < routes[j].Url
+	})
+	return routes
+}
+
+/*
+Требования доступа к роуту url для документации
+*/
+func RouteAccess(url string) (bool, []string) {
+	for _, info := range HandlersList {
+		if info.url == url {
+			return info.auth, info.permissions
 		}
 	}
-	return nil
+	return false, nil
 }
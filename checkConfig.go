@@ -0,0 +1,211 @@
+package main
+
+/*
+	Команда check-config - проверка конфигурации без запуска сервера
+	Загружает полную конфигурацию, проверяет сертификат и ключ, шаблоны писем, каталог аватаров и подключение к БД
+	Печатает отчет по каждой проверке и завершается с ненулевым кодом, если хотя бы одна проверка не прошла
+*/
+
+import (
+	"RestAPI/core"
+	"RestAPI/db"
+	"RestAPI/user"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+const certExpiryWarning = 30 * 24 * time.Hour
+
+type checkStatus string
+
+const (
+	checkOK   checkStatus = "OK"
+	checkWarn checkStatus = "WARN"
+	checkFail checkStatus = "FAIL"
+)
+
+type checkLine struct {
+	status  checkStatus
+	name    string
+	message string
+}
+
+type configReport struct {
+	lines []checkLine
+}
+
+func (r *configReport) add(status checkStatus, name string, format string, args ...interface{}) {
+	r.lines = append(r.lines, checkLine{status: status, name: name, message: fmt.Sprintf(format, args...)})
+}
+
+func (r *configReport) failed() bool {
+	for _, line := range r.lines {
+		if line.status == checkFail {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *configReport) print(w io.Writer) {
+	counts := make(map[checkStatus]int)
+	for _, line := range r.lines {
+		counts[line.status]++
+		fmt.Fprintf(w, "[%-4s] %-14s %s\n", line.status, line.name, line.message)
+	}
+	fmt.Fprintf(w, "\n%d ok, %d warnings, %d failed\n", counts[checkOK], counts[checkWarn], counts[checkFail])
+}
+
+func checkConfigCommand(args []string) int {
+	report := &configReport{}
+	cfg, err := core.LoadConfig(args)
+	if cfg == nil {
+		report.add(checkFail, "config", "%v", err)
+		report.print(os.Stdout)
+		return 1
+	}
+	var problems core.ConfigErrors
+	if errors.As(err, &problems) {
+		for _, problem := range problems {
+			report.add(checkFail, "config", "%s", problem)
+		}
+	} else {
+		report.add(checkOK, "config", "loaded")
+	}
+
+	checkCertificate(report, cfg.Server)
+	checkMailTemplates(report, cfg.Mail.TemplatesPath)
+	checkAvatarsDir(report, cfg.Media.AvatarsDir)
+	checkDatabase(report, cfg.DB)
+
+	report.print(os.Stdout)
+	if report.failed() {
+		return 1
+	}
+	return 0
+}
+
+func checkCertificate(report *configReport, cfg core.ServerConfig) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		report.add(checkFail, "tls", "certificate or key path is not set")
+		return
+	}
+	pair, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		report.add(checkFail, "tls", "invalid certificate/key pair: %v", err)
+		return
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		report.add(checkFail, "tls", "parsing certificate: %v", err)
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case now.Before(cert.NotBefore):
+		report.add(checkFail, "tls", "certificate is not valid until %s", cert.NotBefore.Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		report.add(checkFail, "tls", "certificate expired at %s", cert.NotAfter.Format(time.RFC3339))
+	case cert.NotAfter.Sub(now) < certExpiryWarning:
+		report.add(checkWarn, "tls", "certificate expires soon: %s", cert.NotAfter.Format(time.RFC3339))
+	default:
+		report.add(checkOK, "tls", "%s, valid until %s", cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+	}
+
+	if cfg.AdminClientCA != "" {
+		data, err := os.ReadFile(cfg.AdminClientCA)
+		if err != nil {
+			report.add(checkFail, "tls", "reading admin client CA: %v", err)
+		} else if !x509.NewCertPool().AppendCertsFromPEM(data) {
+			report.add(checkFail, "tls", "no certificates found in admin client CA %s", cfg.AdminClientCA)
+		} else {
+			report.add(checkOK, "tls", "admin client CA loaded")
+		}
+	}
+}
+
+func checkMailTemplates(report *configReport, path string) {
+	for _, name := range []string{user.ActivateEmailTemplateFile, user.ResetPasswordTemplateFile} {
+		if _, err := template.ParseFiles(filepath.Join(path, name)); err != nil {
+			report.add(checkFail, "mail template", "%v", err)
+			continue
+		}
+		report.add(checkOK, "mail template", "%s parsed", name)
+	}
+}
+
+/*
+Каталог аватаров задается относительно рабочего каталога и создается при первой загрузке, поэтому
+если каталога нет, проверяется возможность записи в ближайший существующий родительский каталог
+*/
+func checkAvatarsDir(report *configReport, avatarsDir string) {
+	currentDir, err := os.Getwd()
+	if err != nil {
+		report.add(checkFail, "avatars dir", "getting current directory: %v", err)
+		return
+	}
+	dir := currentDir + avatarsDir
+
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		parent := filepath.Dir(dir)
+		for {
+			if _, err := os.Stat(parent); err == nil || parent == filepath.Dir(parent) {
+				break
+			}
+			parent = filepath.Dir(parent)
+		}
+		if err := checkWritable(parent); err != nil {
+			report.add(checkFail, "avatars dir", "%s does not exist and can't be created: %v", dir, err)
+			return
+		}
+		report.add(checkWarn, "avatars dir", "%s does not exist, it will be created on first upload", dir)
+		return
+	}
+	if err != nil {
+		report.add(checkFail, "avatars dir", "%v", err)
+		return
+	}
+	if !info.IsDir() {
+		report.add(checkFail, "avatars dir", "%s is not a directory", dir)
+		return
+	}
+	if err := checkWritable(dir); err != nil {
+		report.add(checkFail, "avatars dir", "%s is not writable: %v", dir, err)
+		return
+	}
+	report.add(checkOK, "avatars dir", "%s is writable", dir)
+}
+
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".check-config-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func checkDatabase(report *configReport, connData core.DBCredentials) {
+	connData.ConnectRetries = 1
+	if err := db.ConnectToDB(connData); err != nil {
+		report.add(checkFail, "database", "connecting to %s:%d/%s: %v", connData.Host, connData.Port, connData.DB_Name, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := db.Ping(ctx); err != nil {
+		report.add(checkFail, "database", "ping %s:%d/%s: %v", connData.Host, connData.Port, connData.DB_Name, err)
+		return
+	}
+	report.add(checkOK, "database", "connected to %s:%d/%s", connData.Host, connData.Port, connData.DB_Name)
+}
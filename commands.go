@@ -0,0 +1,469 @@
+package main
+
+/*
+	Служебные команды: миграции, тестовые данные, список роутов, генерация документации, управление пользователями, токенами и ключами подписи
+	Команды, работающие с БД, требуют корректный раздел db конфигурации, ошибки в остальных разделах выводятся как предупреждения
+*/
+
+import (
+	"RestAPI/app"
+	"RestAPI/core"
+	"RestAPI/db"
+	"RestAPI/docs"
+	"RestAPI/media"
+	"RestAPI/seed"
+	"RestAPI/user"
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+Загрузка конфигурации для команды. Если переданы разделы (например, "db"), то ошибкой считаются
+только проблемы в этих разделах, остальные выводятся как предупреждения
+*/
+func loadCommandConfig(fs *flag.FlagSet, args []string, sections ...string) (*core.Config, error) {
+	loader := core.NewConfigLoader(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	cfg, err := loader.Load()
+	var problems core.ConfigErrors
+	if cfg == nil || len(sections) == 0 || !errors.As(err, &problems) {
+		return cfg, err
+	}
+
+	var blocking core.ConfigErrors
+	for _, problem := range problems {
+		required := false
+		for _, section := range sections {
+			if strings.HasPrefix(problem, section+".") {
+				required = true
+				break
+			}
+		}
+		if required {
+			blocking = append(blocking, problem)
+		} else {
+			log.Println("Warning:", problem)
+		}
+	}
+	if len(blocking) > 0 {
+		return cfg, blocking
+	}
+	return cfg, nil
+}
+
+func connectCommandDB(fs *flag.FlagSet, args []string) *db.Repositories {
+	cfg, err := loadCommandConfig(fs, args, "db")
+	if err != nil {
+		log.Println("Error loading config", err)
+		return nil
+	}
+	if err := db.ConnectToDB(cfg.DB); err != nil {
+		log.Println("Error connecting to DB", err)
+		return nil
+	}
+	return db.NewGormRepositories(db.DB)
+}
+
+func subcommand(args []string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "", args
+	}
+	return args[0], args[1:]
+}
+
+func migrateCommand(args []string) int {
+	action, args := subcommand(args)
+	if action != "up" && action != "down" && action != "status" {
+		fmt.Fprintln(os.Stderr, "Usage: server migrate up|down|status [-to <version>] [-steps <n>] [-dry-run] [flags]")
+		return 2
+	}
+	fs := flag.NewFlagSet("migrate "+action, flag.ContinueOnError)
+	to := fs.Int64("to", db.LatestVersion, "Target version (up: default latest, down: 0 rolls back everything)")
+	steps := fs.Int("steps", 1, "Number of migrations to roll back (down without -to)")
+	dryRun := fs.Bool("dry-run", false, "Print SQL without executing it")
+	if connectCommandDB(fs, args) == nil {
+		return 1
+	}
+
+	if action == "status" {
+		statuses, err := db.GetMigrationStatus()
+		if err != nil {
+			log.Println("Error getting migration status", err)
+			return 1
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tSTATUS\tAPPLIED AT")
+		code := 0
+		for _, status := range statuses {
+			state, appliedAt := "pending", "-"
+			if status.Applied {
+				state = "applied"
+				appliedAt = status.AppliedAt.Format(time.RFC3339)
+			}
+			if status.ChecksumMismatch {
+				state = "applied, checksum mismatch"
+				code = 1
+			}
+			if status.Missing {
+				state = "applied, file missing"
+				code = 1
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", status.Version, status.Name, state, appliedAt)
+		}
+		w.Flush()
+		return code
+	}
+
+	ctx := context.Background()
+	var err error
+	switch {
+	case action == "up" || *to != db.LatestVersion:
+		err = db.MigrateTo(ctx, *to, *dryRun, os.Stdout)
+	default:
+		err = db.MigrateDown(ctx, *steps, *dryRun, os.Stdout)
+	}
+	if err != nil {
+		log.Println("Error applying migrations", err)
+		return 1
+	}
+	return 0
+}
+
+/*
+Загрузка фикстур (см. seed/seed.go). С -reset все пользователи, токены и изображения удаляются перед загрузкой
+*/
+func seedCommand(args []string) int {
+	fs := flag.NewFlagSet("seed", flag.ContinueOnError)
+	fixturesPath := fs.String("fixtures", "seed/fixtures", "Fixture file or directory with .yaml/.yml/.json files")
+	reset := fs.Bool("reset", false, "Delete all users, tokens and images before loading fixtures")
+	repos := connectCommandDB(fs, args)
+	if repos == nil {
+		return 1
+	}
+
+	fixtures, err := seed.Load(*fixturesPath)
+	if err != nil {
+		log.Println("Error loading fixtures", err)
+		return 1
+	}
+	result, err := seed.Apply(context.Background(), repos, fixtures, *reset)
+	if err != nil {
+		log.Println("Error seeding database", err)
+		return 1
+	}
+	log.Printf("Seeded %d user(s) from %s: %s", len(fixtures.Users), *fixturesPath, result)
+	return 0
+}
+
+func routesCommand(args []string) int {
+	fs := flag.NewFlagSet("routes", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	app.RegisterRoutes()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "URL\tNAME\tACCESS")
+	for _, route := range app.Routes() {
+		access := "public"
+		if len(route.Permissions) > 0 {
+			access = strings.Join(route.Permissions, ",")
+		} else if route.Auth {
+			access = "auth"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", route.Url, route.Name, access)
+	}
+	w.Flush()
+	return 0
+}
+
+func docsCommand(args []string) int {
+	action, _ := subcommand(args)
+	if action != "build" {
+		fmt.Fprintln(os.Stderr, "Usage: server docs build")
+		return 2
+	}
+	app.RegisterRoutes()
+	if err := docs.GenerateDocs(app.RouteAccess); err != nil {
+		log.Println("Error generating docs", err)
+		return 1
+	}
+	log.Println("Docs generated successfully")
+	return 0
+}
+
+func userCommand(args []string) int {
+	action, args := subcommand(args)
+	switch action {
+	case "create-admin":
+		return createAdminCommand(args)
+	case "activate":
+		return activateUserCommand(args)
+	case "purge-deleted":
+		return purgeDeletedCommand(args)
+	}
+	fmt.Fprintln(os.Stderr, "Usage: server user create-admin|activate|purge-deleted [flags]")
+	return 2
+}
+
+/*
+Создание администратора. Если пользователь с таким email уже существует, он получает права администратора
+Пароль можно передать флагом -password, иначе он читается из стандартного ввода
+*/
+func createAdminCommand(args []string) int {
+	fs := flag.NewFlagSet("user create-admin", flag.ContinueOnError)
+	email := fs.String("email", "", "Admin email")
+	username := fs.String("username", "", "Admin username (default: part of email before @)")
+	password := fs.String("password", "", "Admin password (read from stdin if empty)")
+	repos := connectCommandDB(fs, args)
+	if repos == nil {
+		return 1
+	}
+	if *email == "" {
+		log.Println("Email is required")
+		return 2
+	}
+
+	ctx := context.Background()
+	existing, err := repos.Users.GetByEmail(ctx, *email)
+	if err == nil {
+		existing.IsActive = true
+		if err := repos.Users.Save(ctx, existing); err != nil {
+			log.Println("Error updating user", err)
+			return 1
+		}
+		if err := grantAdmin(ctx, repos, existing.ID); err != nil {
+			log.Println("Error assigning admin role", err)
+			return 1
+		}
+		log.Printf("User %s (id %d) is now an admin", existing.Email, existing.ID)
+		return 0
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		log.Println("Error getting user", err)
+		return 1
+	}
+
+	if *password == "" {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			log.Println("Error reading password", err)
+			return 1
+		}
+		*password = strings.TrimSpace(line)
+	}
+	if *username == "" {
+		*username = strings.Split(*email, "@")[0]
+	}
+
+	admin := &db.User{
+		Username: *username,
+		Email:    *email,
+		Password: *password,
+		IsActive: true,
+	}
+	if _, err := user.ValidateUser(admin); err != nil {
+		log.Println("Invalid user data:", err)
+		return 1
+	}
+	hash, err := user.HashPassword(admin.Password)
+	if err != nil {
+		log.Println("Error hashing password", err)
+		return 1
+	}
+	admin.Password = hash
+
+	err = repos.Transaction(ctx, func(uow *db.UnitOfWork) error {
+		if err := uow.Repos.Users.Create(ctx, admin); err != nil {
+			return err
+		}
+		return grantAdmin(ctx, uow.Repos, admin.ID)
+	})
+	if err != nil {
+		log.Println("Error creating user", err)
+		return 1
+	}
+	log.Printf("Admin %s created with id %d", admin.Email, admin.ID)
+	return 0
+}
+
+func grantAdmin(ctx context.Context, repos *db.Repositories, userID uint) error {
+	role, err := repos.Roles.GetByName(ctx, user.RoleAdmin)
+	if err != nil {
+		return err
+	}
+	return repos.Roles.Assign(ctx, userID, role.ID)
+}
+
+func activateUserCommand(args []string) int {
+	fs := flag.NewFlagSet("user activate", flag.ContinueOnError)
+	email := fs.String("email", "", "User email")
+	repos := connectCommandDB(fs, args)
+	if repos == nil {
+		return 1
+	}
+	if *email == "" {
+		log.Println("Email is required")
+		return 2
+	}
+
+	ctx := context.Background()
+	reqUser, err := repos.Users.GetByEmail(ctx, *email)
+	if err != nil {
+		log.Println("Error getting user", err)
+		return 1
+	}
+	reqUser.IsActive = true
+	reqUser.Otp = 0
+	reqUser.OtpExpires = nil
+	reqUser.OtpTries = 0
+	reqUser.OtpTimeout = nil
+	if err := repos.Users.Save(ctx, reqUser); err != nil {
+		log.Println("Error activating user", err)
+		return 1
+	}
+	log.Println("User activated:", *email)
+	return 0
+}
+
+/*
+Окончательное удаление аккаунтов с истекшим сроком восстановления (то же, что делает задача очистки сервера)
+*/
+func purgeDeletedCommand(args []string) int {
+	fs := flag.NewFlagSet("user purge-deleted", flag.ContinueOnError)
+	cfg, err := loadCommandConfig(fs, args, "db", "account", "media")
+	if err != nil {
+		log.Println("Error loading config", err)
+		return 1
+	}
+	if err := db.ConnectToDB(cfg.DB); err != nil {
+		log.Println("Error connecting to DB", err)
+		return 1
+	}
+	user.Configure(cfg, db.NewGormRepositories(db.DB))
+	media.Init(cfg.Media)
+
+	total := 0
+	for {
+		purged, err := user.PurgeDeletedAccounts(context.Background(), time.Now())
+		total += purged
+		if err != nil {
+			log.Println("Error purging deleted accounts", err)
+			return 1
+		}
+		if purged < cfg.Account.PurgeBatchSize {
+			break
+		}
+	}
+	log.Printf("Purged %d deleted account(s)", total)
+	return 0
+}
+
+/*
+Отзыв токенов: отзыв активных сессий пользователя (или всех пользователей с -all)
+*/
+func tokensCommand(args []string) int {
+	action, args := subcommand(args)
+	if action != "revoke" {
+		fmt.Fprintln(os.Stderr, "Usage: server tokens revoke -email <email> | -all")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("tokens revoke", flag.ContinueOnError)
+	email := fs.String("email", "", "Revoke tokens of the user with this email")
+	all := fs.Bool("all", false, "Revoke tokens of all users")
+	repos := connectCommandDB(fs, args)
+	if repos == nil {
+		return 1
+	}
+	if (*email == "") == !*all {
+		log.Println("Either -email or -all is required")
+		return 2
+	}
+
+	ctx := context.Background()
+	var revoked int64
+	var err error
+	if *email != "" {
+		var reqUser *db.User
+		reqUser, err = repos.Users.GetByEmail(ctx, *email)
+		if err != nil {
+			log.Println("Error getting user", err)
+			return 1
+		}
+		revoked, err = repos.Sessions.RevokeByUser(ctx, reqUser.ID, 0)
+	} else {
+		revoked, err = repos.Sessions.RevokeAll(ctx)
+	}
+	if err != nil {
+		log.Println("Error revoking tokens", err)
+		return 1
+	}
+	log.Printf("Revoked %d session(s)", revoked)
+	return 0
+}
+
+/*
+Ключи подписи JWT (RS256/EdDSA): list - ключи в jwt.keys_dir, rotate - немедленное создание нового активного ключа
+Старые ключи удаляются только после истечения подписанных ими токенов, поэтому ротация не завершает сессии
+*/
+func keysCommand(args []string) int {
+	action, args := subcommand(args)
+	if action != "list" && action != "rotate" {
+		fmt.Fprintln(os.Stderr, "Usage: server keys list|rotate [flags]")
+		return 2
+	}
+	fs := flag.NewFlagSet("keys "+action, flag.ContinueOnError)
+	cfg, err := loadCommandConfig(fs, args, "jwt")
+	if err != nil {
+		log.Println("Error loading config", err)
+		return 1
+	}
+	if cfg.JWT.Algorithm == user.AlgorithmHS256 {
+		log.Println("Tokens are signed with HS256 shared secrets, there are no signing keys")
+		return 1
+	}
+	user.Configure(cfg, nil)
+	// list только читает каталог, первый ключ создает rotate или запуск сервера
+	load := user.OpenKeyring
+	if action == "rotate" {
+		load = user.LoadKeyring
+	}
+	keyring, err := load(cfg.JWT.KeysDir, cfg.JWT.Algorithm)
+	if err != nil {
+		log.Println("Error loading signing keys", err)
+		return 1
+	}
+
+	if action == "rotate" {
+		if _, err := keyring.Rotate(time.Now(), 0, user.KeyRetention()); err != nil {
+			log.Println("Error rotating signing keys", err)
+			return 1
+		}
+		log.Println("New active signing key:", keyring.Active().ID)
+	}
+
+	active := keyring.Active()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KID	ALGORITHM	CREATED AT	STATUS")
+	for _, key := range keyring.Keys() {
+		status := "retiring"
+		if key == active {
+			status = "active"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", key.ID, key.Algorithm, key.CreatedAt.Format(time.RFC3339), status)
+	}
+	w.Flush()
+	return 0
+}
@@ -0,0 +1,307 @@
+package core
+
+/*
+	Журнал доступа: одна строка на каждый обработанный запрос
+	Поддерживаются форматы Combined Log Format (access_log.format=combined) и JSON (access_log.format=json)
+	Если access_log.path не задан, журнал пишется в stdout, иначе в файл с ротацией по размеру
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+/*
+Пользователь запроса, для которого можно получить идентификатор для журнала доступа
+*/
+type AccessLogIdentity interface {
+	Identity() string
+}
+
+type AccessLogEntry struct {
+	RemoteAddr  string        `json:"remote_addr"`
+	User        string        `json:"user"`
+	Time        time.Time     `json:"time"`
+	RequestLine string        `json:"request"`
+	Method      string        `json:"method"`
+	Url         string        `json:"url"`
+	Status      int           `json:"status"`
+	Bytes       int           `json:"bytes"`
+	Referer     string        `json:"referer"`
+	UserAgent   string        `json:"user_agent"`
+	Latency     time.Duration `json:"-"`
+}
+
+func (e *AccessLogEntry) Combined() string {
+	user := e.User
+	if user == "" {
+		user = "-"
+	}
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.Itoa(e.Bytes)
+	}
+	return fmt.Sprintf(`%s - %s [%s] "%s" %d %s "%s" "%s" %d`,
+		valueOrDash(e.RemoteAddr),
+		user,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		escapeLogValue(e.RequestLine),
+		e.Status,
+		size,
+		escapeLogValue(valueOrDash(e.Referer)),
+		escapeLogValue(valueOrDash(e.UserAgent)),
+		e.Latency.Microseconds(),
+	)
+}
+
+func (e *AccessLogEntry) JSON() string {
+	data, err := json.Marshal(struct {
+		*AccessLogEntry
+		LatencyMs float64 `json:"latency_ms"`
+	}{e, float64(e.Latency.Microseconds()) / 1000})
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+type AccessLogger struct {
+	mu     sync.Mutex
+	format string
+	out    io.Writer
+}
+
+func NewAccessLogger(format string, path string, maxSize int64, maxBackups int) (*AccessLogger, error) {
+	if format != AccessLogCombined && format != AccessLogJSON {
+		return nil, fmt.Errorf("unknown access log format: %s", format)
+	}
+
+	logger := &AccessLogger{format: format, out: os.Stdout}
+	if path != "" {
+		file, err := OpenRotatingFile(path, maxSize, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		logger.out = file
+	}
+	return logger, nil
+}
+
+func (l *AccessLogger) Log(entry *AccessLogEntry) {
+	if l == nil || entry == nil {
+		return
+	}
+	var line string
+	if l.format == AccessLogJSON {
+		line = entry.JSON()
+	} else {
+		line = entry.Combined()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write([]byte(line + "\n"))
+}
+
+func (l *AccessLogger) Close() error {
+	if l == nil {
+		return nil
+	}
+	if closer, ok := l.out.(io.Closer); ok && l.out != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
+
+/*
+Файл с ротацией: при превышении maxSize текущий файл переименовывается в <path>.1,
+предыдущие копии сдвигаются (<path>.1 -> <path>.2 ...), хранится не более maxBackups копий
+*/
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	if path == "" {
+		return nil, errors.New("Log file path is empty")
+	}
+	rf := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rf.file = file
+	rf.size = info.Size()
+	return nil
+}
+
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, errors.New("Log file is closed")
+	}
+	if rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize && rf.size > 0 {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+	rf.file = nil
+
+	if rf.maxBackups > 0 {
+		os.Remove(rf.backupName(rf.maxBackups))
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			os.Rename(rf.backupName(i), rf.backupName(i+1))
+		}
+		if err := os.Rename(rf.path, rf.backupName(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *RotatingFile) backupName(n int) string {
+	return rf.path + "." + strconv.Itoa(n)
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+/*
+Обертка над соединением, запоминающая код ответа и размер тела ответа
+*/
+type responseRecorder struct {
+	Conn
+	status     int
+	bytes      int
+	headerDone bool
+	header     []byte
+}
+
+func newResponseRecorder(conn Conn) *responseRecorder {
+	return &responseRecorder{Conn: conn}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.Conn.Write(b)
+	r.record(b[:n])
+	return n, err
+}
+
+func (r *responseRecorder) record(b []byte) {
+	if r.headerDone {
+		r.bytes += len(b)
+		return
+	}
+	r.header = append(r.header, b...)
+	if r.status == 0 {
+		if end := bytes.IndexByte(r.header, '\n'); end != -1 {
+			parts := strings.Fields(string(r.header[:end]))
+			if len(parts) >= 2 {
+				r.status, _ = strconv.Atoi(parts[1])
+			}
+		}
+	}
+	if end := bytes.Index(r.header, []byte("\r\n\r\n")); end != -1 {
+		r.headerDone = true
+		r.bytes += len(r.header) - end - 4
+		r.header = nil
+	}
+}
+
+func (s *Server) logAccess(rec *responseRecorder, request *HttpRequest, requestLine string, start time.Time) {
+	if s.accessLog == nil {
+		return
+	}
+	entry := &AccessLogEntry{
+		Time:        start,
+		RequestLine: requestLine,
+		Status:      rec.status,
+		Bytes:       rec.bytes,
+		Latency:     time.Since(start),
+	}
+	if addr := rec.RemoteAddr(); addr != nil {
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			host = addr.String()
+		}
+		entry.RemoteAddr = host
+	}
+	if request != nil {
+		entry.Method = request.Method
+		entry.Url = request.Url
+		entry.Referer = request.Headers["Referer"]
+		entry.UserAgent = request.Headers["User-Agent"]
+		if identity, ok := request.User.(AccessLogIdentity); ok {
+			entry.User = identity.Identity()
+		}
+	}
+	s.accessLog.Log(entry)
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+func escapeLogValue(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
@@ -112,6 +112,16 @@ var (
 		},
 		Body: `{"Message": "Conflict"}`,
 	}
+	HTTP410 = HttpResponse{
+		Version: "HTTP/1.1",
+		Status:  410,
+		Reason:  "Gone",
+		Headers: map[string]string{
+			"Content-Type":   "application/json",
+			"Content-Length": strconv.Itoa(len(`{"Message": "Gone"}`)),
+		},
+		Body: `{"Message": "Gone"}`,
+	}
 	HTTP411 = HttpResponse{
 		Version: "HTTP/1.1",
 		Status:  411,
@@ -152,4 +162,14 @@ var (
 		},
 		Body: `{"Message": "Internal Server Error"}`,
 	}
+	HTTP503 = HttpResponse{
+		Version: "HTTP/1.1",
+		Status:  503,
+		Reason:  "Service Unavailable",
+		Headers: map[string]string{
+			"Content-Type":   "application/json",
+			"Content-Length": strconv.Itoa(len(`{"Message": "Service Unavailable"}`)),
+		},
+		Body: `{"Message": "Service Unavailable"}`,
+	}
 )
@@ -0,0 +1,34 @@
+package core
+
+/*
+	Реестр размеров кэшей в памяти для диагностики
+	Пакет с кэшем регистрирует функцию, возвращающую текущее количество элементов
+*/
+
+import "sync"
+
+var (
+	cachesMu sync.RWMutex
+	caches   = make(map[string]func() int)
+)
+
+func RegisterCache(name string, size func() int) {
+	cachesMu.Lock()
+	defer cachesMu.Unlock()
+	caches[name] = size
+}
+
+func CacheSizes() map[string]int {
+	cachesMu.RLock()
+	registered := make(map[string]func() int, len(caches))
+	for name, size := range caches {
+		registered[name] = size
+	}
+	cachesMu.RUnlock()
+
+	sizes := make(map[string]int, len(registered))
+	for name, size := range registered {
+		sizes[name] = size()
+	}
+	return sizes
+}
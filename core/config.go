@@ -0,0 +1,431 @@
+package core
+
+/*
+	Загрузка конфигурации
+	NewConfigLoader() - регистрирует флаги -config, -env-file и флаги всех настроек в переданном FlagSet
+	Load() - после разбора флагов собирает конфигурацию: значения по умолчанию -> файл YAML или TOML -> переменные окружения -> флаги
+	LoadConfig() - загрузка конфигурации из аргументов командной строки
+	Ошибки разбора и валидации не прерывают загрузку, а собираются в ConfigErrors, чтобы показать все проблемы сразу
+*/
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e, "\n  - ")
+}
+
+/*
+Поле конфигурации с тегами yaml/env/flag
+*/
+type configField struct {
+	path  string
+	env   string
+	flag  string
+	usage string
+	value reflect.Value
+}
+
+func collectFields(v reflect.Value, prefix string) []configField {
+	var fields []configField
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		fieldValue := v.Field(i)
+		name := field.Tag.Get("yaml")
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+		if field.Type.Kind() == reflect.Struct && field.Type != reflect.TypeOf(time.Duration(0)) {
+			fields = append(fields, collectFields(fieldValue, name)...)
+			continue
+		}
+		fields = append(fields, configField{
+			path:  name,
+			env:   field.Tag.Get("env"),
+			flag:  field.Tag.Get("flag"),
+			usage: field.Tag.Get("usage"),
+			value: fieldValue,
+		})
+	}
+	return fields
+}
+
+func setFieldValue(v reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("expected boolean, got %q", raw)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		if v.Type() == reflect.TypeOf(time.Duration(0)) {
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				return fmt.Errorf("expected duration (e.g. 20s, 5m, 24h), got %q", raw)
+			}
+			v.SetInt(int64(d))
+			return nil
+		}
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected integer, got %q", raw)
+		}
+		v.SetInt(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported slice type %s", v.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
+
+/*
+Значение флага, которое запоминается и применяется после файла и переменных окружения
+*/
+type configFlag struct {
+	raw    string
+	isBool bool
+}
+
+func (f *configFlag) String() string {
+	return f.raw
+}
+
+func (f *configFlag) Set(value string) error {
+	f.raw = value
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+type ConfigLoader struct {
+	fs         *flag.FlagSet
+	configFile *string
+	envFiles   *string
+	flags      map[string]*configFlag
+}
+
+func NewConfigLoader(fs *flag.FlagSet) *ConfigLoader {
+	loader := &ConfigLoader{
+		fs:    fs,
+		flags: make(map[string]*configFlag),
+	}
+	loader.configFile = fs.String("config", os.Getenv("CONFIG_FILE"), "Path to YAML (.yaml, .yml) or TOML (.toml) config file")
+	loader.envFiles = fs.String("env-file", "", "Comma separated .env files (default .env if present, ignored in production)")
+
+	for _, field := range collectFields(reflect.ValueOf(DefaultConfig()).Elem(), "") {
+		if field.flag == "" {
+			continue
+		}
+		value := &configFlag{isBool: field.value.Kind() == reflect.Bool}
+		usage := field.usage
+		if field.env != "" {
+			usage += " (env " + field.env + ")"
+		}
+		fs.Var(value, field.flag, usage)
+		loader.flags[field.flag] = value
+	}
+	return loader
+}
+
+/*
+Разбор файла конфигурации, формат определяется расширением
+Ключи TOML те же, что в YAML: документ TOML переводится в YAML и разбирается по yaml-тегам
+*/
+func parseConfigFile(path string, data []byte, cfg *Config) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return yaml.Unmarshal(data, cfg)
+	case ".toml":
+		values := make(map[string]interface{})
+		if err := toml.Unmarshal(data, &values); err != nil {
+			return err
+		}
+		converted, err := yaml.Marshal(values)
+		if err != nil {
+			return err
+		}
+		return yaml.Unmarshal(converted, cfg)
+	}
+	return fmt.Errorf("unsupported config file extension %q, expected .yaml, .yml or .toml", filepath.Ext(path))
+}
+
+/*
+Сборка конфигурации. При ошибках валидации возвращается и конфигурация, и ConfigErrors со списком проблем
+*/
+func (l *ConfigLoader) Load() (*Config, error) {
+	cfg := DefaultConfig()
+	var problems ConfigErrors
+
+	if *l.configFile != "" {
+		data, err := os.ReadFile(*l.configFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := parseConfigFile(*l.configFile, data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing config file %s: %w", *l.configFile, err)
+		}
+	}
+
+	visited := make(map[string]bool)
+	l.fs.Visit(func(f *flag.Flag) {
+		visited[f.Name] = true
+	})
+
+	production := cfg.Production
+	if value, ok := os.LookupEnv("PRODUCTION"); ok {
+		production = value == "true"
+	}
+	if visited["production"] {
+		production = l.flags["production"].raw == "" || l.flags["production"].raw == "true"
+	}
+	if !production {
+		if err := l.loadEnvFiles(); err != nil {
+			return nil, err
+		}
+	}
+
+	fields := collectFields(reflect.ValueOf(cfg).Elem(), "")
+	for _, field := range fields {
+		if field.env == "" {
+			continue
+		}
+		if raw, ok := os.LookupEnv(field.env); ok && raw != "" {
+			if err := setFieldValue(field.value, raw); err != nil {
+				problems = append(problems, fmt.Sprintf("%s (env %s): %s", field.path, field.env, err))
+			}
+		}
+	}
+	for _, field := range fields {
+		if field.flag == "" || !visited[field.flag] {
+			continue
+		}
+		raw := l.flags[field.flag].raw
+		if field.value.Kind() == reflect.Bool && raw == "" {
+			raw = "true"
+		}
+		if err := setFieldValue(field.value, raw); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (flag -%s): %s", field.path, field.flag, err))
+		}
+	}
+
+	for name, provider := range cfg.OIDC.Providers {
+		if secret := os.Getenv("OIDC_" + strings.ToUpper(name) + "_CLIENT_SECRET"); secret != "" {
+			provider.ClientSecret = secret
+			cfg.OIDC.Providers[name] = provider
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		var validationErrors ConfigErrors
+		if errors.As(err, &validationErrors) {
+			problems = append(problems, validationErrors...)
+		}
+	}
+	if len(problems) > 0 {
+		return cfg, problems
+	}
+	return cfg, nil
+}
+
+func (l *ConfigLoader) loadEnvFiles() error {
+	if *l.envFiles == "" {
+		if _, err := os.Stat(".env"); err == nil {
+			return godotenv.Load()
+		}
+		return nil
+	}
+	var paths []string
+	for _, path := range strings.Split(*l.envFiles, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if err := godotenv.Load(paths...); err != nil {
+		return fmt.Errorf("loading env files: %w", err)
+	}
+	return nil
+}
+
+func LoadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("imagolab", flag.ContinueOnError)
+	loader := NewConfigLoader(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	return loader.Load()
+}
+
+/*
+Проверка конфигурации, возвращает ConfigErrors со всеми найденными проблемами
+*/
+func (c *Config) Validate() error {
+	var problems ConfigErrors
+	require := func(value string, name string) {
+		if strings.TrimSpace(value) == "" {
+			problems = append(problems, name+" is required")
+		}
+	}
+	checkPort := func(port int, name string) {
+		if port < 1 || port > 65535 {
+			problems = append(problems, fmt.Sprintf("%s must be between 1 and 65535, got %d", name, port))
+		}
+	}
+	checkPositive := func(d time.Duration, name string) {
+		if d <= 0 {
+			problems = append(problems, fmt.Sprintf("%s must be positive, got %s", name, d))
+		}
+	}
+
+	require(c.Server.Host, "server.host")
+	checkPort(c.Server.HTTPPort, "server.http_port")
+	checkPort(c.Server.HTTPSPort, "server.https_port")
+	if c.Server.HTTPPort == c.Server.HTTPSPort {
+		problems = append(problems, "server.http_port and server.https_port must differ")
+	}
+	checkPositive(c.Server.ConnTimeout, "server.conn_timeout")
+	checkPositive(c.Server.WriteTimeout, "server.write_timeout")
+	require(c.Server.CertFile, "server.cert_file (SSL_CERT_PATH)")
+	require(c.Server.KeyFile, "server.key_file (SSL_KEY_PATH)")
+	if len(c.Server.AllowedHosts) == 0 {
+		problems = append(problems, "server.allowed_hosts must not be empty (use /* to allow any)")
+	}
+
+	require(c.Media.AvatarsDir, "media.avatars_dir")
+
+	require(c.DB.Host, "db.host")
+	require(c.DB.User, "db.user")
+	require(c.DB.Password, "db.password (DB_PASSWORD)")
+	require(c.DB.DB_Name, "db.name")
+	checkPort(c.DB.Port, "db.port")
+	switch c.DB.SSLMode {
+	case "disable", "allow", "prefer", "require":
+	case "verify-ca", "verify-full":
+		require(c.DB.SSLRootCert, "db.sslrootcert (required for sslmode "+c.DB.SSLMode+")")
+	default:
+		problems = append(problems, fmt.Sprintf("db.sslmode must be one of disable, allow, prefer, require, verify-ca, verify-full, got %q", c.DB.SSLMode))
+	}
+	if c.DB.MaxOpenConns < 0 || c.DB.MaxIdleConns < 0 || c.DB.ConnMaxLifetime < 0 || c.DB.ConnMaxIdleTime < 0 {
+		problems = append(problems, "db.max_open_conns, db.max_idle_conns, db.conn_max_lifetime and db.conn_max_idle_time must not be negative")
+	}
+	if c.DB.MaxOpenConns > 0 && c.DB.MaxIdleConns > c.DB.MaxOpenConns {
+		problems = append(problems, fmt.Sprintf("db.max_idle_conns (%d) must not exceed db.max_open_conns (%d)", c.DB.MaxIdleConns, c.DB.MaxOpenConns))
+	}
+	if c.DB.ConnectRetries < 1 {
+		problems = append(problems, fmt.Sprintf("db.connect_retries must be at least 1, got %d", c.DB.ConnectRetries))
+	}
+	switch c.DB.LogLevel {
+	case "silent", "error", "warn", "info":
+	default:
+		problems = append(problems, fmt.Sprintf("db.log_level must be silent, error, warn or info, got %q", c.DB.LogLevel))
+	}
+
+	switch c.JWT.Algorithm {
+	case "HS256":
+		require(c.JWT.AccessSecretKey, "jwt.access_secret_key (JWT_ACCESS_SECRET_KEY)")
+		require(c.JWT.RefreshSecretKey, "jwt.refresh_secret_key (JWT_REFRESH_SECRET_KEY)")
+	case "RS256", "EdDSA":
+		require(c.JWT.KeysDir, "jwt.keys_dir (JWT_KEYS_DIR)")
+		checkPositive(c.JWT.KeyRotationInterval, "jwt.key_rotation_interval")
+	default:
+		problems = append(problems, fmt.Sprintf("jwt.algorithm must be EdDSA, RS256 or HS256, got %q", c.JWT.Algorithm))
+	}
+	checkPositive(c.JWT.AccessExpiration, "jwt.access_expiration")
+	checkPositive(c.JWT.RefreshExpiration, "jwt.refresh_expiration")
+	checkPositive(c.JWT.SessionLifetime, "jwt.session_lifetime")
+	require(c.JWT.Issuer, "jwt.issuer")
+	require(c.JWT.Audience, "jwt.audience")
+	if c.JWT.Leeway < 0 {
+		problems = append(problems, "jwt.leeway must not be negative")
+	}
+
+	checkPositive(c.Auth.AuthTimeout, "auth.auth_timeout")
+	checkPositive(c.Auth.OtpExpiration, "auth.otp_expiration")
+	checkPositive(c.Auth.OtpTimeout, "auth.otp_timeout")
+	checkPositive(c.Auth.MfaChallengeExpiration, "auth.mfa_challenge_expiration")
+	require(c.Auth.TotpIssuer, "auth.totp_issuer")
+
+	if len(c.OIDC.Providers) > 0 {
+		require(c.OIDC.RedirectURL, "oidc.redirect_url")
+		checkPositive(c.OIDC.StateExpiration, "oidc.state_expiration")
+	}
+	for name, provider := range c.OIDC.Providers {
+		require(provider.Issuer, "oidc.providers."+name+".issuer")
+		require(provider.ClientID, "oidc.providers."+name+".client_id")
+	}
+
+	checkPositive(c.Account.DeletionGracePeriod, "account.deletion_grace_period")
+	checkPositive(c.Account.PurgeInterval, "account.purge_interval")
+	if c.Account.PurgeBatchSize < 1 {
+		problems = append(problems, fmt.Sprintf("account.purge_batch_size must be at least 1, got %d", c.Account.PurgeBatchSize))
+	}
+
+	require(c.Mail.Host, "mail.host")
+	checkPort(c.Mail.Port, "mail.port")
+	require(c.Mail.User, "mail.user")
+	require(c.Mail.Password, "mail.password (MAIL_PASSWORD)")
+	require(c.Mail.TemplatesPath, "mail.templates_path (MAIL_TEMPLATES_PATH)")
+
+	require(c.Runware.APIKey, "runware.api_key (RUNWARE_API_KEY)")
+
+	if c.AccessLog.Enabled {
+		if c.AccessLog.Format != AccessLogCombined && c.AccessLog.Format != AccessLogJSON {
+			problems = append(problems, fmt.Sprintf("access_log.format must be %q or %q, got %q", AccessLogCombined, AccessLogJSON, c.AccessLog.Format))
+		}
+		if c.AccessLog.MaxSize < 0 || c.AccessLog.MaxBackups < 0 {
+			problems = append(problems, "access_log.max_size and access_log.max_backups must not be negative")
+		}
+	}
+
+	if c.Tracing.Enabled {
+		switch c.Tracing.Exporter {
+		case "otlp":
+			require(c.Tracing.OTLPEndpoint, "tracing.otlp_endpoint")
+		case "file":
+			require(c.Tracing.FilePath, "tracing.file_path")
+		default:
+			problems = append(problems, fmt.Sprintf("tracing.exporter must be \"otlp\" or \"file\", got %q", c.Tracing.Exporter))
+		}
+	}
+
+	checkPositive(c.Readiness.Timeout, "readiness.timeout")
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
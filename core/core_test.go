@@ -2,8 +2,16 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -323,7 +331,7 @@ func TestCreateServer(t *testing.T) {
 	}
 
 	for i, testCase := range testCases {
-		_, err := CreateServer(testCase.mainApplication)
+		_, err := CreateServer(DefaultConfig(), testCase.mainApplication)
 		if err != nil && !testCase.expectedError {
 			t.Errorf("Unexpected error in %d test case: %s", i, err)
 		}
@@ -346,12 +354,15 @@ func TestStartServer(t *testing.T) {
 	}
 
 	for i, testCase := range testCases {
-		err := InitEnv("../.env")
+		cfg, err := LoadConfig([]string{"-env-file", "../.env"})
+		if cfg == nil {
+			t.Fatalf("Error loading config in %d test case: %s", i, err)
+		}
 		if err != nil {
-			t.Errorf("Error initializing environment in %d test case: %s", i, err)
+			t.Errorf("Error loading config in %d test case: %s", i, err)
 		}
 
-		server, er := CreateServer(testCase.handleApp)
+		server, er := CreateServer(cfg, testCase.handleApp)
 		if er != nil && !testCase.expectedError {
 			t.Errorf("Error creating server in %d test case: %s", i, er)
 		} else if er == nil && testCase.expectedError {
@@ -370,11 +381,185 @@ func TestStartServer(t *testing.T) {
 	}
 }
 
+/*
+config.go testing
+*/
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	err := os.WriteFile(configFile, []byte(`
+server:
+  http_port: 9000
+  https_port: 9443
+  conn_timeout: 30s
+  allowed_hosts: ["127.0.0.1"]
+  cert_file: /certs/server.crt
+  key_file: /certs/server.key
+db:
+  host: db.internal
+  password: file-password
+jwt:
+  access_secret_key: file-access
+  refresh_secret_key: file-refresh
+mail:
+  password: file-mail
+  templates_path: /templates
+runware:
+  api_key: file-runware
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tomlFile := filepath.Join(dir, "config.toml")
+	err = os.WriteFile(tomlFile, []byte(`
+[server]
+http_port = 9000
+conn_timeout = "30s"
+cert_file = "/certs/server.crt"
+key_file = "/certs/server.key"
+
+[db]
+host = "db.toml"
+password = "file-password"
+
+[jwt]
+access_secret_key = "file-access"
+refresh_secret_key = "file-refresh"
+
+[mail]
+password = "file-mail"
+templates_path = "/templates"
+
+[runware]
+api_key = "file-runware"
+
+[oidc.providers.google]
+issuer = "https://accounts.google.com"
+client_id = "client"
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name   string
+		env    map[string]string
+		args   []string
+		check  func(cfg *Config) error
+		errors []string
+	}{
+		{
+			name: "Values from file",
+			args: []string{"-config", configFile},
+			check: func(cfg *Config) error {
+				if cfg.Server.HTTPPort != 9000 || cfg.Server.ConnTimeout != 30*time.Second || cfg.DB.Host != "db.internal" {
+					return fmt.Errorf("file values not applied: %+v", cfg.Server)
+				}
+				if cfg.Server.WriteTimeout != 20*time.Second || cfg.DB.Port != 5432 {
+					return errors.New("defaults not kept for missing keys")
+				}
+				return nil
+			},
+		},
+		{
+			name: "Values from TOML file",
+			env:  map[string]string{"OIDC_REDIRECT_URL": "https://app.example.com/oidc"},
+			args: []string{"-config", tomlFile},
+			check: func(cfg *Config) error {
+				if cfg.Server.HTTPPort != 9000 || cfg.Server.ConnTimeout != 30*time.Second || cfg.DB.Host != "db.toml" || cfg.DB.Port != 5432 {
+					return fmt.Errorf("TOML values not applied: %+v %+v", cfg.Server, cfg.DB)
+				}
+				if cfg.OIDC.Providers["google"].ClientID != "client" {
+					return fmt.Errorf("TOML tables not applied: %+v", cfg.OIDC.Providers)
+				}
+				return nil
+			},
+		},
+		{
+			name: "Env overrides file",
+			env:  map[string]string{"HTTP_PORT": "9100", "DB_HOST": "db.env", "ALLOWED_HOSTS": "10.0.0.1, 10.0.0.2"},
+			args: []string{"-config", configFile},
+			check: func(cfg *Config) error {
+				if cfg.Server.HTTPPort != 9100 || cfg.DB.Host != "db.env" {
+					return errors.New("env values not applied")
+				}
+				if len(cfg.Server.AllowedHosts) != 2 || cfg.Server.AllowedHosts[1] != "10.0.0.2" {
+					return fmt.Errorf("unexpected allowed hosts: %v", cfg.Server.AllowedHosts)
+				}
+				return nil
+			},
+		},
+		{
+			name: "Flags override env",
+			env:  map[string]string{"HTTP_PORT": "9100", "KEEP_ALIVE": "true"},
+			args: []string{"-config", configFile, "-http-port", "9200", "-keep-alive=false", "-jwt-access-expiration", "1h"},
+			check: func(cfg *Config) error {
+				if cfg.Server.HTTPPort != 9200 || cfg.Server.KeepAlive || cfg.JWT.AccessExpiration != time.Hour {
+					return errors.New("flag values not applied")
+				}
+				return nil
+			},
+		},
+		{
+			name: "All problems reported",
+			env:  map[string]string{"HTTPS_PORT": "70000", "CONN_TIMEOUT": "soon", "JWT_ALGORITHM": "HS256"},
+			args: []string{"-access-log-format", "xml"},
+			errors: []string{
+				"server.https_port",
+				"server.conn_timeout (env CONN_TIMEOUT)",
+				"db.password",
+				"jwt.access_secret_key",
+				"runware.api_key",
+				"access_log.format",
+			},
+		},
+		{
+			name:   "Unknown JWT algorithm",
+			args:   []string{"-jwt-algorithm", "none"},
+			errors: []string{"jwt.algorithm must be EdDSA, RS256 or HS256"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+			cfg, err := LoadConfig(append([]string{"-env-file", os.DevNull}, tc.args...))
+			if tc.errors == nil {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if err := tc.check(cfg); err != nil {
+					t.Error(err)
+				}
+				return
+			}
+			var problems ConfigErrors
+			if !errors.As(err, &problems) {
+				t.Fatalf("Expected ConfigErrors, got %v", err)
+			}
+			for _, expected := range tc.errors {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("Expected problem %q in:\n%s", expected, err)
+				}
+			}
+		})
+	}
+
+	iniFile := filepath.Join(dir, "config.ini")
+	os.WriteFile(iniFile, []byte("[server]\nhttp_port = 9000\n"), 0644)
+	if _, err := LoadConfig([]string{"-env-file", os.DevNull, "-config", iniFile}); err == nil || !strings.Contains(err.Error(), "unsupported config file extension") {
+		t.Errorf("Expected unsupported extension error, got %v", err)
+	}
+}
+
 /*
 middlewares.go testing
 */
 func TestIsAllowedHostMiddleware(t *testing.T) {
-	if !IS_ALLOWED_HOSTS {
+	cfg := &DefaultConfig().Server
+	if !cfg.IsAllowedHosts {
 		t.Skip("Allowed hosts are not set")
 	}
 	testCases := []struct {
@@ -396,7 +581,7 @@ func TestIsAllowedHostMiddleware(t *testing.T) {
 	}
 
 	for i, testCase := range testCases {
-		result := isAllowedHostMiddleware(testCase.clientAddr)
+		result := isAllowedHostMiddleware(cfg, testCase.clientAddr)
 		if result != testCase.expected {
 			t.Errorf("Unexpected result in %d test case: %t != %t", i, result, testCase.expected)
 		}
@@ -404,7 +589,8 @@ func TestIsAllowedHostMiddleware(t *testing.T) {
 }
 
 func TestReqMiddleware(t *testing.T) {
-	if !REQ_MIDDLEWARE {
+	cfg := &DefaultConfig().Server
+	if !cfg.ReqMiddleware {
 		t.Skip("Request middleware is disabled")
 	}
 	connMock := &ConnMock{
@@ -468,7 +654,7 @@ func TestReqMiddleware(t *testing.T) {
 	}
 
 	for i, testCase := range testCases {
-		err := reqMiddleware(&testCase.request, testCase.clientConn)
+		err := reqMiddleware(cfg, &testCase.request, testCase.clientConn)
 
 		if testCase.expectedError == nil && err != nil {
 			t.Errorf("Test case %d: Expected no error, but got: %s", i, err)
@@ -487,7 +673,8 @@ func TestReqMiddleware(t *testing.T) {
 }
 
 func TestKeepAliveMiddleware(t *testing.T) {
-	if !KEEP_ALIVE {
+	cfg := &DefaultConfig().Server
+	if !cfg.KeepAlive {
 		t.Skip("Keep-alive is disabled")
 	}
 	connMock := &ConnMock{
@@ -533,7 +720,7 @@ func TestKeepAliveMiddleware(t *testing.T) {
 	}
 
 	for i, testCase := range testCases {
-		err := keepAliveMiddleware(&testCase.request, testCase.clientConn)
+		err := keepAliveMiddleware(cfg, &testCase.request, testCase.clientConn)
 
 		if testCase.expectedError == nil && err != nil {
 			t.Errorf("Test case %d: Expected no error, but got: %s", i, err)
@@ -550,3 +737,260 @@ func TestKeepAliveMiddleware(t *testing.T) {
 		}
 	}
 }
+
+/*
+accessLog.go testing
+*/
+func TestAccessLogEntryFormat(t *testing.T) {
+	entry := &AccessLogEntry{
+		RemoteAddr:  "127.0.0.1",
+		User:        "42",
+		Time:        time.Date(2024, time.October, 10, 13, 55, 36, 0, time.UTC),
+		RequestLine: "GET /user/me HTTP/1.1",
+		Method:      "GET",
+		Url:         "/user/me",
+		Status:      200,
+		Bytes:       2326,
+		UserAgent:   `curl/8.0 "test"`,
+		Latency:     1500 * time.Microsecond,
+	}
+
+	expected := `127.0.0.1 - 42 [10/Oct/2024:13:55:36 +0000] "GET /user/me HTTP/1.1" 200 2326 "-" "curl/8.0 \"test\"" 1500`
+	if got := entry.Combined(); got != expected {
+		t.Errorf("Unexpected combined line: got '%s', want '%s'", got, expected)
+	}
+
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(entry.JSON()), &decoded); err != nil {
+		t.Fatalf("Invalid JSON line: %s", err)
+	}
+	if decoded["status"] != float64(200) || decoded["user"] != "42" || decoded["latency_ms"] != 1.5 {
+		t.Errorf("Unexpected JSON line: %s", entry.JSON())
+	}
+}
+
+func TestResponseRecorder(t *testing.T) {
+	connMock := &ConnMock{
+		WriteFunc: func(b []byte) (n int, err error) {
+			return len(b), nil
+		},
+	}
+
+	rec := newResponseRecorder(connMock)
+	response := HTTP404.Copy()
+	rec.Write([]byte(response.ToString()[:10]))
+	rec.Write([]byte(response.ToString()[10:]))
+
+	if rec.status != 404 {
+		t.Errorf("Unexpected status: got %d, want 404", rec.status)
+	}
+	if rec.bytes != len(response.Body) {
+		t.Errorf("Unexpected bytes: got %d, want %d", rec.bytes, len(response.Body))
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	file, err := OpenRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatalf("Error opening rotating file: %s", err)
+	}
+	defer file.Close()
+
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatalf("Error writing to rotating file: %s", err)
+		}
+	}
+
+	testCases := []struct {
+		path     string
+		expected string
+	}{
+		{path, "fourth\n"},
+		{path + ".1", "third\n"},
+		{path + ".2", "second\n"},
+	}
+	for i, testCase := range testCases {
+		data, err := os.ReadFile(testCase.path)
+		if err != nil {
+			t.Errorf("Test case %d: Error reading %s: %s", i, testCase.path, err)
+			continue
+		}
+		if string(data) != testCase.expected {
+			t.Errorf("Test case %d: Unexpected content: got '%s', want '%s'", i, data, testCase.expected)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("Expected only 2 backups to be kept")
+	}
+}
+
+/*
+metrics.go testing
+*/
+func TestMetricsExposition(t *testing.T) {
+	counter := NewCounterVec("test_requests_total", "Test counter", "route")
+	histogram := NewHistogramVec("test_duration_seconds", "Test histogram", []float64{0.1, 1}, "route")
+	gauge := NewGaugeVec("test_connections", "Test gauge")
+
+	counter.Inc("getUser")
+	counter.Add(2, `quoted"route`)
+	histogram.Observe(0.05, "getUser")
+	histogram.Observe(0.5, "getUser")
+	histogram.Observe(5, "getUser")
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+
+	var buf bytes.Buffer
+	DefaultMetrics.WriteMetrics(&buf)
+	output := buf.String()
+
+	expectedLines := []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{route="getUser"} 1`,
+		`test_requests_total{route="quoted\"route"} 2`,
+		"# TYPE test_duration_seconds histogram",
+		`test_duration_seconds_bucket{route="getUser",le="0.1"} 1`,
+		`test_duration_seconds_bucket{route="getUser",le="1"} 2`,
+		`test_duration_seconds_bucket{route="getUser",le="+Inf"} 3`,
+		`test_duration_seconds_sum{route="getUser"} 5.55`,
+		`test_duration_seconds_count{route="getUser"} 3`,
+		"# TYPE test_connections gauge",
+		"test_connections 1",
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(output, line+"\n") {
+			t.Errorf("Expected line '%s' in metrics output:\n%s", line, output)
+		}
+	}
+}
+
+/*
+tracing.go testing
+*/
+func TestParseTraceparent(t *testing.T) {
+	testCases := []struct {
+		header        string
+		expectedError bool
+		sampled       bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", true, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", true, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", true, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-01", true, false},
+		{"", true, false},
+	}
+
+	for i, testCase := range testCases {
+		sc, err := ParseTraceparent(testCase.header)
+		if err != nil && !testCase.expectedError {
+			t.Errorf("Unexpected error in %d test case: %s", i, err)
+		}
+		if err == nil && testCase.expectedError {
+			t.Errorf("Expected error in %d test case but got none", i)
+		}
+		if err == nil {
+			if sc.Sampled != testCase.sampled {
+				t.Errorf("Unexpected sampled flag in %d test case", i)
+			}
+			if sc.Traceparent() != testCase.header {
+				t.Errorf("Unexpected traceparent in %d test case: %s != %s", i, sc.Traceparent(), testCase.header)
+			}
+		}
+	}
+}
+
+type memorySpanExporter struct {
+	spans []*Span
+}
+
+func (e *memorySpanExporter) ExportSpans(spans []*Span) error {
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+func (e *memorySpanExporter) Shutdown() error {
+	return nil
+}
+
+func TestSpanPropagation(t *testing.T) {
+	exporter := &memorySpanExporter{}
+	tracer := NewTracer(exporter)
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	ctx := ContextWithRemoteParent(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, server := StartSpan(ctx, "GET", SpanKindServer)
+	_, child := StartSpan(ctx, "gorm.query users", SpanKindClient)
+	child.Finish()
+	server.Finish()
+	tracer.Shutdown()
+
+	if len(exporter.spans) != 2 {
+		t.Fatalf("Expected 2 exported spans, got %d", len(exporter.spans))
+	}
+	if server.Context.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || server.ParentSpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("Server span does not continue remote trace: %s", server.Context.Traceparent())
+	}
+	if child.Context.TraceID != server.Context.TraceID || child.ParentSpanID != server.Context.SpanID {
+		t.Errorf("Child span is not linked to server span")
+	}
+
+	SetTracer(nil)
+	_, noop := StartSpan(context.Background(), "disabled", SpanKindInternal)
+	if noop != nil {
+		t.Errorf("Expected nil span when tracing is disabled")
+	}
+	noop.SetAttribute("key", "value")
+	noop.Finish()
+}
+
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan OTLPTraceRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var payload OTLPTraceRequest
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- payload
+	}))
+	defer collector.Close()
+
+	exporter, err := NewOTLPExporter(collector.URL, "imagolab-test")
+	if err != nil {
+		t.Fatalf("Error creating exporter: %s", err)
+	}
+	tracer := NewTracer(exporter)
+	SetTracer(tracer)
+	defer SetTracer(nil)
+
+	_, span := StartSpan(context.Background(), "runware.imageInference", SpanKindClient)
+	span.SetAttribute("runware.model", "civitai:25694@143906")
+	span.SetError(errors.New("timeout"))
+	span.Finish()
+	tracer.Flush()
+
+	select {
+	case payload := <-received:
+		spans := payload.ResourceSpans[0].ScopeSpans[0].Spans
+		if len(spans) != 1 || spans[0].Name != "runware.imageInference" || spans[0].Status.Code != int(SpanStatusError) {
+			t.Errorf("Unexpected exported spans: %+v", spans)
+		}
+		if spans[0].TraceID != span.Context.TraceID.String() || spans[0].Kind != int(SpanKindClient) {
+			t.Errorf("Unexpected span identifiers: %+v", spans[0])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Collector did not receive spans")
+	}
+	tracer.Shutdown()
+}
@@ -2,6 +2,8 @@ package core
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"io"
@@ -15,14 +17,68 @@ import (
 Структуры для работы с HTTP-запросами и ответами
 */
 type HttpRequest struct {
-	Method   string
-	Url      string
-	Query    map[string]string
-	Version  string
-	Headers  map[string]string
-	User     interface{}
-	Body     string
-	FormData *FormData
+	Method     string
+	Url        string
+	Query      map[string]string
+	Version    string
+	Headers    map[string]string
+	User       interface{}
+	Principal  *Principal // nil - анонимный запрос
+	Body       string
+	FormData   *FormData
+	TLS        *tls.ConnectionState
+	RemoteAddr string
+	ctx        context.Context
+}
+
+/*
+Кто выполняет запрос: пользователь с его ролями и правами (см. user.LoadPrincipal)
+Для запросов с API ключом права пользователя дополнительно ограничены правами ключа (Scopes)
+*/
+type Principal struct {
+	UserID      uint
+	Username    string
+	Roles       []string
+	Permissions []string
+	// Права API ключа, nil - вход по токену сессии или сертификату
+	Scopes []string
+}
+
+/*
+Право "*" дает все права. Методы можно вызывать у nil (анонимный запрос)
+*/
+func (p *Principal) Can(permission string) bool {
+	if p == nil {
+		return false
+	}
+	if p.Scopes != nil && !contains(p.Scopes, permission) {
+		return false
+	}
+	return contains(p.Permissions, permission) || contains(p.Permissions, "*")
+}
+
+func (p *Principal) HasRole(role string) bool {
+	return p != nil && contains(p.Roles, role)
+}
+
+func (p *Principal) IsAPIKey() bool {
+	return p != nil && p.Scopes != nil
+}
+
+/*
+Запрос от пользователя (токен сессии или API ключ), у клиентского сертификата администратора пользователя нет
+*/
+func (p *Principal) IsUser() bool {
+	return p != nil && p.UserID != 0
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
 }
 
 type FormData struct {
@@ -50,6 +106,9 @@ type HttpResponse struct {
 	ParseFormData() - разбор multipart/form-data из тела HTTP-запроса
 	Serialize() - сериализация данных в JSON и запись в тело HTTP-ответа
 	Copy() - копирование HTTP-ответа
+	Context() / SetContext() - контекст запроса (трассировка, отмена)
+	Header() - получение заголовка запроса без учета регистра
+	Can() - есть ли у запроса право permission (у анонимного запроса прав нет)
 */
 
 func (rqst *HttpRequest) ParseRequest(buffer []byte) error {
@@ -107,6 +166,33 @@ func (rqst *HttpRequest) ParseRequest(buffer []byte) error {
 	return nil
 }
 
+func (rqst *HttpRequest) Context() context.Context {
+	if rqst.ctx == nil {
+		return context.Background()
+	}
+	return rqst.ctx
+}
+
+func (rqst *HttpRequest) SetContext(ctx context.Context) {
+	rqst.ctx = ctx
+}
+
+func (rqst *HttpRequest) Header(name string) string {
+	if value, ok := rqst.Headers[name]; ok {
+		return value
+	}
+	for key, value := range rqst.Headers {
+		if strings.EqualFold(key, name) {
+			return value
+		}
+	}
+	return ""
+}
+
+func (rqst *HttpRequest) Can(permission string) bool {
+	return rqst.Principal.Can(permission)
+}
+
 func (rqst *HttpRequest) ToString() string {
 	reqStr := rqst.Method + " " + rqst.Url + " " + rqst.Version + "\r\n"
 	for key, value := range rqst.Headers {
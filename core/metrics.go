@@ -0,0 +1,329 @@
+package core
+
+/*
+	Метрики в текстовом формате Prometheus (text exposition format 0.0.4)
+	Метрики создаются функциями NewCounterVec, NewGaugeVec, NewHistogramVec и автоматически регистрируются в DefaultMetrics
+	WriteMetrics() - запись всех зарегистрированных метрик в формате Prometheus
+*/
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type metricCollector interface {
+	metricName() string
+	write(w io.Writer)
+}
+
+type MetricsRegistry struct {
+	mu         sync.Mutex
+	collectors map[string]metricCollector
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{collectors: make(map[string]metricCollector)}
+}
+
+var DefaultMetrics = NewMetricsRegistry()
+
+func (r *MetricsRegistry) register(c metricCollector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.collectors[c.metricName()]; ok {
+		panic("metric already registered: " + c.metricName())
+	}
+	r.collectors[c.metricName()] = c
+}
+
+func (r *MetricsRegistry) WriteMetrics(w io.Writer) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	collectors := make([]metricCollector, 0, len(names))
+	for _, name := range names {
+		collectors = append(collectors, r.collectors[name])
+	}
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+/*
+Общая часть всех метрик: имя, описание, метки и значения по наборам меток
+*/
+type metricVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	keys   map[string][]string
+}
+
+func (m *metricVec) metricName() string {
+	return m.name
+}
+
+func (m *metricVec) key(labelValues []string) string {
+	if len(labelValues) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s: expected %d label values, got %d", m.name, len(m.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	if _, ok := m.keys[key]; !ok {
+		m.keys[key] = append([]string(nil), labelValues...)
+	}
+	return key
+}
+
+func (m *metricVec) sortedKeys() []string {
+	keys := make([]string, 0, len(m.keys))
+	for key := range m.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (m *metricVec) writeHeader(w io.Writer, metricType string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", m.name, escapeMetricHelp(m.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", m.name, metricType)
+}
+
+func (m *metricVec) labelString(labelValues []string, extra ...string) string {
+	pairs := make([]string, 0, len(labelValues)+len(extra)/2)
+	for i, value := range labelValues {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, m.labels[i], escapeMetricLabel(value)))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeMetricLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+/*
+Счетчик (counter) - монотонно возрастающее значение
+*/
+type CounterVec struct {
+	metricVec
+	values map[string]float64
+}
+
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		metricVec: metricVec{name: name, help: help, labels: labels, keys: make(map[string][]string)},
+		values:    make(map[string]float64),
+	}
+	DefaultMetrics.register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[c.key(labelValues)] += value
+}
+
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(labelValues, "\xff")]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w, "counter")
+	for _, key := range c.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(c.keys[key]), formatMetricValue(c.values[key]))
+	}
+}
+
+/*
+Измеритель (gauge) - значение, которое может как расти, так и уменьшаться
+*/
+type GaugeVec struct {
+	metricVec
+	values map[string]float64
+}
+
+func NewGaugeVec(name string, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		metricVec: metricVec{name: name, help: help, labels: labels, keys: make(map[string][]string)},
+		values:    make(map[string]float64),
+	}
+	DefaultMetrics.register(g)
+	return g
+}
+
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.key(labelValues)] = value
+}
+
+func (g *GaugeVec) Add(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.key(labelValues)] += value
+}
+
+func (g *GaugeVec) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+func (g *GaugeVec) Value(labelValues ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[strings.Join(labelValues, "\xff")]
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.writeHeader(w, "gauge")
+	for _, key := range g.sortedKeys() {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, g.labelString(g.keys[key]), formatMetricValue(g.values[key]))
+	}
+}
+
+/*
+Гистограмма - распределение наблюдаемых значений (например, длительности запросов) по корзинам
+*/
+type HistogramVec struct {
+	metricVec
+	buckets []float64
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	sorted := append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	h := &HistogramVec{
+		metricVec: metricVec{name: name, help: help, labels: labels, keys: make(map[string][]string)},
+		buckets:   sorted,
+		values:    make(map[string]*histogramValue),
+	}
+	DefaultMetrics.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := h.key(labelValues)
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += value
+}
+
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if hv, ok := h.values[strings.Join(labelValues, "\xff")]; ok {
+		return hv.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w, "histogram")
+	for _, key := range h.sortedKeys() {
+		labelValues := h.keys[key]
+		hv := h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(labelValues, "le", formatMetricValue(bound)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(labelValues, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(labelValues), formatMetricValue(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(labelValues), hv.count)
+	}
+}
+
+func formatMetricValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeMetricLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
+
+func escapeMetricHelp(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+/*
+Метрики сервера
+*/
+var (
+	activeConnections = NewGaugeVec(
+		"imagolab_server_active_connections",
+		"Number of currently open client connections",
+		"protocol",
+	)
+	connectionsTotal = NewCounterVec(
+		"imagolab_server_connections_total",
+		"Total number of accepted client connections",
+		"protocol",
+	)
+	tlsHandshakeFailures = NewCounterVec(
+		"imagolab_server_tls_handshake_failures_total",
+		"Total number of failed TLS handshakes",
+	)
+)
@@ -9,8 +9,8 @@ import (
 	"time"
 )
 
-func isAllowedHostMiddleware(clientAddr string) bool {
-	if !IS_ALLOWED_HOSTS || ALLOWED_HOSTS[0] == "/*" {
+func isAllowedHostMiddleware(cfg *ServerConfig, clientAddr string) bool {
+	if !cfg.IsAllowedHosts || len(cfg.AllowedHosts) == 0 || cfg.AllowedHosts[0] == "/*" {
 		return true
 	}
 
@@ -19,7 +19,7 @@ func isAllowedHostMiddleware(clientAddr string) bool {
 		host = clientAddr
 	}
 
-	for _, allowedHost := range ALLOWED_HOSTS {
+	for _, allowedHost := range cfg.AllowedHosts {
 		if host == allowedHost {
 			return true
 		}
@@ -35,8 +35,8 @@ func isAllowedHostMiddleware(clientAddr string) bool {
 	return false
 }
 
-func reqMiddleware(request *HttpRequest, clientConn Conn) error {
-	if !REQ_MIDDLEWARE {
+func reqMiddleware(cfg *ServerConfig, request *HttpRequest, clientConn Conn) error {
+	if !cfg.ReqMiddleware {
 		return nil
 	}
 	methodFlag := false
@@ -97,8 +97,8 @@ func reqMiddleware(request *HttpRequest, clientConn Conn) error {
 	return nil
 }
 
-func keepAliveMiddleware(request *HttpRequest, clientConn Conn) error {
-	if !KEEP_ALIVE {
+func keepAliveMiddleware(cfg *ServerConfig, request *HttpRequest, clientConn Conn) error {
+	if !cfg.KeepAlive {
 		return nil
 	}
 	if request.Headers == nil {
@@ -110,7 +110,7 @@ func keepAliveMiddleware(request *HttpRequest, clientConn Conn) error {
 				return errors.New("Connection: close")
 			}
 			if request.Headers[key] == "keep-alive" {
-				clientConn.SetDeadline(time.Now().Add(CONN_TIMEOUT * time.Second))
+				clientConn.SetDeadline(time.Now().Add(cfg.ConnTimeout))
 			}
 		}
 	}
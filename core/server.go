@@ -3,7 +3,9 @@ package core
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
@@ -13,6 +15,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,12 +34,19 @@ type Server struct {
 	handleApp     RequestHandler
 	certFile      string
 	keyFile       string
+	accessLog     *AccessLogger
+	openConns     atomic.Int64
+	config        *Config
 }
 
-func CreateServer(mainApplication RequestHandler) (*Server, error) {
+func CreateServer(cfg *Config, mainApplication RequestHandler) (*Server, error) {
+	if cfg == nil {
+		log.Println("Server config is not set")
+		return nil, errors.New("Server config is not set")
+	}
 	regex := regexp.MustCompile(`^([a-zA-Z0-9.-]+):([0-9]{1,5})$`)
-	httpAddr := HOST + ":" + strconv.Itoa(HTTP_PORT)
-	httpsAddr := HOST + ":" + strconv.Itoa(HTTPS_PORT)
+	httpAddr := cfg.Server.Host + ":" + strconv.Itoa(cfg.Server.HTTPPort)
+	httpsAddr := cfg.Server.Host + ":" + strconv.Itoa(cfg.Server.HTTPSPort)
 	if !regex.MatchString(httpAddr) || !regex.MatchString(httpsAddr) {
 		log.Println("Invalid address format")
 		return nil, errors.New("Invalid address format")
@@ -50,8 +60,18 @@ func CreateServer(mainApplication RequestHandler) (*Server, error) {
 		httpAddr:  httpAddr,
 		httpsAddr: httpsAddr,
 		handleApp: mainApplication,
-		certFile:  CERT_FILE,
-		keyFile:   KEY_FILE,
+		certFile:  cfg.Server.CertFile,
+		keyFile:   cfg.Server.KeyFile,
+		config:    cfg,
+	}
+
+	if cfg.AccessLog.Enabled {
+		accessLog, err := NewAccessLogger(cfg.AccessLog.Format, cfg.AccessLog.Path, cfg.AccessLog.MaxSize, cfg.AccessLog.MaxBackups)
+		if err != nil {
+			log.Println("Error creating access log", err)
+			return nil, err
+		}
+		server.accessLog = accessLog
 	}
 	return server, nil
 }
@@ -92,6 +112,19 @@ func (s *Server) Start() error {
 	}
 
 	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if s.config.Server.AdminClientCA != "" {
+		caData, err := os.ReadFile(s.config.Server.AdminClientCA)
+		if err != nil {
+			log.Printf("Error loading admin client CA: %v", err)
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caData) {
+			return fmt.Errorf("no certificates found in admin client CA: %s", s.config.Server.AdminClientCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
 	httpsListener, err := tls.Listen("tcp", s.httpsAddr, config)
 	if err != nil {
 		log.Printf("Error starting HTTPS server: %v", err)
@@ -117,6 +150,8 @@ func (s *Server) ListenHTTP() {
 		}
 
 		go func(clientConn Conn) {
+			s.trackConn("http")
+			defer s.untrackConn("http")
 			defer clientConn.Close()
 			defer log.Println("Connection closed with: ", clientConn.RemoteAddr().String())
 
@@ -156,7 +191,7 @@ func (s *Server) ListenHTTPS() {
 			continue
 		}
 
-		if isAllowedHostMiddleware(clientConn.RemoteAddr().String()) {
+		if isAllowedHostMiddleware(&s.config.Server, clientConn.RemoteAddr().String()) {
 			log.Println("Connection accepted from: ", clientConn.RemoteAddr().String())
 			go s.ConnProcessing(clientConn)
 		} else {
@@ -167,6 +202,8 @@ func (s *Server) ListenHTTPS() {
 }
 
 func (s *Server) ConnProcessing(clientConn Conn) {
+	s.trackConn("https")
+	defer s.untrackConn("https")
 	defer clientConn.Close()
 	defer log.Println("Connection closed with: ", clientConn.RemoteAddr().String())
 
@@ -179,11 +216,13 @@ func (s *Server) ConnProcessing(clientConn Conn) {
 	er := tlsConn.Handshake()
 	if er != nil {
 		log.Println("Error TLS handshake", er)
+		tlsHandshakeFailures.Inc()
 		return
 	}
+	tlsState := tlsConn.ConnectionState()
 
 	for {
-		clientConn.SetDeadline(time.Now().Add(CONN_TIMEOUT * time.Second))
+		clientConn.SetDeadline(time.Now().Add(s.config.Server.ConnTimeout))
 
 		receivedData, er := func(clientConn Conn) ([]byte, error) {
 			reader := bufio.NewReader(clientConn)
@@ -240,38 +279,55 @@ func (s *Server) ConnProcessing(clientConn Conn) {
 			return
 		}
 
-		log.Println(clientConn.RemoteAddr().String(), strings.Split(string(receivedData), "\n")[0])
+		startTime := time.Now()
+		requestLine := strings.TrimSpace(strings.SplitN(string(receivedData), "\n", 2)[0])
+		rec := newResponseRecorder(clientConn)
 
 		request := &HttpRequest{}
 		err := request.ParseRequest(receivedData)
 		if err != nil {
 			log.Println("Error parsing request", err)
-			clientConn.Write(HTTP400.ToBytes())
+			rec.Write(HTTP400.ToBytes())
+			s.logAccess(rec, nil, requestLine, startTime)
 			return
 		}
 
-		er = reqMiddleware(request, clientConn)
+		ctx := ContextWithRemoteParent(context.Background(), request.Header("traceparent"))
+		ctx, span := StartSpan(ctx, request.Method, SpanKindServer)
+		span.SetAttribute("http.method", request.Method)
+		span.SetAttribute("http.target", request.Url)
+		span.SetAttribute("net.peer.addr", clientConn.RemoteAddr().String())
+		request.SetContext(ctx)
+		request.TLS = &tlsState
+		request.RemoteAddr = clientConn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+			request.RemoteAddr = host
+		}
+
+		er = reqMiddleware(&s.config.Server, request, rec)
 		if er != nil {
 			log.Println("Error in request middleware", er)
+			s.finishRequest(rec, request, requestLine, startTime)
 			return
 		}
 
 		response, er := s.handleApp(request)
 		if er != nil {
 			log.Println("Error handling request", er)
-			clientConn.Write(HTTP500.ToBytes())
+			rec.Write(HTTP500.ToBytes())
+			s.finishRequest(rec, request, requestLine, startTime)
 			continue
 		}
 
-		clientConn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT * time.Second))
-		_, err = clientConn.Write(response)
+		clientConn.SetWriteDeadline(time.Now().Add(s.config.Server.WriteTimeout))
+		_, err = rec.Write(response)
+		s.finishRequest(rec, request, requestLine, startTime)
 		if err != nil {
 			log.Println("Error writing response", err)
 			return
 		}
-		log.Println(clientConn.RemoteAddr().String(), strings.Split(string(response), "\n")[0])
 
-		er = keepAliveMiddleware(request, clientConn)
+		er = keepAliveMiddleware(&s.config.Server, request, clientConn)
 		if er != nil {
 			log.Println("Error in keep-alive middleware", er)
 			return
@@ -279,6 +335,39 @@ func (s *Server) ConnProcessing(clientConn Conn) {
 	}
 }
 
+func (s *Server) finishRequest(rec *responseRecorder, request *HttpRequest, requestLine string, start time.Time) {
+	s.logAccess(rec, request, requestLine, start)
+
+	span := SpanFromContext(request.Context())
+	span.SetAttribute("http.status_code", rec.status)
+	span.SetAttribute("http.response_content_length", rec.bytes)
+	if rec.status >= 500 {
+		span.SetStatus(SpanStatusError, strconv.Itoa(rec.status))
+	}
+	span.Finish()
+}
+
+func (s *Server) trackConn(protocol string) {
+	s.openConns.Add(1)
+	connectionsTotal.Inc(protocol)
+	activeConnections.Inc(protocol)
+}
+
+func (s *Server) untrackConn(protocol string) {
+	s.openConns.Add(-1)
+	activeConnections.Dec(protocol)
+}
+
+/*
+Количество открытых в данный момент клиентских соединений
+*/
+func (s *Server) OpenConnections() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.openConns.Load()
+}
+
 func (s *Server) Stop() {
 	if s == nil {
 		log.Println("Server is not created")
@@ -293,4 +382,5 @@ func (s *Server) Stop() {
 	log.Println("Stopping server ...")
 	s.httpListener.Close()
 	s.httpsListener.Close()
+	s.accessLog.Close()
 }
@@ -2,69 +2,272 @@ package core
 
 /*
 	Настройки сервера (и приложения)
+	Все изменяемые настройки собраны в структуре Config и загружаются функцией LoadConfig (см. config.go)
+	в порядке: значения по умолчанию -> YAML-файл -> переменные окружения -> флаги командной строки
+	Теги полей: yaml - ключ в файле, env - переменная окружения, flag - флаг командной строки
 */
 
 import (
-	"errors"
-	"log"
-	"os"
-	"path/filepath"
-	"strconv"
-	"text/template"
 	"time"
-
-	"github.com/joho/godotenv"
 )
 
+type Config struct {
+	Production bool `yaml:"production" env:"PRODUCTION" flag:"production" usage:"Production mode (.env is not loaded)"`
+
+	Server    ServerConfig    `yaml:"server"`
+	Media     MediaConfig     `yaml:"media"`
+	DB        DBCredentials   `yaml:"db"`
+	JWT       JWTConfig       `yaml:"jwt"`
+	Auth      AuthConfig      `yaml:"auth"`
+	OIDC      OIDCConfig      `yaml:"oidc"`
+	Account   AccountConfig   `yaml:"account"`
+	Mail      MailConfig      `yaml:"mail"`
+	Runware   RunwareConfig   `yaml:"runware"`
+	AccessLog AccessLogConfig `yaml:"access_log"`
+	Metrics   MetricsConfig   `yaml:"metrics"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	Readiness ReadinessConfig `yaml:"readiness"`
+}
+
+type ServerConfig struct {
+	Host          string        `yaml:"host" env:"HOST" flag:"host" usage:"Listen address"`
+	HTTPPort      int           `yaml:"http_port" env:"HTTP_PORT" flag:"http-port" usage:"HTTP port (redirects to HTTPS)"`
+	HTTPSPort     int           `yaml:"https_port" env:"HTTPS_PORT" flag:"https-port" usage:"HTTPS port"`
+	ConnTimeout   time.Duration `yaml:"conn_timeout" env:"CONN_TIMEOUT" flag:"conn-timeout" usage:"Idle connection timeout"`
+	WriteTimeout  time.Duration `yaml:"write_timeout" env:"WRITE_TIMEOUT" flag:"write-timeout" usage:"Response write timeout"`
+	CertFile      string        `yaml:"cert_file" env:"SSL_CERT_PATH" flag:"cert-file" usage:"TLS certificate path"`
+	KeyFile       string        `yaml:"key_file" env:"SSL_KEY_PATH" flag:"key-file" usage:"TLS private key path"`
+	AdminClientCA string        `yaml:"admin_client_ca" env:"ADMIN_CLIENT_CA_PATH" flag:"admin-client-ca" usage:"CA for admin client certificates (mTLS)"`
+	// Настройки мидлваров
+	AllowedHosts   []string `yaml:"allowed_hosts" env:"ALLOWED_HOSTS" flag:"allowed-hosts" usage:"Comma separated list of allowed client addresses (/* - any)"`
+	IsAllowedHosts bool     `yaml:"is_allowed_hosts" env:"IS_ALLOWED_HOSTS" flag:"is-allowed-hosts" usage:"Enable allowed hosts middleware"`
+	ReqMiddleware  bool     `yaml:"req_middleware" env:"REQ_MIDDLEWARE" flag:"req-middleware" usage:"Enable request validation middleware"`
+	KeepAlive      bool     `yaml:"keep_alive" env:"KEEP_ALIVE" flag:"keep-alive" usage:"Enable keep-alive connections"`
+}
+
+type MediaConfig struct {
+	AvatarsDir string `yaml:"avatars_dir" env:"AVATARS_DIR" flag:"avatars-dir" usage:"Avatars directory (relative to working directory)"`
+}
+
 type DBCredentials struct {
-	Host     string
-	User     string
-	Password string
-	DB_Name  string
-	Port     int
+	Host     string `yaml:"host" env:"DB_HOST" flag:"db-host" usage:"Database host"`
+	User     string `yaml:"user" env:"DB_USER" flag:"db-user" usage:"Database user"`
+	Password string `yaml:"password" env:"DB_PASSWORD" flag:"db-password" usage:"Database password"`
+	DB_Name  string `yaml:"name" env:"DB_NAME" flag:"db-name" usage:"Database name"`
+	Port     int    `yaml:"port" env:"DB_PORT" flag:"db-port" usage:"Database port"`
+	// Параметры подключения
+	SSLMode         string `yaml:"sslmode" env:"DB_SSLMODE" flag:"db-sslmode" usage:"SSL mode: disable, allow, prefer, require, verify-ca or verify-full"`
+	SSLRootCert     string `yaml:"sslrootcert" env:"DB_SSLROOTCERT" flag:"db-sslrootcert" usage:"CA certificate for verify-ca/verify-full"`
+	TimeZone        string `yaml:"timezone" env:"DB_TIMEZONE" flag:"db-timezone" usage:"Session time zone"`
+	ApplicationName string `yaml:"application_name" env:"DB_APPLICATION_NAME" flag:"db-application-name" usage:"application_name reported to Postgres"`
+	// Пул соединений
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"DB_MAX_OPEN_CONNS" flag:"db-max-open-conns" usage:"Maximum open connections (0 - unlimited)"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"DB_MAX_IDLE_CONNS" flag:"db-max-idle-conns" usage:"Maximum idle connections"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"DB_CONN_MAX_LIFETIME" flag:"db-conn-max-lifetime" usage:"Maximum connection lifetime (0 - unlimited)"`
+	ConnMaxIdleTime time.Duration `yaml:"conn_max_idle_time" env:"DB_CONN_MAX_IDLE_TIME" flag:"db-conn-max-idle-time" usage:"Maximum connection idle time (0 - unlimited)"`
+	// Повторные попытки подключения при запуске
+	ConnectRetries    int           `yaml:"connect_retries" env:"DB_CONNECT_RETRIES" flag:"db-connect-retries" usage:"Connection attempts at startup"`
+	ConnectRetryDelay time.Duration `yaml:"connect_retry_delay" env:"DB_CONNECT_RETRY_DELAY" flag:"db-connect-retry-delay" usage:"Initial delay between connection attempts (doubles each attempt)"`
+	// Журнал запросов
+	LogLevel           string        `yaml:"log_level" env:"DB_LOG_LEVEL" flag:"db-log-level" usage:"Query log level: silent, error, warn or info"`
+	SlowQueryThreshold time.Duration `yaml:"slow_query_threshold" env:"DB_SLOW_QUERY_THRESHOLD" flag:"db-slow-query-threshold" usage:"Queries slower than this are logged as warnings"`
+}
+
+type JWTConfig struct {
+	// HS256 - подпись секретами ниже, RS256/EdDSA - ключами из KeysDir с ротацией
+	// При переходе с HS256 секреты нужно оставить: пока они заданы, выданные ранее токены HS256 продолжают приниматься,
+	// и пользователи не разлогиниваются. Секреты можно убрать через refresh_expiration после перехода
+	Algorithm           string        `yaml:"algorithm" env:"JWT_ALGORITHM" flag:"jwt-algorithm" usage:"Token signing algorithm: EdDSA, RS256 or HS256"`
+	KeysDir             string        `yaml:"keys_dir" env:"JWT_KEYS_DIR" flag:"jwt-keys-dir" usage:"Directory with signing keys for RS256 and EdDSA"`
+	KeyRotationInterval time.Duration `yaml:"key_rotation_interval" env:"JWT_KEY_ROTATION_INTERVAL" flag:"jwt-key-rotation-interval" usage:"Age of the active signing key after which a new key is generated"`
+	AccessSecretKey     string        `yaml:"access_secret_key" env:"JWT_ACCESS_SECRET_KEY" flag:"jwt-access-secret" usage:"Secret key for access tokens"`
+	RefreshSecretKey    string        `yaml:"refresh_secret_key" env:"JWT_REFRESH_SECRET_KEY" flag:"jwt-refresh-secret" usage:"Secret key for refresh tokens"`
+	AccessExpiration    time.Duration `yaml:"access_expiration" env:"JWT_ACCESS_EXPIRATION_TIME" flag:"jwt-access-expiration" usage:"Access token lifetime"`
+	RefreshExpiration   time.Duration `yaml:"refresh_expiration" env:"JWT_REFRESH_EXPIRATION_TIME" flag:"jwt-refresh-expiration" usage:"Refresh token lifetime"`
+	Issuer              string        `yaml:"issuer" env:"JWT_ISSUER" flag:"jwt-issuer" usage:"Issuer (iss) of issued tokens, checked on validation"`
+	Audience            string        `yaml:"audience" env:"JWT_AUDIENCE" flag:"jwt-audience" usage:"Audience (aud) of issued tokens, checked on validation"`
+	// Допустимое расхождение часов при проверке exp, nbf и iat
+	Leeway time.Duration `yaml:"leeway" env:"JWT_LEEWAY" flag:"jwt-leeway" usage:"Clock skew allowed when validating token times"`
+	// Сессия не продлевается обновлением токенов дольше SessionLifetime с момента входа
+	SessionLifetime time.Duration `yaml:"session_lifetime" env:"JWT_SESSION_LIFETIME" flag:"jwt-session-lifetime" usage:"Absolute session lifetime since login, refresh does not extend it"`
+}
+
+type AuthConfig struct {
+	AuthTimeout   time.Duration `yaml:"auth_timeout" env:"AUTH_TIMEOUT" flag:"auth-timeout" usage:"Base lockout after failed logins"`
+	OtpExpiration time.Duration `yaml:"otp_expiration" env:"OTP_EXP_TIME" flag:"otp-expiration" usage:"Activation and reset code lifetime"`
+	OtpTimeout    time.Duration `yaml:"otp_timeout" env:"OTP_TIMEOUT" flag:"otp-timeout" usage:"Base lockout after invalid codes"`
+	// Время на ввод кода второго фактора после проверки пароля
+	MfaChallengeExpiration time.Duration `yaml:"mfa_challenge_expiration" env:"MFA_CHALLENGE_EXPIRATION" flag:"mfa-challenge-expiration" usage:"Lifetime of the MFA challenge token issued after the password check"`
+	// Название сервиса в приложении-аутентификаторе (issuer в otpauth:// URI)
+	TotpIssuer string `yaml:"totp_issuer" env:"TOTP_ISSUER" flag:"totp-issuer" usage:"Service name shown in authenticator apps"`
 }
 
 /*
-Список приложений, которые будут докумментироваться
+Вход через внешних провайдеров OpenID Connect (authorization code + PKCE)
+Провайдеры задаются только в YAML, секрет клиента можно передать переменной окружения OIDC_<ИМЯ>_CLIENT_SECRET
+Незавершенные входы хранятся в памяти процесса: при нескольких экземплярах сервера нужны sticky sessions
 */
-var APPS = []string{
-	"user",
-	"pictureGeneration",
+type OIDCConfig struct {
+	// Адрес клиента, на который провайдер возвращает пользователя с кодом, одинаковый для всех провайдеров
+	RedirectURL     string                  `yaml:"redirect_url" env:"OIDC_REDIRECT_URL" flag:"oidc-redirect-url" usage:"Redirect URI registered with OpenID Connect providers"`
+	StateExpiration time.Duration           `yaml:"state_expiration" env:"OIDC_STATE_EXPIRATION" flag:"oidc-state-expiration" usage:"Time to complete login at the OpenID Connect provider"`
+	Providers       map[string]OIDCProvider `yaml:"providers"`
 }
 
-var (
-	// Настройки сервера
-	PRODUCTION    bool          = false
-	HOST          string        = "0.0.0.0"
-	HTTP_PORT     int           = 8082
-	HTTPS_PORT    int           = 8446
-	CONN_TIMEOUT  time.Duration = 20
-	WRITE_TIMEOUT time.Duration = 20
-	BUFSIZE       int           = 5 * 1024 * 1024
-	AVATARS_DIR   string        = "/media/images/avatars"
-	// Настройки мидлваров
-	IS_ALLOWED_HOSTS bool = true
-	REQ_MIDDLEWARE   bool = true
-	KEEP_ALIVE       bool = true
-	// Настройки таймаутов для запросов
-	AUTH_TIMEOUT time.Duration = time.Minute * 1
-)
+type OIDCProvider struct {
+	// Issuer, по которому загружается /.well-known/openid-configuration
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	// По умолчанию openid email profile
+	Scopes []string `yaml:"scopes"`
+}
+
+// Удаленный аккаунт можно восстановить в течение DeletionGracePeriod, затем задача очистки удаляет его окончательно
+type AccountConfig struct {
+	DeletionGracePeriod time.Duration `yaml:"deletion_grace_period" env:"ACCOUNT_DELETION_GRACE_PERIOD" flag:"account-deletion-grace-period" usage:"Time to restore a deleted account before it is purged"`
+	PurgeInterval       time.Duration `yaml:"purge_interval" env:"ACCOUNT_PURGE_INTERVAL" flag:"account-purge-interval" usage:"Interval of the deleted accounts purge job"`
+	PurgeBatchSize      int           `yaml:"purge_batch_size" env:"ACCOUNT_PURGE_BATCH_SIZE" flag:"account-purge-batch-size" usage:"Max accounts purged per job run"`
+}
+
+type MailConfig struct {
+	Host          string `yaml:"host" env:"MAIL_HOST" flag:"mail-host" usage:"SMTP host"`
+	Port          int    `yaml:"port" env:"MAIL_PORT" flag:"mail-port" usage:"SMTP port (SSL)"`
+	User          string `yaml:"user" env:"MAIL_USER" flag:"mail-user" usage:"SMTP user and sender address"`
+	Password      string `yaml:"password" env:"MAIL_PASSWORD" flag:"mail-password" usage:"SMTP password"`
+	TemplatesPath string `yaml:"templates_path" env:"MAIL_TEMPLATES_PATH" flag:"mail-templates" usage:"Directory with mail templates"`
+}
+
+type RunwareConfig struct {
+	APIKey string `yaml:"api_key" env:"RUNWARE_API_KEY" flag:"runware-api-key" usage:"runware.ai API key"`
+}
+
+type AccessLogConfig struct {
+	Enabled    bool   `yaml:"enabled" env:"ACCESS_LOG" flag:"access-log" usage:"Enable access log"`
+	Format     string `yaml:"format" env:"ACCESS_LOG_FORMAT" flag:"access-log-format" usage:"Access log format: combined or json"`
+	Path       string `yaml:"path" env:"ACCESS_LOG_PATH" flag:"access-log-path" usage:"Access log file (empty - stdout)"`
+	MaxSize    int64  `yaml:"max_size" env:"ACCESS_LOG_MAX_SIZE" flag:"access-log-max-size" usage:"Access log rotation size in bytes"`
+	MaxBackups int    `yaml:"max_backups" env:"ACCESS_LOG_MAX_BACKUPS" flag:"access-log-max-backups" usage:"Number of rotated access log files to keep"`
+}
+
+// /metrics требует заголовок Authorization: Bearer <token>, без токена отдается только при Public
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled" env:"METRICS_ENABLED" flag:"metrics" usage:"Enable /metrics endpoint"`
+	Token   string `yaml:"token" env:"METRICS_TOKEN" flag:"metrics-token" usage:"Bearer token required for /metrics"`
+	Public  bool   `yaml:"public" env:"METRICS_PUBLIC" flag:"metrics-public" usage:"Serve /metrics without a token"`
+}
+
+type TracingConfig struct {
+	Enabled      bool   `yaml:"enabled" env:"TRACING_ENABLED" flag:"tracing" usage:"Enable tracing"`
+	Exporter     string `yaml:"exporter" env:"TRACING_EXPORTER" flag:"tracing-exporter" usage:"Span exporter: otlp or file"`
+	OTLPEndpoint string `yaml:"otlp_endpoint" env:"TRACING_OTLP_ENDPOINT" flag:"tracing-otlp-endpoint" usage:"OTLP/HTTP collector endpoint"`
+	FilePath     string `yaml:"file_path" env:"TRACING_FILE_PATH" flag:"tracing-file" usage:"File for the file exporter"`
+	ServiceName  string `yaml:"service_name" env:"TRACING_SERVICE_NAME" flag:"tracing-service-name" usage:"service.name resource attribute"`
+}
+
+type ReadinessConfig struct {
+	Timeout       time.Duration `yaml:"timeout" env:"READY_TIMEOUT" flag:"ready-timeout" usage:"Timeout for /readyz checks"`
+	CheckMail     bool          `yaml:"check_mail" env:"READY_CHECK_MAIL" flag:"ready-check-mail" usage:"Check mail server in /readyz"`
+	CheckProvider bool          `yaml:"check_provider" env:"READY_CHECK_PROVIDER" flag:"ready-check-provider" usage:"Check runware.ai in /readyz"`
+}
 
 /*
-Настройки базы данных
+Значения по умолчанию
 */
-var DB_CREDENTIALS = DBCredentials{
-	Host:    "localhost",
-	User:    "admin",
-	DB_Name: "dev",
-	Port:    5432,
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Host:           "0.0.0.0",
+			HTTPPort:       8082,
+			HTTPSPort:      8446,
+			ConnTimeout:    time.Second * 20,
+			WriteTimeout:   time.Second * 20,
+			AllowedHosts:   []string{"/*"},
+			IsAllowedHosts: true,
+			ReqMiddleware:  true,
+			KeepAlive:      true,
+		},
+		Media: MediaConfig{
+			AvatarsDir: "/media/images/avatars",
+		},
+		DB: DBCredentials{
+			Host:               "localhost",
+			User:               "admin",
+			DB_Name:            "dev",
+			Port:               5432,
+			SSLMode:            "disable",
+			TimeZone:           "Europe/Moscow",
+			ApplicationName:    "imagolab",
+			MaxOpenConns:       25,
+			MaxIdleConns:       5,
+			ConnMaxLifetime:    time.Hour,
+			ConnMaxIdleTime:    time.Minute * 10,
+			ConnectRetries:     5,
+			ConnectRetryDelay:  time.Second,
+			LogLevel:           "warn",
+			SlowQueryThreshold: time.Millisecond * 200,
+		},
+		JWT: JWTConfig{
+			Algorithm:           "EdDSA",
+			KeysDir:             "keys/jwt",
+			KeyRotationInterval: time.Hour * 24 * 30,
+			AccessExpiration:    time.Hour * 24,
+			RefreshExpiration:   time.Hour * 336,
+			SessionLifetime:     time.Hour * 24 * 90,
+			Issuer:              "RestAPI",
+			Audience:            "RestAPI",
+			Leeway:              time.Second * 30,
+		},
+		Auth: AuthConfig{
+			AuthTimeout:   time.Minute * 1,
+			OtpExpiration: time.Minute * 5,
+			OtpTimeout:    time.Minute * 1,
+
+			MfaChallengeExpiration: time.Minute * 5,
+			TotpIssuer:             "imagolab",
+		},
+		OIDC: OIDCConfig{
+			StateExpiration: time.Minute * 10,
+		},
+		Account: AccountConfig{
+			DeletionGracePeriod: time.Hour * 24 * 30,
+			PurgeInterval:       time.Hour,
+			PurgeBatchSize:      100,
+		},
+		Mail: MailConfig{
+			Host: "mail.hosting.reg.ru",
+			Port: 465,
+			User: "main@pixel-team.ru",
+		},
+		AccessLog: AccessLogConfig{
+			Enabled:    true,
+			Format:     AccessLogCombined,
+			MaxSize:    100 * 1024 * 1024,
+			MaxBackups: 5,
+		},
+		Metrics: MetricsConfig{
+			Enabled: true,
+		},
+		Tracing: TracingConfig{
+			Exporter:     "otlp",
+			OTLPEndpoint: "http://localhost:4318",
+			FilePath:     "traces.jsonl",
+			ServiceName:  "imagolab",
+		},
+		Readiness: ReadinessConfig{
+			Timeout:       time.Second * 3,
+			CheckProvider: true,
+		},
+	}
 }
 
 /*
-Настройки подключений
+Список приложений, которые будут докумментироваться
 */
-var ALLOWED_HOSTS = []string{
-	"/*",
+var APPS = []string{
+	"user",
+	"pictureGeneration",
+	"monitoring",
 }
 
 var ALLOWED_METHODS = []string{
@@ -84,158 +287,3 @@ var SUPPORTED_MEDIA_TYPES = []string{
 	"image/jpeg",
 	"image/png",
 }
-
-/*
-Настройки JWT
-*/
-var (
-	JWT_ACCESS_SECRET_KEY       string
-	JWT_REFRESH_SECRET_KEY      string
-	JWT_ACCESS_EXPIRATION_TIME  time.Duration = time.Hour * 24
-	JWT_REFRESH_EXPIRATION_TIME time.Duration = time.Hour * 336
-)
-
-/*
-Настройки сертификатов
-*/
-var (
-	CERT_FILE string
-	KEY_FILE  string
-)
-
-/*
-Шаблоны
-*/
-var (
-	MAIL_TEMPLATES_PATH     string
-	ACTIVATE_EMAIL_TEMPLATE *template.Template
-	RESET_PASSWORD_TEMPLATE *template.Template
-)
-
-/*
-MAIL SETTINGS
-*/
-var (
-	MAIL_HOST     string = "mail.hosting.reg.ru"
-	MAIL_PORT     int    = 465
-	MAIL_USER     string = "main@pixel-team.ru"
-	MAIL_PASSWORD string
-	OTP_EXP_TIME  time.Duration = time.Minute * 5
-	OTP_TIMEOUT   time.Duration = time.Minute * 1
-)
-
-/*
-Ranware settings
-*/
-var (
-	RUNWARE_API_KEY string
-)
-
-/*
-инициализация переменных окружения
-*/
-func InitEnv(paths ...string) error {
-	var err error
-	if !PRODUCTION {
-		if len(paths) > 0 {
-			err = godotenv.Load(paths...)
-		} else {
-			err = godotenv.Load()
-		}
-		if err != nil {
-			log.Fatalf("Error env load %v", err)
-			return err
-		}
-	}
-
-	JWT_ACCESS_SECRET_KEY = os.Getenv("JWT_ACCESS_SECRET_KEY")
-	JWT_REFRESH_SECRET_KEY = os.Getenv("JWT_REFRESH_SECRET_KEY")
-	if JWT_ACCESS_SECRET_KEY == "" || JWT_REFRESH_SECRET_KEY == "" {
-		err = errors.New("JWT keys not found")
-		log.Fatalf("Error env load %v", err)
-		return err
-	}
-
-	DB_CREDENTIALS.Password = os.Getenv("DB_PASSWORD")
-	if os.Getenv("DB_USER") != "" {
-		DB_CREDENTIALS.User = os.Getenv("DB_USER")
-	}
-	if os.Getenv("DB_HOST") != "" {
-		DB_CREDENTIALS.Host = os.Getenv("DB_HOST")
-	}
-	if os.Getenv("DB_NAME") != "" {
-		DB_CREDENTIALS.DB_Name = os.Getenv("DB_NAME")
-	}
-	if os.Getenv("DB_PORT") != "" {
-		DB_CREDENTIALS.Port, err = strconv.Atoi(os.Getenv("DB_PORT"))
-		if err != nil {
-			log.Fatalf("Error env load %v", err)
-			return err
-		}
-	}
-
-	if DB_CREDENTIALS.Password == "" {
-		err = errors.New("DB password not found")
-		log.Fatalf("Error env load %v", err)
-		return err
-	}
-
-	CERT_FILE = os.Getenv("SSL_CERT_PATH")
-	KEY_FILE = os.Getenv("SSL_KEY_PATH")
-	if CERT_FILE == "" || KEY_FILE == "" {
-		err = errors.New("Cert or key file not found")
-		log.Fatalf("Error env load %v", err)
-		return err
-	}
-
-	MAIL_PASSWORD = os.Getenv("MAIL_PASSWORD")
-	if MAIL_PASSWORD == "" {
-		err = errors.New("Mail password not found")
-		log.Fatalf("Error env load %v", err)
-		return err
-	}
-
-	MAIL_TEMPLATES_PATH = os.Getenv("MAIL_TEMPLATES_PATH")
-	if MAIL_TEMPLATES_PATH == "" {
-		err = errors.New("Mail templates path not found")
-		log.Fatalf("Error env load %v", err)
-		return err
-	}
-
-	ACTIVATE_EMAIL_TEMPLATE, err = template.ParseFiles(filepath.Join(MAIL_TEMPLATES_PATH, "Activate.html"))
-	RESET_PASSWORD_TEMPLATE, err = template.ParseFiles(filepath.Join(MAIL_TEMPLATES_PATH, "ResetPass.html"))
-	if err != nil {
-		err = errors.New("Error parsing mail templates")
-		log.Fatalf("Error env load %v", err)
-		return err
-	}
-
-	RUNWARE_API_KEY = os.Getenv("RUNWARE_API_KEY")
-	if RUNWARE_API_KEY == "" {
-		err = errors.New("Runware API key not found")
-		log.Fatalf("Error env load %v", err)
-		return err
-	}
-
-	if os.Getenv("HTTPS_PORT") != "" {
-		HTTPS_PORT, err = strconv.Atoi(os.Getenv("HTTPS_POST"))
-		if err != nil {
-			log.Fatalf("Error env load %v", err)
-			return err
-		}
-	}
-
-	if os.Getenv("HTTP_PORT") != "" {
-		HTTPS_PORT, err = strconv.Atoi(os.Getenv("HTTP_POST"))
-		if err != nil {
-			log.Fatalf("Error env load %v", err)
-			return err
-		}
-	}
-
-	if os.Getenv("AVATARS_DIR") != "" {
-		AVATARS_DIR = os.Getenv("AVATARS_DIR")
-	}
-
-	return nil
-}
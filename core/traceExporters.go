@@ -0,0 +1,199 @@
+package core
+
+/*
+	Экспортеры спанов в формате OTLP/JSON
+	OTLPExporter - отправка по OTLP/HTTP на коллектор (<endpoint>/v1/traces)
+	FileExporter - запись каждого пакета спанов отдельной строкой в файл (удобно для локальной отладки и тестов)
+*/
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type OTLPTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func toOTLPValue(value interface{}) otlpAnyValue {
+	switch v := value.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpAnyValue{IntValue: &s}
+	case uint:
+		s := strconv.FormatUint(uint64(v), 10)
+		return otlpAnyValue{IntValue: &s}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return otlpAnyValue{StringValue: &s}
+	}
+}
+
+func buildOTLPRequest(serviceName string, spans []*Span) OTLPTraceRequest {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "RestAPI"
+	for _, span := range spans {
+		span.mu.Lock()
+		out := otlpSpan{
+			TraceID:           span.Context.TraceID.String(),
+			SpanID:            span.Context.SpanID.String(),
+			Name:              span.Name,
+			Kind:              int(span.Kind),
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: int(span.Status), Message: span.StatusMessage},
+		}
+		if span.ParentSpanID.IsValid() {
+			out.ParentSpanID = span.ParentSpanID.String()
+		}
+		for key, value := range span.Attributes {
+			out.Attributes = append(out.Attributes, otlpKeyValue{Key: key, Value: toOTLPValue(value)})
+		}
+		span.mu.Unlock()
+		scope.Spans = append(scope.Spans, out)
+	}
+
+	resource := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	resource.Resource.Attributes = []otlpKeyValue{
+		{Key: "service.name", Value: toOTLPValue(serviceName)},
+	}
+	return OTLPTraceRequest{ResourceSpans: []otlpResourceSpans{resource}}
+}
+
+type OTLPExporter struct {
+	url         string
+	serviceName string
+	client      *http.Client
+}
+
+func NewOTLPExporter(endpoint string, serviceName string) (*OTLPExporter, error) {
+	if endpoint == "" {
+		return nil, errors.New("OTLP endpoint is empty")
+	}
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	return &OTLPExporter{
+		url:         url,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+func (e *OTLPExporter) ExportSpans(spans []*Span) error {
+	data, err := json.Marshal(buildOTLPRequest(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("OTLP collector responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (e *OTLPExporter) Shutdown() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+type FileExporter struct {
+	mu          sync.Mutex
+	serviceName string
+	file        *os.File
+}
+
+func NewFileExporter(path string, serviceName string) (*FileExporter, error) {
+	if path == "" {
+		return nil, errors.New("Trace file path is empty")
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{serviceName: serviceName, file: file}, nil
+}
+
+func (e *FileExporter) ExportSpans(spans []*Span) error {
+	data, err := json.Marshal(buildOTLPRequest(e.serviceName, spans))
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, err = e.file.Write(append(data, '\n'))
+	return err
+}
+
+func (e *FileExporter) Shutdown() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.file.Close()
+}
@@ -0,0 +1,415 @@
+package core
+
+/*
+	Трассировка запросов, совместимая с OpenTelemetry
+	Контекст трассировки передается в заголовке traceparent (W3C Trace Context)
+	StartSpan() - создание дочернего спана для контекста (если трассировка выключена, возвращается nil и все методы спана ничего не делают)
+	Готовые спаны пакетами отправляются в экспортер (OTLP/HTTP или файл)
+*/
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string {
+	return hex.EncodeToString(t[:])
+}
+
+func (t TraceID) IsValid() bool {
+	return t != TraceID{}
+}
+
+func (s SpanID) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s SpanID) IsValid() bool {
+	return s != SpanID{}
+}
+
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	Remote  bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+/*
+Разбор заголовка traceparent вида 00-<trace-id>-<parent-id>-<flags>
+*/
+func ParseTraceparent(header string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 {
+		return SpanContext{}, errors.New("Invalid traceparent format")
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return SpanContext{}, errors.New("Unsupported traceparent version")
+	}
+	if len(traceID) != 32 || len(spanID) != 16 || len(flags) != 2 {
+		return SpanContext{}, errors.New("Invalid traceparent field length")
+	}
+
+	sc := SpanContext{Remote: true}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(traceID)); err != nil || strings.ToLower(traceID) != traceID {
+		return SpanContext{}, errors.New("Invalid trace id")
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(spanID)); err != nil || strings.ToLower(spanID) != spanID {
+		return SpanContext{}, errors.New("Invalid parent id")
+	}
+	flagBytes, err := hex.DecodeString(flags)
+	if err != nil {
+		return SpanContext{}, errors.New("Invalid trace flags")
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, errors.New("Trace id and parent id must not be zero")
+	}
+	sc.Sampled = flagBytes[0]&0x01 == 0x01
+	return sc, nil
+}
+
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+type SpanKind int
+
+// Значения совпадают с SpanKind из спецификации OTLP
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+type SpanStatus int
+
+const (
+	SpanStatusUnset SpanStatus = 0
+	SpanStatusOk    SpanStatus = 1
+	SpanStatusError SpanStatus = 2
+)
+
+type Span struct {
+	mu            sync.Mutex
+	Name          string
+	Kind          SpanKind
+	Context       SpanContext
+	ParentSpanID  SpanID
+	Start         time.Time
+	End           time.Time
+	Attributes    map[string]interface{}
+	Status        SpanStatus
+	StatusMessage string
+	tracer        *Tracer
+	ended         bool
+}
+
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Name = name
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Status = SpanStatusError
+	s.StatusMessage = err.Error()
+}
+
+func (s *Span) SetStatus(status SpanStatus, message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Status = status
+	s.StatusMessage = message
+}
+
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+type spanContextKey struct{}
+
+func ContextWithSpan(ctx context.Context, span *Span) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+type remoteContextKey struct{}
+
+/*
+Контекст с родительским спаном из входящего заголовка traceparent
+*/
+func ContextWithRemoteParent(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	sc, err := ParseTraceparent(traceparent)
+	if err != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteContextKey{}, sc)
+}
+
+/*
+Заголовок traceparent для исходящих запросов от имени текущего спана
+*/
+func TraceparentFromContext(ctx context.Context) string {
+	if span := SpanFromContext(ctx); span != nil {
+		return span.Context.Traceparent()
+	}
+	return ""
+}
+
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+	Shutdown() error
+}
+
+type Tracer struct {
+	exporter      SpanExporter
+	queue         chan *Span
+	batchSize     int
+	flushInterval time.Duration
+	done          chan struct{}
+	flushReq      chan chan struct{}
+	wg            sync.WaitGroup
+}
+
+var (
+	tracerMu     sync.RWMutex
+	activeTracer *Tracer
+)
+
+func NewTracer(exporter SpanExporter) *Tracer {
+	t := &Tracer{
+		exporter:      exporter,
+		queue:         make(chan *Span, 2048),
+		batchSize:     256,
+		flushInterval: 5 * time.Second,
+		done:          make(chan struct{}),
+		flushReq:      make(chan chan struct{}),
+	}
+	t.wg.Add(1)
+	go t.loop()
+	return t
+}
+
+/*
+Установка глобального трассировщика (nil - выключить трассировку)
+*/
+func SetTracer(t *Tracer) {
+	tracerMu.Lock()
+	defer tracerMu.Unlock()
+	activeTracer = t
+}
+
+func currentTracer() *Tracer {
+	tracerMu.RLock()
+	defer tracerMu.RUnlock()
+	return activeTracer
+}
+
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	t := currentTracer()
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		Attributes: make(map[string]interface{}),
+		tracer:     t,
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.Context.TraceID = parent.Context.TraceID
+		span.Context.Sampled = parent.Context.Sampled
+		span.ParentSpanID = parent.Context.SpanID
+	} else if remote, ok := ctx.Value(remoteContextKey{}).(SpanContext); ok {
+		if !remote.Sampled {
+			return ctx, nil
+		}
+		span.Context.TraceID = remote.TraceID
+		span.Context.Sampled = true
+		span.ParentSpanID = remote.SpanID
+	} else {
+		rand.Read(span.Context.TraceID[:])
+		span.Context.Sampled = true
+	}
+	rand.Read(span.Context.SpanID[:])
+
+	return ContextWithSpan(ctx, span), span
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	if t == nil {
+		return
+	}
+	select {
+	case t.queue <- span:
+	default:
+		log.Println("Trace queue is full, span dropped:", span.Name)
+	}
+}
+
+func (t *Tracer) loop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, t.batchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.ExportSpans(batch); err != nil {
+			log.Println("Error exporting spans:", err)
+		}
+		batch = make([]*Span, 0, t.batchSize)
+	}
+	drain := func() {
+		for {
+			select {
+			case span := <-t.queue:
+				batch = append(batch, span)
+			default:
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= t.batchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		case done := <-t.flushReq:
+			drain()
+			export()
+			close(done)
+		case <-t.done:
+			drain()
+			export()
+			return
+		}
+	}
+}
+
+/*
+Принудительная отправка накопленных спанов
+*/
+func (t *Tracer) Flush() {
+	if t == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case t.flushReq <- done:
+		<-done
+	case <-t.done:
+	}
+}
+
+func (t *Tracer) Shutdown() error {
+	if t == nil {
+		return nil
+	}
+	close(t.done)
+	t.wg.Wait()
+	return t.exporter.Shutdown()
+}
+
+/*
+Инициализация трассировки по настройкам tracing
+*/
+func InitTracing(cfg TracingConfig) error {
+	if !cfg.Enabled {
+		return nil
+	}
+	var exporter SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "otlp":
+		exporter, err = NewOTLPExporter(cfg.OTLPEndpoint, cfg.ServiceName)
+	case "file":
+		exporter, err = NewFileExporter(cfg.FilePath, cfg.ServiceName)
+	default:
+		err = fmt.Errorf("unknown tracing exporter: %s", cfg.Exporter)
+	}
+	if err != nil {
+		return err
+	}
+	SetTracer(NewTracer(exporter))
+	log.Println("Tracing enabled, exporter:", cfg.Exporter)
+	return nil
+}
+
+func ShutdownTracing() error {
+	t := currentTracer()
+	SetTracer(nil)
+	return t.Shutdown()
+}
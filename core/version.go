@@ -0,0 +1,30 @@
+package core
+
+/*
+	Информация о сборке, подставляется при сборке через -ldflags:
+	go build -ldflags "-X RestAPI/core.Version=v1.2.0 -X RestAPI/core.Commit=$(git rev-parse --short HEAD) -X RestAPI/core.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+*/
+
+import "runtime"
+
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown"
+)
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+func GetBuildInfo() BuildInfo {
+	return BuildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+}
@@ -2,8 +2,12 @@ package db
 
 import (
 	"RestAPI/core"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -11,17 +15,101 @@ import (
 
 var DB *gorm.DB
 
+// Максимальная задержка между попытками подключения
+const maxConnectRetryDelay = 30 * time.Second
+
+/*
+Подключение к БД. Пока Postgres недоступен (например, еще запускается), делается до ConnectRetries попыток
+с задержкой, удваивающейся после каждой неудачной попытки
+*/
 func ConnectToDB(connData core.DBCredentials) error {
 	log.Println("Connecting to database...")
-	dsn := fmt.Sprintf("user=%s password=%s dbname=%s port=%d sslmode=disable TimeZone=Europe/Moscow",
-		connData.User, connData.Password, connData.DB_Name, connData.Port)
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	gormConfig := &gorm.Config{Logger: newGormLogger(connData.LogLevel, connData.SlowQueryThreshold)}
+
+	attempts := max(connData.ConnectRetries, 1)
+	delay := connData.ConnectRetryDelay
+	var db *gorm.DB
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		db, err = gorm.Open(postgres.Open(buildDSN(connData)), gormConfig)
+		if err == nil {
+			break
+		}
+		log.Printf("Failed to connect to database (attempt %d/%d), error: %v", attempt, attempts, err)
+		if attempt < attempts {
+			time.Sleep(delay)
+			delay = min(delay*2, maxConnectRetryDelay)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	sqlDB, err := db.DB()
 	if err != nil {
-		log.Println("Failed to connect to database, error:", err)
 		return err
 	}
+	sqlDB.SetMaxOpenConns(connData.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(connData.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(connData.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(connData.ConnMaxIdleTime)
 	log.Println("Connected to database successfully")
 
+	err = db.Use(queryInstrumentationPlugin{})
+	if err != nil {
+		log.Println("Failed to register query instrumentation, error:", err)
+		return err
+	}
+
 	DB = db
 	return nil
 }
+
+/*
+DSN в формате key=value, пустые параметры не включаются
+*/
+func buildDSN(connData core.DBCredentials) string {
+	params := []struct {
+		key   string
+		value string
+	}{
+		{"host", connData.Host},
+		{"port", fmt.Sprint(connData.Port)},
+		{"user", connData.User},
+		{"password", connData.Password},
+		{"dbname", connData.DB_Name},
+		{"sslmode", connData.SSLMode},
+		{"sslrootcert", connData.SSLRootCert},
+		{"TimeZone", connData.TimeZone},
+		{"application_name", connData.ApplicationName},
+	}
+
+	parts := make([]string, 0, len(params))
+	for _, param := range params {
+		if param.value == "" || (param.key == "port" && param.value == "0") {
+			continue
+		}
+		parts = append(parts, param.key+"="+quoteDSNValue(param.value))
+	}
+	return strings.Join(parts, " ")
+}
+
+func quoteDSNValue(value string) string {
+	if value != "" && !strings.ContainsAny(value, ` '\`) {
+		return value
+	}
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
+}
+
+func Ping(ctx context.Context) error {
+	if DB == nil {
+		return errors.New("Database is not connected")
+	}
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
@@ -0,0 +1,422 @@
+package db
+
+import (
+	"RestAPI/core"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+/*
+dbConnect.go testing
+*/
+func TestBuildDSN(t *testing.T) {
+	testCases := []struct {
+		name     string
+		connData core.DBCredentials
+		expected string
+	}{
+		{
+			name:     "Defaults",
+			connData: core.DBCredentials{Host: "localhost", Port: 5432, User: "admin", Password: "secret", DB_Name: "dev", SSLMode: "disable", TimeZone: "Europe/Moscow", ApplicationName: "imagolab"},
+			expected: "host=localhost port=5432 user=admin password=secret dbname=dev sslmode=disable TimeZone=Europe/Moscow application_name=imagolab",
+		},
+		{
+			name:     "Quoted values and root cert",
+			connData: core.DBCredentials{Host: "db.internal", Port: 6432, User: "app", Password: `p a's\`, DB_Name: "prod", SSLMode: "verify-full", SSLRootCert: "/certs/ca.pem"},
+			expected: `host=db.internal port=6432 user=app password='p a\'s\\' dbname=prod sslmode=verify-full sslrootcert=/certs/ca.pem`,
+		},
+		{
+			name:     "Empty values skipped",
+			connData: core.DBCredentials{Host: "/var/run/postgresql", DB_Name: "dev"},
+			expected: "host=/var/run/postgresql dbname=dev",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if dsn := buildDSN(tc.connData); dsn != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, dsn)
+			}
+		})
+	}
+}
+
+/*
+migrations.go testing
+*/
+func TestLoadMigrations(t *testing.T) {
+	testCases := []struct {
+		name          string
+		files         fstest.MapFS
+		expected      []int64
+		expectedError string
+	}{
+		{
+			name: "Ordered by version",
+			files: fstest.MapFS{
+				"0010_second.up.sql":   {Data: []byte("SELECT 2;")},
+				"0010_second.down.sql": {Data: []byte("SELECT -2;")},
+				"0002_first.up.sql":    {Data: []byte("SELECT 1;")},
+				"0002_first.down.sql":  {Data: []byte("SELECT -1;")},
+			},
+			expected: []int64{2, 10},
+		},
+		{
+			name: "Missing down file",
+			files: fstest.MapFS{
+				"0001_init.up.sql": {Data: []byte("SELECT 1;")},
+			},
+			expectedError: "must have non-empty up and down files",
+		},
+		{
+			name: "Invalid file name",
+			files: fstest.MapFS{
+				"init.sql": {Data: []byte("SELECT 1;")},
+			},
+			expectedError: "invalid migration file name",
+		},
+		{
+			name: "Same version with different names",
+			files: fstest.MapFS{
+				"0001_init.up.sql":    {Data: []byte("SELECT 1;")},
+				"0001_other.down.sql": {Data: []byte("SELECT -1;")},
+			},
+			expectedError: "different names",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			migrations, err := LoadMigrations(tc.files)
+			if tc.expectedError != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.expectedError) {
+					t.Fatalf("Expected error containing %q, got %v", tc.expectedError, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(migrations) != len(tc.expected) {
+				t.Fatalf("Expected %d migrations, got %d", len(tc.expected), len(migrations))
+			}
+			for i, m := range migrations {
+				if m.Version != tc.expected[i] {
+					t.Errorf("Expected version %d at %d, got %d", tc.expected[i], i, m.Version)
+				}
+				if len(m.Checksum) != 64 {
+					t.Errorf("Expected sha256 checksum for version %d, got %q", m.Version, m.Checksum)
+				}
+			}
+		})
+	}
+
+	migrations, err := embeddedMigrations()
+	if err != nil {
+		t.Fatalf("Embedded migrations are invalid: %v", err)
+	}
+	if len(migrations) == 0 || migrations[0].Version != 1 {
+		t.Errorf("Expected embedded migrations starting from version 1")
+	}
+}
+
+/*
+memoryRepositories.go testing
+*/
+func TestMemoryRepositories(t *testing.T) {
+	repos := NewMemoryRepositories()
+	ctx := context.Background()
+
+	user := &User{Username: "test", Email: "test@example.com"}
+	if err := repos.Users.Create(ctx, user); err != nil || user.ID == 0 {
+		t.Fatalf("Create: expected user with ID, got %d, %v", user.ID, err)
+	}
+	if err := repos.Users.Create(ctx, &User{Username: "other", Email: "test@example.com"}); !errors.Is(err, ErrDuplicateEmail) {
+		t.Errorf("Create: expected ErrDuplicateEmail, got %v", err)
+	}
+
+	found, err := repos.Users.GetByEmail(ctx, "test@example.com")
+	if err != nil || found.ID != user.ID {
+		t.Fatalf("GetByEmail: expected user %d, got %v", user.ID, err)
+	}
+	found.Username = "changed"
+	if stored, _ := repos.Users.GetByID(ctx, user.ID); stored.Username != "test" {
+		t.Error("GetByID: changes leaked into the store without Save")
+	}
+	if err := repos.Users.Save(ctx, found); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if stored, _ := repos.Users.GetByID(ctx, user.ID); stored.Username != "changed" {
+		t.Errorf("Save: expected username changed, got %s", stored.Username)
+	}
+	if _, err := repos.Users.GetByID(ctx, 999); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetByID: expected ErrNotFound, got %v", err)
+	}
+
+	lockedUntil := time.Now().Add(time.Hour)
+	others := []*User{
+		{Username: "Banned", Email: "banned@example.com", IsActive: true, BannedAt: &lockedUntil},
+		{Username: "locked", Email: "locked@example.com", IsActive: true, AuthTimeout: &lockedUntil},
+	}
+	for _, other := range others {
+		if err := repos.Users.Create(ctx, other); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	listTests := []struct {
+		filter   UserFilter
+		expected []uint
+	}{
+		{UserFilter{Limit: -1}, []uint{user.ID, others[0].ID, others[1].ID}},
+		{UserFilter{Offset: 1, Limit: 1}, []uint{others[0].ID}},
+		{UserFilter{Query: "BAN", Limit: -1}, []uint{others[0].ID}},
+		{UserFilter{Query: fmt.Sprint(others[1].ID), Limit: -1}, []uint{others[1].ID}},
+		{UserFilter{Status: UserStatusInactive, Limit: -1}, []uint{user.ID}},
+		{UserFilter{Status: UserStatusActive, Limit: -1}, []uint{others[1].ID}},
+		{UserFilter{Status: UserStatusBanned, Limit: -1}, []uint{others[0].ID}},
+		{UserFilter{Status: UserStatusLocked, Limit: -1}, []uint{others[1].ID}},
+		{UserFilter{Status: UserStatusDeleted, Limit: -1}, []uint{}},
+	}
+	for _, tc := range listTests {
+		list, total, err := repos.Users.List(ctx, tc.filter)
+		ids := []uint{}
+		for _, u := range list {
+			ids = append(ids, u.ID)
+		}
+		if err != nil || fmt.Sprint(ids) != fmt.Sprint(tc.expected) {
+			t.Errorf("Users.List(%+v): expected %v, got %v, %v", tc.filter, tc.expected, ids, err)
+		}
+		if tc.filter.Limit < 0 && total != int64(len(tc.expected)) {
+			t.Errorf("Users.List(%+v): expected total %d, got %d", tc.filter, len(tc.expected), total)
+		}
+	}
+
+	expiresAt := time.Now().Add(time.Hour)
+	sessions := []*Session{
+		{UserID: user.ID, AccessTokenHash: "a1", RefreshTokenHash: "r1", ExpiresAt: expiresAt},
+		{UserID: user.ID, AccessTokenHash: "a2", RefreshTokenHash: "r2", ExpiresAt: expiresAt},
+		{UserID: user.ID, AccessTokenHash: "a3", RefreshTokenHash: "r3", ExpiresAt: time.Now().Add(-time.Second)},
+	}
+	for _, session := range sessions {
+		if err := repos.Sessions.Create(ctx, session); err != nil {
+			t.Fatalf("Sessions.Create: %v", err)
+		}
+	}
+	if err := repos.Sessions.Create(ctx, &Session{UserID: user.ID, AccessTokenHash: "a1", RefreshTokenHash: "r4"}); err == nil {
+		t.Error("Sessions.Create: expected error for duplicate token hash")
+	}
+	if session, err := repos.Sessions.GetByRefreshHash(ctx, "r1"); err != nil || session.ID != sessions[0].ID {
+		t.Errorf("GetByRefreshHash: unexpected result %v, %v", session, err)
+	}
+	if _, err := repos.Sessions.GetByAccessHash(ctx, "a3"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetByAccessHash: expected expired session to be skipped, got %v", err)
+	}
+	if list, _ := repos.Sessions.ListByUser(ctx, user.ID); len(list) != 2 {
+		t.Errorf("ListByUser: expected 2 active sessions, got %d", len(list))
+	}
+	rotated := *sessions[0]
+	rotated.AccessTokenHash, rotated.RefreshTokenHash = "a1-2", "r1-2"
+	if err := repos.Sessions.Rotate(ctx, &rotated, "r1"); err != nil {
+		t.Errorf("Rotate: %v", err)
+	}
+	if err := repos.Sessions.Rotate(ctx, &rotated, "r1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Rotate: expected ErrNotFound for already used token, got %v", err)
+	}
+	if session, err := repos.Sessions.GetByUsedRefreshHash(ctx, "r1"); err != nil || session.ID != sessions[0].ID {
+		t.Errorf("GetByUsedRefreshHash: unexpected result %v, %v", session, err)
+	}
+	if _, err := repos.Sessions.GetByUsedRefreshHash(ctx, "r1-2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetByUsedRefreshHash: expected ErrNotFound for current token, got %v", err)
+	}
+	if err := repos.Sessions.Revoke(ctx, user.ID+1, sessions[0].ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Revoke: expected ErrNotFound for another user's session, got %v", err)
+	}
+	if revoked, _ := repos.Sessions.RevokeByUser(ctx, user.ID, sessions[0].ID); revoked != 1 {
+		t.Errorf("RevokeByUser: expected 1 revoked, got %d", revoked)
+	}
+	if _, err := repos.Sessions.GetByAccessHash(ctx, "a2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetByAccessHash: expected revoked session to be skipped, got %v", err)
+	}
+	if err := repos.Sessions.Revoke(ctx, user.ID, sessions[0].ID); err != nil {
+		t.Errorf("Revoke: %v", err)
+	}
+	if deleted, _ := repos.Sessions.DeleteByUser(ctx, user.ID); deleted != 3 {
+		t.Errorf("DeleteByUser: expected 3 deleted, got %d", deleted)
+	}
+
+	admin, err := repos.Roles.GetByName(ctx, "admin")
+	if err != nil {
+		t.Fatalf("Roles.GetByName: %v", err)
+	}
+	if roles, _ := repos.Roles.ListByUser(ctx, user.ID); len(roles) != 1 || roles[0].Name != "user" {
+		t.Errorf("Roles.ListByUser: expected only the default role, got %v", roles)
+	}
+	if err := repos.Roles.Assign(ctx, user.ID, admin.ID); err != nil {
+		t.Errorf("Roles.Assign: %v", err)
+	}
+	if err := repos.Roles.Assign(ctx, user.ID, admin.ID); err != nil {
+		t.Errorf("Roles.Assign: expected repeated assignment to succeed, got %v", err)
+	}
+	if roles, _ := repos.Roles.ListByUser(ctx, user.ID); len(roles) != 2 || roles[0].Name != "admin" {
+		t.Errorf("Roles.ListByUser: expected admin and user roles, got %v", roles)
+	}
+	if err := repos.Roles.Unassign(ctx, user.ID, admin.ID); err != nil {
+		t.Errorf("Roles.Unassign: %v", err)
+	}
+	if err := repos.Roles.Unassign(ctx, user.ID, admin.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Roles.Unassign: expected ErrNotFound for unassigned role, got %v", err)
+	}
+
+	past := time.Now().Add(-time.Second)
+	keys := []*APIKey{
+		{UserID: user.ID, Name: "ci", KeyHash: "k1", Scopes: StringList{"images:read"}},
+		{UserID: user.ID, Name: "old", KeyHash: "k2", ExpiresAt: &past},
+	}
+	for _, key := range keys {
+		if err := repos.APIKeys.Create(ctx, key); err != nil {
+			t.Fatalf("APIKeys.Create: %v", err)
+		}
+	}
+	if err := repos.APIKeys.Create(ctx, &APIKey{UserID: user.ID, KeyHash: "k1"}); err == nil {
+		t.Error("APIKeys.Create: expected error for duplicate key hash")
+	}
+	if key, err := repos.APIKeys.GetByHash(ctx, "k1"); err != nil || key.ID != keys[0].ID || len(key.Scopes) != 1 {
+		t.Errorf("APIKeys.GetByHash: unexpected result %v, %v", key, err)
+	}
+	if _, err := repos.APIKeys.GetByHash(ctx, "k2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("APIKeys.GetByHash: expected expired key to be skipped, got %v", err)
+	}
+	repos.APIKeys.Touch(ctx, keys[0].ID, "10.0.0.1")
+	if list, _ := repos.APIKeys.ListByUser(ctx, user.ID); len(list) != 2 || list[1].LastUsedAt == nil || list[1].LastUsedIP != "10.0.0.1" {
+		t.Errorf("APIKeys.ListByUser: expected 2 keys with last use tracked, got %v", list)
+	}
+	if err := repos.APIKeys.Revoke(ctx, user.ID+1, keys[0].ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("APIKeys.Revoke: expected ErrNotFound for another user's key, got %v", err)
+	}
+	if err := repos.APIKeys.Revoke(ctx, user.ID, keys[0].ID); err != nil {
+		t.Errorf("APIKeys.Revoke: %v", err)
+	}
+	if _, err := repos.APIKeys.GetByHash(ctx, "k1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("APIKeys.GetByHash: expected revoked key to be skipped, got %v", err)
+	}
+	if revoked, _ := repos.APIKeys.RevokeByUser(ctx, user.ID); revoked != 1 {
+		t.Errorf("APIKeys.RevokeByUser: expected 1 revoked, got %d", revoked)
+	}
+	if deleted, _ := repos.APIKeys.DeleteByUser(ctx, user.ID); deleted != 2 {
+		t.Errorf("APIKeys.DeleteByUser: expected 2 deleted, got %d", deleted)
+	}
+
+	if err := repos.RecoveryCodes.Replace(ctx, user.ID, []string{"c1", "c2"}); err != nil {
+		t.Fatalf("RecoveryCodes.Replace: %v", err)
+	}
+	if err := repos.RecoveryCodes.Use(ctx, user.ID+1, "c1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RecoveryCodes.Use: expected ErrNotFound for another user's code, got %v", err)
+	}
+	if err := repos.RecoveryCodes.Use(ctx, user.ID, "c1"); err != nil {
+		t.Errorf("RecoveryCodes.Use: %v", err)
+	}
+	if err := repos.RecoveryCodes.Use(ctx, user.ID, "c1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RecoveryCodes.Use: expected ErrNotFound for used code, got %v", err)
+	}
+	if left, _ := repos.RecoveryCodes.CountUnused(ctx, user.ID); left != 1 {
+		t.Errorf("RecoveryCodes.CountUnused: expected 1, got %d", left)
+	}
+	repos.RecoveryCodes.Replace(ctx, user.ID, []string{"c3"})
+	if err := repos.RecoveryCodes.Use(ctx, user.ID, "c2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("RecoveryCodes.Use: expected replaced code to be rejected, got %v", err)
+	}
+	if deleted, _ := repos.RecoveryCodes.DeleteByUser(ctx, user.ID); deleted != 1 {
+		t.Errorf("RecoveryCodes.DeleteByUser: expected 1 deleted, got %d", deleted)
+	}
+
+	if err := repos.Identities.Create(ctx, &UserIdentity{UserID: user.ID, Provider: "google", Subject: "s1"}); err != nil {
+		t.Fatalf("Identities.Create: %v", err)
+	}
+	if err := repos.Identities.Create(ctx, &UserIdentity{UserID: user.ID + 1, Provider: "google", Subject: "s1"}); !errors.Is(err, ErrDuplicateIdentity) {
+		t.Errorf("Identities.Create: expected ErrDuplicateIdentity, got %v", err)
+	}
+	if identity, err := repos.Identities.GetBySubject(ctx, "google", "s1"); err != nil || identity.UserID != user.ID {
+		t.Errorf("Identities.GetBySubject: expected identity of user %d, got %+v, %v", user.ID, identity, err)
+	}
+	if _, err := repos.Identities.GetBySubject(ctx, "github", "s1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Identities.GetBySubject: expected ErrNotFound for another provider, got %v", err)
+	}
+	if deleted, _ := repos.Identities.DeleteByUser(ctx, user.ID); deleted != 1 {
+		t.Errorf("Identities.DeleteByUser: expected 1 deleted, got %d", deleted)
+	}
+
+	images := []Image{{UserID: user.ID, Url: "1"}, {UserID: user.ID, Url: "2"}, {UserID: user.ID, Url: "3"}}
+	if err := repos.Images.CreateBatch(ctx, images); err != nil {
+		t.Fatalf("CreateBatch: %v", err)
+	}
+	if total, _ := repos.Images.CountByUser(ctx, user.ID); total != 3 {
+		t.Errorf("CountByUser: expected 3, got %d", total)
+	}
+	page, _ := repos.Images.ListByUser(ctx, user.ID, 1, 5)
+	if len(page) != 2 || page[0].Url != "2" {
+		t.Errorf("ListByUser: unexpected page %v", page)
+	}
+}
+
+/*
+unitOfWork.go testing
+*/
+func TestUnitOfWork(t *testing.T) {
+	repos := NewMemoryRepositories()
+	ctx := context.Background()
+	failure := errors.New("failure")
+
+	var actions []string
+	record := func(name string) func() error {
+		return func() error {
+			actions = append(actions, name)
+			return nil
+		}
+	}
+
+	err := repos.Transaction(ctx, func(uow *UnitOfWork) error {
+		uow.OnRollback(record("rollback"))
+		uow.OnCommit(record("commit 1"))
+		uow.OnCommit(record("commit 2"))
+		return uow.Repos.Users.Create(ctx, &User{Username: "committed", Email: "committed@example.com"})
+	})
+	if err != nil {
+		t.Fatalf("Commit: unexpected error %v", err)
+	}
+	if strings.Join(actions, ",") != "commit 2,commit 1" {
+		t.Errorf("Commit: unexpected actions %v", actions)
+	}
+	if _, err := repos.Users.GetByEmail(ctx, "committed@example.com"); err != nil {
+		t.Errorf("Commit: user not saved: %v", err)
+	}
+
+	actions = nil
+	err = repos.Transaction(ctx, func(uow *UnitOfWork) error {
+		uow.OnRollback(record("rollback 1"))
+		uow.OnCommit(record("commit"))
+		if err := uow.Repos.Users.Create(ctx, &User{Username: "rolledback", Email: "rolledback@example.com"}); err != nil {
+			return err
+		}
+		uow.OnRollback(record("rollback 2"))
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Fatalf("Rollback: expected failure, got %v", err)
+	}
+	if strings.Join(actions, ",") != "rollback 2,rollback 1" {
+		t.Errorf("Rollback: unexpected actions %v", actions)
+	}
+	if _, err := repos.Users.GetByEmail(ctx, "rolledback@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Rollback: expected user to be rolled back, got %v", err)
+	}
+
+	user := &User{Username: "next", Email: "next@example.com"}
+	if err := repos.Users.Create(ctx, user); err != nil || user.ID != 2 {
+		t.Errorf("Rollback: expected ID sequence to be restored, got %d, %v", user.ID, err)
+	}
+}
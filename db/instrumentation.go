@@ -0,0 +1,99 @@
+package db
+
+import (
+	"RestAPI/core"
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	queryDuration = core.NewHistogramVec(
+		"imagolab_db_query_duration_seconds",
+		"Duration of database queries executed through GORM",
+		[]float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5},
+		"operation", "table",
+	)
+	queryErrors = core.NewCounterVec(
+		"imagolab_db_query_errors_total",
+		"Total number of failed database queries",
+		"operation", "table",
+	)
+)
+
+const (
+	queryStartKey = "instrumentation:query_start"
+	querySpanKey  = "instrumentation:query_span"
+)
+
+/*
+Плагин GORM, замеряющий длительность каждого запроса к базе данных и создающий для него спан трассировки
+*/
+type queryInstrumentationPlugin struct{}
+
+func (queryInstrumentationPlugin) Name() string {
+	return "imagolab:query_instrumentation"
+}
+
+func (queryInstrumentationPlugin) Initialize(db *gorm.DB) error {
+	cb := db.Callback()
+	return errors.Join(
+		cb.Create().Before("gorm:create").Register("instrumentation:before_create", beforeQuery),
+		cb.Create().After("gorm:create").Register("instrumentation:after_create", afterQuery("create")),
+		cb.Query().Before("gorm:query").Register("instrumentation:before_query", beforeQuery),
+		cb.Query().After("gorm:query").Register("instrumentation:after_query", afterQuery("query")),
+		cb.Update().Before("gorm:update").Register("instrumentation:before_update", beforeQuery),
+		cb.Update().After("gorm:update").Register("instrumentation:after_update", afterQuery("update")),
+		cb.Delete().Before("gorm:delete").Register("instrumentation:before_delete", beforeQuery),
+		cb.Delete().After("gorm:delete").Register("instrumentation:after_delete", afterQuery("delete")),
+		cb.Row().Before("gorm:row").Register("instrumentation:before_row", beforeQuery),
+		cb.Row().After("gorm:row").Register("instrumentation:after_row", afterQuery("row")),
+		cb.Raw().Before("gorm:raw").Register("instrumentation:before_raw", beforeQuery),
+		cb.Raw().After("gorm:raw").Register("instrumentation:after_raw", afterQuery("raw")),
+	)
+}
+
+func beforeQuery(tx *gorm.DB) {
+	tx.InstanceSet(queryStartKey, time.Now())
+	_, span := core.StartSpan(tx.Statement.Context, "gorm.query", core.SpanKindClient)
+	if span != nil {
+		tx.InstanceSet(querySpanKey, span)
+	}
+}
+
+func afterQuery(operation string) func(*gorm.DB) {
+	return func(tx *gorm.DB) {
+		if value, ok := tx.InstanceGet(querySpanKey); ok {
+			if span, ok := value.(*core.Span); ok {
+				span.SetName("gorm." + operation + " " + tx.Statement.Table)
+				span.SetAttribute("db.system", "postgresql")
+				span.SetAttribute("db.operation", operation)
+				span.SetAttribute("db.sql.table", tx.Statement.Table)
+				span.SetAttribute("db.statement", tx.Statement.SQL.String())
+				span.SetAttribute("db.rows_affected", tx.RowsAffected)
+				if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+					span.SetError(tx.Error)
+				}
+				span.Finish()
+			}
+		}
+
+		value, ok := tx.InstanceGet(queryStartKey)
+		if !ok {
+			return
+		}
+		start, ok := value.(time.Time)
+		if !ok {
+			return
+		}
+		table := tx.Statement.Table
+		if table == "" {
+			table = "unknown"
+		}
+		queryDuration.Observe(time.Since(start).Seconds(), operation, table)
+		if tx.Error != nil && !errors.Is(tx.Error, gorm.ErrRecordNotFound) {
+			queryErrors.Inc(operation, table)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package db
+
+/*
+	Журнал запросов GORM через log/slog
+	Ошибки запросов (кроме "record not found") пишутся с уровнем ERROR, медленные запросы - WARN,
+	все запросы при уровне info - INFO
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type gormLogger struct {
+	logger        *slog.Logger
+	level         logger.LogLevel
+	slowThreshold time.Duration
+}
+
+func parseGormLogLevel(level string) logger.LogLevel {
+	switch level {
+	case "silent":
+		return logger.Silent
+	case "error":
+		return logger.Error
+	case "info":
+		return logger.Info
+	default:
+		return logger.Warn
+	}
+}
+
+func newGormLogger(level string, slowThreshold time.Duration) *gormLogger {
+	return &gormLogger{
+		logger:        slog.Default().With("component", "gorm"),
+		level:         parseGormLogLevel(level),
+		slowThreshold: slowThreshold,
+	}
+}
+
+func (l *gormLogger) LogMode(level logger.LogLevel) logger.Interface {
+	copied := *l
+	copied.level = level
+	return &copied
+}
+
+func (l *gormLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= logger.Info {
+		l.logger.InfoContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= logger.Warn {
+		l.logger.WarnContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	if l.level >= logger.Error {
+		l.logger.ErrorContext(ctx, fmt.Sprintf(msg, args...))
+	}
+}
+
+func (l *gormLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+	if l.level <= logger.Silent {
+		return
+	}
+	elapsed := time.Since(begin)
+	switch {
+	case err != nil && !errors.Is(err, gorm.ErrRecordNotFound) && l.level >= logger.Error:
+		sql, rows := fc()
+		l.logger.ErrorContext(ctx, "query failed", "error", err, "sql", sql, "rows", rows, "duration", elapsed)
+	case l.slowThreshold > 0 && elapsed > l.slowThreshold && l.level >= logger.Warn:
+		sql, rows := fc()
+		l.logger.WarnContext(ctx, "slow query", "sql", sql, "rows", rows, "duration", elapsed, "threshold", l.slowThreshold)
+	case l.level >= logger.Info:
+		sql, rows := fc()
+		l.logger.InfoContext(ctx, "query", "sql", sql, "rows", rows, "duration", elapsed)
+	}
+}
@@ -0,0 +1,988 @@
+package db
+
+/*
+	Репозитории в памяти для тестов: ведут себя как GORM-реализация (автоинкремент ID, CreatedAt/UpdatedAt,
+	уникальность email, мягкое удаление), но не требуют Postgres
+	Методы возвращают копии записей, чтобы изменения вне репозитория не попадали в "базу" без Save
+*/
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+type memoryStore struct {
+	txMu     sync.Mutex
+	mu       sync.Mutex
+	users    map[uint]User
+	sessions map[uint]Session
+	// Хеш использованного refresh токена -> ID сессии
+	usedRefresh map[string]uint
+	apiKeys     map[uint]APIKey
+	recovery    map[uint]RecoveryCode
+	identities  map[uint]UserIdentity
+	// Роли только читаются, поэтому не копируются в снимок транзакции
+	roles     map[uint]Role
+	userRoles map[userRole]bool
+	images    map[uint]Image
+	audit     []AuditEvent
+	nextUser  uint
+	nextSess  uint
+	nextKey   uint
+	nextCode  uint
+	nextIdent uint
+	nextImg   uint
+}
+
+type userRole struct {
+	userID uint
+	roleID uint
+}
+
+/*
+Те же роли, что создает миграция 0007_roles
+*/
+func memoryRoles() map[uint]Role {
+	now := time.Now()
+	return map[uint]Role{
+		1: {ID: 1, CreatedAt: now, UpdatedAt: now, Name: "user", Description: "Every registered user", IsDefault: true,
+			Permissions: StringList{"images:generate", "images:read"}},
+		2: {ID: 2, CreatedAt: now, UpdatedAt: now, Name: "admin", Description: "Full access including audit log and diagnostics",
+			Permissions: StringList{"*"}},
+	}
+}
+
+func NewMemoryRepositories() *Repositories {
+	store := &memoryStore{
+		users:       make(map[uint]User),
+		sessions:    make(map[uint]Session),
+		usedRefresh: make(map[string]uint),
+		apiKeys:     make(map[uint]APIKey),
+		recovery:    make(map[uint]RecoveryCode),
+		identities:  make(map[uint]UserIdentity),
+		roles:       memoryRoles(),
+		userRoles:   make(map[userRole]bool),
+		images:      make(map[uint]Image),
+	}
+	return &Repositories{
+		Users:         &memoryUserRepo{store},
+		Sessions:      &memorySessionRepo{store},
+		APIKeys:       &memoryAPIKeyRepo{store},
+		RecoveryCodes: &memoryRecoveryCodeRepo{store},
+		Identities:    &memoryIdentityRepo{store},
+		Roles:         &memoryRoleRepo{store},
+		Images:        &memoryImageRepo{store},
+		Audit:         &memoryAuditRepo{store},
+
+		transaction: store.transaction,
+		reset:       store.reset,
+	}
+}
+
+func (s *memoryStore) reset(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = make(map[uint]User)
+	s.sessions = make(map[uint]Session)
+	s.usedRefresh = make(map[string]uint)
+	s.apiKeys = make(map[uint]APIKey)
+	s.recovery = make(map[uint]RecoveryCode)
+	s.identities = make(map[uint]UserIdentity)
+	s.userRoles = make(map[userRole]bool)
+	s.images = make(map[uint]Image)
+	s.audit = nil
+	s.nextUser, s.nextSess, s.nextKey, s.nextCode, s.nextIdent, s.nextImg = 0, 0, 0, 0, 0, 0
+	return nil
+}
+
+/*
+Транзакция в памяти: перед выполнением делается снимок данных, при ошибке он восстанавливается
+Транзакции выполняются последовательно, но не изолированы от операций вне транзакции
+*/
+func (s *memoryStore) transaction(ctx context.Context, fn func(tx *Repositories) error) (err error) {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	s.mu.Lock()
+	snapshot := memoryStore{
+		users:       make(map[uint]User, len(s.users)),
+		sessions:    make(map[uint]Session, len(s.sessions)),
+		usedRefresh: make(map[string]uint, len(s.usedRefresh)),
+		apiKeys:     make(map[uint]APIKey, len(s.apiKeys)),
+		recovery:    make(map[uint]RecoveryCode, len(s.recovery)),
+		identities:  make(map[uint]UserIdentity, len(s.identities)),
+		userRoles:   make(map[userRole]bool, len(s.userRoles)),
+		images:      make(map[uint]Image, len(s.images)),
+		nextUser:    s.nextUser,
+		nextSess:    s.nextSess,
+		nextKey:     s.nextKey,
+		nextCode:    s.nextCode,
+		nextIdent:   s.nextIdent,
+		nextImg:     s.nextImg,
+		audit:       append([]AuditEvent{}, s.audit...),
+	}
+	for id, user := range s.users {
+		snapshot.users[id] = copyUser(&user)
+	}
+	for id, session := range s.sessions {
+		snapshot.sessions[id] = copySession(&session)
+	}
+	for hash, id := range s.usedRefresh {
+		snapshot.usedRefresh[hash] = id
+	}
+	for id, key := range s.apiKeys {
+		snapshot.apiKeys[id] = copyAPIKey(&key)
+	}
+	for id, code := range s.recovery {
+		snapshot.recovery[id] = copyRecoveryCode(&code)
+	}
+	for id, identity := range s.identities {
+		snapshot.identities[id] = identity
+	}
+	for key := range s.userRoles {
+		snapshot.userRoles[key] = true
+	}
+	for id, image := range s.images {
+		snapshot.images[id] = image
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		if p := recover(); p != nil || err != nil {
+			s.mu.Lock()
+			s.users, s.sessions, s.usedRefresh, s.apiKeys = snapshot.users, snapshot.sessions, snapshot.usedRefresh, snapshot.apiKeys
+			s.recovery, s.identities, s.userRoles, s.images, s.audit = snapshot.recovery, snapshot.identities, snapshot.userRoles, snapshot.images, snapshot.audit
+			s.nextUser, s.nextSess, s.nextKey, s.nextCode, s.nextIdent, s.nextImg = snapshot.nextUser, snapshot.nextSess, snapshot.nextKey, snapshot.nextCode, snapshot.nextIdent, snapshot.nextImg
+			s.mu.Unlock()
+			if p != nil {
+				panic(p)
+			}
+		}
+	}()
+	return fn(&Repositories{
+		Users:         &memoryUserRepo{s},
+		Sessions:      &memorySessionRepo{s},
+		APIKeys:       &memoryAPIKeyRepo{s},
+		RecoveryCodes: &memoryRecoveryCodeRepo{s},
+		Identities:    &memoryIdentityRepo{s},
+		Roles:         &memoryRoleRepo{s},
+		Images:        &memoryImageRepo{s},
+		Audit:         &memoryAuditRepo{s},
+		reset:         s.reset,
+	})
+}
+
+type memoryUserRepo struct {
+	*memoryStore
+}
+
+func (r *memoryUserRepo) emailTaken(email string, exceptID uint) bool {
+	for id, user := range r.users {
+		if id != exceptID && user.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *memoryUserRepo) Create(ctx context.Context, user *User) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.emailTaken(user.Email, 0) {
+		return ErrDuplicateEmail
+	}
+	r.nextUser++
+	now := time.Now()
+	user.ID = r.nextUser
+	user.CreatedAt = now
+	user.UpdatedAt = now
+	r.users[user.ID] = copyUser(user)
+	return nil
+}
+
+func (r *memoryUserRepo) GetByID(ctx context.Context, id uint) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt.Valid {
+		return nil, ErrNotFound
+	}
+	result := copyUser(&user)
+	return &result, nil
+}
+
+func (r *memoryUserRepo) GetByEmail(ctx context.Context, email string) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, user := range r.users {
+		if user.Email == email && !user.DeletedAt.Valid {
+			result := copyUser(&user)
+			return &result, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryUserRepo) Save(ctx context.Context, user *User) error {
+	if user.ID == 0 {
+		return r.Create(ctx, user)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.emailTaken(user.Email, user.ID) {
+		return ErrDuplicateEmail
+	}
+	if existing, ok := r.users[user.ID]; ok {
+		user.CreatedAt = existing.CreatedAt
+	} else {
+		user.CreatedAt = time.Now()
+	}
+	user.UpdatedAt = time.Now()
+	r.users[user.ID] = copyUser(user)
+	return nil
+}
+
+func (r *memoryUserRepo) Delete(ctx context.Context, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[id]
+	if !ok || user.DeletedAt.Valid {
+		return ErrNotFound
+	}
+	user.DeletedAt = gorm.DeletedAt{Time: time.Now(), Valid: true}
+	r.users[id] = user
+	return nil
+}
+
+func (r *memoryUserRepo) GetDeletedByEmail(ctx context.Context, email string) (*User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, user := range r.users {
+		if user.Email == email && user.DeletedAt.Valid {
+			result := copyUser(&user)
+			return &result, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryUserRepo) Restore(ctx context.Context, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	user, ok := r.users[id]
+	if !ok || !user.DeletedAt.Valid {
+		return ErrNotFound
+	}
+	user.DeletedAt = gorm.DeletedAt{}
+	r.users[id] = user
+	return nil
+}
+
+func (r *memoryUserRepo) ListDeletedBefore(ctx context.Context, before time.Time, limit int) ([]User, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	users := []User{}
+	for _, user := range r.users {
+		if user.DeletedAt.Valid && user.DeletedAt.Time.Before(before) {
+			users = append(users, copyUser(&user))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].DeletedAt.Time.Before(users[j].DeletedAt.Time) })
+	if limit >= 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+func (r *memoryUserRepo) matches(user User, filter UserFilter, now time.Time) bool {
+	if user.DeletedAt.Valid != (filter.Status == UserStatusDeleted) {
+		return false
+	}
+	if filter.Query != "" {
+		query := strings.ToLower(filter.Query)
+		if strconv.FormatUint(uint64(user.ID), 10) != filter.Query &&
+			!strings.Contains(strings.ToLower(user.Username), query) && !strings.Contains(strings.ToLower(user.Email), query) {
+			return false
+		}
+	}
+	after := func(t *time.Time) bool { return t != nil && t.After(now) }
+	switch filter.Status {
+	case UserStatusActive:
+		return user.IsActive && user.BannedAt == nil
+	case UserStatusInactive:
+		return !user.IsActive
+	case UserStatusBanned:
+		return user.BannedAt != nil
+	case UserStatusLocked:
+		return after(user.AuthTimeout) || after(user.OtpTimeout) || after(user.ResetTimeout)
+	}
+	return true
+}
+
+func (r *memoryUserRepo) List(ctx context.Context, filter UserFilter) ([]User, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	users := []User{}
+	for _, user := range r.users {
+		if r.matches(user, filter, now) {
+			users = append(users, copyUser(&user))
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	total := int64(len(users))
+	if filter.Offset >= len(users) {
+		return []User{}, total, nil
+	}
+	end := len(users)
+	if filter.Limit >= 0 && filter.Offset+filter.Limit < end {
+		end = filter.Offset + filter.Limit
+	}
+	return users[filter.Offset:end], total, nil
+}
+
+func (r *memoryUserRepo) Purge(ctx context.Context, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.users, id)
+	for key := range r.userRoles {
+		if key.userID == id {
+			delete(r.userRoles, key)
+		}
+	}
+	for i := range r.audit {
+		for _, ref := range []**uint{&r.audit[i].UserID, &r.audit[i].ActorID} {
+			if *ref != nil && **ref == id {
+				*ref = nil
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Копия пользователя без связанных записей и с собственными указателями на время
+*/
+func copyUser(user *User) User {
+	result := *user
+	result.Sessions = nil
+	result.APIKeys = nil
+	result.RecoveryCodes = nil
+	result.Identities = nil
+	result.Roles = nil
+	result.Images = nil
+	for _, field := range []**time.Time{&result.OtpExpires, &result.OtpTimeout, &result.ResetExpires, &result.ResetTimeout, &result.AuthTimeout, &result.BannedAt, &result.TotpEnabledAt} {
+		if *field != nil {
+			value := **field
+			*field = &value
+		}
+	}
+	return result
+}
+
+type memorySessionRepo struct {
+	*memoryStore
+}
+
+func copySession(session *Session) Session {
+	result := *session
+	if session.RevokedAt != nil {
+		revokedAt := *session.RevokedAt
+		result.RevokedAt = &revokedAt
+	}
+	if session.ImpersonatorID != nil {
+		impersonatorID := *session.ImpersonatorID
+		result.ImpersonatorID = &impersonatorID
+	}
+	return result
+}
+
+func (r *memorySessionRepo) hashTaken(session *Session) bool {
+	for id, existing := range r.sessions {
+		if id != session.ID && (existing.AccessTokenHash == session.AccessTokenHash || existing.RefreshTokenHash == session.RefreshTokenHash) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *memorySessionRepo) Create(ctx context.Context, session *Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hashTaken(session) {
+		return errors.New(`duplicate key value violates unique constraint "uni_sessions_access_token_hash"`)
+	}
+	r.nextSess++
+	now := time.Now()
+	session.ID = r.nextSess
+	session.CreatedAt = now
+	session.UpdatedAt = now
+	r.sessions[session.ID] = copySession(session)
+	return nil
+}
+
+func (r *memorySessionRepo) Save(ctx context.Context, session *Session) error {
+	if session.ID == 0 {
+		return r.Create(ctx, session)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hashTaken(session) {
+		return errors.New(`duplicate key value violates unique constraint "uni_sessions_access_token_hash"`)
+	}
+	session.UpdatedAt = time.Now()
+	r.sessions[session.ID] = copySession(session)
+	return nil
+}
+
+func (r *memorySessionRepo) find(match func(session Session) bool) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for _, session := range r.sessions {
+		if session.Active(now) && match(session) {
+			result := copySession(&session)
+			return &result, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memorySessionRepo) GetByAccessHash(ctx context.Context, hash string) (*Session, error) {
+	return r.find(func(session Session) bool { return session.AccessTokenHash == hash })
+}
+
+func (r *memorySessionRepo) GetByRefreshHash(ctx context.Context, hash string) (*Session, error) {
+	return r.find(func(session Session) bool { return session.RefreshTokenHash == hash })
+}
+
+func (r *memorySessionRepo) Rotate(ctx context.Context, session *Session, usedHash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, ok := r.sessions[session.ID]
+	if !ok || !current.Active(time.Now()) || current.RefreshTokenHash != usedHash {
+		return ErrNotFound
+	}
+	if r.hashTaken(session) {
+		return errors.New(`duplicate key value violates unique constraint "uni_sessions_access_token_hash"`)
+	}
+	if _, ok := r.usedRefresh[usedHash]; ok {
+		return errors.New(`duplicate key value violates unique constraint "uni_used_refresh_tokens_token_hash"`)
+	}
+	session.UpdatedAt = time.Now()
+	r.sessions[session.ID] = copySession(session)
+	r.usedRefresh[usedHash] = session.ID
+	return nil
+}
+
+func (r *memorySessionRepo) GetByUsedRefreshHash(ctx context.Context, hash string) (*Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, ok := r.usedRefresh[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	session, ok := r.sessions[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	result := copySession(&session)
+	return &result, nil
+}
+
+func (r *memorySessionRepo) ListByUser(ctx context.Context, userID uint) ([]Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	sessions := []Session{}
+	for _, session := range r.sessions {
+		if session.UserID == userID && session.Active(now) {
+			sessions = append(sessions, copySession(&session))
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt) })
+	return sessions, nil
+}
+
+func (r *memorySessionRepo) Touch(ctx context.Context, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if session, ok := r.sessions[id]; ok {
+		session.LastUsedAt = time.Now()
+		r.sessions[id] = session
+	}
+	return nil
+}
+
+func (r *memorySessionRepo) revoke(match func(session Session) bool) int64 {
+	now := time.Now()
+	var revoked int64
+	for id, session := range r.sessions {
+		if session.Active(now) && match(session) {
+			revokedAt := now
+			session.RevokedAt = &revokedAt
+			r.sessions[id] = session
+			revoked++
+		}
+	}
+	return revoked
+}
+
+func (r *memorySessionRepo) Revoke(ctx context.Context, userID uint, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.revoke(func(session Session) bool { return session.ID == id && session.UserID == userID }) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *memorySessionRepo) RevokeByUser(ctx context.Context, userID uint, exceptID uint) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.revoke(func(session Session) bool { return session.UserID == userID && session.ID != exceptID }), nil
+}
+
+func (r *memorySessionRepo) RevokeAll(ctx context.Context) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.revoke(func(session Session) bool { return true }), nil
+}
+
+func (r *memorySessionRepo) DeleteByUser(ctx context.Context, userID uint) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deleted int64
+	for id, session := range r.sessions {
+		if session.UserID == userID {
+			delete(r.sessions, id)
+			deleted++
+		}
+	}
+	for hash, id := range r.usedRefresh {
+		if _, ok := r.sessions[id]; !ok {
+			delete(r.usedRefresh, hash)
+		}
+	}
+	return deleted, nil
+}
+
+type memoryRoleRepo struct {
+	*memoryStore
+}
+
+func copyRole(role *Role) Role {
+	result := *role
+	result.Permissions = append(StringList{}, role.Permissions...)
+	return result
+}
+
+func (r *memoryRoleRepo) list(match func(role Role) bool) []Role {
+	roles := []Role{}
+	for _, role := range r.roles {
+		if match(role) {
+			roles = append(roles, copyRole(&role))
+		}
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i].Name < roles[j].Name })
+	return roles
+}
+
+func (r *memoryRoleRepo) List(ctx context.Context) ([]Role, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.list(func(role Role) bool { return true }), nil
+}
+
+func (r *memoryRoleRepo) GetByName(ctx context.Context, name string) (*Role, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, role := range r.roles {
+		if role.Name == name {
+			result := copyRole(&role)
+			return &result, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryRoleRepo) ListByUser(ctx context.Context, userID uint) ([]Role, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.list(func(role Role) bool { return role.IsDefault || r.userRoles[userRole{userID, role.ID}] }), nil
+}
+
+func (r *memoryRoleRepo) Assign(ctx context.Context, userID uint, roleID uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.users[userID]; !ok {
+		return errors.New(`insert or update on table "user_roles" violates foreign key constraint "fk_user_roles_user"`)
+	}
+	if _, ok := r.roles[roleID]; !ok {
+		return errors.New(`insert or update on table "user_roles" violates foreign key constraint "fk_user_roles_role"`)
+	}
+	r.userRoles[userRole{userID, roleID}] = true
+	return nil
+}
+
+func (r *memoryRoleRepo) Unassign(ctx context.Context, userID uint, roleID uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := userRole{userID, roleID}
+	if !r.userRoles[key] {
+		return ErrNotFound
+	}
+	delete(r.userRoles, key)
+	return nil
+}
+
+type memoryAPIKeyRepo struct {
+	*memoryStore
+}
+
+func copyAPIKey(key *APIKey) APIKey {
+	result := *key
+	result.Scopes = append(StringList{}, key.Scopes...)
+	for _, field := range []**time.Time{&result.ExpiresAt, &result.LastUsedAt, &result.RevokedAt} {
+		if *field != nil {
+			value := **field
+			*field = &value
+		}
+	}
+	return result
+}
+
+func (r *memoryAPIKeyRepo) Create(ctx context.Context, key *APIKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.apiKeys {
+		if existing.KeyHash == key.KeyHash {
+			return errors.New(`duplicate key value violates unique constraint "uni_api_keys_key_hash"`)
+		}
+	}
+	r.nextKey++
+	now := time.Now()
+	key.ID = r.nextKey
+	key.CreatedAt = now
+	key.UpdatedAt = now
+	r.apiKeys[key.ID] = copyAPIKey(key)
+	return nil
+}
+
+func (r *memoryAPIKeyRepo) GetByHash(ctx context.Context, hash string) (*APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for _, key := range r.apiKeys {
+		if key.KeyHash == hash && key.Active(now) {
+			result := copyAPIKey(&key)
+			return &result, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryAPIKeyRepo) ListByUser(ctx context.Context, userID uint) ([]APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys := []APIKey{}
+	for _, key := range r.apiKeys {
+		if key.UserID == userID && key.RevokedAt == nil {
+			keys = append(keys, copyAPIKey(&key))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID > keys[j].ID })
+	return keys, nil
+}
+
+func (r *memoryAPIKeyRepo) Touch(ctx context.Context, id uint, ip string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if key, ok := r.apiKeys[id]; ok {
+		now := time.Now()
+		key.LastUsedAt = &now
+		key.LastUsedIP = ip
+		r.apiKeys[id] = key
+	}
+	return nil
+}
+
+func (r *memoryAPIKeyRepo) revoke(match func(key APIKey) bool) int64 {
+	now := time.Now()
+	var revoked int64
+	for id, key := range r.apiKeys {
+		if key.RevokedAt == nil && match(key) {
+			revokedAt := now
+			key.RevokedAt = &revokedAt
+			r.apiKeys[id] = key
+			revoked++
+		}
+	}
+	return revoked
+}
+
+func (r *memoryAPIKeyRepo) Revoke(ctx context.Context, userID uint, id uint) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.revoke(func(key APIKey) bool { return key.ID == id && key.UserID == userID }) == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (r *memoryAPIKeyRepo) RevokeByUser(ctx context.Context, userID uint) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.revoke(func(key APIKey) bool { return key.UserID == userID }), nil
+}
+
+func (r *memoryAPIKeyRepo) DeleteByUser(ctx context.Context, userID uint) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deleted int64
+	for id, key := range r.apiKeys {
+		if key.UserID == userID {
+			delete(r.apiKeys, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+type memoryRecoveryCodeRepo struct {
+	*memoryStore
+}
+
+func copyRecoveryCode(code *RecoveryCode) RecoveryCode {
+	result := *code
+	if code.UsedAt != nil {
+		usedAt := *code.UsedAt
+		result.UsedAt = &usedAt
+	}
+	return result
+}
+
+func (r *memoryRecoveryCodeRepo) deleteByUser(userID uint) int64 {
+	var deleted int64
+	for id, code := range r.recovery {
+		if code.UserID == userID {
+			delete(r.recovery, id)
+			deleted++
+		}
+	}
+	return deleted
+}
+
+func (r *memoryRecoveryCodeRepo) Replace(ctx context.Context, userID uint, hashes []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deleteByUser(userID)
+	now := time.Now()
+	for _, hash := range hashes {
+		r.nextCode++
+		r.recovery[r.nextCode] = RecoveryCode{ID: r.nextCode, CreatedAt: now, UserID: userID, CodeHash: hash}
+	}
+	return nil
+}
+
+func (r *memoryRecoveryCodeRepo) Use(ctx context.Context, userID uint, hash string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, code := range r.recovery {
+		if code.UserID == userID && code.CodeHash == hash && code.UsedAt == nil {
+			now := time.Now()
+			code.UsedAt = &now
+			r.recovery[id] = code
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (r *memoryRecoveryCodeRepo) CountUnused(ctx context.Context, userID uint) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var total int64
+	for _, code := range r.recovery {
+		if code.UserID == userID && code.UsedAt == nil {
+			total++
+		}
+	}
+	return total, nil
+}
+
+func (r *memoryRecoveryCodeRepo) DeleteByUser(ctx context.Context, userID uint) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deleteByUser(userID), nil
+}
+
+type memoryIdentityRepo struct {
+	*memoryStore
+}
+
+func (r *memoryIdentityRepo) Create(ctx context.Context, identity *UserIdentity) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.identities {
+		if existing.Provider == identity.Provider && existing.Subject == identity.Subject {
+			return ErrDuplicateIdentity
+		}
+	}
+	r.nextIdent++
+	now := time.Now()
+	identity.ID = r.nextIdent
+	identity.CreatedAt, identity.UpdatedAt = now, now
+	r.identities[identity.ID] = *identity
+	return nil
+}
+
+func (r *memoryIdentityRepo) GetBySubject(ctx context.Context, provider string, subject string) (*UserIdentity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, identity := range r.identities {
+		if identity.Provider == provider && identity.Subject == subject {
+			return &identity, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (r *memoryIdentityRepo) ListByUser(ctx context.Context, userID uint) ([]UserIdentity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	identities := []UserIdentity{}
+	for _, identity := range r.identities {
+		if identity.UserID == userID {
+			identities = append(identities, identity)
+		}
+	}
+	sort.Slice(identities, func(i, j int) bool { return identities[i].ID < identities[j].ID })
+	return identities, nil
+}
+
+func (r *memoryIdentityRepo) DeleteByUser(ctx context.Context, userID uint) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deleted int64
+	for id, identity := range r.identities {
+		if identity.UserID == userID {
+			delete(r.identities, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+type memoryImageRepo struct {
+	*memoryStore
+}
+
+func (r *memoryImageRepo) CreateBatch(ctx context.Context, images []Image) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	for i := range images {
+		r.nextImg++
+		images[i].ID = r.nextImg
+		images[i].CreatedAt = now
+		images[i].UpdatedAt = now
+		r.images[images[i].ID] = images[i]
+	}
+	return nil
+}
+
+func (r *memoryImageRepo) byUser(userID uint) []Image {
+	images := []Image{}
+	for _, image := range r.images {
+		if image.UserID == userID && !image.DeletedAt.Valid {
+			images = append(images, image)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].ID < images[j].ID })
+	return images
+}
+
+func (r *memoryImageRepo) PurgeByUser(ctx context.Context, userID uint) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deleted int64
+	for id, image := range r.images {
+		if image.UserID == userID {
+			delete(r.images, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (r *memoryImageRepo) CountByUser(ctx context.Context, userID uint) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return int64(len(r.byUser(userID))), nil
+}
+
+func (r *memoryImageRepo) ListByUser(ctx context.Context, userID uint, offset int, limit int) ([]Image, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	images := r.byUser(userID)
+	if offset >= len(images) {
+		return []Image{}, nil
+	}
+	end := len(images)
+	if limit >= 0 && offset+limit < end {
+		end = offset + limit
+	}
+	return images[offset:end], nil
+}
+
+type memoryAuditRepo struct {
+	*memoryStore
+}
+
+func (r *memoryAuditRepo) Create(ctx context.Context, event *AuditEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	event.ID = uint(len(r.audit) + 1)
+	if event.CreatedAt.IsZero() {
+		event.CreatedAt = time.Now()
+	}
+	r.audit = append(r.audit, *event)
+	return nil
+}
+
+func (r *memoryAuditRepo) List(ctx context.Context, filter AuditFilter) ([]AuditEvent, int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	events := []AuditEvent{}
+	for i := len(r.audit) - 1; i >= 0; i-- {
+		event := r.audit[i]
+		switch {
+		case filter.UserID != nil && (event.UserID == nil || *event.UserID != *filter.UserID),
+			filter.ActorID != nil && (event.ActorID == nil || *event.ActorID != *filter.ActorID),
+			filter.Action != "" && event.Action != filter.Action,
+			filter.Result != "" && event.Result != filter.Result,
+			filter.IP != "" && event.IP != filter.IP,
+			filter.Since != nil && event.CreatedAt.Before(*filter.Since),
+			filter.Until != nil && !event.CreatedAt.Before(*filter.Until):
+			continue
+		}
+		events = append(events, event)
+	}
+	total := int64(len(events))
+	if filter.Offset >= len(events) {
+		return []AuditEvent{}, total, nil
+	}
+	end := len(events)
+	if filter.Limit >= 0 && filter.Offset+filter.Limit < end {
+		end = filter.Offset + filter.Limit
+	}
+	return events[filter.Offset:end], total, nil
+}
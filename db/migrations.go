@@ -1,71 +1,355 @@
 package db
 
+/*
+	Версионные миграции
+	Миграции - пары SQL-файлов в каталоге db/migrations вида <версия>_<название>.up.sql и <версия>_<название>.down.sql,
+	встроенные в бинарник. Примененные версии и контрольные суммы up-файлов хранятся в таблице schema_migrations
+	MigrateTo() - переход к указанной версии (вверх или вниз), с dryRun только печатает SQL
+	На время миграции берется advisory lock, поэтому несколько экземпляров не мигрируют одновременно
+	Для новой миграции достаточно добавить пару файлов со следующим номером версии
+*/
+
 import (
-	"RestAPI/core"
+	"context"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"gorm.io/gorm"
 )
 
-func migrate(rollback bool) error {
-	if rollback {
-		return rollbackMigrations()
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Ключ pg_advisory_lock для миграций
+const migrationLockKey = 7152024031
+
+// Версия, означающая "последняя доступная миграция"
+const LatestVersion int64 = -1
+
+type Migration struct {
+	Version  int64
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+type MigrationStatus struct {
+	Version          int64
+	Name             string
+	Applied          bool
+	AppliedAt        *time.Time
+	ChecksumMismatch bool
+	Missing          bool
+}
+
+type schemaMigration struct {
+	Version   int64     `gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `gorm:"size:256;not null"`
+	Checksum  string    `gorm:"size:64;not null"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+func (schemaMigration) TableName() string {
+	return "schema_migrations"
+}
+
+var migrationFileRegex = regexp.MustCompile(`^(\d+)_([a-zA-Z0-9_]+)\.(up|down)\.sql$`)
+
+/*
+Загрузка миграций из файловой системы: у каждой версии должны быть up и down файлы, версии не повторяются
+*/
+func LoadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*Migration)
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		matches := migrationFileRegex.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration version: %s", entry.Name())
+		}
+		data, err := fs.ReadFile(fsys, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = m
+		} else if m.Name != matches[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s and %s", version, m.Name, matches[2])
+		}
+		if matches[3] == "up" {
+			m.Up = string(data)
+			sum := sha256.Sum256(data)
+			m.Checksum = hex.EncodeToString(sum[:])
+		} else {
+			m.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			return nil, fmt.Errorf("migration %d_%s must have non-empty up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+func embeddedMigrations() ([]Migration, error) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return LoadMigrations(sub)
+}
+
+func ensureMigrationsTable(db *gorm.DB) error {
+	return db.Exec(`CREATE TABLE IF NOT EXISTS "schema_migrations" (
+	"version" bigint PRIMARY KEY,
+	"name" varchar(256) NOT NULL,
+	"checksum" varchar(64) NOT NULL,
+	"applied_at" timestamptz NOT NULL
+)`).Error
+}
+
+func appliedMigrations(db *gorm.DB) (map[int64]schemaMigration, error) {
+	var rows []schemaMigration
+	if err := db.Order("version").Find(&rows).Error; err != nil {
+		return nil, err
 	}
-	return applyMigrations()
+	applied := make(map[int64]schemaMigration, len(rows))
+	for _, row := range rows {
+		applied[row.Version] = row
+	}
+	return applied, nil
 }
 
-func applyMigrations() error {
-	for _, model := range autoMigrateModels {
-		log.Printf("Migrating model: %T", model)
-		if err := migrateModel(DB, model); err != nil {
-			return fmt.Errorf("failed to migrate %T: %w", model, err)
+/*
+Состояние миграций: для каждой версии из файлов и из schema_migrations
+*/
+func GetMigrationStatus() ([]MigrationStatus, error) {
+	if DB == nil {
+		return nil, errors.New("Database is not connected")
+	}
+	migrations, err := embeddedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureMigrationsTable(DB); err != nil {
+		return nil, err
+	}
+	applied, err := appliedMigrations(DB)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{Version: m.Version, Name: m.Name}
+		if row, ok := applied[m.Version]; ok {
+			appliedAt := row.AppliedAt
+			status.Applied = true
+			status.AppliedAt = &appliedAt
+			status.ChecksumMismatch = row.Checksum != m.Checksum
+			delete(applied, m.Version)
 		}
+		statuses = append(statuses, status)
 	}
-	log.Println("Applied migrations for all models")
-	return nil
+	for _, row := range applied {
+		appliedAt := row.AppliedAt
+		statuses = append(statuses, MigrationStatus{Version: row.Version, Name: row.Name, Applied: true, AppliedAt: &appliedAt, Missing: true})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses, nil
 }
 
-func migrateModel(db *gorm.DB, model any) error {
-	err := db.AutoMigrate(model)
+/*
+Переход к версии target (LatestVersion - последняя, 0 - откат всех миграций)
+Перед применением проверяются контрольные суммы уже примененных миграций
+С dryRun SQL печатается в out и не выполняется
+*/
+func MigrateTo(ctx context.Context, target int64, dryRun bool, out io.Writer) error {
+	if DB == nil {
+		return errors.New("Database is not connected")
+	}
+	migrations, err := embeddedMigrations()
 	if err != nil {
-		if strings.Contains(err.Error(), "constraint") && strings.Contains(err.Error(), "does not exist") {
-			log.Printf("Warning: Constraint does not exist. Continuing with migration. Error: %v", err)
-			return nil
+		return err
+	}
+	if target == LatestVersion {
+		target = 0
+		if len(migrations) > 0 {
+			target = migrations[len(migrations)-1].Version
 		}
+	} else if target != 0 && !hasVersion(migrations, target) {
+		return fmt.Errorf("unknown migration version: %d", target)
+	}
+
+	unlock, err := lockMigrations(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	db := DB.WithContext(ctx)
+	if err := ensureMigrationsTable(db); err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
 		return err
 	}
+	for _, m := range migrations {
+		if row, ok := applied[m.Version]; ok && row.Checksum != m.Checksum {
+			return fmt.Errorf("checksum mismatch for applied migration %d_%s: file was changed after it was applied", m.Version, m.Name)
+		}
+	}
+
+	steps := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok || m.Version > target {
+			continue
+		}
+		if err := runMigration(db, m, true, dryRun, out); err != nil {
+			return err
+		}
+		steps++
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok || m.Version <= target {
+			continue
+		}
+		if err := runMigration(db, m, false, dryRun, out); err != nil {
+			return err
+		}
+		steps++
+	}
+
+	if steps == 0 {
+		log.Println("Database is already at version", target)
+	} else if !dryRun {
+		log.Println("Database migrated to version", target)
+	}
 	return nil
 }
 
-func rollbackMigrations() error {
-	return DB.Transaction(func(tx *gorm.DB) error {
-		log.Println("Rolling back migrations ...")
-		for _, model := range autoMigrateModels {
-			if err := tx.Migrator().DropTable(model); err != nil {
-				return fmt.Errorf("failed to drop table for %T: %w", model, err)
-			}
-			log.Printf("Dropped table for %T", model)
+/*
+Откат последних steps примененных миграций
+*/
+func MigrateDown(ctx context.Context, steps int, dryRun bool, out io.Writer) error {
+	statuses, err := GetMigrationStatus()
+	if err != nil {
+		return err
+	}
+	var applied []int64
+	for _, status := range statuses {
+		if status.Applied && !status.Missing {
+			applied = append(applied, status.Version)
 		}
-		log.Println("Rolled back migrations successfully")
+	}
+	if steps <= 0 || len(applied) == 0 {
 		return nil
-	})
+	}
+	target := int64(0)
+	if steps < len(applied) {
+		target = applied[len(applied)-steps-1]
+	}
+	return MigrateTo(ctx, target, dryRun, out)
 }
 
-func RunMigrations(rollback bool) {
-	err := core.InitEnv()
-	if err != nil {
-		log.Fatalf("Error initializing environment: %v", err)
+func runMigration(db *gorm.DB, m Migration, up bool, dryRun bool, out io.Writer) error {
+	direction, sql := "up", m.Up
+	if !up {
+		direction, sql = "down", m.Down
 	}
 
-	err = ConnectToDB(core.DB_CREDENTIALS)
+	if dryRun {
+		fmt.Fprintf(out, "-- %d_%s (%s)\n%s\n", m.Version, m.Name, direction, strings.TrimSpace(sql))
+		if up {
+			fmt.Fprintf(out, "INSERT INTO \"schema_migrations\" (\"version\", \"name\", \"checksum\", \"applied_at\") VALUES (%d, '%s', '%s', now());\n\n", m.Version, m.Name, m.Checksum)
+		} else {
+			fmt.Fprintf(out, "DELETE FROM \"schema_migrations\" WHERE \"version\" = %d;\n\n", m.Version)
+		}
+		return nil
+	}
+
+	log.Printf("Applying migration %d_%s (%s)", m.Version, m.Name, direction)
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec(sql).Error; err != nil {
+			return err
+		}
+		if up {
+			return tx.Create(&schemaMigration{Version: m.Version, Name: m.Name, Checksum: m.Checksum, AppliedAt: time.Now()}).Error
+		}
+		return tx.Delete(&schemaMigration{}, m.Version).Error
+	})
 	if err != nil {
-		log.Fatalf("Error connecting to DB: %v", err)
+		return fmt.Errorf("migration %d_%s (%s) failed: %w", m.Version, m.Name, direction, err)
 	}
+	return nil
+}
 
-	err = migrate(rollback)
+/*
+Блокировка на уровне сессии БД: держится на отдельном соединении до вызова unlock
+*/
+func lockMigrations(ctx context.Context) (func(), error) {
+	sqlDB, err := DB.DB()
 	if err != nil {
-		log.Fatalf("Error applying migrations: %v", err)
+		return nil, err
+	}
+	conn, err := sqlDB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Println("Waiting for migration lock ...")
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("acquiring migration lock: %w", err)
+	}
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey); err != nil {
+			log.Println("Error releasing migration lock:", err)
+		}
+		conn.Close()
+	}, nil
+}
+
+func hasVersion(migrations []Migration, version int64) bool {
+	for _, m := range migrations {
+		if m.Version == version {
+			return true
+		}
 	}
+	return false
 }
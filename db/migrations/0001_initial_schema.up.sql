@@ -0,0 +1,47 @@
+-- Начальная схема, совпадает со схемой, которую создавал AutoMigrate,
+-- поэтому миграция безопасно применяется и к уже существующей базе
+CREATE TABLE IF NOT EXISTS "users" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "username" varchar(64) NOT NULL,
+    "is_active" boolean DEFAULT false,
+    "email" varchar(256) NOT NULL,
+    "password" varchar(256) NOT NULL,
+    "avatar" text,
+    "otp" bigint,
+    "otp_expires" timestamp,
+    "otp_tries" bigint DEFAULT 0,
+    "otp_timeout" timestamp,
+    "reset_token" text,
+    "reset_expires" timestamp,
+    "reset_tries" bigint DEFAULT 0,
+    "reset_timeout" timestamp,
+    "auth_tries" bigint DEFAULT 0,
+    "auth_timeout" timestamp,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "uni_users_email" UNIQUE ("email")
+);
+CREATE INDEX IF NOT EXISTS "idx_users_deleted_at" ON "users" ("deleted_at");
+
+CREATE TABLE IF NOT EXISTS "tokens" (
+    "id" bigserial,
+    "user_id" bigint,
+    "access_token" varchar(256),
+    "refresh_token" varchar(256),
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_users_tokens" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE SET NULL ON UPDATE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS "images" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "deleted_at" timestamptz,
+    "user_id" bigint,
+    "url" text,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_users_images" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE SET NULL ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_images_deleted_at" ON "images" ("deleted_at");
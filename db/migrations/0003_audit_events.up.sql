@@ -0,0 +1,19 @@
+-- Журнал событий безопасности: входы, смена пароля и email, обновление токенов
+-- user_id - пользователь, к которому относится событие, actor_id - кто выполнил действие (например, администратор)
+CREATE TABLE IF NOT EXISTS "audit_events" (
+    "id" bigserial,
+    "created_at" timestamptz NOT NULL DEFAULT now(),
+    "user_id" bigint,
+    "actor_id" bigint,
+    "action" varchar(64) NOT NULL,
+    "result" varchar(16) NOT NULL,
+    "ip" varchar(64),
+    "user_agent" text,
+    "metadata" jsonb,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_audit_events_user" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE SET NULL ON UPDATE CASCADE,
+    CONSTRAINT "fk_audit_events_actor" FOREIGN KEY ("actor_id") REFERENCES "users"("id") ON DELETE SET NULL ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_audit_events_user_created" ON "audit_events" ("user_id", "created_at" DESC);
+CREATE INDEX IF NOT EXISTS "idx_audit_events_action_created" ON "audit_events" ("action", "created_at" DESC);
+CREATE INDEX IF NOT EXISTS "idx_audit_events_created" ON "audit_events" ("created_at" DESC);
@@ -0,0 +1,11 @@
+-- Хеши нельзя превратить обратно в токены, поэтому после отката все пользователи должны войти заново
+CREATE TABLE IF NOT EXISTS "tokens" (
+    "id" bigserial,
+    "user_id" bigint,
+    "access_token" varchar(256),
+    "refresh_token" varchar(256),
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_users_tokens" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE SET NULL ON UPDATE CASCADE
+);
+
+DROP TABLE IF EXISTS "sessions";
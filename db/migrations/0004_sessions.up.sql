@@ -0,0 +1,33 @@
+-- Сессии вместо таблицы tokens: токены хранятся только в виде SHA-256 хешей,
+-- для каждого устройства своя сессия с IP, User-Agent, временем последнего использования и сроком действия
+CREATE TABLE IF NOT EXISTS "sessions" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "user_id" bigint NOT NULL,
+    "device_name" varchar(128),
+    "user_agent" text,
+    "ip" varchar(64),
+    "access_token_hash" varchar(64) NOT NULL,
+    "refresh_token_hash" varchar(64) NOT NULL,
+    "last_used_at" timestamptz,
+    "expires_at" timestamptz NOT NULL,
+    "revoked_at" timestamptz,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "uni_sessions_access_token_hash" UNIQUE ("access_token_hash"),
+    CONSTRAINT "uni_sessions_refresh_token_hash" UNIQUE ("refresh_token_hash"),
+    CONSTRAINT "fk_users_sessions" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_sessions_user_id" ON "sessions" ("user_id");
+
+-- Выданные ранее токены переносятся как сессии, срок действия - срок refresh токена по умолчанию
+INSERT INTO "sessions" ("created_at", "updated_at", "user_id", "device_name", "access_token_hash", "refresh_token_hash", "last_used_at", "expires_at")
+SELECT now(), now(), "user_id", 'legacy',
+    encode(sha256(convert_to("access_token", 'UTF8')), 'hex'),
+    encode(sha256(convert_to("refresh_token", 'UTF8')), 'hex'),
+    now(), now() + interval '14 days'
+FROM "tokens"
+WHERE "user_id" IS NOT NULL AND "access_token" IS NOT NULL AND "refresh_token" IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+DROP TABLE IF EXISTS "tokens";
@@ -0,0 +1,11 @@
+-- Использованные refresh токены сессий: повторное предъявление такого токена отзывает всю сессию
+CREATE TABLE IF NOT EXISTS "used_refresh_tokens" (
+    "id" bigserial,
+    "session_id" bigint NOT NULL,
+    "token_hash" varchar(64) NOT NULL,
+    "used_at" timestamptz NOT NULL,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "uni_used_refresh_tokens_token_hash" UNIQUE ("token_hash"),
+    CONSTRAINT "fk_used_refresh_tokens_session" FOREIGN KEY ("session_id") REFERENCES "sessions"("id") ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_used_refresh_tokens_session_id" ON "used_refresh_tokens" ("session_id");
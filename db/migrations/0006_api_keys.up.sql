@@ -0,0 +1,19 @@
+-- API ключи пользователей для скриптов: хранится только SHA-256 хеш ключа, права ограничены списком scopes
+CREATE TABLE IF NOT EXISTS "api_keys" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "user_id" bigint NOT NULL,
+    "name" varchar(64) NOT NULL,
+    "prefix" varchar(16) NOT NULL,
+    "key_hash" varchar(64) NOT NULL,
+    "scopes" jsonb NOT NULL DEFAULT '[]',
+    "expires_at" timestamptz,
+    "last_used_at" timestamptz,
+    "last_used_ip" varchar(64),
+    "revoked_at" timestamptz,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "uni_api_keys_key_hash" UNIQUE ("key_hash"),
+    CONSTRAINT "fk_users_api_keys" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_api_keys_user_id" ON "api_keys" ("user_id");
@@ -0,0 +1,12 @@
+-- Флаг is_admin восстанавливается для пользователей с ролью admin, остальные роли теряются
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "is_admin" boolean DEFAULT false;
+
+UPDATE "users" SET "is_admin" = true
+WHERE "id" IN (
+    SELECT "user_roles"."user_id" FROM "user_roles"
+    JOIN "roles" ON "roles"."id" = "user_roles"."role_id"
+    WHERE "roles"."name" = 'admin'
+);
+
+DROP TABLE IF EXISTS "user_roles";
+DROP TABLE IF EXISTS "roles";
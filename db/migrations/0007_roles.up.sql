@@ -0,0 +1,34 @@
+-- Роли и права вместо флага is_admin: права роли хранятся списком в jsonb, "*" - все права
+-- Роли по умолчанию (is_default) есть у всех пользователей, остальные назначаются через user_roles
+CREATE TABLE IF NOT EXISTS "roles" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "name" varchar(32) NOT NULL,
+    "description" text,
+    "is_default" boolean NOT NULL DEFAULT false,
+    "permissions" jsonb NOT NULL DEFAULT '[]',
+    PRIMARY KEY ("id"),
+    CONSTRAINT "uni_roles_name" UNIQUE ("name")
+);
+
+CREATE TABLE IF NOT EXISTS "user_roles" (
+    "user_id" bigint NOT NULL,
+    "role_id" bigint NOT NULL,
+    PRIMARY KEY ("user_id", "role_id"),
+    CONSTRAINT "fk_user_roles_user" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE CASCADE ON UPDATE CASCADE,
+    CONSTRAINT "fk_user_roles_role" FOREIGN KEY ("role_id") REFERENCES "roles"("id") ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_user_roles_role_id" ON "user_roles" ("role_id");
+
+INSERT INTO "roles" ("created_at", "updated_at", "name", "description", "is_default", "permissions") VALUES
+    (now(), now(), 'user', 'Every registered user', true, '["images:generate", "images:read"]'),
+    (now(), now(), 'admin', 'Full access including audit log and diagnostics', false, '["*"]')
+ON CONFLICT DO NOTHING;
+
+INSERT INTO "user_roles" ("user_id", "role_id")
+SELECT "users"."id", "roles"."id" FROM "users", "roles"
+WHERE "users"."is_admin" AND "roles"."name" = 'admin'
+ON CONFLICT DO NOTHING;
+
+ALTER TABLE "users" DROP COLUMN IF EXISTS "is_admin";
@@ -0,0 +1,13 @@
+-- Блокировка пользователей администратором и сессии, выданные администратору для входа под пользователем
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "banned_at" timestamp;
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "ban_reason" varchar(256);
+
+ALTER TABLE "sessions" ADD COLUMN IF NOT EXISTS "impersonator_id" bigint;
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint WHERE conname = 'fk_sessions_impersonator' AND conrelid = 'sessions'::regclass) THEN
+        ALTER TABLE "sessions" ADD CONSTRAINT "fk_sessions_impersonator" FOREIGN KEY ("impersonator_id") REFERENCES "users"("id") ON DELETE CASCADE ON UPDATE CASCADE;
+    END IF;
+END
+$$;
+CREATE INDEX IF NOT EXISTS "idx_users_banned_at" ON "users" ("banned_at") WHERE "banned_at" IS NOT NULL;
@@ -0,0 +1,15 @@
+-- Двухфакторная аутентификация TOTP (RFC 6238) и одноразовые коды восстановления (хранятся SHA-256 хеши)
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "totp_secret" varchar(64);
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "totp_enabled_at" timestamptz;
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "totp_last_step" bigint DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS "recovery_codes" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "user_id" bigint NOT NULL,
+    "code_hash" varchar(64) NOT NULL,
+    "used_at" timestamptz,
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_users_recovery_codes" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_recovery_codes_user_id" ON "recovery_codes" ("user_id");
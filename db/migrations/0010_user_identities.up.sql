@@ -0,0 +1,14 @@
+-- Внешние аккаунты OpenID Connect, привязанные к пользователям (вход через Google, GitHub и т.п.)
+CREATE TABLE IF NOT EXISTS "user_identities" (
+    "id" bigserial,
+    "created_at" timestamptz,
+    "updated_at" timestamptz,
+    "user_id" bigint NOT NULL,
+    "provider" varchar(64) NOT NULL,
+    "subject" varchar(256) NOT NULL,
+    "email" varchar(256),
+    PRIMARY KEY ("id"),
+    CONSTRAINT "fk_users_identities" FOREIGN KEY ("user_id") REFERENCES "users"("id") ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE INDEX IF NOT EXISTS "idx_user_identities_user_id" ON "user_identities" ("user_id");
+CREATE UNIQUE INDEX IF NOT EXISTS "idx_user_identities_provider_subject" ON "user_identities" ("provider", "subject");
@@ -0,0 +1,2 @@
+-- Новый email пользователя до подтверждения кодом из письма, до этого вход и привязка аккаунтов идут по старому email
+ALTER TABLE "users" ADD COLUMN IF NOT EXISTS "pending_email" varchar(256);
@@ -1,20 +1,19 @@
 package db
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strconv"
 	"time"
 
 	"gorm.io/gorm"
 )
 
 /*
-Для автоматической миграции моделей в базу данных внести модель в массив AutoMigrateModels
+Схема таблиц задается SQL-миграциями в каталоге db/migrations (см. migrations.go),
+при изменении модели нужно добавить новую миграцию
 */
-var autoMigrateModels = []any{
-	User{},
-	Token{},
-	Image{},
-}
-
 // Create our models here
 type User struct {
 	gorm.Model
@@ -33,16 +32,123 @@ type User struct {
 	ResetTimeout *time.Time `json:"-" gorm:"type:timestamp"`
 	AuthTries    int        `json:"-" gorm:"default:0"`
 	AuthTimeout  *time.Time `json:"-" gorm:"type:timestamp"`
+	BannedAt     *time.Time `json:"-" gorm:"type:timestamp"`
+	BanReason    string     `json:"-" gorm:"size:256"`
+	// Новый email, ожидающий подтверждения кодом Otp, Email меняется только после подтверждения
+	PendingEmail string `json:"pending_email,omitempty" gorm:"size:256"`
+	// Секрет TOTP (base32), до подтверждения кодом TotpEnabledAt пустое и второй фактор не запрашивается
+	TotpSecret    string     `json:"-" gorm:"size:64"`
+	TotpEnabledAt *time.Time `json:"-" gorm:"type:timestamptz"`
+	// Последний принятый шаг TOTP, код того же или более раннего шага повторно не принимается
+	TotpLastStep int64 `json:"-" gorm:"default:0"`
+
+	Sessions      []Session      `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	APIKeys       []APIKey       `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	RecoveryCodes []RecoveryCode `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Identities    []UserIdentity `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+	Images        []Image        `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+	Roles         []Role         `json:"-" gorm:"many2many:user_roles;constraint:OnUpdate:CASCADE,OnDelete:CASCADE;"`
+}
+
+func (u *User) Identity() string {
+	return strconv.FormatUint(uint64(u.ID), 10)
+}
+
+/*
+Роль - именованный набор прав ("images:generate", "audit:read", "*" - все права)
+Роли по умолчанию (IsDefault) есть у всех пользователей, остальные назначаются через таблицу user_roles
+*/
+type Role struct {
+	ID          uint       `json:"id" gorm:"primaryKey"`
+	CreatedAt   time.Time  `json:"-"`
+	UpdatedAt   time.Time  `json:"-"`
+	Name        string     `json:"name" gorm:"size:32;not null;unique"`
+	Description string     `json:"description"`
+	IsDefault   bool       `json:"is_default" gorm:"not null;default:false"`
+	Permissions StringList `json:"permissions" gorm:"type:jsonb;not null"`
+}
+
+/*
+Сессия - пара токенов, выданная одному устройству. Токены хранятся только в виде SHA-256 хешей
+Сессия активна, пока не отозвана и не истек ExpiresAt
+*/
+type Session struct {
+	ID               uint       `json:"id" gorm:"primaryKey"`
+	CreatedAt        time.Time  `json:"created_at"`
+	UpdatedAt        time.Time  `json:"-"`
+	UserID           uint       `json:"-" gorm:"not null"`
+	DeviceName       string     `json:"device_name" gorm:"size:128"`
+	UserAgent        string     `json:"user_agent"`
+	IP               string     `json:"ip" gorm:"column:ip;size:64"`
+	AccessTokenHash  string     `json:"-" gorm:"size:64;not null;unique"`
+	RefreshTokenHash string     `json:"-" gorm:"size:64;not null;unique"`
+	LastUsedAt       time.Time  `json:"last_used_at"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	RevokedAt        *time.Time `json:"-"`
+	// Администратор, выдавший сессию для входа под пользователем (поддержка), nil - обычный вход
+	ImpersonatorID *uint `json:"impersonator_id,omitempty"`
+}
+
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+/*
+Использованный refresh токен. Сессия - семейство токенов: при каждом обновлении старый refresh токен
+запоминается здесь, повторное его предъявление означает, что токен украден, и вся сессия отзывается
+*/
+type UsedRefreshToken struct {
+	ID        uint      `gorm:"primaryKey"`
+	SessionID uint      `gorm:"not null;index"`
+	TokenHash string    `gorm:"size:64;not null;unique"`
+	UsedAt    time.Time `gorm:"not null"`
+}
+
+/*
+API ключ пользователя для скриптов: хранится только SHA-256 хеш, Prefix - начало ключа для отображения в списке
+Права ключа ограничены Scopes (например, images:generate)
+*/
+type APIKey struct {
+	ID         uint       `json:"id" gorm:"primaryKey"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"-"`
+	UserID     uint       `json:"-" gorm:"not null;index"`
+	Name       string     `json:"name" gorm:"size:64;not null"`
+	Prefix     string     `json:"prefix" gorm:"size:16;not null"`
+	KeyHash    string     `json:"-" gorm:"size:64;not null;unique"`
+	Scopes     StringList `json:"scopes" gorm:"type:jsonb;not null"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip" gorm:"size:64"`
+	RevokedAt  *time.Time `json:"-"`
+}
 
-	Tokens *Token  `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
-	Images []Image `json:"-" gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
 }
 
-type Token struct {
-	ID           uint `json:"-" gorm:"primaryKey"`
-	UserID       uint
-	AccessToken  string `json:"access_token,omitempty," gorm:"size:256"`
-	RefreshToken string `json:"refresh_token,omitempty" gorm:"size:256"`
+/*
+Одноразовый код восстановления для входа без TOTP, хранится только SHA-256 хеш
+*/
+type RecoveryCode struct {
+	ID        uint       `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time  `json:"created_at"`
+	UserID    uint       `json:"-" gorm:"not null;index"`
+	CodeHash  string     `json:"-" gorm:"size:64;not null"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+/*
+Внешний аккаунт пользователя у провайдера OpenID Connect: Subject - claim sub из id_token, уникален в пределах провайдера
+*/
+type UserIdentity struct {
+	ID        uint      `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"-"`
+	UserID    uint      `json:"-" gorm:"not null;index"`
+	Provider  string    `json:"provider" gorm:"size:64;not null;uniqueIndex:idx_user_identities_provider_subject"`
+	Subject   string    `json:"-" gorm:"size:256;not null;uniqueIndex:idx_user_identities_provider_subject"`
+	Email     string    `json:"email" gorm:"size:256"`
 }
 
 type Image struct {
@@ -50,3 +156,71 @@ type Image struct {
 	UserID uint
 	Url    string `json:"url"`
 }
+
+/*
+Событие безопасности (вход, смена пароля и т.д.), записывается пакетом user
+UserID - пользователь, к которому относится событие (nil, если email не найден), ActorID - кто выполнил действие
+*/
+type AuditEvent struct {
+	ID        uint          `json:"id" gorm:"primaryKey"`
+	CreatedAt time.Time     `json:"created_at"`
+	UserID    *uint         `json:"user_id,omitempty"`
+	ActorID   *uint         `json:"actor_id,omitempty"`
+	Action    string        `json:"action" gorm:"size:64;not null"`
+	Result    string        `json:"result" gorm:"size:16;not null"`
+	IP        string        `json:"ip,omitempty" gorm:"column:ip;size:64"`
+	UserAgent string        `json:"user_agent,omitempty"`
+	Metadata  AuditMetadata `json:"metadata,omitempty" gorm:"type:jsonb"`
+}
+
+/*
+Дополнительные данные события, хранятся в колонке jsonb
+*/
+type AuditMetadata map[string]string
+
+func (m AuditMetadata) Value() (driver.Value, error) {
+	if m == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(m)
+	return string(data), err
+}
+
+func (m *AuditMetadata) Scan(value interface{}) error {
+	switch data := value.(type) {
+	case nil:
+		*m = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(data, m)
+	case string:
+		return json.Unmarshal([]byte(data), m)
+	}
+	return fmt.Errorf("unsupported audit metadata type %T", value)
+}
+
+/*
+Список строк, хранится в jsonb
+*/
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal([]string(l))
+	return string(data), err
+}
+
+func (l *StringList) Scan(value interface{}) error {
+	switch data := value.(type) {
+	case nil:
+		*l = nil
+		return nil
+	case []byte:
+		return json.Unmarshal(data, (*[]string)(l))
+	case string:
+		return json.Unmarshal([]byte(data), (*[]string)(l))
+	}
+	return fmt.Errorf("unsupported string list type %T", value)
+}
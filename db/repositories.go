@@ -0,0 +1,632 @@
+package db
+
+/*
+	Репозитории - доступ к моделям через интерфейсы, чтобы обработчики не зависели от глобального DB
+	NewGormRepositories() - реализация поверх GORM/Postgres
+	NewMemoryRepositories() - реализация в памяти для тестов (см. memoryRepositories.go)
+	Transaction() - выполнение нескольких операций в одной транзакции (см. unitOfWork.go)
+	Если запись не найдена, методы возвращают ErrNotFound (тот же "record not found", что и у GORM)
+*/
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNotFound       = gorm.ErrRecordNotFound
+	ErrDuplicateEmail = errors.New(`duplicate key value violates unique constraint "uni_users_email"`)
+	// Внешний аккаунт уже привязан (к этому или другому пользователю)
+	ErrDuplicateIdentity = errors.New(`duplicate key value violates unique constraint "idx_user_identities_provider_subject"`)
+)
+
+type UserRepo interface {
+	Create(ctx context.Context, user *User) error
+	GetByID(ctx context.Context, id uint) (*User, error)
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	Save(ctx context.Context, user *User) error
+	// Мягкое удаление: пользователь не находится методами Get*, но его можно восстановить
+	Delete(ctx context.Context, id uint) error
+	GetDeletedByEmail(ctx context.Context, email string) (*User, error)
+	Restore(ctx context.Context, id uint) error
+	ListDeletedBefore(ctx context.Context, before time.Time, limit int) ([]User, error)
+	// Окончательное удаление, в том числе мягко удаленного пользователя
+	Purge(ctx context.Context, id uint) error
+	// Поиск для администраторов, пользователи упорядочены по ID
+	List(ctx context.Context, filter UserFilter) ([]User, int64, error)
+}
+
+const (
+	UserStatusActive   = "active"
+	UserStatusInactive = "inactive"
+	UserStatusBanned   = "banned"
+	UserStatusLocked   = "locked"
+	UserStatusDeleted  = "deleted"
+)
+
+/*
+Фильтр списка пользователей: Query - подстрока имени или email либо ID, Status - одно из UserStatus*
+Удаленные пользователи возвращаются только со статусом deleted
+*/
+type UserFilter struct {
+	Query  string
+	Status string
+	Offset int
+	Limit  int
+}
+
+/*
+Сессии ищутся по хешам токенов, методы поиска и ListByUser возвращают только активные сессии
+*/
+type SessionRepo interface {
+	Create(ctx context.Context, session *Session) error
+	Save(ctx context.Context, session *Session) error
+	GetByAccessHash(ctx context.Context, hash string) (*Session, error)
+	GetByRefreshHash(ctx context.Context, hash string) (*Session, error)
+	ListByUser(ctx context.Context, userID uint) ([]Session, error)
+	// Замена пары токенов сессии, если ее текущий refresh токен - usedHash, usedHash запоминается как использованный
+	// ErrNotFound, если сессия неактивна или уже обновлена с этим токеном
+	Rotate(ctx context.Context, session *Session, usedHash string) error
+	// Сессия (в том числе отозванная), в которой refresh токен с таким хешем уже был использован
+	GetByUsedRefreshHash(ctx context.Context, hash string) (*Session, error)
+	Touch(ctx context.Context, id uint) error
+	// Отзыв сессии id пользователя userID, ErrNotFound, если активной сессии нет
+	Revoke(ctx context.Context, userID uint, id uint) error
+	// Отзыв всех сессий пользователя, кроме exceptID (0 - без исключений)
+	RevokeByUser(ctx context.Context, userID uint, exceptID uint) (int64, error)
+	RevokeAll(ctx context.Context) (int64, error)
+	DeleteByUser(ctx context.Context, userID uint) (int64, error)
+}
+
+/*
+Роли создаются миграциями, репозиторий только читает их и назначает пользователям
+*/
+type RoleRepo interface {
+	List(ctx context.Context) ([]Role, error)
+	GetByName(ctx context.Context, name string) (*Role, error)
+	// Роли по умолчанию и назначенные пользователю роли, по имени
+	ListByUser(ctx context.Context, userID uint) ([]Role, error)
+	// Повторное назначение роли не является ошибкой
+	Assign(ctx context.Context, userID uint, roleID uint) error
+	// ErrNotFound, если роль не была назначена
+	Unassign(ctx context.Context, userID uint, roleID uint) error
+}
+
+type APIKeyRepo interface {
+	Create(ctx context.Context, key *APIKey) error
+	// Только активные ключи (не отозванные и не истекшие)
+	GetByHash(ctx context.Context, hash string) (*APIKey, error)
+	// Не отозванные ключи пользователя (включая истекшие), новые первыми
+	ListByUser(ctx context.Context, userID uint) ([]APIKey, error)
+	Touch(ctx context.Context, id uint, ip string) error
+	// ErrNotFound, если ключа нет или он уже отозван
+	Revoke(ctx context.Context, userID uint, id uint) error
+	RevokeByUser(ctx context.Context, userID uint) (int64, error)
+	DeleteByUser(ctx context.Context, userID uint) (int64, error)
+}
+
+type RecoveryCodeRepo interface {
+	// Замена всех кодов пользователя новыми
+	Replace(ctx context.Context, userID uint, hashes []string) error
+	// Отметка неиспользованного кода использованным, ErrNotFound, если такого кода нет
+	Use(ctx context.Context, userID uint, hash string) error
+	CountUnused(ctx context.Context, userID uint) (int64, error)
+	DeleteByUser(ctx context.Context, userID uint) (int64, error)
+}
+
+type IdentityRepo interface {
+	Create(ctx context.Context, identity *UserIdentity) error
+	GetBySubject(ctx context.Context, provider string, subject string) (*UserIdentity, error)
+	ListByUser(ctx context.Context, userID uint) ([]UserIdentity, error)
+	DeleteByUser(ctx context.Context, userID uint) (int64, error)
+}
+
+type ImageRepo interface {
+	CreateBatch(ctx context.Context, images []Image) error
+	CountByUser(ctx context.Context, userID uint) (int64, error)
+	ListByUser(ctx context.Context, userID uint, offset int, limit int) ([]Image, error)
+	PurgeByUser(ctx context.Context, userID uint) (int64, error)
+}
+
+/*
+Фильтр журнала событий, пустые поля не учитываются. События возвращаются от новых к старым
+*/
+type AuditFilter struct {
+	UserID  *uint
+	ActorID *uint
+	Action  string
+	Result  string
+	IP      string
+	Since   *time.Time
+	Until   *time.Time
+	Offset  int
+	Limit   int
+}
+
+type AuditRepo interface {
+	Create(ctx context.Context, event *AuditEvent) error
+	List(ctx context.Context, filter AuditFilter) ([]AuditEvent, int64, error)
+}
+
+type Repositories struct {
+	Users         UserRepo
+	Sessions      SessionRepo
+	APIKeys       APIKeyRepo
+	RecoveryCodes RecoveryCodeRepo
+	Identities    IdentityRepo
+	Roles         RoleRepo
+	Images        ImageRepo
+	Audit         AuditRepo
+
+	transaction func(ctx context.Context, fn func(tx *Repositories) error) error
+	reset       func(ctx context.Context) error
+}
+
+/*
+Удаление всех пользователей, токенов и изображений со сбросом счетчиков ID, схема, роли и история миграций не меняются
+*/
+func (r *Repositories) Reset(ctx context.Context) error {
+	if r.reset == nil {
+		return fmt.Errorf("reset is not supported by these repositories")
+	}
+	return r.reset(ctx)
+}
+
+func NewGormRepositories(db *gorm.DB) *Repositories {
+	return &Repositories{
+		Users:         &gormUserRepo{db: db},
+		Sessions:      &gormSessionRepo{db: db},
+		APIKeys:       &gormAPIKeyRepo{db: db},
+		RecoveryCodes: &gormRecoveryCodeRepo{db: db},
+		Identities:    &gormIdentityRepo{db: db},
+		Roles:         &gormRoleRepo{db: db},
+		Images:        &gormImageRepo{db: db},
+		Audit:         &gormAuditRepo{db: db},
+
+		transaction: gormTransaction(db),
+		reset: func(ctx context.Context) error {
+			return db.WithContext(ctx).Exec("TRUNCATE TABLE audit_events, user_identities, recovery_codes, api_keys, used_refresh_tokens, sessions, user_roles, images, users RESTART IDENTITY CASCADE").Error
+		},
+	}
+}
+
+func translateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if strings.Contains(err.Error(), "duplicate key value") && strings.Contains(err.Error(), "uni_users_email") {
+		return ErrDuplicateEmail
+	}
+	if strings.Contains(err.Error(), "duplicate key value") && strings.Contains(err.Error(), "idx_user_identities_provider_subject") {
+		return ErrDuplicateIdentity
+	}
+	return err
+}
+
+type gormUserRepo struct {
+	db *gorm.DB
+}
+
+func (r *gormUserRepo) Create(ctx context.Context, user *User) error {
+	return translateError(r.db.WithContext(ctx).Create(user).Error)
+}
+
+func (r *gormUserRepo) GetByID(ctx context.Context, id uint) (*User, error) {
+	user := new(User)
+	if err := r.db.WithContext(ctx).Where("id = ?", id).First(user).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *gormUserRepo) GetByEmail(ctx context.Context, email string) (*User, error) {
+	user := new(User)
+	if err := r.db.WithContext(ctx).Where("email = ?", email).First(user).Error; err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *gormUserRepo) Save(ctx context.Context, user *User) error {
+	return translateError(r.db.WithContext(ctx).Save(user).Error)
+}
+
+func (r *gormUserRepo) Delete(ctx context.Context, id uint) error {
+	result := r.db.WithContext(ctx).Delete(&User{}, id)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return result.Error
+}
+
+func (r *gormUserRepo) GetDeletedByEmail(ctx context.Context, email string) (*User, error) {
+	user := new(User)
+	err := r.db.WithContext(ctx).Unscoped().Where("email = ? AND deleted_at IS NOT NULL", email).First(user).Error
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (r *gormUserRepo) Restore(ctx context.Context, id uint) error {
+	result := r.db.WithContext(ctx).Unscoped().Model(&User{}).Where("id = ? AND deleted_at IS NOT NULL", id).Update("deleted_at", nil)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return result.Error
+}
+
+func (r *gormUserRepo) ListDeletedBefore(ctx context.Context, before time.Time, limit int) ([]User, error) {
+	users := []User{}
+	err := r.db.WithContext(ctx).Unscoped().Where("deleted_at IS NOT NULL AND deleted_at < ?", before).
+		Order("deleted_at").Limit(limit).Find(&users).Error
+	return users, err
+}
+
+func (r *gormUserRepo) List(ctx context.Context, filter UserFilter) ([]User, int64, error) {
+	query := r.db.WithContext(ctx).Model(&User{})
+	if filter.Status == UserStatusDeleted {
+		query = query.Unscoped().Where("deleted_at IS NOT NULL")
+	}
+	if filter.Query != "" {
+		pattern := "%" + strings.ToLower(filter.Query) + "%"
+		if id, err := strconv.ParseUint(filter.Query, 10, 64); err == nil {
+			query = query.Where("id = ? OR lower(username) LIKE ? OR lower(email) LIKE ?", id, pattern, pattern)
+		} else {
+			query = query.Where("lower(username) LIKE ? OR lower(email) LIKE ?", pattern, pattern)
+		}
+	}
+	switch filter.Status {
+	case UserStatusActive:
+		query = query.Where("is_active AND banned_at IS NULL")
+	case UserStatusInactive:
+		query = query.Where("NOT is_active")
+	case UserStatusBanned:
+		query = query.Where("banned_at IS NOT NULL")
+	case UserStatusLocked:
+		now := time.Now()
+		query = query.Where("auth_timeout > ? OR otp_timeout > ? OR reset_timeout > ?", now, now, now)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	users := []User{}
+	err := query.Order("id").Offset(filter.Offset).Limit(filter.Limit).Find(&users).Error
+	return users, total, err
+}
+
+func (r *gormUserRepo) Purge(ctx context.Context, id uint) error {
+	return r.db.WithContext(ctx).Unscoped().Delete(&User{}, id).Error
+}
+
+type gormSessionRepo struct {
+	db *gorm.DB
+}
+
+func (r *gormSessionRepo) active() *gorm.DB {
+	return r.db.Where("revoked_at IS NULL AND expires_at > ?", time.Now())
+}
+
+func (r *gormSessionRepo) Create(ctx context.Context, session *Session) error {
+	return r.db.WithContext(ctx).Create(session).Error
+}
+
+func (r *gormSessionRepo) Save(ctx context.Context, session *Session) error {
+	return r.db.WithContext(ctx).Save(session).Error
+}
+
+func (r *gormSessionRepo) GetByAccessHash(ctx context.Context, hash string) (*Session, error) {
+	session := new(Session)
+	if err := r.active().WithContext(ctx).Where("access_token_hash = ?", hash).First(session).Error; err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (r *gormSessionRepo) GetByRefreshHash(ctx context.Context, hash string) (*Session, error) {
+	session := new(Session)
+	if err := r.active().WithContext(ctx).Where("refresh_token_hash = ?", hash).First(session).Error; err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (r *gormSessionRepo) Rotate(ctx context.Context, session *Session, usedHash string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&Session{}).
+			Where("id = ? AND refresh_token_hash = ? AND revoked_at IS NULL AND expires_at > ?", session.ID, usedHash, now).
+			Updates(map[string]interface{}{
+				"access_token_hash":  session.AccessTokenHash,
+				"refresh_token_hash": session.RefreshTokenHash,
+				"ip":                 session.IP,
+				"user_agent":         session.UserAgent,
+				"last_used_at":       session.LastUsedAt,
+				"expires_at":         session.ExpiresAt,
+				"updated_at":         now,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return tx.Create(&UsedRefreshToken{SessionID: session.ID, TokenHash: usedHash, UsedAt: now}).Error
+	})
+}
+
+func (r *gormSessionRepo) GetByUsedRefreshHash(ctx context.Context, hash string) (*Session, error) {
+	session := new(Session)
+	err := r.db.WithContext(ctx).
+		Where("id = (?)", r.db.Model(&UsedRefreshToken{}).Select("session_id").Where("token_hash = ?", hash)).
+		First(session).Error
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (r *gormSessionRepo) ListByUser(ctx context.Context, userID uint) ([]Session, error) {
+	sessions := []Session{}
+	err := r.active().WithContext(ctx).Where("user_id = ?", userID).Order("last_used_at DESC").Find(&sessions).Error
+	return sessions, err
+}
+
+func (r *gormSessionRepo) Touch(ctx context.Context, id uint) error {
+	return r.db.WithContext(ctx).Model(&Session{}).Where("id = ?", id).Update("last_used_at", time.Now()).Error
+}
+
+func (r *gormSessionRepo) Revoke(ctx context.Context, userID uint, id uint) error {
+	result := r.active().WithContext(ctx).Model(&Session{}).Where("id = ? AND user_id = ?", id, userID).Update("revoked_at", time.Now())
+	if result.Error == nil && result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return result.Error
+}
+
+func (r *gormSessionRepo) RevokeByUser(ctx context.Context, userID uint, exceptID uint) (int64, error) {
+	result := r.active().WithContext(ctx).Model(&Session{}).Where("user_id = ? AND id <> ?", userID, exceptID).Update("revoked_at", time.Now())
+	return result.RowsAffected, result.Error
+}
+
+func (r *gormSessionRepo) RevokeAll(ctx context.Context) (int64, error) {
+	result := r.active().WithContext(ctx).Model(&Session{}).Update("revoked_at", time.Now())
+	return result.RowsAffected, result.Error
+}
+
+func (r *gormSessionRepo) DeleteByUser(ctx context.Context, userID uint) (int64, error) {
+	result := r.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&Session{})
+	return result.RowsAffected, result.Error
+}
+
+type gormRoleRepo struct {
+	db *gorm.DB
+}
+
+func (r *gormRoleRepo) List(ctx context.Context) ([]Role, error) {
+	roles := []Role{}
+	err := r.db.WithContext(ctx).Order("name").Find(&roles).Error
+	return roles, err
+}
+
+func (r *gormRoleRepo) GetByName(ctx context.Context, name string) (*Role, error) {
+	role := new(Role)
+	if err := r.db.WithContext(ctx).Where("name = ?", name).First(role).Error; err != nil {
+		return nil, err
+	}
+	return role, nil
+}
+
+func (r *gormRoleRepo) ListByUser(ctx context.Context, userID uint) ([]Role, error) {
+	roles := []Role{}
+	err := r.db.WithContext(ctx).
+		Where("is_default OR id IN (?)", r.db.Table("user_roles").Select("role_id").Where("user_id = ?", userID)).
+		Order("name").Find(&roles).Error
+	return roles, err
+}
+
+func (r *gormRoleRepo) Assign(ctx context.Context, userID uint, roleID uint) error {
+	return r.db.WithContext(ctx).
+		Exec(`INSERT INTO "user_roles" ("user_id", "role_id") VALUES (?, ?) ON CONFLICT DO NOTHING`, userID, roleID).Error
+}
+
+func (r *gormRoleRepo) Unassign(ctx context.Context, userID uint, roleID uint) error {
+	result := r.db.WithContext(ctx).Exec(`DELETE FROM "user_roles" WHERE "user_id" = ? AND "role_id" = ?`, userID, roleID)
+	if result.Error == nil && result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return result.Error
+}
+
+type gormAPIKeyRepo struct {
+	db *gorm.DB
+}
+
+func (r *gormAPIKeyRepo) Create(ctx context.Context, key *APIKey) error {
+	return r.db.WithContext(ctx).Create(key).Error
+}
+
+func (r *gormAPIKeyRepo) GetByHash(ctx context.Context, hash string) (*APIKey, error) {
+	key := new(APIKey)
+	err := r.db.WithContext(ctx).
+		Where("key_hash = ? AND revoked_at IS NULL AND (expires_at IS NULL OR expires_at > ?)", hash, time.Now()).
+		First(key).Error
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (r *gormAPIKeyRepo) ListByUser(ctx context.Context, userID uint) ([]APIKey, error) {
+	keys := []APIKey{}
+	err := r.db.WithContext(ctx).Where("user_id = ? AND revoked_at IS NULL", userID).Order("created_at DESC, id DESC").Find(&keys).Error
+	return keys, err
+}
+
+func (r *gormAPIKeyRepo) Touch(ctx context.Context, id uint, ip string) error {
+	return r.db.WithContext(ctx).Model(&APIKey{}).Where("id = ?", id).
+		Updates(map[string]interface{}{"last_used_at": time.Now(), "last_used_ip": ip}).Error
+}
+
+func (r *gormAPIKeyRepo) Revoke(ctx context.Context, userID uint, id uint) error {
+	result := r.db.WithContext(ctx).Model(&APIKey{}).Where("id = ? AND user_id = ? AND revoked_at IS NULL", id, userID).Update("revoked_at", time.Now())
+	if result.Error == nil && result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return result.Error
+}
+
+func (r *gormAPIKeyRepo) RevokeByUser(ctx context.Context, userID uint) (int64, error) {
+	result := r.db.WithContext(ctx).Model(&APIKey{}).Where("user_id = ? AND revoked_at IS NULL", userID).Update("revoked_at", time.Now())
+	return result.RowsAffected, result.Error
+}
+
+func (r *gormAPIKeyRepo) DeleteByUser(ctx context.Context, userID uint) (int64, error) {
+	result := r.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&APIKey{})
+	return result.RowsAffected, result.Error
+}
+
+type gormRecoveryCodeRepo struct {
+	db *gorm.DB
+}
+
+func (r *gormRecoveryCodeRepo) Replace(ctx context.Context, userID uint, hashes []string) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if len(hashes) == 0 {
+			return nil
+		}
+		codes := make([]RecoveryCode, 0, len(hashes))
+		for _, hash := range hashes {
+			codes = append(codes, RecoveryCode{UserID: userID, CodeHash: hash})
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+func (r *gormRecoveryCodeRepo) Use(ctx context.Context, userID uint, hash string) error {
+	result := r.db.WithContext(ctx).Model(&RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, hash).Update("used_at", time.Now())
+	if result.Error == nil && result.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return result.Error
+}
+
+func (r *gormRecoveryCodeRepo) CountUnused(ctx context.Context, userID uint) (int64, error) {
+	var total int64
+	err := r.db.WithContext(ctx).Model(&RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&total).Error
+	return total, err
+}
+
+func (r *gormRecoveryCodeRepo) DeleteByUser(ctx context.Context, userID uint) (int64, error) {
+	result := r.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&RecoveryCode{})
+	return result.RowsAffected, result.Error
+}
+
+type gormIdentityRepo struct {
+	db *gorm.DB
+}
+
+func (r *gormIdentityRepo) Create(ctx context.Context, identity *UserIdentity) error {
+	return translateError(r.db.WithContext(ctx).Create(identity).Error)
+}
+
+func (r *gormIdentityRepo) GetBySubject(ctx context.Context, provider string, subject string) (*UserIdentity, error) {
+	identity := new(UserIdentity)
+	err := r.db.WithContext(ctx).Where("provider = ? AND subject = ?", provider, subject).First(identity).Error
+	if err != nil {
+		return nil, err
+	}
+	return identity, nil
+}
+
+func (r *gormIdentityRepo) ListByUser(ctx context.Context, userID uint) ([]UserIdentity, error) {
+	var identities []UserIdentity
+	err := r.db.WithContext(ctx).Where("user_id = ?", userID).Order("id").Find(&identities).Error
+	return identities, err
+}
+
+func (r *gormIdentityRepo) DeleteByUser(ctx context.Context, userID uint) (int64, error) {
+	result := r.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&UserIdentity{})
+	return result.RowsAffected, result.Error
+}
+
+type gormImageRepo struct {
+	db *gorm.DB
+}
+
+func (r *gormImageRepo) CreateBatch(ctx context.Context, images []Image) error {
+	if len(images) == 0 {
+		return nil
+	}
+	return r.db.WithContext(ctx).Create(&images).Error
+}
+
+func (r *gormImageRepo) CountByUser(ctx context.Context, userID uint) (int64, error) {
+	var total int64
+	err := r.db.WithContext(ctx).Model(&Image{}).Where("user_id = ?", userID).Count(&total).Error
+	return total, err
+}
+
+func (r *gormImageRepo) PurgeByUser(ctx context.Context, userID uint) (int64, error) {
+	result := r.db.WithContext(ctx).Unscoped().Where("user_id = ?", userID).Delete(&Image{})
+	return result.RowsAffected, result.Error
+}
+
+func (r *gormImageRepo) ListByUser(ctx context.Context, userID uint, offset int, limit int) ([]Image, error) {
+	images := []Image{}
+	err := r.db.WithContext(ctx).Where("user_id = ?", userID).Offset(offset).Limit(limit).Find(&images).Error
+	return images, err
+}
+
+type gormAuditRepo struct {
+	db *gorm.DB
+}
+
+func (r *gormAuditRepo) Create(ctx context.Context, event *AuditEvent) error {
+	return r.db.WithContext(ctx).Create(event).Error
+}
+
+func (r *gormAuditRepo) List(ctx context.Context, filter AuditFilter) ([]AuditEvent, int64, error) {
+	query := r.db.WithContext(ctx).Model(&AuditEvent{})
+	if filter.UserID != nil {
+		query = query.Where("user_id = ?", *filter.UserID)
+	}
+	if filter.ActorID != nil {
+		query = query.Where("actor_id = ?", *filter.ActorID)
+	}
+	if filter.Action != "" {
+		query = query.Where("action = ?", filter.Action)
+	}
+	if filter.Result != "" {
+		query = query.Where("result = ?", filter.Result)
+	}
+	if filter.IP != "" {
+		query = query.Where("ip = ?", filter.IP)
+	}
+	if filter.Since != nil {
+		query = query.Where("created_at >= ?", *filter.Since)
+	}
+	if filter.Until != nil {
+		query = query.Where("created_at < ?", *filter.Until)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	events := []AuditEvent{}
+	err := query.Order("created_at DESC, id DESC").Offset(filter.Offset).Limit(filter.Limit).Find(&events).Error
+	return events, total, err
+}
@@ -0,0 +1,72 @@
+package db
+
+/*
+	Единица работы: несколько операций с БД в одной транзакции плюс компенсирующие действия вне БД (например, с файлами)
+	OnRollback() - действие отменяет уже сделанный побочный эффект (удалить только что сохраненный файл), выполняется при откате
+	OnCommit() - действие, которое нельзя отменить (удалить старый файл), откладывается до успешного коммита
+	Действия выполняются в обратном порядке регистрации, их ошибки логируются и не меняют результат транзакции
+*/
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+type UnitOfWork struct {
+	Repos      *Repositories
+	onRollback []func() error
+	onCommit   []func() error
+}
+
+func (u *UnitOfWork) OnRollback(action func() error) {
+	u.onRollback = append(u.onRollback, action)
+}
+
+func (u *UnitOfWork) OnCommit(action func() error) {
+	u.onCommit = append(u.onCommit, action)
+}
+
+func runActions(kind string, actions []func() error) {
+	for i := len(actions) - 1; i >= 0; i-- {
+		if err := actions[i](); err != nil {
+			log.Printf("Error running %s action: %v", kind, err)
+		}
+	}
+}
+
+/*
+Выполняет fn в транзакции. Если fn вернула ошибку или запаниковала, транзакция откатывается
+и выполняются действия OnRollback, иначе транзакция коммитится и выполняются действия OnCommit
+*/
+func (r *Repositories) Transaction(ctx context.Context, fn func(uow *UnitOfWork) error) (err error) {
+	if r.transaction == nil {
+		return fmt.Errorf("transactions are not supported by these repositories")
+	}
+	uow := &UnitOfWork{}
+	defer func() {
+		if p := recover(); p != nil {
+			runActions("rollback", uow.onRollback)
+			panic(p)
+		}
+		if err != nil {
+			runActions("rollback", uow.onRollback)
+			return
+		}
+		runActions("commit", uow.onCommit)
+	}()
+	return r.transaction(ctx, func(tx *Repositories) error {
+		uow.Repos = tx
+		return fn(uow)
+	})
+}
+
+func gormTransaction(db *gorm.DB) func(ctx context.Context, fn func(tx *Repositories) error) error {
+	return func(ctx context.Context, fn func(tx *Repositories) error) error {
+		return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			return fn(NewGormRepositories(tx))
+		})
+	}
+}
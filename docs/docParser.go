@@ -20,7 +20,8 @@ type HandlerInfo struct {
 	RespContentType string
 	Summary         string
 	Description     string
-	IsAuth          string
+	Auth            bool
+	Permissions     []string
 	JsonRequestBody string
 	FormDataBody    map[string]string
 	ResponseBody    string
@@ -37,7 +38,12 @@ var handlers = make(map[string]*HandlerInfo)
 
 var groupedHandlers = make(map[string][]HandlerInfo)
 
-func parseDocs() error {
+/*
+Требования доступа к роуту по его url: нужна ли авторизация и какие права (см. app.RouteAccess)
+*/
+type AccessFunc func(path string) (bool, []string)
+
+func parseDocs(access AccessFunc) error {
 	for _, app := range core.APPS {
 		err := filepath.Walk(app, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
@@ -54,6 +60,9 @@ func parseDocs() error {
 	}
 
 	for _, handler := range handlers {
+		if access != nil {
+			handler.Auth, handler.Permissions = access(handler.Path)
+		}
 		groupedHandlers[handler.Tag] = append(groupedHandlers[handler.Tag], *handler)
 	}
 	return nil
@@ -104,10 +113,6 @@ func parseFile(path string) {
 					handlerInfo.Summary = value
 				case "description":
 					handlerInfo.Description = value
-				case "isauth":
-					if value == "true" || value == "false" {
-						handlerInfo.IsAuth = value
-					}
 				case "queryparams":
 					reg := regexp.MustCompile(`\{([^}]*)\}`)
 					matches := reg.FindStringSubmatch(value)
@@ -232,8 +237,8 @@ func parseFile(path string) {
 	return
 }
 
-func GenerateDocs() error {
-	err := parseDocs()
+func GenerateDocs(access AccessFunc) error {
+	err := parseDocs(access)
 	if err != nil {
 		return err
 	}
@@ -1,50 +1,122 @@
 package main
 
+/*
+	Единая точка входа: server <command> [subcommand] [flags]
+	Без команды (или если первый аргумент - флаг) запускается сервер, как команда serve
+	Все команды принимают флаги конфигурации (-config, -env-file и флаги настроек, см. core/config.go)
+*/
+
 import (
 	"RestAPI/app"
 	"RestAPI/core"
 	"RestAPI/db"
 	"RestAPI/docs"
+	"RestAPI/monitoring"
+	"RestAPI/user"
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strings"
 )
 
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+func commands() []command {
+	return []command{
+		{"serve", "serve [flags] - start the server", serveCommand},
+		{"check-config", "check-config [flags] - validate configuration and dependencies", checkConfigCommand},
+		{"migrate", "migrate up|down|status [flags] - apply, roll back or show database migrations", migrateCommand},
+		{"seed", "seed [-fixtures <path>] [-reset] [flags] - load fixtures into the database", seedCommand},
+		{"routes", "routes - list registered routes", routesCommand},
+		{"docs", "docs build - generate API documentation", docsCommand},
+		{"user", "user create-admin|activate|purge-deleted [flags] - manage users", userCommand},
+		{"tokens", "tokens revoke [flags] - revoke user tokens", tokensCommand},
+		{"keys", "keys list|rotate [flags] - show or rotate JWT signing keys", keysCommand},
+	}
+}
+
 func main() {
-	Production := os.Getenv("PRODUCTION")
-	if Production == "true" {
-		core.PRODUCTION = true
+	args := os.Args[1:]
+	name := "serve"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	for _, c := range commands() {
+		if c.name == name {
+			os.Exit(c.run(args))
+		}
+	}
+	if name != "help" {
+		fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", name)
+	}
+	printUsage()
+	if name != "help" {
+		os.Exit(2)
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: server <command> [flags]")
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+	for _, c := range commands() {
+		fmt.Fprintln(os.Stderr, "  "+c.usage)
+	}
+	fmt.Fprintln(os.Stderr, "\nRun server <command> -h to list command flags")
+}
+
+func serveCommand(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	cfg, er := loadCommandConfig(fs, args)
+	if er != nil {
+		log.Println("Error loading config", er)
+		return 1
 	}
 
-	er := core.InitEnv()
+	er = core.InitTracing(cfg.Tracing)
 	if er != nil {
-		log.Println("Error initializing environment", er)
-		return
+		log.Println("Error initializing tracing", er)
+		return 1
 	}
 
-	er = db.ConnectToDB(core.DB_CREDENTIALS)
+	er = db.ConnectToDB(cfg.DB)
 	if er != nil {
 		log.Println("Error connecting to DB", er)
-		return
+		return 1
+	}
+
+	er = app.InitHandlers(cfg, db.NewGormRepositories(db.DB))
+	if er != nil {
+		log.Println("Error initializing handlers", er)
+		return 1
 	}
 
-	app.InitHandlers()
+	user.StartPurgeJob(context.Background())
+	user.StartKeyRotation(context.Background())
 
-	er = docs.GenerateDocs()
+	er = docs.GenerateDocs(app.RouteAccess)
 	if er != nil {
 		log.Println("Error generating docs", er)
-		return
+		return 1
 	}
 
-	serv, er := core.CreateServer(app.MainApplication)
+	serv, er := core.CreateServer(cfg, app.MainApplication)
 	if er != nil {
 		log.Println("Error creating server", er)
-		return
+		return 1
 	}
+	monitoring.SetServer(serv)
 
 	er = serv.Start()
 	if er != nil {
 		log.Println("Error starting server", er)
-		return
+		return 1
 	}
 
 	select {}
@@ -4,6 +4,7 @@ import (
 	"RestAPI/core"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -23,7 +24,7 @@ func ImageHandler(request core.HttpRequest) core.HttpResponse {
 
 	filename := strings.TrimPrefix(request.Url, "/images/")
 
-	filePath := currentDir + core.AVATARS_DIR + "/" + filename
+	filePath := currentDir + avatarsDir + "/" + filename
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return *core.HTTP404.Copy()
 	}
@@ -50,10 +51,10 @@ func SaveFile(fileData []byte, userID uint) (string, error) {
 	}
 
 	filename := generateFileName(userID)
-	filePath := currentDir + core.AVATARS_DIR + "/" + filename
+	filePath := currentDir + avatarsDir + "/" + filename
 
-	if _, err := os.Stat(currentDir + core.AVATARS_DIR); os.IsNotExist(err) {
-		err := os.MkdirAll(currentDir+core.AVATARS_DIR, 0755)
+	if _, err := os.Stat(currentDir + avatarsDir); os.IsNotExist(err) {
+		err := os.MkdirAll(currentDir+avatarsDir, 0755)
 		if err != nil {
 			return "", err
 		}
@@ -77,7 +78,7 @@ func DeleteFile(filename string) error {
 	if er != nil {
 		return er
 	}
-	filePath := currentDir + core.AVATARS_DIR + "/" + filename
+	filePath := currentDir + avatarsDir + "/" + filename
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		return nil
 	}
@@ -88,3 +89,23 @@ func generateFileName(userID uint) string {
 	id := uuid.New().String()
 	return strconv.Itoa(int(userID)) + "_" + id + ".jpg"
 }
+
+/*
+Удаление всех файлов пользователя (имена файлов начинаются с "<userID>_", см. generateFileName)
+*/
+func DeleteUserFiles(userID uint) error {
+	currentDir, er := os.Getwd()
+	if er != nil {
+		return er
+	}
+	files, er := filepath.Glob(currentDir + avatarsDir + "/" + strconv.Itoa(int(userID)) + "_*")
+	if er != nil {
+		return er
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package media
+
+import "RestAPI/core"
+
+/*
+Каталог аватаров относительно рабочего каталога, устанавливается функцией Init()
+*/
+var avatarsDir = core.DefaultConfig().Media.AvatarsDir
+
+func Init(cfg core.MediaConfig) {
+	avatarsDir = cfg.AvatarsDir
+}
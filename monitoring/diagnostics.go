@@ -0,0 +1,205 @@
+package monitoring
+
+import (
+	"RestAPI/core"
+	"bytes"
+	"log"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	startTime = time.Now()
+	server    *core.Server
+)
+
+/*
+Сервер, для которого в диагностике показывается количество открытых соединений
+*/
+func SetServer(s *core.Server) {
+	server = s
+}
+
+type MemoryStats struct {
+	Alloc         uint64  `json:"alloc_bytes"`
+	TotalAlloc    uint64  `json:"total_alloc_bytes"`
+	Sys           uint64  `json:"sys_bytes"`
+	HeapObjects   uint64  `json:"heap_objects"`
+	HeapInuse     uint64  `json:"heap_inuse_bytes"`
+	NumGC         uint32  `json:"num_gc"`
+	PauseTotalNs  uint64  `json:"gc_pause_total_ns"`
+	LastGC        string  `json:"last_gc"`
+	GCCPUFraction float64 `json:"gc_cpu_fraction"`
+}
+
+type Diagnostics struct {
+	Build           core.BuildInfo `json:"build"`
+	Uptime          string         `json:"uptime"`
+	Goroutines      int            `json:"goroutines"`
+	NumCPU          int            `json:"num_cpu"`
+	GOMAXPROCS      int            `json:"gomaxprocs"`
+	OpenConnections int64          `json:"open_connections"`
+	Caches          map[string]int `json:"caches"`
+	Memory          MemoryStats    `json:"memory"`
+}
+
+func collectDiagnostics() Diagnostics {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	lastGC := ""
+	if mem.LastGC > 0 {
+		lastGC = time.Unix(0, int64(mem.LastGC)).UTC().Format(time.RFC3339)
+	}
+
+	return Diagnostics{
+		Build:           core.GetBuildInfo(),
+		Uptime:          time.Since(startTime).Round(time.Second).String(),
+		Goroutines:      runtime.NumGoroutine(),
+		NumCPU:          runtime.NumCPU(),
+		GOMAXPROCS:      runtime.GOMAXPROCS(0),
+		OpenConnections: server.OpenConnections(),
+		Caches:          core.CacheSizes(),
+		Memory: MemoryStats{
+			Alloc:         mem.Alloc,
+			TotalAlloc:    mem.TotalAlloc,
+			Sys:           mem.Sys,
+			HeapObjects:   mem.HeapObjects,
+			HeapInuse:     mem.HeapInuse,
+			NumGC:         mem.NumGC,
+			PauseTotalNs:  mem.PauseTotalNs,
+			LastGC:        lastGC,
+			GCCPUFraction: mem.GCCPUFraction,
+		},
+	}
+}
+
+/*
+docs(
+
+	name: Diagnostics;
+	tag: monitoring;
+	path: /admin/diagnostics;
+	method: GET;
+	summary: Runtime diagnostics;
+	description: Goroutine count, GC and memory stats, open connections and in-memory cache sizes. Requires admin user or admin client certificate;
+	resp_content_type: application/json;
+	responsebody: {
+		"build": {
+			"version": "string",
+			"commit": "string",
+			"build_time": "string",
+			"go_version": "string"
+		},
+		"uptime": "string",
+		"goroutines": int,
+		"num_cpu": int,
+		"gomaxprocs": int,
+		"open_connections": int,
+		"caches": {
+			"runware_clients": int
+		},
+		"memory": {
+			"alloc_bytes": int,
+			"total_alloc_bytes": int,
+			"sys_bytes": int,
+			"heap_objects": int,
+			"heap_inuse_bytes": int,
+			"num_gc": int,
+			"gc_pause_total_ns": int,
+			"last_gc": "time",
+			"gc_cpu_fraction": float64
+		}
+	};
+
+)docs
+*/
+func DiagnosticsHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+
+	response := core.HTTP200.Copy()
+	err := response.Serialize(collectDiagnostics())
+	if err != nil {
+		log.Println("Error serializing diagnostics:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+docs(
+
+	name: Pprof;
+	tag: monitoring;
+	path: /admin/diagnostics/pprof/{string:profile};
+	method: GET;
+	summary: Runtime profiles;
+	description: Profiles goroutine, heap, allocs, threadcreate, block, mutex and CPU profile (profile?seconds=N). Use debug=1 or debug=2 for text output (goroutine?debug=2 is a full goroutine dump). Requires admin user or admin client certificate;
+	PathParams: {
+		"profile": "string"
+	};
+	QueryParams: {
+		"debug": "int",
+		"seconds": "int"
+	};
+	resp_content_type: application/octet-stream;
+	responsebody: {
+		"profile": "binary"
+	};
+
+)docs
+*/
+func PprofHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+
+	name := strings.TrimPrefix(request.Url, "/admin/diagnostics/pprof/")
+	debug, _ := strconv.Atoi(request.Query["debug"])
+
+	var buf bytes.Buffer
+	if name == "profile" {
+		seconds, err := strconv.Atoi(request.Query["seconds"])
+		if err != nil || seconds <= 0 {
+			seconds = 10
+		}
+		if seconds > 60 {
+			seconds = 60
+		}
+		if err := pprof.StartCPUProfile(&buf); err != nil {
+			resp := core.HTTP409.Copy()
+			resp.Body = `{"Message": "CPU profiling is already in progress"}`
+			return *resp
+		}
+		select {
+		case <-time.After(time.Duration(seconds) * time.Second):
+		case <-request.Context().Done():
+		}
+		pprof.StopCPUProfile()
+		debug = 0
+	} else {
+		profile := pprof.Lookup(name)
+		if profile == nil {
+			return *core.HTTP404.Copy()
+		}
+		if err := profile.WriteTo(&buf, debug); err != nil {
+			log.Println("Error writing profile:", err)
+			return *core.HTTP500.Copy()
+		}
+	}
+
+	response := core.HTTP200.Copy()
+	response.Body = buf.String()
+	if debug > 0 {
+		response.SetHeader("Content-Type", "text/plain; charset=utf-8")
+	} else {
+		response.SetHeader("Content-Type", "application/octet-stream")
+		response.SetHeader("Content-Disposition", `attachment; filename="`+name+`.pb.gz"`)
+	}
+	return *response
+}
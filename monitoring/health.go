@@ -0,0 +1,179 @@
+package monitoring
+
+import (
+	"RestAPI/core"
+	"RestAPI/db"
+	pg "RestAPI/pictureGeneration"
+	"RestAPI/user"
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+type CheckResult struct {
+	Status    string  `json:"status"`
+	Required  bool    `json:"required"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type ReadinessReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+type readinessCheck struct {
+	name     string
+	required bool
+	check    func(ctx context.Context) error
+}
+
+func readinessChecks() []readinessCheck {
+	checks := []readinessCheck{
+		{name: "database", required: true, check: db.Ping},
+	}
+	if readinessConfig.CheckMail {
+		checks = append(checks, readinessCheck{name: "mail", required: false, check: user.CheckMailServer})
+	}
+	if readinessConfig.CheckProvider {
+		checks = append(checks, readinessCheck{name: "image_provider", required: true, check: pg.CheckProvider})
+	}
+	return checks
+}
+
+func runChecks(ctx context.Context, checks []readinessCheck) ReadinessReport {
+	report := ReadinessReport{Status: "ok", Checks: make(map[string]CheckResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c readinessCheck) {
+			defer wg.Done()
+			start := time.Now()
+			err := c.check(ctx)
+			result := CheckResult{
+				Status:    "ok",
+				Required:  c.required,
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = "fail"
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[c.name] = result
+			if err != nil && c.required {
+				report.Status = "fail"
+			}
+		}(c)
+	}
+	wg.Wait()
+	return report
+}
+
+/*
+docs(
+
+	name: Healthz;
+	tag: monitoring;
+	path: /healthz;
+	method: GET;
+	summary: Liveness probe;
+	description: Returns 200 while the process is alive;
+	resp_content_type: application/json;
+	responsebody: {
+		"status": "string"
+	};
+
+)docs
+*/
+func HealthzHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+	response := core.HTTP200.Copy()
+	response.Body = `{"status": "ok"}`
+	return *response
+}
+
+/*
+docs(
+
+	name: Readyz;
+	tag: monitoring;
+	path: /readyz;
+	method: GET;
+	summary: Readiness probe;
+	description: Checks database, image provider and (optionally) mail server availability. Returns 503 if a required dependency is unavailable;
+	resp_content_type: application/json;
+	responsebody: {
+		"status": "string",
+		"checks": {
+			"database": {
+				"status": "string",
+				"required": bool,
+				"latency_ms": float64,
+				"error": "string"
+			}
+		}
+	};
+
+)docs
+*/
+func ReadyzHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+
+	ctx, cancel := context.WithTimeout(request.Context(), readinessConfig.Timeout)
+	defer cancel()
+	report := runChecks(ctx, readinessChecks())
+
+	response := core.HTTP200.Copy()
+	if report.Status != "ok" {
+		log.Println("Readiness check failed:", report.Checks)
+		response = core.HTTP503.Copy()
+	}
+	err := response.Serialize(report)
+	if err != nil {
+		log.Println("Error serializing readiness report:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+docs(
+
+	name: Version;
+	tag: monitoring;
+	path: /version;
+	method: GET;
+	summary: Build information;
+	description: Returns build version, commit, build time and Go version;
+	resp_content_type: application/json;
+	responsebody: {
+		"version": "string",
+		"commit": "string",
+		"build_time": "string",
+		"go_version": "string"
+	};
+
+)docs
+*/
+func VersionHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+	response := core.HTTP200.Copy()
+	err := response.Serialize(core.GetBuildInfo())
+	if err != nil {
+		log.Println("Error serializing build info:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
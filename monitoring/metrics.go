@@ -0,0 +1,36 @@
+package monitoring
+
+import (
+	"RestAPI/core"
+	"bytes"
+	"crypto/subtle"
+	"strings"
+)
+
+func MetricsHandler(request core.HttpRequest) core.HttpResponse {
+	if !metricsConfig.Enabled {
+		return *core.HTTP404.Copy()
+	}
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+	if metricsConfig.Token == "" && !metricsConfig.Public {
+		response := core.HTTP403.Copy()
+		response.Body = `{"Message": "Set metrics.token or metrics.public to expose metrics"}`
+		return *response
+	}
+	if metricsConfig.Token != "" {
+		token := strings.TrimPrefix(request.Headers["Authorization"], "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(metricsConfig.Token)) != 1 {
+			return *core.HTTP401.Copy()
+		}
+	}
+
+	var buf bytes.Buffer
+	core.DefaultMetrics.WriteMetrics(&buf)
+
+	response := core.HTTP200.Copy()
+	response.Body = buf.String()
+	response.SetHeader("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	return *response
+}
@@ -0,0 +1,16 @@
+package monitoring
+
+import "RestAPI/core"
+
+/*
+Настройки /metrics и /readyz, устанавливаются функцией Init()
+*/
+var (
+	metricsConfig   = core.DefaultConfig().Metrics
+	readinessConfig = core.DefaultConfig().Readiness
+)
+
+func Init(cfg *core.Config) {
+	metricsConfig = cfg.Metrics
+	readinessConfig = cfg.Readiness
+}
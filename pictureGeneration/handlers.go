@@ -3,11 +3,14 @@ package pictureGeneration
 import (
 	"RestAPI/core"
 	"RestAPI/db"
+	"RestAPI/user"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math"
 	"strconv"
+	"sync"
+	"time"
 
 	pg "github.com/prorok210/WS_Client-for_runware.ai-"
 )
@@ -16,7 +19,36 @@ type User struct {
 	db.User
 }
 
-var connectedClients = make(map[uint]*pg.WSClient)
+var (
+	clientsMu        sync.Mutex
+	connectedClients = make(map[uint]*pg.WSClient)
+	runwareAPIKey    string
+	repos            *db.Repositories
+)
+
+func Init(cfg core.RunwareConfig, repositories *db.Repositories) {
+	runwareAPIKey = cfg.APIKey
+	repos = repositories
+}
+
+func init() {
+	core.RegisterCache("runware_clients", ConnectedClientsCount)
+}
+
+func ConnectedClientsCount() int {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	return len(connectedClients)
+}
+
+func getClient(userID uint) *pg.WSClient {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if connectedClients[userID] == nil {
+		connectedClients[userID] = pg.CreateWsClient(runwareAPIKey, userID)
+	}
+	return connectedClients[userID]
+}
 
 /*
 docs(
@@ -26,7 +58,6 @@ docs(
 	path: /image/generate;
 	method: POST;
 	summary: Generate an image using the given data;
-	isAuth: true;
 	req_content_type:application/json;
 	requestbody: {
 		"taskType": "string",
@@ -57,9 +88,6 @@ docs(
 )docs
 */
 func GenerateImageHandler(request core.HttpRequest) core.HttpResponse {
-	if request.User == nil {
-		return *core.HTTP401.Copy()
-	}
 	if request.Method != "POST" {
 		return *core.HTTP405.Copy()
 	}
@@ -79,18 +107,25 @@ func GenerateImageHandler(request core.HttpRequest) core.HttpResponse {
 		return *response
 	}
 
-	user := request.User.(*db.User)
+	reqUser := user.RequestUser(request)
 
 	newReq.TaskUUID = pg.GenerateUUID()
 
-	if connectedClients[user.ID] == nil {
-		connectedClients[user.ID] = pg.CreateWsClient(core.RUNWARE_API_KEY, user.ID)
-	}
-
-	client := connectedClients[user.ID]
+	client := getClient(reqUser.ID)
 
+	_, span := core.StartSpan(request.Context(), "runware.imageInference", core.SpanKindClient)
+	span.SetAttribute("peer.service", "runware.ai")
+	span.SetAttribute("runware.model", metricModel(newReq.Model))
+	span.SetAttribute("runware.number_results", newReq.NumberResults)
+	start := time.Now()
 	resp, err := client.SendAndReceiveMsg(*newReq)
+	span.SetError(err)
+	if err == nil && len(resp) > 0 && len(resp[0].Err) > 0 {
+		span.SetStatus(core.SpanStatusError, resp[0].Err[0].Message)
+	}
+	span.Finish()
 	if err != nil {
+		observeGeneration(newReq.Model, start, "transport")
 		log.Println("Error sending request to runware.ai:", err)
 		response := core.HTTP500.Copy()
 		response.Body = fmt.Sprintf(`{"message":"%s"}`, err.Error())
@@ -98,10 +133,12 @@ func GenerateImageHandler(request core.HttpRequest) core.HttpResponse {
 	}
 
 	if len(resp) == 0 {
+		observeGeneration(newReq.Model, start, "empty_response")
 		return *core.HTTP204.Copy()
 	}
 
 	if resp[0].Err != nil {
+		observeGeneration(newReq.Model, start, "provider")
 		log.Println("Error from runware.ai:", resp[0].Err[0].Message)
 		response := core.HTTP500.Copy()
 		response.Body = fmt.Sprintf(`{"message":"%s"}`, resp[0].Err[0].Message)
@@ -111,30 +148,32 @@ func GenerateImageHandler(request core.HttpRequest) core.HttpResponse {
 	imagesData := []db.Image{}
 
 	if len(resp[0].Data) == 0 {
+		observeGeneration(newReq.Model, start, "empty_response")
 		return *core.HTTP204.Copy()
 	}
+	observeGeneration(newReq.Model, start, "")
 
 	for _, respData := range resp {
 		for _, data := range respData.Data {
 			newImage := db.Image{
-				UserID: user.ID,
+				UserID: reqUser.ID,
 				Url:    data.ImageURL,
 			}
 			imagesData = append(imagesData, newImage)
 		}
 	}
 
-	result := db.DB.Create(&imagesData)
-	if result.Error != nil {
-		log.Println("Error saving image to database:", result.Error)
+	err = repos.Images.CreateBatch(request.Context(), imagesData)
+	if err != nil {
+		log.Println("Error saving image to database:", err)
 		return *core.HTTP500.Copy()
 	}
 	for _, data := range imagesData {
-		user.Images = append(user.Images, data)
+		reqUser.Images = append(reqUser.Images, data)
 	}
 
 	response := core.HTTP201.Copy()
-	response.Serialize(user.Images)
+	response.Serialize(reqUser.Images)
 	return *response
 }
 
@@ -146,7 +185,6 @@ docs(
 	path: /image/get;
 	method: GET;
 	summary: Get all images of the user;
-	isAuth: true;
 	QueryParams: {
 		"page": "int",
 		"limit": "int"
@@ -169,14 +207,11 @@ docs(
 )docs
 */
 func GetImagesHandler(request core.HttpRequest) core.HttpResponse {
-	if request.User == nil {
-		return *core.HTTP401.Copy()
-	}
 	if request.Method != "GET" {
 		return *core.HTTP405.Copy()
 	}
 
-	user := request.User.(*db.User)
+	reqUser := user.RequestUser(request)
 
 	page := 1
 	limit := 10
@@ -193,8 +228,8 @@ func GetImagesHandler(request core.HttpRequest) core.HttpResponse {
 		}
 	}
 
-	var total int64
-	if err := db.DB.Model(&db.Image{}).Where("user_id = ?", user.ID).Count(&total).Error; err != nil {
+	total, err := repos.Images.CountByUser(request.Context(), reqUser.ID)
+	if err != nil {
 		log.Println("Error counting images:", err)
 		return *core.HTTP500.Copy()
 	}
@@ -202,14 +237,9 @@ func GetImagesHandler(request core.HttpRequest) core.HttpResponse {
 	totalPages := int(math.Ceil(float64(total) / float64(limit)))
 
 	offset := (page - 1) * limit
-	images := []db.Image{}
-	result := db.DB.Where("user_id = ?", user.ID).
-		Offset(offset).
-		Limit(limit).
-		Find(&images)
-
-	if result.Error != nil {
-		log.Println("Error getting images from database:", result.Error)
+	userImages, err := repos.Images.ListByUser(request.Context(), reqUser.ID, offset, limit)
+	if err != nil {
+		log.Println("Error getting images from database:", err)
 		return *core.HTTP500.Copy()
 	}
 
@@ -223,7 +253,7 @@ func GetImagesHandler(request core.HttpRequest) core.HttpResponse {
 		Total:       total,
 		TotalPages:  totalPages,
 		CurrentPage: page,
-		Items:       images,
+		Items:       userImages,
 	}
 
 	response.Serialize(paginatedResponse)
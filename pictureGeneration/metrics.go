@@ -0,0 +1,52 @@
+package pictureGeneration
+
+import (
+	"RestAPI/core"
+	"time"
+)
+
+var (
+	runwareRequests = core.NewCounterVec(
+		"imagolab_runware_requests_total",
+		"Total number of image generation requests sent to runware.ai",
+		"model",
+	)
+	runwareErrors = core.NewCounterVec(
+		"imagolab_runware_request_errors_total",
+		"Total number of failed image generation requests to runware.ai",
+		"model", "reason",
+	)
+	runwareDuration = core.NewHistogramVec(
+		"imagolab_runware_request_duration_seconds",
+		"Duration of image generation requests to runware.ai",
+		[]float64{0.5, 1, 2, 5, 10, 15, 20, 30, 45, 60, 90},
+		"model",
+	)
+)
+
+/*
+Модели, которые попадают в метрики и трейсы под своим именем. Модель приходит от клиента,
+поэтому остальные считаются как "other", чтобы число серий метрик было ограничено
+*/
+var metricModels = map[string]bool{
+	"civitai:25694@143906": true,
+}
+
+func metricModel(model string) string {
+	switch {
+	case model == "":
+		return "default"
+	case metricModels[model]:
+		return model
+	}
+	return "other"
+}
+
+func observeGeneration(model string, start time.Time, reason string) {
+	model = metricModel(model)
+	runwareRequests.Inc(model)
+	runwareDuration.Observe(time.Since(start).Seconds(), model)
+	if reason != "" {
+		runwareErrors.Inc(model, reason)
+	}
+}
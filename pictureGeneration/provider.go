@@ -0,0 +1,30 @@
+package pictureGeneration
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/url"
+
+	pg "github.com/prorok210/WS_Client-for_runware.ai-"
+)
+
+/*
+Проверка доступности runware.ai (TLS-соединение с хостом websocket API)
+*/
+func CheckProvider(ctx context.Context) error {
+	providerURL, err := url.Parse(pg.URL)
+	if err != nil {
+		return err
+	}
+	port := providerURL.Port()
+	if port == "" {
+		port = "443"
+	}
+	dialer := &tls.Dialer{Config: &tls.Config{ServerName: providerURL.Hostname()}}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(providerURL.Hostname(), port))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
@@ -1,8 +1,16 @@
 # test - запуск тестов
-# migrate - запуск миграций
-# migrate -rollback - откат миграций
+# migrate [up|down|status] - запуск, откат миграций или их состояние
+# seed [флаги] - загрузка тестовых данных (например, seed -reset)
+# check-config [флаги] - проверка конфигурации
 # dev - сборка и запуск сервера в режиме разработки
 # По умолчанию сборка и запуск сервера
+build_ldflags() {
+    local version=$(git describe --tags --always 2>/dev/null || echo dev)
+    local commit=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+    local build_time=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+    echo "-X RestAPI/core.Version=$version -X RestAPI/core.Commit=$commit -X RestAPI/core.BuildTime=$build_time"
+}
+
 load_env() {
     local env_file_path=${1:-.env} 
     echo "Loading environment from $env_file_path..."
@@ -33,7 +41,7 @@ load_dependencies() {
 
 run_tests() {
     echo "Running tests..."
-    sudo go test ./... -v
+    go test ./... -v
     if [ $? -ne 0 ]; then
         echo "Tests failed."
         exit 1
@@ -41,19 +49,11 @@ run_tests() {
 }
 
 run_migrate() {
-    echo "Running migrations..."
-    go run db/cmd/runMigrations.go
+    local action=${1:-up}
+    echo "Running migrations ($action)..."
+    go run . migrate "$action"
     if [ $? -ne 0 ]; then
-        echo "Migration failed."
-        exit 1
-    fi
-}
-
-run_migrate_rollback() {
-    echo "Rolling back migrations..."
-    go run db/cmd/runMigrations.go -rollback
-    if [ $? -ne 0 ]; then
-        echo "Migration rollback failed."
+        echo "Migration $action failed."
         exit 1
     fi
 }
@@ -67,14 +67,14 @@ pre_build() {
 
 build_and_run_dev_server() {
     echo "Building server..."
-    go build -o server main.go
+    go build -ldflags "$(build_ldflags)" -o server .
     if [ $? -ne 0 ]; then
         echo "Build failed. Aborting server start."
         exit 1
     fi
     
     echo "Starting dev server..."
-    sudo ./server
+    ./server serve
 }
 
 build_server() {
@@ -89,25 +89,45 @@ build_server() {
     pre_build "$env_path"
     
     echo "Building server..."
-    go build -trimpath -ldflags "-s -w" -o server main.go
+    go build -trimpath -ldflags "-s -w $(build_ldflags)" -o server .
     if [ $? -ne 0 ]; then
         echo "Build failed. Aborting server start."
         exit 1
     fi
 }
 
+run_seed() {
+    echo "Seeding database..."
+    go run . seed "$@"
+    if [ $? -ne 0 ]; then
+        echo "Seeding failed."
+        exit 1
+    fi
+}
+
+run_check_config() {
+    echo "Checking configuration..."
+    go run . check-config "$@"
+    if [ $? -ne 0 ]; then
+        echo "Configuration check failed."
+        exit 1
+    fi
+}
+
 if [ "$1" = "test" ]; then
     run_tests
+elif [ "$1" = "seed" ]; then
+    shift
+    run_seed "$@"
+elif [ "$1" = "check-config" ]; then
+    shift
+    run_check_config "$@"
 elif [ "$1" = "migrate" ]; then
-    if [ "$2" = "-rollback" ]; then
-        run_migrate_rollback
+    if [ "$2" = "" ] || [ "$2" = "up" ] || [ "$2" = "down" ] || [ "$2" = "status" ]; then
+        run_migrate "$2"
     else
-        if [ "$2" = "" ]; then
-            run_migrate
-        else
-            echo "Invalid argument."
-            exit 1
-        fi
+        echo "Invalid argument."
+        exit 1
     fi
 else
     if [ "$1" = "dev" ]; then
@@ -120,14 +140,14 @@ else
         fi
         build_server $env_path
         echo "Starting server..."
-        sudo ./server
+        ./server serve
     elif [ "$1" != "" ]; then
         echo "Invalid argument."
         exit 1
     else 
         build_server
         echo "Starting server..."
-        sudo ./server
+        ./server serve
     fi
     
 fi
\ No newline at end of file
@@ -0,0 +1,347 @@
+package seed
+
+/*
+	Заполнение БД тестовыми данными из файлов фикстур (YAML или JSON)
+	Изображения и токены описываются внутри пользователя, поэтому фикстуры не зависят от ID в БД
+	Повторная загрузка не создает дубликатов: пользователи ищутся по email, изображения по url, токены по access_token
+	Пароли в фикстурах хранятся в открытом виде и хешируются при загрузке, токены сохраняются как сессии устройства "seed" с хешами токенов
+*/
+
+import (
+	"RestAPI/db"
+	"RestAPI/user"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type Fixtures struct {
+	Users []UserFixture `yaml:"users" json:"users"`
+}
+
+type UserFixture struct {
+	Username string         `yaml:"username" json:"username"`
+	Email    string         `yaml:"email" json:"email"`
+	Password string         `yaml:"password" json:"password"`
+	IsActive bool           `yaml:"is_active" json:"is_active"`
+	Roles    []string       `yaml:"roles" json:"roles"`
+	Avatar   string         `yaml:"avatar" json:"avatar"`
+	Images   []ImageFixture `yaml:"images" json:"images"`
+	Tokens   []TokenFixture `yaml:"tokens" json:"tokens"`
+}
+
+type ImageFixture struct {
+	Url string `yaml:"url" json:"url"`
+}
+
+const (
+	seedDeviceName      = "seed"
+	seedSessionLifetime = 365 * 24 * time.Hour
+)
+
+type TokenFixture struct {
+	AccessToken  string `yaml:"access_token" json:"access_token"`
+	RefreshToken string `yaml:"refresh_token" json:"refresh_token"`
+}
+
+/*
+Итог загрузки: сколько записей создано, обновлено и пропущено, потому что уже совпадали с фикстурами
+*/
+type Result struct {
+	Created   int
+	Updated   int
+	Unchanged int
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("%d created, %d updated, %d unchanged", r.Created, r.Updated, r.Unchanged)
+}
+
+func LoadFile(path string) (*Fixtures, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fixtures := new(Fixtures)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		err = decoder.Decode(fixtures)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(fixtures)
+	default:
+		return nil, fmt.Errorf("%s: unsupported fixture format, expected .yaml, .yml or .json", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := fixtures.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return fixtures, nil
+}
+
+/*
+Загрузка фикстур из файла или из всех .yaml/.yml/.json файлов каталога в алфавитном порядке
+*/
+func Load(path string) (*Fixtures, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return LoadFile(path)
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yaml", ".yml", ".json":
+			if !entry.IsDir() {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+	sort.Strings(names)
+
+	all := new(Fixtures)
+	emails := make(map[string]string)
+	for _, name := range names {
+		fixtures, err := LoadFile(filepath.Join(path, name))
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range fixtures.Users {
+			if previous, ok := emails[u.Email]; ok {
+				return nil, fmt.Errorf("%s: user %s is already defined in %s", name, u.Email, previous)
+			}
+			emails[u.Email] = name
+		}
+		all.Users = append(all.Users, fixtures.Users...)
+	}
+	return all, nil
+}
+
+func (f *Fixtures) Validate() error {
+	emails := make(map[string]bool)
+	for i, u := range f.Users {
+		if u.Email == "" || u.Username == "" || u.Password == "" {
+			return fmt.Errorf("users[%d]: username, email and password are required", i)
+		}
+		if emails[u.Email] {
+			return fmt.Errorf("users[%d]: duplicate email %s", i, u.Email)
+		}
+		emails[u.Email] = true
+		for j, image := range u.Images {
+			if image.Url == "" {
+				return fmt.Errorf("users[%d].images[%d]: url is required", i, j)
+			}
+		}
+		for j, token := range u.Tokens {
+			if token.AccessToken == "" || token.RefreshToken == "" {
+				return fmt.Errorf("users[%d].tokens[%d]: access_token and refresh_token are required", i, j)
+			}
+		}
+	}
+	return nil
+}
+
+/*
+Загрузка фикстур в БД в одной транзакции. Если reset, то перед загрузкой все данные удаляются
+Существующие пользователи приводятся к состоянию из фикстур, лишние изображения и токены не удаляются
+*/
+func Apply(ctx context.Context, repos *db.Repositories, fixtures *Fixtures, reset bool) (Result, error) {
+	var result Result
+	err := repos.Transaction(ctx, func(uow *db.UnitOfWork) error {
+		result = Result{}
+		if reset {
+			if err := uow.Repos.Reset(ctx); err != nil {
+				return fmt.Errorf("resetting data: %w", err)
+			}
+		}
+		for _, fixture := range fixtures.Users {
+			if err := applyUser(ctx, uow.Repos, fixture, &result); err != nil {
+				return fmt.Errorf("user %s: %w", fixture.Email, err)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func applyUser(ctx context.Context, repos *db.Repositories, fixture UserFixture, result *Result) error {
+	dbUser, err := repos.Users.GetByEmail(ctx, fixture.Email)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return err
+	}
+
+	if dbUser == nil {
+		hash, err := user.HashPassword(fixture.Password)
+		if err != nil {
+			return err
+		}
+		dbUser = &db.User{
+			Username: fixture.Username,
+			Email:    fixture.Email,
+			Password: hash,
+			IsActive: fixture.IsActive,
+			Avatar:   fixture.Avatar,
+		}
+		if err := repos.Users.Create(ctx, dbUser); err != nil {
+			return err
+		}
+		result.Created++
+	} else {
+		changed := dbUser.Username != fixture.Username || dbUser.IsActive != fixture.IsActive ||
+			dbUser.Avatar != fixture.Avatar
+		if !user.CheckPassword(dbUser.Password, fixture.Password) {
+			hash, err := user.HashPassword(fixture.Password)
+			if err != nil {
+				return err
+			}
+			dbUser.Password = hash
+			changed = true
+		}
+		if changed {
+			dbUser.Username = fixture.Username
+			dbUser.IsActive = fixture.IsActive
+			dbUser.Avatar = fixture.Avatar
+			if err := repos.Users.Save(ctx, dbUser); err != nil {
+				return err
+			}
+			result.Updated++
+		} else {
+			result.Unchanged++
+		}
+	}
+
+	if err := applyRoles(ctx, repos, dbUser.ID, fixture.Roles, result); err != nil {
+		return err
+	}
+
+	existing, err := repos.Images.ListByUser(ctx, dbUser.ID, 0, -1)
+	if err != nil {
+		return err
+	}
+	urls := make(map[string]bool)
+	for _, image := range existing {
+		urls[image.Url] = true
+	}
+	newImages := []db.Image{}
+	for _, image := range fixture.Images {
+		if urls[image.Url] {
+			result.Unchanged++
+			continue
+		}
+		urls[image.Url] = true
+		newImages = append(newImages, db.Image{UserID: dbUser.ID, Url: image.Url})
+	}
+	if err := repos.Images.CreateBatch(ctx, newImages); err != nil {
+		return err
+	}
+	result.Created += len(newImages)
+
+	for _, fixtureToken := range fixture.Tokens {
+		accessHash := user.HashToken(fixtureToken.AccessToken)
+		refreshHash := user.HashToken(fixtureToken.RefreshToken)
+		session, err := repos.Sessions.GetByAccessHash(ctx, accessHash)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return err
+		}
+		if session == nil {
+			now := time.Now()
+			session = &db.Session{
+				UserID:           dbUser.ID,
+				DeviceName:       seedDeviceName,
+				AccessTokenHash:  accessHash,
+				RefreshTokenHash: refreshHash,
+				LastUsedAt:       now,
+				ExpiresAt:        now.Add(seedSessionLifetime),
+			}
+			if err := repos.Sessions.Create(ctx, session); err != nil {
+				return err
+			}
+			result.Created++
+			continue
+		}
+		if session.UserID == dbUser.ID && session.RefreshTokenHash == refreshHash {
+			result.Unchanged++
+			continue
+		}
+		session.UserID = dbUser.ID
+		session.RefreshTokenHash = refreshHash
+		if err := repos.Sessions.Save(ctx, session); err != nil {
+			return err
+		}
+		result.Updated++
+	}
+	return nil
+}
+
+/*
+Назначенные пользователю роли приводятся к списку из фикстуры, роли по умолчанию не назначаются явно
+*/
+func applyRoles(ctx context.Context, repos *db.Repositories, userID uint, names []string, result *Result) error {
+	current, err := repos.Roles.ListByUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	assigned := make(map[string]bool)
+	for _, role := range current {
+		if !role.IsDefault {
+			assigned[role.Name] = true
+		}
+	}
+
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[name] = true
+		if assigned[name] {
+			result.Unchanged++
+			continue
+		}
+		role, err := repos.Roles.GetByName(ctx, name)
+		if errors.Is(err, db.ErrNotFound) {
+			return fmt.Errorf("unknown role %q", name)
+		}
+		if err != nil {
+			return err
+		}
+		if role.IsDefault {
+			continue
+		}
+		if err := repos.Roles.Assign(ctx, userID, role.ID); err != nil {
+			return err
+		}
+		result.Created++
+	}
+	for _, role := range current {
+		if !role.IsDefault && !wanted[role.Name] {
+			if err := repos.Roles.Unassign(ctx, userID, role.ID); err != nil {
+				return err
+			}
+			result.Updated++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package seed
+
+import (
+	"RestAPI/db"
+	"RestAPI/user"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+Test seed.go
+*/
+func TestLoad(t *testing.T) {
+	fixtures, err := Load("fixtures")
+	if err != nil {
+		t.Fatalf("Error loading fixtures: %v", err)
+	}
+	if len(fixtures.Users) != 4 {
+		t.Errorf("Expected 4 users from yaml and json fixtures, got %d", len(fixtures.Users))
+	}
+
+	dir := t.TempDir()
+	testCases := []struct {
+		name     string
+		file     string
+		content  string
+		expected string
+	}{
+		{
+			name:     "Unknown field",
+			file:     "unknown.yaml",
+			content:  "users:\n  - username: a\n    email: a@example.com\n    password: x\n    role: admin\n",
+			expected: "field role not found",
+		},
+		{
+			name:     "Missing password",
+			file:     "missing.json",
+			content:  `{"users": [{"username": "a", "email": "a@example.com"}]}`,
+			expected: "username, email and password are required",
+		},
+		{
+			name:     "Duplicate email",
+			file:     "duplicate.yml",
+			content:  "users:\n  - {username: a, email: a@example.com, password: x}\n  - {username: b, email: a@example.com, password: y}\n",
+			expected: "duplicate email",
+		},
+		{
+			name:     "Unsupported format",
+			file:     "users.txt",
+			content:  "users",
+			expected: "unsupported fixture format",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, tc.file)
+			if err := os.WriteFile(path, []byte(tc.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadFile(path)
+			if err == nil || !strings.Contains(err.Error(), tc.expected) {
+				t.Errorf("Expected error containing %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	repos := db.NewMemoryRepositories()
+	ctx := context.Background()
+	fixtures := &Fixtures{Users: []UserFixture{
+		{
+			Username: "alice",
+			Email:    "alice@example.com",
+			Password: "Al1ce!Pass",
+			IsActive: true,
+			Roles:    []string{"admin"},
+			Images:   []ImageFixture{{Url: "https://example.com/1.jpg"}, {Url: "https://example.com/2.jpg"}},
+			Tokens:   []TokenFixture{{AccessToken: "access", RefreshToken: "refresh"}},
+		},
+	}}
+
+	result, err := Apply(ctx, repos, fixtures, false)
+	if err != nil {
+		t.Fatalf("Error applying fixtures: %v", err)
+	}
+	if result != (Result{Created: 5}) {
+		t.Errorf("First run: expected 5 created, got %s", result)
+	}
+	alice, err := repos.Users.GetByEmail(ctx, "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.CheckPassword(alice.Password, "Al1ce!Pass") {
+		t.Error("Password is not hashed with user.HashPassword")
+	}
+	if session, err := repos.Sessions.GetByAccessHash(ctx, user.HashToken("access")); err != nil || session.UserID != alice.ID {
+		t.Errorf("Token is not stored as a hashed session: %v", err)
+	}
+	if roles, _ := repos.Roles.ListByUser(ctx, alice.ID); len(roles) != 2 || roles[0].Name != "admin" {
+		t.Errorf("Admin role is not assigned: %v", roles)
+	}
+
+	result, err = Apply(ctx, repos, fixtures, false)
+	if err != nil || result != (Result{Unchanged: 5}) {
+		t.Errorf("Second run: expected 5 unchanged, got %s, %v", result, err)
+	}
+	if total, _ := repos.Images.CountByUser(ctx, alice.ID); total != 2 {
+		t.Errorf("Second run: expected 2 images, got %d", total)
+	}
+
+	fixtures.Users[0].Password = "N3w!Passwd"
+	result, err = Apply(ctx, repos, fixtures, false)
+	if err != nil || result.Updated != 1 {
+		t.Errorf("Changed password: expected 1 updated, got %s, %v", result, err)
+	}
+
+	fixtures.Users[0].Roles = nil
+	result, err = Apply(ctx, repos, fixtures, false)
+	if err != nil || result.Updated != 1 {
+		t.Errorf("Removed role: expected 1 updated, got %s, %v", result, err)
+	}
+	if roles, _ := repos.Roles.ListByUser(ctx, alice.ID); len(roles) != 1 || !roles[0].IsDefault {
+		t.Errorf("Removed role: expected only the default role, got %v", roles)
+	}
+	fixtures.Users[0].Roles = []string{"root"}
+	if _, err := Apply(ctx, repos, fixtures, false); err == nil || !strings.Contains(err.Error(), "unknown role") {
+		t.Errorf("Unknown role: expected error, got %v", err)
+	}
+	fixtures.Users[0].Roles = []string{"admin"}
+
+	extra := &db.User{Username: "extra", Email: "extra@example.com"}
+	if err := repos.Users.Create(ctx, extra); err != nil {
+		t.Fatal(err)
+	}
+	result, err = Apply(ctx, repos, fixtures, true)
+	if err != nil || result != (Result{Created: 5}) {
+		t.Errorf("Reset: expected 5 created, got %s, %v", result, err)
+	}
+	if _, err := repos.Users.GetByEmail(ctx, "extra@example.com"); err == nil {
+		t.Error("Reset: user not from fixtures was not deleted")
+	}
+	if alice, _ := repos.Users.GetByEmail(ctx, "alice@example.com"); alice == nil || alice.ID != 1 {
+		t.Error("Reset: expected IDs to start from 1")
+	}
+}
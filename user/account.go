@@ -0,0 +1,240 @@
+package user
+
+/*
+	Удаление аккаунта: DELETE /user/me мягко удаляет пользователя и отзывает его сессии
+	В течение account.deletion_grace_period аккаунт можно восстановить через /user/restore,
+	после этого задача очистки (PurgeDeletedAccounts) окончательно удаляет пользователя, его сессии, изображения и файлы аватаров
+*/
+
+import (
+	"RestAPI/core"
+	"RestAPI/db"
+	"RestAPI/media"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+/*
+Роут /user/me: GET - данные текущего пользователя, DELETE - удаление аккаунта
+*/
+func MeHandler(request core.HttpRequest) core.HttpResponse {
+	switch request.Method {
+	case "GET":
+		return GetMeHandler(request)
+	case "DELETE":
+		return DeleteMeHandler(request)
+	}
+	return *core.HTTP405.Copy()
+}
+
+/*
+docs(
+
+	name: DeleteMeHandler;
+	tag: user;
+	path: /user/me;
+	method: DELETE;
+	summary: Delete account;
+	description: Delete the current user after password confirmation. All sessions are revoked and the account can be restored until restore_until, after that it is deleted permanently with images and avatar;
+	req_content_type: application/json;
+	requestbody: {
+		"password*": "string"
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string",
+		"restore_until": "time"
+	};
+
+)docs
+*/
+func DeleteMeHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "DELETE" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	reqData := new(User)
+	err := json.Unmarshal([]byte(request.Body), reqData)
+	if err != nil {
+		log.Println("Error unmarshaling request:", err)
+		return *core.HTTP400.Copy()
+	}
+	if reqData.Password == "" {
+		return *core.HTTP400.Copy()
+	}
+	if !CheckPassword(reqUser.Password, reqData.Password) {
+		audit(request, AuditAccountDelete, AuditFailure, reqUser.ID, db.AuditMetadata{"reason": "invalid_password"})
+		resp := core.HTTP401.Copy()
+		resp.Body = `{"Message": "Invalid password"}`
+		return *resp
+	}
+
+	err = repos.Transaction(request.Context(), func(uow *db.UnitOfWork) error {
+		if _, err := uow.Repos.Sessions.RevokeByUser(request.Context(), reqUser.ID, 0); err != nil {
+			return err
+		}
+		if _, err := uow.Repos.APIKeys.RevokeByUser(request.Context(), reqUser.ID); err != nil {
+			return err
+		}
+		return uow.Repos.Users.Delete(request.Context(), reqUser.ID)
+	})
+	if err != nil {
+		log.Println("Error deleting user:", err)
+		return *core.HTTP500.Copy()
+	}
+
+	restoreUntil := time.Now().Add(config.Account.DeletionGracePeriod)
+	audit(request, AuditAccountDelete, AuditSuccess, reqUser.ID, db.AuditMetadata{"restore_until": restoreUntil.Format(time.RFC3339)})
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(map[string]interface{}{
+		"Message":       "Account scheduled for deletion",
+		"restore_until": restoreUntil,
+	})
+	if err != nil {
+		log.Println("Error serializing response:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+docs(
+
+	name: RestoreAccountHandler;
+	tag: user;
+	path: /user/restore;
+	method: POST;
+	summary: Restore deleted account;
+	description: Restore an account deleted less than the grace period ago. Sessions revoked on deletion are not restored, log in again after restore;
+	req_content_type: application/json;
+	requestbody: {
+		"email*": "string",
+		"password*": "string"
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string"
+	};
+
+)docs
+*/
+func RestoreAccountHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "POST" {
+		return *core.HTTP405.Copy()
+	}
+	reqData := new(User)
+	err := json.Unmarshal([]byte(request.Body), reqData)
+	if err != nil {
+		log.Println("Error unmarshaling request:", err)
+		return *core.HTTP400.Copy()
+	}
+	if reqData.Email == "" || reqData.Password == "" {
+		return *core.HTTP400.Copy()
+	}
+
+	user, err := repos.Users.GetDeletedByEmail(request.Context(), reqData.Email)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			resp := core.HTTP404.Copy()
+			resp.Body = `{"Message": "Deleted account not found"}`
+			return *resp
+		}
+		log.Println("Error finding deleted user:", err)
+		return *core.HTTP500.Copy()
+	}
+	if !CheckPassword(user.Password, reqData.Password) {
+		audit(request, AuditAccountRestore, AuditFailure, user.ID, db.AuditMetadata{"reason": "invalid_password"})
+		resp := core.HTTP401.Copy()
+		resp.Body = `{"Message": "Invalid email or password"}`
+		return *resp
+	}
+	if user.DeletedAt.Time.Add(config.Account.DeletionGracePeriod).Before(time.Now()) {
+		resp := core.HTTP410.Copy()
+		resp.Body = `{"Message": "Restore period expired"}`
+		return *resp
+	}
+
+	err = repos.Users.Restore(request.Context(), user.ID)
+	if err != nil {
+		log.Println("Error restoring user:", err)
+		return *core.HTTP500.Copy()
+	}
+	audit(request, AuditAccountRestore, AuditSuccess, user.ID, nil)
+
+	response := core.HTTP200.Copy()
+	response.Body = `{"Message": "Account restored"}`
+	return *response
+}
+
+/*
+Окончательное удаление аккаунтов, у которых истек срок восстановления, не более account.purge_batch_size за вызов
+Каждый аккаунт удаляется в отдельной транзакции, файлы удаляются только после коммита
+Возвращает количество удаленных аккаунтов
+*/
+func PurgeDeletedAccounts(ctx context.Context, now time.Time) (int, error) {
+	cutoff := now.Add(-config.Account.DeletionGracePeriod)
+	users, err := repos.Users.ListDeletedBefore(ctx, cutoff, config.Account.PurgeBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("listing deleted users: %w", err)
+	}
+
+	purged := 0
+	for _, user := range users {
+		userID := user.ID
+		err := repos.Transaction(ctx, func(uow *db.UnitOfWork) error {
+			if _, err := uow.Repos.Sessions.DeleteByUser(ctx, userID); err != nil {
+				return err
+			}
+			if _, err := uow.Repos.APIKeys.DeleteByUser(ctx, userID); err != nil {
+				return err
+			}
+			if _, err := uow.Repos.RecoveryCodes.DeleteByUser(ctx, userID); err != nil {
+				return err
+			}
+			if _, err := uow.Repos.Identities.DeleteByUser(ctx, userID); err != nil {
+				return err
+			}
+			if _, err := uow.Repos.Images.PurgeByUser(ctx, userID); err != nil {
+				return err
+			}
+			uow.OnCommit(func() error { return media.DeleteUserFiles(userID) })
+			return uow.Repos.Users.Purge(ctx, userID)
+		})
+		if err != nil {
+			return purged, fmt.Errorf("purging user %d: %w", userID, err)
+		}
+		audit(core.HttpRequest{}, AuditAccountPurge, AuditSuccess, 0, db.AuditMetadata{"user_id": strconv.FormatUint(uint64(userID), 10)})
+		purged++
+	}
+	return purged, nil
+}
+
+/*
+Запуск задачи очистки с интервалом account.purge_interval (первый запуск сразу), останавливается при отмене ctx
+*/
+func StartPurgeJob(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(config.Account.PurgeInterval)
+		defer ticker.Stop()
+		for {
+			purged, err := PurgeDeletedAccounts(ctx, time.Now())
+			if err != nil {
+				log.Println("Error purging deleted accounts:", err)
+			} else if purged > 0 {
+				log.Printf("Purged %d deleted account(s)", purged)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
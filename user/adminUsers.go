@@ -0,0 +1,739 @@
+package user
+
+/*
+	Управление пользователями для администраторов (поддержки): поиск, просмотр изображений и сессий пользователя,
+	активация и деактивация, блокировка, снятие временных блокировок после неудачных попыток, принудительный сброс пароля
+	и вход под пользователем (impersonation)
+	Просмотр требует права users:read, изменения - users:manage, вход под пользователем - users:impersonate
+	Все изменения записываются в журнал событий, действующим лицом считается администратор
+	Сессия входа под пользователем помечается ImpersonatorID и живет не дольше impersonationLifetime,
+	события в такой сессии записываются от имени администратора
+*/
+
+import (
+	"RestAPI/core"
+	"RestAPI/db"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	impersonationLifetime = time.Hour
+	banReasonMaxLength    = 256
+)
+
+var ErrUserBanned = errors.New("User is banned")
+
+var userStatuses = []string{db.UserStatusActive, db.UserStatusInactive, db.UserStatusBanned, db.UserStatusLocked, db.UserStatusDeleted}
+
+/*
+Пользователь в ответах администраторам: служебные поля (счетчики попыток, блокировки) показываются, секреты - нет
+*/
+type adminUserView struct {
+	ID          uint       `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DeletedAt   *time.Time `json:"deleted_at,omitempty"`
+	Username    string     `json:"username"`
+	Email       string     `json:"email"`
+	IsActive    bool       `json:"is_active"`
+	BannedAt    *time.Time `json:"banned_at,omitempty"`
+	BanReason   string     `json:"ban_reason,omitempty"`
+	AuthTries   int        `json:"auth_tries"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+	Roles       []string   `json:"roles,omitempty"`
+}
+
+func newAdminUserView(user *db.User, now time.Time) adminUserView {
+	view := adminUserView{
+		ID:        user.ID,
+		CreatedAt: user.CreatedAt,
+		Username:  user.Username,
+		Email:     user.Email,
+		IsActive:  user.IsActive,
+		BannedAt:  user.BannedAt,
+		BanReason: user.BanReason,
+		AuthTries: user.AuthTries,
+	}
+	if user.DeletedAt.Valid {
+		view.DeletedAt = &user.DeletedAt.Time
+	}
+	for _, timeout := range []*time.Time{user.AuthTimeout, user.OtpTimeout, user.ResetTimeout} {
+		if timeout != nil && timeout.After(now) && (view.LockedUntil == nil || timeout.After(*view.LockedUntil)) {
+			view.LockedUntil = timeout
+		}
+	}
+	return view
+}
+
+type adminUserPage struct {
+	Total       int64           `json:"total"`
+	TotalPages  int             `json:"total_pages"`
+	CurrentPage int             `json:"current_page"`
+	Items       []adminUserView `json:"items"`
+}
+
+/*
+Пользователь из url вида /admin/users/{id}/..., при ошибке возвращается готовый ответ
+*/
+func adminTargetUser(request core.HttpRequest) (*db.User, *core.HttpResponse) {
+	rawID, _, _ := strings.Cut(strings.TrimPrefix(request.Url, "/admin/users/"), "/")
+	id, err := strconv.ParseUint(rawID, 10, 64)
+	if err != nil {
+		log.Println("Error converting id:", err)
+		return nil, core.HTTP400.Copy()
+	}
+	user, err := repos.Users.GetByID(request.Context(), uint(id))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			resp := core.HTTP404.Copy()
+			resp.Body = `{"Message": "User not found"}`
+			return nil, resp
+		}
+		log.Println("Error finding user:", err)
+		return nil, core.HTTP500.Copy()
+	}
+	return user, nil
+}
+
+/*
+Является ли user тем же пользователем, что и автор запроса
+*/
+func isRequestUser(request core.HttpRequest, user *db.User) bool {
+	actor := RequestUser(request)
+	return actor != nil && actor.ID == user.ID
+}
+
+func messageResponse(response *core.HttpResponse, message string) core.HttpResponse {
+	response.Body = fmt.Sprintf(`{"Message": %q}`, message)
+	return *response
+}
+
+/*
+docs(
+
+	name: AdminListUsersHandler;
+	tag: admin;
+	path: /admin/users;
+	method: GET;
+	summary: Search users;
+	description: Users ordered by id. q matches id or part of username or email, status is one of active, inactive, banned, locked, deleted. Deleted users are listed only with status deleted;
+	QueryParams: {
+		"q": "string",
+		"status": "string",
+		"page": "int",
+		"limit": "int"
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"total": int,
+		"total_pages": int,
+		"current_page": int,
+		"items": [{
+			"id": int,
+			"created_at": "time",
+			"deleted_at": "time",
+			"username": "string",
+			"email": "string",
+			"is_active": bool,
+			"banned_at": "time",
+			"ban_reason": "string",
+			"auth_tries": int,
+			"locked_until": "time"
+		}]
+	};
+
+)docs
+*/
+func AdminListUsersHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+
+	filter := db.UserFilter{Status: request.Query["status"]}
+	if filter.Status != "" && !slices.Contains(userStatuses, filter.Status) {
+		return messageResponse(core.HTTP400.Copy(), fmt.Sprintf("Unknown status %q, allowed statuses are %s", filter.Status, strings.Join(userStatuses, ", ")))
+	}
+	if query := strings.TrimSpace(request.Query["q"]); query != "" {
+		unescaped, err := url.QueryUnescape(query)
+		if err != nil {
+			return messageResponse(core.HTTP400.Copy(), "Invalid q")
+		}
+		filter.Query = unescaped
+	}
+	page, limit := pageParams(request)
+	filter.Offset = (page - 1) * limit
+	filter.Limit = limit
+
+	users, total, err := repos.Users.List(request.Context(), filter)
+	if err != nil {
+		log.Println("Error getting users:", err)
+		return *core.HTTP500.Copy()
+	}
+	now := time.Now()
+	views := make([]adminUserView, 0, len(users))
+	for i := range users {
+		views = append(views, newAdminUserView(&users[i], now))
+	}
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(adminUserPage{
+		Total:       total,
+		TotalPages:  int(math.Ceil(float64(total) / float64(limit))),
+		CurrentPage: page,
+		Items:       views,
+	})
+	if err != nil {
+		log.Println("Error serializing users:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+docs(
+
+	name: AdminGetUserHandler;
+	tag: admin;
+	path: /admin/users/{int:ID};
+	method: GET;
+	summary: User details;
+	description: User with roles, ban and lockout state;
+	resp_content_type: application/json;
+	responsebody: {
+		"id": int,
+		"created_at": "time",
+		"username": "string",
+		"email": "string",
+		"is_active": bool,
+		"banned_at": "time",
+		"ban_reason": "string",
+		"auth_tries": int,
+		"locked_until": "time",
+		"roles": ["string"]
+	};
+
+)docs
+*/
+func AdminGetUserHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+	user, errResp := adminTargetUser(request)
+	if errResp != nil {
+		return *errResp
+	}
+
+	roles, err := repos.Roles.ListByUser(request.Context(), user.ID)
+	if err != nil {
+		log.Println("Error getting roles:", err)
+		return *core.HTTP500.Copy()
+	}
+	view := newAdminUserView(user, time.Now())
+	for _, role := range roles {
+		view.Roles = append(view.Roles, role.Name)
+	}
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(view)
+	if err != nil {
+		log.Println("Error serializing user:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+docs(
+
+	name: AdminUserImagesHandler;
+	tag: admin;
+	path: /admin/users/{int:ID}/images;
+	method: GET;
+	summary: User images;
+	description: Images generated by the user;
+	QueryParams: {
+		"page": "int",
+		"limit": "int"
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"total": int,
+		"total_pages": int,
+		"current_page": int,
+		"items": [{
+			"ID": int,
+			"CreatedAt": "time",
+			"UpdatedAt": "time",
+			"DeletedAt": time,
+			"UserID": int,
+			"url": "string"
+		}]
+	};
+
+)docs
+*/
+func AdminUserImagesHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+	user, errResp := adminTargetUser(request)
+	if errResp != nil {
+		return *errResp
+	}
+
+	page, limit := pageParams(request)
+	total, err := repos.Images.CountByUser(request.Context(), user.ID)
+	if err != nil {
+		log.Println("Error counting images:", err)
+		return *core.HTTP500.Copy()
+	}
+	images, err := repos.Images.ListByUser(request.Context(), user.ID, (page-1)*limit, limit)
+	if err != nil {
+		log.Println("Error getting images from database:", err)
+		return *core.HTTP500.Copy()
+	}
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(struct {
+		Total       int64      `json:"total"`
+		TotalPages  int        `json:"total_pages"`
+		CurrentPage int        `json:"current_page"`
+		Items       []db.Image `json:"items"`
+	}{
+		Total:       total,
+		TotalPages:  int(math.Ceil(float64(total) / float64(limit))),
+		CurrentPage: page,
+		Items:       images,
+	})
+	if err != nil {
+		log.Println("Error serializing images:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+docs(
+
+	name: AdminUserSessionsHandler;
+	tag: admin;
+	path: /admin/users/{int:ID}/sessions;
+	method: GET;
+	summary: User sessions;
+	description: Active sessions of the user. Sessions issued for support login have impersonator_id;
+	resp_content_type: application/json;
+	responsebody: [{
+		"id": int,
+		"created_at": "time",
+		"device_name": "string",
+		"user_agent": "string",
+		"ip": "string",
+		"last_used_at": "time",
+		"expires_at": "time",
+		"impersonator_id": int
+	}];
+
+)docs
+*/
+func AdminUserSessionsHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+	user, errResp := adminTargetUser(request)
+	if errResp != nil {
+		return *errResp
+	}
+
+	sessions, err := repos.Sessions.ListByUser(request.Context(), user.ID)
+	if err != nil {
+		log.Println("Error getting sessions:", err)
+		return *core.HTTP500.Copy()
+	}
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(sessions)
+	if err != nil {
+		log.Println("Error serializing sessions:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+Общая часть POST действий над пользователем: проверка метода, загрузка пользователя,
+выполнение action и запись события. action возвращает метаданные события или готовый ответ с ошибкой
+*/
+func adminUserAction(request core.HttpRequest, auditAction string, message string,
+	action func(ctx context.Context, user *db.User) (db.AuditMetadata, *core.HttpResponse)) core.HttpResponse {
+	if request.Method != "POST" {
+		return *core.HTTP405.Copy()
+	}
+	user, errResp := adminTargetUser(request)
+	if errResp != nil {
+		return *errResp
+	}
+
+	metadata, errResp := action(request.Context(), user)
+	if errResp != nil {
+		return *errResp
+	}
+	audit(request, auditAction, AuditSuccess, user.ID, metadata)
+	return messageResponse(core.HTTP200.Copy(), message)
+}
+
+/*
+Сохранение пользователя вместе с отзывом всех его сессий и API ключей
+*/
+func saveAndSignOut(ctx context.Context, user *db.User) (db.AuditMetadata, error) {
+	var sessions, keys int64
+	err := repos.Transaction(ctx, func(uow *db.UnitOfWork) error {
+		var err error
+		if sessions, err = uow.Repos.Sessions.RevokeByUser(ctx, user.ID, 0); err != nil {
+			return fmt.Errorf("revoking sessions: %w", err)
+		}
+		if keys, err = uow.Repos.APIKeys.RevokeByUser(ctx, user.ID); err != nil {
+			return fmt.Errorf("revoking API keys: %w", err)
+		}
+		return uow.Repos.Users.Save(ctx, user)
+	})
+	return db.AuditMetadata{
+		"revoked_sessions": strconv.FormatInt(sessions, 10),
+		"revoked_api_keys": strconv.FormatInt(keys, 10),
+	}, err
+}
+
+/*
+docs(
+
+	name: AdminActivateUserHandler;
+	tag: admin;
+	path: /admin/users/{int:ID}/activate;
+	method: POST;
+	summary: Activate user;
+	description: Activate the account without the email code;
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string"
+	};
+
+)docs
+*/
+func AdminActivateUserHandler(request core.HttpRequest) core.HttpResponse {
+	return adminUserAction(request, AuditUserActivate, "User activated", func(ctx context.Context, user *db.User) (db.AuditMetadata, *core.HttpResponse) {
+		user.IsActive = true
+		user.Otp = 0
+		user.OtpExpires = nil
+		if err := repos.Users.Save(ctx, user); err != nil {
+			log.Println("Error saving user:", err)
+			return nil, core.HTTP500.Copy()
+		}
+		return nil, nil
+	})
+}
+
+/*
+docs(
+
+	name: AdminDeactivateUserHandler;
+	tag: admin;
+	path: /admin/users/{int:ID}/deactivate;
+	method: POST;
+	summary: Deactivate user;
+	description: Deactivate the account and revoke all its sessions and API keys. The user can activate it again by email code;
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string"
+	};
+
+)docs
+*/
+func AdminDeactivateUserHandler(request core.HttpRequest) core.HttpResponse {
+	return adminUserAction(request, AuditUserDeactivate, "User deactivated", func(ctx context.Context, user *db.User) (db.AuditMetadata, *core.HttpResponse) {
+		if isRequestUser(request, user) {
+			resp := core.HTTP409.Copy()
+			resp.Body = `{"Message": "You cannot deactivate yourself"}`
+			return nil, resp
+		}
+		user.IsActive = false
+		metadata, err := saveAndSignOut(ctx, user)
+		if err != nil {
+			log.Println("Error deactivating user:", err)
+			return nil, core.HTTP500.Copy()
+		}
+		return metadata, nil
+	})
+}
+
+type banRequest struct {
+	Reason string `json:"reason"`
+}
+
+/*
+docs(
+
+	name: AdminBanUserHandler;
+	tag: admin;
+	path: /admin/users/{int:ID}/ban;
+	method: POST;
+	summary: Ban user;
+	description: Ban the user: login, tokens and API keys are rejected, all sessions and API keys are revoked. The reason is optional;
+	req_content_type: application/json;
+	requestbody: {
+		"reason": "string"
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string"
+	};
+
+)docs
+*/
+func AdminBanUserHandler(request core.HttpRequest) core.HttpResponse {
+	return adminUserAction(request, AuditUserBan, "User banned", func(ctx context.Context, user *db.User) (db.AuditMetadata, *core.HttpResponse) {
+		reqData := new(banRequest)
+		if strings.TrimSpace(request.Body) != "" {
+			if err := json.Unmarshal([]byte(request.Body), reqData); err != nil {
+				log.Println("Error unmarshaling request:", err)
+				return nil, core.HTTP400.Copy()
+			}
+		}
+		reason := strings.TrimSpace(reqData.Reason)
+		if len(reason) > banReasonMaxLength {
+			resp := core.HTTP400.Copy()
+			resp.Body = fmt.Sprintf(`{"Message": "Reason must be at most %d characters"}`, banReasonMaxLength)
+			return nil, resp
+		}
+		if isRequestUser(request, user) {
+			resp := core.HTTP409.Copy()
+			resp.Body = `{"Message": "You cannot ban yourself"}`
+			return nil, resp
+		}
+		if user.BannedAt != nil {
+			resp := core.HTTP409.Copy()
+			resp.Body = `{"Message": "User is already banned"}`
+			return nil, resp
+		}
+
+		now := time.Now()
+		user.BannedAt = &now
+		user.BanReason = reason
+		metadata, err := saveAndSignOut(ctx, user)
+		if err != nil {
+			log.Println("Error banning user:", err)
+			return nil, core.HTTP500.Copy()
+		}
+		if reason != "" {
+			metadata["reason"] = reason
+		}
+		return metadata, nil
+	})
+}
+
+/*
+docs(
+
+	name: AdminUnbanUserHandler;
+	tag: admin;
+	path: /admin/users/{int:ID}/unban;
+	method: POST;
+	summary: Unban user;
+	description: Lift the ban. Revoked sessions and API keys are not restored;
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string"
+	};
+
+)docs
+*/
+func AdminUnbanUserHandler(request core.HttpRequest) core.HttpResponse {
+	return adminUserAction(request, AuditUserUnban, "User unbanned", func(ctx context.Context, user *db.User) (db.AuditMetadata, *core.HttpResponse) {
+		if user.BannedAt == nil {
+			resp := core.HTTP409.Copy()
+			resp.Body = `{"Message": "User is not banned"}`
+			return nil, resp
+		}
+		user.BannedAt = nil
+		user.BanReason = ""
+		if err := repos.Users.Save(ctx, user); err != nil {
+			log.Println("Error saving user:", err)
+			return nil, core.HTTP500.Copy()
+		}
+		return nil, nil
+	})
+}
+
+/*
+docs(
+
+	name: AdminClearLockoutHandler;
+	tag: admin;
+	path: /admin/users/{int:ID}/clear_lockout;
+	method: POST;
+	summary: Clear lockouts;
+	description: Reset failed login, activation code and reset code attempts and their timeouts;
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string"
+	};
+
+)docs
+*/
+func AdminClearLockoutHandler(request core.HttpRequest) core.HttpResponse {
+	return adminUserAction(request, AuditUserClearLockout, "Lockouts cleared", func(ctx context.Context, user *db.User) (db.AuditMetadata, *core.HttpResponse) {
+		user.AuthTries, user.AuthTimeout = 0, nil
+		user.OtpTries, user.OtpTimeout = 0, nil
+		user.ResetTries, user.ResetTimeout = 0, nil
+		if err := repos.Users.Save(ctx, user); err != nil {
+			log.Println("Error saving user:", err)
+			return nil, core.HTTP500.Copy()
+		}
+		return nil, nil
+	})
+}
+
+/*
+docs(
+
+	name: AdminResetPasswordHandler;
+	tag: admin;
+	path: /admin/users/{int:ID}/reset_password;
+	method: POST;
+	summary: Force password reset;
+	description: Replace the password with a random one, revoke all sessions and send the user a reset code by email. The user sets a new password with /user/reset_password;
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string"
+	};
+
+)docs
+*/
+func AdminResetPasswordHandler(request core.HttpRequest) core.HttpResponse {
+	return adminUserAction(request, AuditUserPasswordReset, "Password reset, reset code sent to the user", func(ctx context.Context, user *db.User) (db.AuditMetadata, *core.HttpResponse) {
+		password, err := generateSecureToken()
+		if err != nil {
+			log.Println("Error generating password:", err)
+			return nil, core.HTTP500.Copy()
+		}
+		resetCode, err := generateSecureToken()
+		if err != nil {
+			log.Println("Error generating reset code:", err)
+			return nil, core.HTTP500.Copy()
+		}
+		if user.Password, err = HashPassword(password); err != nil {
+			log.Println("Error hashing password:", err)
+			return nil, core.HTTP500.Copy()
+		}
+		user.ResetToken = resetCode
+		user.ResetExpires = new(time.Time)
+		*user.ResetExpires = time.Now().Add(config.Auth.OtpExpiration)
+		user.ResetTries, user.ResetTimeout = 0, nil
+
+		var revoked int64
+		err = repos.Transaction(ctx, func(uow *db.UnitOfWork) error {
+			var err error
+			if revoked, err = uow.Repos.Sessions.RevokeByUser(ctx, user.ID, 0); err != nil {
+				return fmt.Errorf("revoking sessions: %w", err)
+			}
+			return uow.Repos.Users.Save(ctx, user)
+		})
+		if err != nil {
+			log.Println("Error saving user:", err)
+			return nil, core.HTTP500.Copy()
+		}
+		if err := SendResetPasswordEmail(user.Email, resetCode); err != nil {
+			log.Println("Error sending email:", err)
+			return nil, core.HTTP500.Copy()
+		}
+		return db.AuditMetadata{"revoked_sessions": strconv.FormatInt(revoked, 10)}, nil
+	})
+}
+
+type impersonationResponse struct {
+	TokenPair
+	SessionID uint      `json:"session_id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+/*
+docs(
+
+	name: AdminImpersonateHandler;
+	tag: admin;
+	path: /admin/users/{int:ID}/impersonate;
+	method: POST;
+	summary: Log in as user;
+	description: Issue a session of the user for support. The session lasts at most one hour, is shown to the user and administrators with impersonator_id, and its actions are recorded in the audit log as done by the administrator. Administrators, banned and inactive users cannot be impersonated;
+	resp_content_type: application/json;
+	responsebody: {
+		"access_token": "string",
+		"refresh_token": "string",
+		"session_id": int,
+		"expires_at": "time"
+	};
+
+)docs
+*/
+func AdminImpersonateHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "POST" {
+		return *core.HTTP405.Copy()
+	}
+	admin := RequestUser(request)
+	if admin == nil {
+		return messageResponse(core.HTTP403.Copy(), "Impersonation requires a user session")
+	}
+	if session := SessionFromContext(request.Context()); session != nil && session.ImpersonatorID != nil {
+		return messageResponse(core.HTTP403.Copy(), "Impersonated sessions cannot impersonate")
+	}
+	user, errResp := adminTargetUser(request)
+	if errResp != nil {
+		return *errResp
+	}
+
+	reason := ""
+	switch {
+	case user.ID == admin.ID:
+		reason = "self"
+	case !user.IsActive:
+		reason = "not_activated"
+	case user.BannedAt != nil:
+		reason = "banned"
+	}
+	if reason == "" {
+		principal, err := LoadPrincipal(request.Context(), user, nil)
+		if err != nil {
+			log.Println("Error loading permissions:", err)
+			return *core.HTTP500.Copy()
+		}
+		if principal.Can(PermissionUsersManage) || principal.Can(PermissionUsersImpersonate) {
+			reason = "privileged_user"
+		}
+	}
+	if reason != "" {
+		audit(request, AuditImpersonate, AuditFailure, user.ID, db.AuditMetadata{"reason": reason})
+		return messageResponse(core.HTTP409.Copy(), "This user cannot be impersonated")
+	}
+
+	tokens, session, err := startSession(request, user, "impersonated by "+admin.Username, &admin.ID)
+	if err != nil {
+		log.Println("Error creating session:", err)
+		return *core.HTTP500.Copy()
+	}
+	audit(request, AuditImpersonate, AuditSuccess, user.ID, db.AuditMetadata{"session_id": strconv.FormatUint(uint64(session.ID), 10)})
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(impersonationResponse{TokenPair: *tokens, SessionID: session.ID, ExpiresAt: session.ExpiresAt})
+	if err != nil {
+		log.Println("Error serializing tokens:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
@@ -0,0 +1,323 @@
+package user
+
+/*
+	API ключи для скриптов и интеграций: ключ показывается один раз при создании, в БД хранится только SHA-256 хеш
+	Ключ передается в заголовке X-API-Key или Authorization: Bearer (ключи отличаются от JWT префиксом apiKeyPrefix)
+	Права ключа ограничены списком scopes, запросы с ключом допускаются только к роутам, которым нужно одно из этих прав
+	Ключи не дают доступа к управлению аккаунтом, сессиями и самими ключами
+	Ключи отзываются вручную (/user/api_keys/{id}) и при удалении аккаунта
+*/
+
+import (
+	"RestAPI/core"
+	"RestAPI/db"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Права, которые можно выдать API ключу. Ключ не может дать больше прав, чем есть у его владельца
+*/
+var APIKeyScopes = []string{PermissionImagesGenerate, PermissionImagesRead}
+
+const (
+	apiKeyPrefix = "rapi_"
+	// Длина видимой части ключа, которая хранится открыто и показывается в списке ключей
+	apiKeyVisibleLength = 12
+	apiKeyNameMaxLength = 64
+	apiKeysPerUser      = 20
+	// Не чаще одного раза в apiKeyTouchInterval обновляется время последнего использования ключа
+	apiKeyTouchInterval = time.Minute
+)
+
+/*
+Похожа ли строка на API ключ (а не на JWT)
+*/
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, apiKeyPrefix)
+}
+
+func generateAPIKey() (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+/*
+Проверка API ключа: активный (не отозванный и не истекший) ключ и активный пользователь-владелец
+*/
+func AuthenticateAPIKey(ctx context.Context, key string, ip string) (*db.User, *db.APIKey, error) {
+	apiKey, err := repos.APIKeys.GetByHash(ctx, HashToken(key))
+	if err != nil {
+		return nil, nil, err
+	}
+	user, err := repos.Users.GetByID(ctx, apiKey.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user.IsActive {
+		return nil, nil, ErrUserNotActivated
+	}
+	if user.BannedAt != nil {
+		return nil, nil, ErrUserBanned
+	}
+
+	now := time.Now()
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > apiKeyTouchInterval || apiKey.LastUsedIP != ip {
+		if err := repos.APIKeys.Touch(ctx, apiKey.ID, ip); err != nil {
+			log.Println("Error updating API key last use:", err)
+		}
+		apiKey.LastUsedAt, apiKey.LastUsedIP = &now, ip
+	}
+	return user, apiKey, nil
+}
+
+type apiKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+/*
+Проверка запроса на создание ключа, scopes возвращаются без повторов
+*/
+func (r *apiKeyRequest) validate(now time.Time) ([]string, error) {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		return nil, errors.New("Name is required")
+	}
+	if len(r.Name) > apiKeyNameMaxLength {
+		return nil, fmt.Errorf("Name must be at most %d characters", apiKeyNameMaxLength)
+	}
+	if len(r.Scopes) == 0 {
+		return nil, errors.New("At least one scope is required")
+	}
+	scopes := []string{}
+	seen := make(map[string]bool)
+	for _, scope := range r.Scopes {
+		known := false
+		for _, s := range APIKeyScopes {
+			known = known || s == scope
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown scope %q, allowed scopes are %s", scope, strings.Join(APIKeyScopes, ", "))
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	if r.ExpiresAt != nil && !r.ExpiresAt.After(now) {
+		return nil, errors.New("Expiration time must be in the future")
+	}
+	return scopes, nil
+}
+
+type createdAPIKey struct {
+	db.APIKey
+	Key string `json:"key"`
+}
+
+/*
+Роут /user/api_keys: GET - список ключей, POST - создание ключа
+*/
+func APIKeysHandler(request core.HttpRequest) core.HttpResponse {
+	switch request.Method {
+	case "GET":
+		return ListAPIKeysHandler(request)
+	case "POST":
+		return CreateAPIKeyHandler(request)
+	}
+	return *core.HTTP405.Copy()
+}
+
+/*
+docs(
+
+	name: ListAPIKeysHandler;
+	tag: user;
+	path: /user/api_keys;
+	method: GET;
+	summary: API keys;
+	description: API keys of the current user that have not been revoked, including expired ones. The keys themselves are not shown, only their prefixes;
+	resp_content_type: application/json;
+	responsebody: [{
+		"id": int,
+		"created_at": "time",
+		"name": "string",
+		"prefix": "string",
+		"scopes": ["string"],
+		"expires_at": "time",
+		"last_used_at": "time",
+		"last_used_ip": "string"
+	}];
+
+)docs
+*/
+func ListAPIKeysHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	keys, err := repos.APIKeys.ListByUser(request.Context(), reqUser.ID)
+	if err != nil {
+		log.Println("Error getting API keys:", err)
+		return *core.HTTP500.Copy()
+	}
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(keys)
+	if err != nil {
+		log.Println("Error serializing API keys:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+docs(
+
+	name: CreateAPIKeyHandler;
+	tag: user;
+	path: /user/api_keys;
+	method: POST;
+	summary: Create API key;
+	description: Create a named API key for scripts. Allowed scopes are images:generate and images:read. The key is returned only in this response, send it in the X-API-Key header or as a Bearer token. Expiration is optional;
+	req_content_type: application/json;
+	requestbody: {
+		"name*": "string",
+		"scopes*": ["string"],
+		"expires_at": "time"
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"id": int,
+		"created_at": "time",
+		"name": "string",
+		"prefix": "string",
+		"scopes": ["string"],
+		"expires_at": "time",
+		"last_used_at": "time",
+		"last_used_ip": "string",
+		"key": "string"
+	};
+
+)docs
+*/
+func CreateAPIKeyHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "POST" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	reqData := new(apiKeyRequest)
+	err := json.Unmarshal([]byte(request.Body), reqData)
+	if err != nil {
+		log.Println("Error unmarshaling request:", err)
+		return *core.HTTP400.Copy()
+	}
+	scopes, err := reqData.validate(time.Now())
+	if err != nil {
+		resp := core.HTTP400.Copy()
+		resp.Body = fmt.Sprintf(`{"Message": %q}`, err.Error())
+		return *resp
+	}
+
+	ctx := request.Context()
+	keys, err := repos.APIKeys.ListByUser(ctx, reqUser.ID)
+	if err != nil {
+		log.Println("Error getting API keys:", err)
+		return *core.HTTP500.Copy()
+	}
+	if len(keys) >= apiKeysPerUser {
+		resp := core.HTTP409.Copy()
+		resp.Body = fmt.Sprintf(`{"Message": "API key limit reached (%d), revoke unused keys first"}`, apiKeysPerUser)
+		return *resp
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		log.Println("Error generating API key:", err)
+		return *core.HTTP500.Copy()
+	}
+	apiKey := &db.APIKey{
+		UserID:    reqUser.ID,
+		Name:      reqData.Name,
+		Prefix:    key[:apiKeyVisibleLength],
+		KeyHash:   HashToken(key),
+		Scopes:    scopes,
+		ExpiresAt: reqData.ExpiresAt,
+	}
+	if err := repos.APIKeys.Create(ctx, apiKey); err != nil {
+		log.Println("Error creating API key:", err)
+		return *core.HTTP500.Copy()
+	}
+	audit(request, AuditAPIKeyCreate, AuditSuccess, reqUser.ID, db.AuditMetadata{
+		"api_key_id": strconv.FormatUint(uint64(apiKey.ID), 10),
+		"scopes":     strings.Join(scopes, ","),
+	})
+
+	response := core.HTTP201.Copy()
+	err = response.Serialize(createdAPIKey{APIKey: *apiKey, Key: key})
+	if err != nil {
+		log.Println("Error serializing API key:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+docs(
+
+	name: RevokeAPIKeyHandler;
+	tag: user;
+	path: /user/api_keys/{int:ID};
+	method: DELETE;
+	summary: Revoke API key;
+	description: Revoke an API key. Requests with this key are rejected immediately;
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string"
+	};
+
+)docs
+*/
+func RevokeAPIKeyHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "DELETE" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(request.Url, "/user/api_keys/"), 10, 64)
+	if err != nil {
+		log.Println("Error converting id:", err)
+		return *core.HTTP400.Copy()
+	}
+
+	err = repos.APIKeys.Revoke(request.Context(), reqUser.ID, uint(id))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			resp := core.HTTP404.Copy()
+			resp.Body = `{"Message": "API key not found"}`
+			return *resp
+		}
+		log.Println("Error revoking API key:", err)
+		return *core.HTTP500.Copy()
+	}
+	audit(request, AuditAPIKeyRevoke, AuditSuccess, reqUser.ID, db.AuditMetadata{"api_key_id": strconv.FormatUint(id, 10)})
+
+	response := core.HTTP200.Copy()
+	response.Body = `{"Message": "API key revoked"}`
+	return *response
+}
@@ -0,0 +1,268 @@
+package user
+
+/*
+	Журнал событий безопасности: вход, активация, сброс и смена пароля, смена email, обновление токенов
+	Ошибка записи события логируется и не влияет на ответ обработчика
+*/
+
+import (
+	"RestAPI/core"
+	"RestAPI/db"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	AuditRegister             = "register"
+	AuditActivate             = "activate"
+	AuditLogin                = "login"
+	AuditTokenRefresh         = "token_refresh"
+	AuditPasswordResetRequest = "password_reset_request"
+	AuditPasswordReset        = "password_reset"
+	AuditPasswordChange       = "password_change"
+	AuditEmailChange          = "email_change"
+	AuditAccountDelete        = "account_delete"
+	AuditAccountRestore       = "account_restore"
+	AuditAccountPurge         = "account_purge"
+	AuditSessionRevoke        = "session_revoke"
+	AuditLogout               = "logout"
+	AuditTokenReuse           = "token_reuse"
+	AuditAPIKeyCreate         = "api_key_create"
+	AuditAPIKeyRevoke         = "api_key_revoke"
+	AuditUserActivate         = "user_activate"
+	AuditUserDeactivate       = "user_deactivate"
+	AuditUserBan              = "user_ban"
+	AuditUserUnban            = "user_unban"
+	AuditUserClearLockout     = "user_clear_lockout"
+	AuditUserPasswordReset    = "user_password_reset"
+	AuditImpersonate          = "impersonate"
+	AuditMfaChallenge         = "mfa_challenge"
+	AuditMfaEnable            = "mfa_enable"
+	AuditMfaDisable           = "mfa_disable"
+	AuditRecoveryCodesRenew   = "recovery_codes_renew"
+	AuditIdentityLink         = "identity_link"
+)
+
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+/*
+Запись события. userID - пользователь, к которому относится событие (0, если неизвестен),
+действующим лицом считается авторизованный пользователь запроса, если он есть,
+а в сессии входа под пользователем - администратор, выдавший сессию (с отметкой impersonated в metadata)
+*/
+func audit(request core.HttpRequest, action string, result string, userID uint, metadata db.AuditMetadata) {
+	event := &db.AuditEvent{
+		Action:    action,
+		Result:    result,
+		IP:        request.RemoteAddr,
+		UserAgent: request.Header("User-Agent"),
+		Metadata:  metadata,
+	}
+	if userID != 0 {
+		event.UserID = &userID
+	}
+	if actor := RequestUser(request); actor != nil {
+		event.ActorID = &actor.ID
+	}
+	if session := SessionFromContext(request.Context()); session != nil && session.ImpersonatorID != nil {
+		event.ActorID = session.ImpersonatorID
+		event.Metadata = db.AuditMetadata{"impersonated": "true"}
+		for key, value := range metadata {
+			event.Metadata[key] = value
+		}
+	}
+	if repos == nil || repos.Audit == nil {
+		return
+	}
+	if err := repos.Audit.Create(context.WithoutCancel(request.Context()), event); err != nil {
+		log.Println("Error saving audit event:", err)
+	}
+}
+
+const (
+	pageDefaultLimit = 20
+	pageMaxLimit     = 100
+)
+
+type auditPage struct {
+	Total       int64           `json:"total"`
+	TotalPages  int             `json:"total_pages"`
+	CurrentPage int             `json:"current_page"`
+	Items       []db.AuditEvent `json:"items"`
+}
+
+/*
+Номер страницы и размер страницы из параметров page и limit, limit ограничен pageMaxLimit
+*/
+func pageParams(request core.HttpRequest) (int, int) {
+	page, limit := 1, pageDefaultLimit
+	if p, err := strconv.Atoi(request.Query["page"]); err == nil && p > 0 {
+		page = p
+	}
+	if l, err := strconv.Atoi(request.Query["limit"]); err == nil && l > 0 {
+		limit = min(l, pageMaxLimit)
+	}
+	return page, limit
+}
+
+func listAudit(request core.HttpRequest, filter db.AuditFilter) core.HttpResponse {
+	page, limit := pageParams(request)
+	filter.Offset = (page - 1) * limit
+	filter.Limit = limit
+
+	events, total, err := repos.Audit.List(request.Context(), filter)
+	if err != nil {
+		log.Println("Error getting audit events:", err)
+		return *core.HTTP500.Copy()
+	}
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(auditPage{
+		Total:       total,
+		TotalPages:  int(math.Ceil(float64(total) / float64(limit))),
+		CurrentPage: page,
+		Items:       events,
+	})
+	if err != nil {
+		log.Println("Error serializing audit events:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+docs(
+
+	name: GetMyAuditHandler;
+	tag: user;
+	path: /user/audit;
+	method: GET;
+	summary: Recent security events;
+	description: Security events of the current user (logins, password and email changes, token refreshes), newest first;
+	QueryParams: {
+		"page": "int",
+		"limit": "int"
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"total": int,
+		"total_pages": int,
+		"current_page": int,
+		"items": [{
+			"id": int,
+			"created_at": "time",
+			"user_id": int,
+			"actor_id": int,
+			"action": "string",
+			"result": "string",
+			"ip": "string",
+			"user_agent": "string",
+			"metadata": {}
+		}]
+	};
+
+)docs
+*/
+func GetMyAuditHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+	return listAudit(request, db.AuditFilter{UserID: &reqUser.ID})
+}
+
+/*
+docs(
+
+	name: AdminAuditHandler;
+	tag: admin;
+	path: /admin/audit;
+	method: GET;
+	summary: Query security events;
+	description: Security events of all users filtered by user, actor, action, result, IP and time range (RFC3339), newest first. Requires admin user or admin client certificate;
+	QueryParams: {
+		"user_id": "int",
+		"actor_id": "int",
+		"action": "string",
+		"result": "string",
+		"ip": "string",
+		"since": "time",
+		"until": "time",
+		"page": "int",
+		"limit": "int"
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"total": int,
+		"total_pages": int,
+		"current_page": int,
+		"items": [{
+			"id": int,
+			"created_at": "time",
+			"user_id": int,
+			"actor_id": int,
+			"action": "string",
+			"result": "string",
+			"ip": "string",
+			"user_agent": "string",
+			"metadata": {}
+		}]
+	};
+
+)docs
+*/
+func AdminAuditHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+
+	filter, err := parseAuditFilter(request.Query)
+	if err != nil {
+		resp := core.HTTP400.Copy()
+		resp.Body = fmt.Sprintf(`{"Message": "%s"}`, err.Error())
+		return *resp
+	}
+	return listAudit(request, filter)
+}
+
+func parseAuditFilter(query map[string]string) (db.AuditFilter, error) {
+	filter := db.AuditFilter{
+		Action: query["action"],
+		Result: query["result"],
+		IP:     query["ip"],
+	}
+	for name, target := range map[string]**uint{"user_id": &filter.UserID, "actor_id": &filter.ActorID} {
+		if query[name] == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(query[name], 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s", name)
+		}
+		value := uint(id)
+		*target = &value
+	}
+	for name, target := range map[string]**time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if query[name] == "" {
+			continue
+		}
+		raw, err := url.PathUnescape(query[name])
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s", name)
+		}
+		value, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s, expected RFC3339 time", name)
+		}
+		*target = &value
+	}
+	return filter, nil
+}
@@ -5,6 +5,7 @@ import (
 	"RestAPI/db"
 	"RestAPI/media"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strconv"
@@ -25,7 +26,6 @@ docs(
 	method: POST;
 	summary: Create a new user;
 	description: Create a new user with the given data and save it to the database;
-	isAuth: false;
 	req_content_type:application/json;
 	requestbody: {
 		"username*": "string",
@@ -70,10 +70,10 @@ func CreateUserHandler(request core.HttpRequest) core.HttpResponse {
 		log.Println("Error hashing password:", err)
 		return *core.HTTP500.Copy()
 	}
-	result := db.DB.Create(user)
-	if result.Error != nil {
-		log.Println("Error creating user:", result.Error)
-		if strings.Contains(result.Error.Error(), `duplicate key value violates unique constraint "uni_users_email"`) {
+	err = repos.Users.Create(request.Context(), user)
+	if err != nil {
+		log.Println("Error creating user:", err)
+		if errors.Is(err, db.ErrDuplicateEmail) {
 			resp := core.HTTP409.Copy()
 			resp.Body = `{"Message": "User with this email already exists"}`
 			return *resp
@@ -81,6 +81,7 @@ func CreateUserHandler(request core.HttpRequest) core.HttpResponse {
 		return *core.HTTP500.Copy()
 	}
 	user.Password = ""
+	audit(request, AuditRegister, AuditSuccess, user.ID, nil)
 
 	response := core.HTTP201.Copy()
 	err = response.Serialize(user)
@@ -100,7 +101,6 @@ docs(
 	method: POST;
 	summary: Send activation code;
 	description: Send activation code to the user's email;
-	isAuth: false;
 	req_content_type:application/json;
 	requestbody: {
 		"email*": "string"
@@ -127,11 +127,10 @@ func SendOtpHandler(request core.HttpRequest) core.HttpResponse {
 		return *core.HTTP400.Copy()
 	}
 
-	user := new(User)
-	result := db.DB.Where("email = ?", reqData.Email).First(user)
-	if result.Error != nil {
-		log.Println("Error finding user:", result.Error)
-		if strings.Contains(result.Error.Error(), "record not found") {
+	user, err := repos.Users.GetByEmail(request.Context(), reqData.Email)
+	if err != nil {
+		log.Println("Error finding user:", err)
+		if strings.Contains(err.Error(), "record not found") {
 			return *core.HTTP404.Copy()
 		}
 		return *core.HTTP500.Copy()
@@ -155,11 +154,11 @@ func SendOtpHandler(request core.HttpRequest) core.HttpResponse {
 		user.OtpExpires = new(time.Time)
 	}
 	user.Otp = otp
-	*user.OtpExpires = time.Now().Add(core.OTP_EXP_TIME)
+	*user.OtpExpires = time.Now().Add(config.Auth.OtpExpiration)
 
-	result = db.DB.Save(user)
-	if result.Error != nil {
-		log.Println("Error saving user:", result.Error)
+	err = repos.Users.Save(request.Context(), user)
+	if err != nil {
+		log.Println("Error saving user:", err)
 		return *core.HTTP500.Copy()
 	}
 
@@ -183,7 +182,6 @@ docs(
 	method: POST;
 	summary: Activate user account;
 	description: Activate user account by activation code;
-	isAuth: false;
 	req_content_type: application/json;
 	requestbody: {
 		"email*": "string",
@@ -210,12 +208,10 @@ func ActivateAccountHandler(request core.HttpRequest) core.HttpResponse {
 		return *core.HTTP400.Copy()
 	}
 
-	user := new(User)
-
-	result := db.DB.Where("email = ?", reqData.Email).First(user)
-	if result.Error != nil {
-		log.Println("Error finding user:", result.Error)
-		if strings.Contains(result.Error.Error(), "record not found") {
+	user, err := repos.Users.GetByEmail(request.Context(), reqData.Email)
+	if err != nil {
+		log.Println("Error finding user:", err)
+		if strings.Contains(err.Error(), "record not found") {
 			return *core.HTTP404.Copy()
 		}
 		return *core.HTTP500.Copy()
@@ -244,17 +240,16 @@ func ActivateAccountHandler(request core.HttpRequest) core.HttpResponse {
 	}
 
 	if user.Otp != reqData.Otp {
-		if user.OtpTries == 5 {
-			user.OtpTimeout = new(time.Time)
-			*user.OtpTimeout = time.Now().Add(core.OTP_TIMEOUT)
-		} else if user.OtpTries == 7 {
-			*user.OtpTimeout = time.Now().Add(core.OTP_TIMEOUT * 5)
-		} else if user.OtpTries == 10 {
-			*user.OtpTimeout = time.Now().Add(core.OTP_TIMEOUT * 10)
-		} else if user.OtpTries%5 == 0 {
-			*user.OtpTimeout = time.Now().Add(core.OTP_TIMEOUT * 30)
+		if lockout := otpLockout(user.OtpTries); lockout > 0 {
+			timeout := time.Now().Add(lockout)
+			user.OtpTimeout = &timeout
 		}
 		user.OtpTries++
+		if err := repos.Users.Save(request.Context(), user); err != nil {
+			log.Println("Error saving user:", err)
+			return *core.HTTP500.Copy()
+		}
+		audit(request, AuditActivate, AuditFailure, user.ID, db.AuditMetadata{"reason": "invalid_code"})
 		resp := core.HTTP409.Copy()
 		resp.Body = `{"Message": "Invalid activation code"}`
 		return *resp
@@ -266,12 +261,14 @@ func ActivateAccountHandler(request core.HttpRequest) core.HttpResponse {
 		user.OtpTries = 0
 	}
 
-	result = db.DB.Save(user)
-	if result.Error != nil {
-		log.Println("Error saving user:", result.Error)
+	err = repos.Users.Save(request.Context(), user)
+	if err != nil {
+		log.Println("Error saving user:", err)
 		return *core.HTTP500.Copy()
 	}
 
+	audit(request, AuditActivate, AuditSuccess, user.ID, nil)
+
 	response := core.HTTP200.Copy()
 	response.Body = `{"Message": "User successfully activated"}`
 	return *response
@@ -286,20 +283,20 @@ docs(
 	method: POST;
 	сontent_type: application/json;
 	summary: Authentification user;
-	isAuth: false;
+	description: Returns a token pair. If two-factor authentication is enabled, returns mfa_required and a short-lived mfa_token instead, exchange it with a code at /user/auth/mfa;
 	req_content_types: application/json;
 	requestbody: {
 		"email*": "string",
-		"password*": "string"
+		"password*": "string",
+		"device_name": "string"
 	};
 	resp_content_type: application/json;
 	responsebody: {
-		"CreatedAt": time,
-		"UpdatedAt": time,
-		"DeletedAt": time,
-		"UserID": int,
-		"AccessToken": "string",
-		"RefreshToken": "string"
+		"access_token": "string",
+		"refresh_token": "string",
+		"mfa_required": bool,
+		"mfa_token": "string",
+		"expires_in": int
 	};
 
 )docs
@@ -318,12 +315,11 @@ func AuthUserHandler(request core.HttpRequest) core.HttpResponse {
 		return *core.HTTP400.Copy()
 	}
 
-	user := new(User)
-
-	result := db.DB.Where("email = ?", reqUser.Email).First(user)
-	if result.Error != nil {
-		log.Println("Error finding user:", result.Error)
-		if strings.Contains(result.Error.Error(), "record not found") {
+	user, err := repos.Users.GetByEmail(request.Context(), reqUser.Email)
+	if err != nil {
+		log.Println("Error finding user:", err)
+		if strings.Contains(err.Error(), "record not found") {
+			audit(request, AuditLogin, AuditFailure, 0, db.AuditMetadata{"reason": "unknown_email", "email": reqUser.Email})
 			resp := core.HTTP404.Copy()
 			resp.Body = `{"Message": "User not found"}`
 			return *resp
@@ -332,13 +328,22 @@ func AuthUserHandler(request core.HttpRequest) core.HttpResponse {
 	}
 
 	if !user.IsActive {
+		audit(request, AuditLogin, AuditFailure, user.ID, db.AuditMetadata{"reason": "not_activated"})
 		resp := core.HTTP401.Copy()
 		resp.Body = `{"Message": "User is not activated"}`
 		return *resp
 	}
 
+	if user.BannedAt != nil {
+		audit(request, AuditLogin, AuditFailure, user.ID, db.AuditMetadata{"reason": "banned"})
+		resp := core.HTTP403.Copy()
+		resp.Body = `{"Message": "User is banned"}`
+		return *resp
+	}
+
 	if user.AuthTimeout != nil {
 		if user.AuthTimeout.After(time.Now()) {
+			audit(request, AuditLogin, AuditFailure, user.ID, db.AuditMetadata{"reason": "timeout"})
 			resp := core.HTTP429.Copy()
 			resp.Body = fmt.Sprintf(`{"Message": "Too many requests, timeout:%d seconds"}`, int64(user.AuthTimeout.Sub(time.Now()).Seconds()))
 			return *resp
@@ -346,56 +351,34 @@ func AuthUserHandler(request core.HttpRequest) core.HttpResponse {
 	}
 
 	if !CheckPassword(user.Password, reqUser.Password) {
-		if user.AuthTries == 3 {
-			user.AuthTimeout = new(time.Time)
-			*user.AuthTimeout = time.Now().Add(core.AUTH_TIMEOUT)
-		} else if user.AuthTries == 5 {
-			*user.AuthTimeout = time.Now().Add(core.AUTH_TIMEOUT * 5)
-		} else if user.AuthTries == 8 {
-			*user.AuthTimeout = time.Now().Add(core.AUTH_TIMEOUT * 10)
-		} else if user.AuthTries%5 == 0 && user.AuthTries > 10 {
-			*user.AuthTimeout = time.Now().Add(core.AUTH_TIMEOUT * 30)
+		if lockout := authLockout(user.AuthTries); lockout > 0 {
+			timeout := time.Now().Add(lockout)
+			user.AuthTimeout = &timeout
 		}
 		user.AuthTries++
+		if err := repos.Users.Save(request.Context(), user); err != nil {
+			log.Println("Error saving user:", err)
+			return *core.HTTP500.Copy()
+		}
+		audit(request, AuditLogin, AuditFailure, user.ID, db.AuditMetadata{"reason": "invalid_password"})
 		resp := core.HTTP401.Copy()
 		resp.Body = `{"Message": "Invalid email or password"}`
 		return *resp
-	} else {
+	} else if user.AuthTries > 0 && user.TotpEnabledAt == nil {
+		// При втором факторе попытки сбрасываются только после верного кода, иначе пароль обнулял бы счетчик подбора кода
 		user.AuthTries = 0
 		user.AuthTimeout = nil
+		if err := repos.Users.Save(request.Context(), user); err != nil {
+			log.Println("Error saving user:", err)
+			return *core.HTTP500.Copy()
+		}
 	}
 
-	accessToken, err := GenerateAccessToken(user.Username, user.Email)
-	if err != nil {
-		log.Println("Error generating access token:", err)
-		return *core.HTTP500.Copy()
-	}
-	refreshToken, err := GenerateRefreshToken(user.Username, user.Email)
-	if err != nil {
-		log.Println("Error generating refresh token:", err)
-		return *core.HTTP500.Copy()
-	}
-
-	tokens := &db.Token{
-		UserID:       user.ID,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-	}
-
-	result = db.DB.Save(tokens)
-	if result.Error != nil {
-		log.Println("Error creating token:", result.Error)
-		return *core.HTTP500.Copy()
-	}
-
-	response := core.HTTP200.Copy()
-	err = response.Serialize(tokens)
-	if err != nil {
-		log.Println("Error serializing tokens:", err)
-		return *core.HTTP500.Copy()
+	if user.TotpEnabledAt != nil {
+		return mfaChallengeResponse(request, user)
 	}
 
-	return *response
+	return loginResponse(request, user, parseDeviceName(request.Body), nil)
 }
 
 /*
@@ -407,19 +390,15 @@ docs(
 	method: POST;
 	сontent_type: application/json;
 	summary: Refresh tokens;
-	isAuth: false;
+	description: Exchange a refresh token for a new token pair of the same session. Each refresh token can be used once, presenting a used one revokes the whole session;
 	req_content_types: application/json;
 	requestbody: {
 		"refresh_token*": "string"
 	};
 	resp_content_type: application/json;
 	responsebody: {
-		"CreatedAt": time,
-		"UpdatedAt": time,
-		"DeletedAt": time,
-		"UserID": int,
-		"AccessToken": "string",
-		"RefreshToken": "string"
+		"access_token": "string",
+		"refresh_token": "string"
 	};
 
 )docs
@@ -429,7 +408,7 @@ func RefreshTokenHandler(request core.HttpRequest) core.HttpResponse {
 		return *core.HTTP405.Copy()
 	}
 
-	reqData := new(db.Token)
+	reqData := new(TokenPair)
 	err := json.Unmarshal([]byte(request.Body), reqData)
 	if err != nil {
 		log.Println("Error unmarshaling token:", err)
@@ -440,46 +419,30 @@ func RefreshTokenHandler(request core.HttpRequest) core.HttpResponse {
 		return *core.HTTP400.Copy()
 	}
 
-	token := new(db.Token)
-	result := db.DB.Where("refresh_token = ?", reqData.RefreshToken).First(token)
-	if result.Error != nil {
-		log.Println("Error finding token:", result.Error)
-		if strings.Contains(result.Error.Error(), "record not found") {
+	newTokens, session, err := RefreshTokens(request, reqData.RefreshToken)
+	if err != nil {
+		log.Println("Error refreshing tokens:", err)
+		switch {
+		case errors.Is(err, ErrRefreshTokenReused):
+			audit(request, AuditTokenReuse, AuditFailure, session.UserID, db.AuditMetadata{"session_id": strconv.FormatUint(uint64(session.ID), 10)})
+			resp := core.HTTP401.Copy()
+			resp.Body = `{"Message": "Refresh token has already been used, session revoked"}`
+			return *resp
+		case errors.Is(err, ErrInvalidRefreshToken):
+			audit(request, AuditTokenRefresh, AuditFailure, session.UserID, db.AuditMetadata{"reason": "invalid_token", "session_id": strconv.FormatUint(uint64(session.ID), 10)})
+			return *core.HTTP401.Copy()
+		case errors.Is(err, ErrUserNotActivated):
+			audit(request, AuditTokenRefresh, AuditFailure, session.UserID, db.AuditMetadata{"reason": "not_activated", "session_id": strconv.FormatUint(uint64(session.ID), 10)})
+			return messageResponse(core.HTTP401.Copy(), "User is not activated")
+		case errors.Is(err, ErrUserBanned):
+			audit(request, AuditTokenRefresh, AuditFailure, session.UserID, db.AuditMetadata{"reason": "banned", "session_id": strconv.FormatUint(uint64(session.ID), 10)})
+			return messageResponse(core.HTTP403.Copy(), "User is banned")
+		case errors.Is(err, db.ErrNotFound):
 			return *core.HTTP404.Copy()
 		}
 		return *core.HTTP500.Copy()
 	}
-
-	claims, err := ValidateToken(reqData.RefreshToken)
-	if err != nil {
-		log.Println("Error validating token:", err)
-		return *core.HTTP401.Copy()
-	}
-	username := claims["username"].(string)
-	email := claims["email"].(string)
-
-	accessToken, err := GenerateAccessToken(username, email)
-	if err != nil {
-		log.Println("Error generating access token:", err)
-		return *core.HTTP500.Copy()
-	}
-	refreshToen, err := GenerateRefreshToken(username, email)
-	if err != nil {
-		log.Println("Error generating refresh token:", err)
-		return *core.HTTP500.Copy()
-	}
-
-	newTokens := &db.Token{
-		UserID:       token.UserID,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToen,
-	}
-
-	result = db.DB.Save(newTokens)
-	if result.Error != nil {
-		log.Println("Error saving token:", result.Error)
-		return *core.HTTP500.Copy()
-	}
+	audit(request, AuditTokenRefresh, AuditSuccess, session.UserID, db.AuditMetadata{"session_id": strconv.FormatUint(uint64(session.ID), 10)})
 
 	response := core.HTTP200.Copy()
 	err = response.Serialize(newTokens)
@@ -500,7 +463,6 @@ docs(
 	method: GET;
 	summary: Get user by id;
 	description: Get user by id from the database;
-	isAuth: false;
 	resp_content_type: application/json;
 	responsebody: {
 		"ID": int,
@@ -526,12 +488,10 @@ func GetUserHandler(request core.HttpRequest) core.HttpResponse {
 		return *core.HTTP400.Copy()
 	}
 
-	user := new(User)
-
-	result := db.DB.Where("id = ?", userId).First(user)
-	if result.Error != nil {
-		log.Println("Error finding user:", result.Error)
-		if strings.Contains(result.Error.Error(), "record not found") {
+	user, err := repos.Users.GetByID(request.Context(), uint(userId))
+	if err != nil {
+		log.Println("Error finding user:", err)
+		if strings.Contains(err.Error(), "record not found") {
 			return *core.HTTP404.Copy()
 		}
 		return *core.HTTP500.Copy()
@@ -541,7 +501,7 @@ func GetUserHandler(request core.HttpRequest) core.HttpResponse {
 	user.Otp = 0
 	user.OtpExpires = nil
 	user.Password = ""
-	user.Tokens = nil
+	user.Sessions = nil
 	user.ResetToken = ""
 	user.ResetExpires = nil
 
@@ -563,7 +523,6 @@ docs(
 	method: GET;
 	summary: Get user by token;
 	description: Get user by token;
-	isAuth: true;
 	resp_content_type: application/json;
 	responsebody: {
 		"ID": int,
@@ -581,15 +540,12 @@ func GetMeHandler(request core.HttpRequest) core.HttpResponse {
 	if request.Method != "GET" {
 		return *core.HTTP405.Copy()
 	}
-	if request.User == nil {
-		return *core.HTTP401.Copy()
-	}
-	reqUser := request.User.(*db.User)
+	reqUser := RequestUser(request)
 
 	reqUser.Otp = 0
 	reqUser.OtpExpires = nil
 	reqUser.Password = ""
-	reqUser.Tokens = nil
+	reqUser.Sessions = nil
 	reqUser.ResetToken = ""
 	reqUser.ResetExpires = nil
 
@@ -610,8 +566,7 @@ docs(
 	path: /user/update;
 	method: PATCH;
 	summary: Update user;
-	description: Update user with the given data and save it to the database;
-	isAuth: true;
+	description: Update user with the given data and save it to the database. Changing the password revokes all sessions including the current one. A new email is applied only after it is confirmed with the code sent to it (/user/confirm_email), until then it is returned as pending_email;
 	req_content_type: multipart/form-data;
 	requestbody: {
 		"username": "string",
@@ -628,7 +583,8 @@ docs(
 		"DeletedAt": time,
 		"username": "string",
 		"is_active": bool,
-		"email": "string"
+		"email": "string",
+		"pending_email": "string"
 	};
 
 )docs
@@ -637,11 +593,9 @@ func UpdateUserHandler(request core.HttpRequest) core.HttpResponse {
 	if request.Method != "PATCH" {
 		return *core.HTTP405.Copy()
 	}
-	if request.User == nil {
-		return *core.HTTP401.Copy()
-	}
 
-	reqUser := request.User.(*db.User)
+	reqUser := RequestUser(request)
+	passwordChanged := false
 
 	if request.FormData != nil {
 		if request.FormData.Fields["username"] == "" && request.FormData.Fields["email"] == "" && request.FormData.Fields["new_password"] == "" && len(request.FormData.Files["avatar"]) == 0 {
@@ -665,10 +619,28 @@ func UpdateUserHandler(request core.HttpRequest) core.HttpResponse {
 				resp.Body = fmt.Sprintf(`{"Message": "%s"}`, err.Error())
 				return *resp
 			}
-			reqUser.Email = request.FormData.Fields["email"]
+			/*
+				Новый email сохраняется как ожидающий и применяется после ввода кода из письма на него,
+				неподтвержденный адрес не используется для входа и привязки аккаунтов OpenID Connect
+			*/
+			if email := request.FormData.Fields["email"]; email != reqUser.Email {
+				if existing, err := repos.Users.GetByEmail(request.Context(), email); err == nil && existing.ID != reqUser.ID {
+					audit(request, AuditEmailChange, AuditFailure, reqUser.ID, db.AuditMetadata{"reason": "duplicate_email", "old_email": reqUser.Email, "new_email": email})
+					return messageResponse(core.HTTP409.Copy(), "User with this email already exists")
+				}
+				expires := time.Now().Add(config.Auth.OtpExpiration)
+				reqUser.PendingEmail = email
+				reqUser.Otp = generateActivationCode()
+				reqUser.OtpExpires = &expires
+				reqUser.OtpTries = 0
+				reqUser.OtpTimeout = nil
+			} else {
+				reqUser.PendingEmail = ""
+			}
 		}
 		if request.FormData.Fields["new_password"] != "" && request.FormData.Fields["old_password"] != "" {
 			if !CheckPassword(reqUser.Password, request.FormData.Fields["old_password"]) {
+				audit(request, AuditPasswordChange, AuditFailure, reqUser.ID, db.AuditMetadata{"reason": "invalid_password"})
 				return *core.HTTP401.Copy()
 			}
 			valErr := ValidatePassword(request.FormData.Fields["new_password"], DefaultValidationRules())
@@ -685,55 +657,60 @@ func UpdateUserHandler(request core.HttpRequest) core.HttpResponse {
 				return *core.HTTP500.Copy()
 			}
 			reqUser.Password = newPass
+			passwordChanged = true
 		}
+	} else {
+		return *core.HTTP400.Copy()
+	}
+
+	/*
+		Новый аватар удаляется, если сохранить пользователя не удалось, а старый - только после успешного сохранения
+	*/
+	err := repos.Transaction(request.Context(), func(uow *db.UnitOfWork) error {
+		oldAvatar := strings.TrimPrefix(reqUser.Avatar, "/images/")
 		if len(request.FormData.Files["avatar"]) > 0 {
 			filename, err := media.SaveFile(request.FormData.Files["avatar"][0].FileData, reqUser.ID)
 			if err != nil {
-				log.Println("Error saving file:", err)
-				return *core.HTTP500.Copy()
-			}
-			if reqUser.Avatar != "" {
-				err := media.DeleteFile(strings.TrimPrefix(reqUser.Avatar, "/images/"))
-				if err != nil {
-					log.Println("Error deleting file:", err)
-					return *core.HTTP500.Copy()
-				}
+				return fmt.Errorf("saving file: %w", err)
 			}
+			uow.OnRollback(func() error { return media.DeleteFile(filename) })
 			reqUser.Avatar = "/images/" + filename
 		} else {
-			if reqUser.Avatar != "" {
-				err := media.DeleteFile(strings.TrimPrefix(reqUser.Avatar, "/images/"))
-				if err != nil {
-					log.Println("Error deleting file:", err)
-					return *core.HTTP500.Copy()
-				}
-				reqUser.Avatar = ""
+			reqUser.Avatar = ""
+		}
+		if oldAvatar != "" {
+			uow.OnCommit(func() error { return media.DeleteFile(oldAvatar) })
+		}
+		if passwordChanged {
+			if _, err := uow.Repos.Sessions.RevokeByUser(request.Context(), reqUser.ID, 0); err != nil {
+				return fmt.Errorf("revoking sessions: %w", err)
 			}
 		}
-	} else {
-		return *core.HTTP400.Copy()
+		return uow.Repos.Users.Save(request.Context(), reqUser)
+	})
+	if err != nil {
+		log.Println("Error saving user:", err)
+		return *core.HTTP500.Copy()
 	}
-
-	result := db.DB.Save(reqUser)
-	if result.Error != nil {
-		if strings.Contains(result.Error.Error(), `duplicate key value violates unique constraint "uni_users_email"`) {
-			resp := core.HTTP409.Copy()
-			resp.Body = `{"Message": "User with this email already exists"}`
-			return *resp
+	if request.FormData.Fields["email"] != "" && reqUser.PendingEmail != "" {
+		// Если письмо не отправилось, код можно получить, повторив изменение email
+		if err := SendActivationEmail(reqUser.PendingEmail, reqUser.Otp); err != nil {
+			log.Println("Error sending email:", err)
 		}
-		log.Println("Error saving user:", result.Error)
-		return *core.HTTP500.Copy()
+	}
+	if passwordChanged {
+		audit(request, AuditPasswordChange, AuditSuccess, reqUser.ID, nil)
 	}
 
 	reqUser.Password = ""
 	reqUser.Otp = 0
 	reqUser.OtpExpires = nil
-	reqUser.Tokens = nil
+	reqUser.Sessions = nil
 	reqUser.ResetToken = ""
 	reqUser.ResetExpires = nil
 
 	response := core.HTTP200.Copy()
-	err := response.Serialize(reqUser)
+	err = response.Serialize(reqUser)
 	if err != nil {
 		log.Println("Error serializing user:", err)
 		return *core.HTTP500.Copy()
@@ -741,6 +718,85 @@ func UpdateUserHandler(request core.HttpRequest) core.HttpResponse {
 	return *response
 }
 
+type confirmEmailRequest struct {
+	Otp int `json:"otp"`
+}
+
+/*
+docs(
+
+	name: ConfirmEmailHandler;
+	tag: user;
+	path: /user/confirm_email;
+	method: POST;
+	summary: Confirm new email;
+	description: Apply the email set in /user/update with the code sent to the new address;
+	req_content_type: application/json;
+	requestbody: {
+		"otp*": int
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string"
+	};
+
+)docs
+*/
+func ConfirmEmailHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "POST" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	reqData := new(confirmEmailRequest)
+	if err := json.Unmarshal([]byte(request.Body), reqData); err != nil || reqData.Otp == 0 {
+		return *core.HTTP400.Copy()
+	}
+	if reqUser.PendingEmail == "" {
+		return messageResponse(core.HTTP409.Copy(), "No email change to confirm")
+	}
+	if reqUser.OtpTimeout != nil && reqUser.OtpTimeout.After(time.Now()) {
+		resp := core.HTTP429.Copy()
+		resp.Body = fmt.Sprintf(`{"Message": "Too many requests, timeout:%d seconds"}`, int64(time.Until(*reqUser.OtpTimeout).Seconds()))
+		return *resp
+	}
+	if reqUser.OtpExpires != nil && reqUser.OtpExpires.Before(time.Now()) {
+		return messageResponse(core.HTTP409.Copy(), "Confirmation code expired")
+	}
+
+	if reqUser.Otp != reqData.Otp {
+		if lockout := otpLockout(reqUser.OtpTries); lockout > 0 {
+			timeout := time.Now().Add(lockout)
+			reqUser.OtpTimeout = &timeout
+		}
+		reqUser.OtpTries++
+		if err := repos.Users.Save(request.Context(), reqUser); err != nil {
+			log.Println("Error saving user:", err)
+			return *core.HTTP500.Copy()
+		}
+		audit(request, AuditEmailChange, AuditFailure, reqUser.ID, db.AuditMetadata{"reason": "invalid_code", "new_email": reqUser.PendingEmail})
+		return messageResponse(core.HTTP409.Copy(), "Invalid confirmation code")
+	}
+
+	oldEmail := reqUser.Email
+	reqUser.Email = reqUser.PendingEmail
+	reqUser.PendingEmail = ""
+	reqUser.Otp = 0
+	reqUser.OtpExpires = nil
+	reqUser.OtpTries = 0
+	reqUser.OtpTimeout = nil
+	if err := repos.Users.Save(request.Context(), reqUser); err != nil {
+		if errors.Is(err, db.ErrDuplicateEmail) {
+			audit(request, AuditEmailChange, AuditFailure, reqUser.ID, db.AuditMetadata{"reason": "duplicate_email", "old_email": oldEmail, "new_email": reqUser.Email})
+			return messageResponse(core.HTTP409.Copy(), "User with this email already exists")
+		}
+		log.Println("Error saving user:", err)
+		return *core.HTTP500.Copy()
+	}
+	audit(request, AuditEmailChange, AuditSuccess, reqUser.ID, db.AuditMetadata{"old_email": oldEmail, "new_email": reqUser.Email})
+	return messageResponse(core.HTTP200.Copy(), "Email changed")
+}
+
 /*
 docs(
 
@@ -750,7 +806,6 @@ docs(
 	method: POST;
 	summary: Send mail for reset password;
 	description: Send mail with reset code to the user's email;
-	isAuth: false;
 	req_content_type:application/json;
 	requestbody: {
 		"email*": "string"
@@ -776,14 +831,15 @@ func SendResetPasswordMailHandler(request core.HttpRequest) core.HttpResponse {
 		return *core.HTTP400.Copy()
 	}
 
-	result := db.DB.Where("email = ?", reqUser.Email).First(reqUser)
-	if result.Error != nil {
-		log.Println("Error finding user:", result.Error)
-		if strings.Contains(result.Error.Error(), "record not found") {
+	dbUser, err := repos.Users.GetByEmail(request.Context(), reqUser.Email)
+	if err != nil {
+		log.Println("Error finding user:", err)
+		if strings.Contains(err.Error(), "record not found") {
 			return *core.HTTP404.Copy()
 		}
 		return *core.HTTP500.Copy()
 	}
+	reqUser.User = *dbUser
 
 	if reqUser.ResetTimeout != nil {
 		if reqUser.ResetTimeout.After(time.Now()) {
@@ -801,11 +857,11 @@ func SendResetPasswordMailHandler(request core.HttpRequest) core.HttpResponse {
 
 	reqUser.ResetToken = resetCode
 	reqUser.ResetExpires = new(time.Time)
-	*reqUser.ResetExpires = time.Now().Add(core.OTP_EXP_TIME)
+	*reqUser.ResetExpires = time.Now().Add(config.Auth.OtpExpiration)
 
-	result = db.DB.Save(reqUser)
-	if result.Error != nil {
-		log.Println("Error saving user:", result.Error)
+	err = repos.Users.Save(request.Context(), &reqUser.User)
+	if err != nil {
+		log.Println("Error saving user:", err)
 		return *core.HTTP500.Copy()
 	}
 
@@ -814,6 +870,7 @@ func SendResetPasswordMailHandler(request core.HttpRequest) core.HttpResponse {
 		log.Println("Error sending email:", err)
 		return *core.HTTP500.Copy()
 	}
+	audit(request, AuditPasswordResetRequest, AuditSuccess, reqUser.ID, nil)
 
 	response := core.HTTP200.Copy()
 	response.Body = `{"Message": "Reset code sent"}`
@@ -828,8 +885,7 @@ docs(
 	path: /user/reset_password;
 	method: POST;
 	summary: Reset password;
-	description: Reset password by reset code;
-	isAuth: false;
+	description: Reset password by reset code. All sessions of the user are revoked;
 	req_content_type: application/json;
 	requestbody: {
 		"email*": "string",
@@ -857,12 +913,10 @@ func ResetPasswordHandler(request core.HttpRequest) core.HttpResponse {
 		return *core.HTTP400.Copy()
 	}
 
-	user := new(User)
-
-	result := db.DB.Where("email = ?", reqUser.Email).First(user)
-	if result.Error != nil {
-		log.Println("Error finding user:", result.Error)
-		if strings.Contains(result.Error.Error(), "record not found") {
+	user, err := repos.Users.GetByEmail(request.Context(), reqUser.Email)
+	if err != nil {
+		log.Println("Error finding user:", err)
+		if strings.Contains(err.Error(), "record not found") {
 			return *core.HTTP404.Copy()
 		}
 		return *core.HTTP500.Copy()
@@ -890,17 +944,16 @@ func ResetPasswordHandler(request core.HttpRequest) core.HttpResponse {
 	}
 
 	if user.ResetToken != reqUser.ResetToken {
-		if user.ResetTries == 5 {
-			user.ResetTimeout = new(time.Time)
-			*user.ResetTimeout = time.Now().Add(core.OTP_TIMEOUT)
-		} else if user.ResetTries == 7 {
-			*user.ResetTimeout = time.Now().Add(core.OTP_TIMEOUT * 5)
-		} else if user.ResetTries == 10 {
-			*user.ResetTimeout = time.Now().Add(core.OTP_TIMEOUT * 10)
-		} else if user.ResetTries%5 == 0 && user.ResetTries > 10 {
-			*user.ResetTimeout = time.Now().Add(core.OTP_TIMEOUT * 30)
+		if lockout := otpLockout(user.ResetTries); lockout > 0 {
+			timeout := time.Now().Add(lockout)
+			user.ResetTimeout = &timeout
 		}
 		user.ResetTries++
+		if err := repos.Users.Save(request.Context(), user); err != nil {
+			log.Println("Error saving user:", err)
+			return *core.HTTP500.Copy()
+		}
+		audit(request, AuditPasswordReset, AuditFailure, user.ID, db.AuditMetadata{"reason": "invalid_code"})
 		resp := core.HTTP409.Copy()
 		resp.Body = `{"Message": "Invalid reset code"}`
 		return *resp
@@ -923,12 +976,19 @@ func ResetPasswordHandler(request core.HttpRequest) core.HttpResponse {
 		user.Password = newPass
 	}
 
-	result = db.DB.Save(user)
-	if result.Error != nil {
-		log.Println("Error saving user:", result.Error)
+	err = repos.Transaction(request.Context(), func(uow *db.UnitOfWork) error {
+		if _, err := uow.Repos.Sessions.RevokeByUser(request.Context(), user.ID, 0); err != nil {
+			return fmt.Errorf("revoking sessions: %w", err)
+		}
+		return uow.Repos.Users.Save(request.Context(), user)
+	})
+	if err != nil {
+		log.Println("Error saving user:", err)
 		return *core.HTTP500.Copy()
 	}
 
+	audit(request, AuditPasswordReset, AuditSuccess, user.ID, nil)
+
 	response := core.HTTP200.Copy()
 	response.Body = `{"Message": "Password successfully reset"}`
 	return *response
@@ -1,13 +1,15 @@
 package user
 
 import (
-	"RestAPI/core"
 	"crypto/rand"
 	"encoding/base64"
 	"errors"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 )
 
 func GenerateSecretKey(length int) (string, error) {
@@ -21,90 +23,142 @@ func GenerateSecretKey(length int) (string, error) {
 	return base64.URLEncoding.EncodeToString(key), nil
 }
 
-func GenerateAccessToken(username string, email string) (string, error) {
-	if username == "" || email == "" {
-		return "", errors.New("Username or email is empty")
-	}
-	claims := jwt.MapClaims{
-		"username":   username,
-		"email":      email,
-		"exp":        time.Now().Add(core.JWT_ACCESS_EXPIRATION_TIME).Unix(),
-		"token_type": "access",
-	}
+const (
+	TokenTypeAccess  = "access"
+	TokenTypeRefresh = "refresh"
+	// Токен второго шага входа: выдается после проверки пароля, меняется на пару токенов вместе с кодом TOTP
+	TokenTypeMFA = "mfa"
+)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(core.JWT_ACCESS_SECRET_KEY))
+/*
+Claims токенов: зарегистрированные claims (sub - ID пользователя, jti, iat, nbf, exp, iss, aud) и тип токена
+*/
+type Claims struct {
+	jwt.RegisteredClaims
+	TokenType string `json:"token_type"`
 }
 
-func GenerateRefreshToken(username string, email string) (string, error) {
-	if username == "" || email == "" {
-		return "", errors.New("Username or email is empty")
-	}
-	claims := jwt.MapClaims{
-		"username":   username,
-		"email":      email,
-		"exp":        time.Now().Add(core.JWT_REFRESH_EXPIRATION_TIME).Unix(),
-		"token_type": "refresh",
+/*
+ID пользователя из sub
+*/
+func (c *Claims) UserID() (uint, error) {
+	id, err := strconv.ParseUint(c.Subject, 10, 64)
+	if err != nil || id == 0 {
+		return 0, errors.New("Invalid subject")
 	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(core.JWT_REFRESH_SECRET_KEY))
+	return uint(id), nil
 }
 
-func ValidateToken(tokenString string) (jwt.MapClaims, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(core.JWT_ACCESS_SECRET_KEY), nil
-	})
-
-	if err != nil {
-		token, err = jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return []byte(core.JWT_REFRESH_SECRET_KEY), nil
-		})
-		if err != nil {
-			return nil, err
-		}
+func generateToken(userID uint, tokenType string, secret string, expiration time.Duration) (string, error) {
+	if userID == 0 {
+		return "", errors.New("User ID is empty")
 	}
-
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		if exp, ok := claims["exp"].(float64); ok {
-			if time.Now().Unix() > int64(exp) {
-				return nil, errors.New("Token has expired")
-			}
-		}
-		return claims, nil
+	now := time.Now()
+	claims := Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.FormatUint(uint64(userID), 10),
+			ID:        uuid.NewString(),
+			Issuer:    config.JWT.Issuer,
+			Audience:  jwt.ClaimStrings{config.JWT.Audience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(expiration)),
+		},
+		TokenType: tokenType,
+	}
+	if keyring == nil {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString([]byte(secret))
+	}
+	key := keyring.Active()
+	if key == nil {
+		return "", errors.New("No active signing key")
 	}
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
 
-	return nil, err
+func GenerateAccessToken(userID uint) (string, error) {
+	return generateToken(userID, TokenTypeAccess, config.JWT.AccessSecretKey, config.JWT.AccessExpiration)
 }
 
-func RefreshTokens(refreshTokenString string) (string, string, error) {
-	token, err := jwt.Parse(refreshTokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(core.JWT_REFRESH_SECRET_KEY), nil
-	})
+func GenerateRefreshToken(userID uint) (string, error) {
+	return generateToken(userID, TokenTypeRefresh, config.JWT.RefreshSecretKey, config.JWT.RefreshExpiration)
+}
 
-	if err != nil || !token.Valid {
-		return "", "", errors.New("Invalid token")
-	}
+func GenerateMFAToken(userID uint) (string, error) {
+	return generateToken(userID, TokenTypeMFA, config.JWT.AccessSecretKey, config.Auth.MfaChallengeExpiration)
+}
 
-	claims, ok := token.Claims.(jwt.MapClaims)
-	if !ok || claims["token_type"] != "refresh" {
-		return "", "", errors.New("Invalid token type")
+/*
+Ключ проверки: секрет типа токена для HS256, иначе открытый ключ из связки по kid
+При RS256/EdDSA токены HS256, выданные до перехода на ключи, принимаются, пока секрет задан в конфигурации
+*/
+func verificationKey(secret string) (jwt.Keyfunc, []string) {
+	if keyring == nil {
+		return func(token *jwt.Token) (interface{}, error) {
+			return []byte(secret), nil
+		}, []string{jwt.SigningMethodHS256.Alg()}
 	}
-	username, usernameOk := claims["username"].(string)
-	email, emailOk := claims["email"].(string)
-	if !usernameOk || !emailOk {
-		return "", "", errors.New("Invalid username or email in token claims")
+	methods := []string{AlgorithmRS256, AlgorithmEdDSA}
+	if secret != "" {
+		methods = append(methods, jwt.SigningMethodHS256.Alg())
 	}
+	return func(token *jwt.Token) (interface{}, error) {
+		if token.Method.Alg() == jwt.SigningMethodHS256.Alg() {
+			return []byte(secret), nil
+		}
+		kid, _ := token.Header["kid"].(string)
+		key := keyring.Find(kid)
+		if key == nil {
+			return nil, fmt.Errorf("Unknown signing key %q", kid)
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, errors.New("Signing algorithm does not match key")
+		}
+		return key.Private.Public(), nil
+	}, methods
+}
 
-	newAccessToken, err := GenerateAccessToken(username, email)
+/*
+Проверка токена одного типа: подпись (HS256 своим секретом или RS256/EdDSA ключом из связки), exp/nbf/iat с допуском jwt.leeway,
+iss и aud из конфигурации, наличие sub и jti и совпадение token_type
+*/
+func validateToken(tokenString string, tokenType string, secret string) (*Claims, error) {
+	claims := new(Claims)
+	keyfunc, methods := verificationKey(secret)
+	_, err := jwt.ParseWithClaims(tokenString, claims, keyfunc,
+		jwt.WithValidMethods(methods),
+		jwt.WithIssuer(config.JWT.Issuer),
+		jwt.WithAudience(config.JWT.Audience),
+		jwt.WithLeeway(config.JWT.Leeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
-
-	newRefreshToken, err := GenerateRefreshToken(username, email)
-	if err != nil {
-		return "", "", err
+	if claims.TokenType != tokenType {
+		return nil, errors.New("Invalid token type")
 	}
+	if claims.ID == "" {
+		return nil, errors.New("Token has no jti")
+	}
+	if _, err := claims.UserID(); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func ValidateAccessToken(tokenString string) (*Claims, error) {
+	return validateToken(tokenString, TokenTypeAccess, config.JWT.AccessSecretKey)
+}
+
+func ValidateRefreshToken(tokenString string) (*Claims, error) {
+	return validateToken(tokenString, TokenTypeRefresh, config.JWT.RefreshSecretKey)
+}
 
-	return newAccessToken, newRefreshToken, nil
+func ValidateMFAToken(tokenString string) (*Claims, error) {
+	return validateToken(tokenString, TokenTypeMFA, config.JWT.AccessSecretKey)
 }
@@ -0,0 +1,427 @@
+package user
+
+/*
+	Ключи подписи JWT (RS256 или EdDSA) с ротацией
+	Каждый ключ хранится в каталоге jwt.keys_dir в отдельном PEM файле (PKCS#8), имя файла без .pem - kid
+	Новые токены подписываются самым новым (активным) ключом, старые ключи остаются для проверки
+	еще jwt.refresh_expiration + jwt.leeway после появления следующего ключа, затем удаляются
+	Время создания берется из заголовка Created PEM блока, для ключей, созданных вручную (openssl genpkey), - из времени изменения файла
+	Публичные части всех ключей отдаются в /.well-known/jwks.json, чтобы другие сервисы могли проверять токены
+*/
+
+import (
+	"RestAPI/core"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+const rsaKeyBits = 2048
+
+// Каталог перечитывается из-за неизвестного kid не чаще раза в keyReloadInterval
+const keyReloadInterval = 10 * time.Second
+
+type SigningKey struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	CreatedAt time.Time
+}
+
+func (k *SigningKey) method() jwt.SigningMethod {
+	if k.Algorithm == AlgorithmRS256 {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+type Keyring struct {
+	mu        sync.RWMutex
+	dir       string
+	algorithm string
+	// Ключи от старых к новым, последний - активный
+	keys       []*SigningKey
+	lastReload time.Time
+}
+
+/*
+Загрузка ключей из каталога dir. Если ключей нет, создается первый ключ алгоритма algorithm
+*/
+func LoadKeyring(dir string, algorithm string) (*Keyring, error) {
+	if algorithm != AlgorithmRS256 && algorithm != AlgorithmEdDSA {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	k, err := OpenKeyring(dir, algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if k.Active() == nil {
+		if _, err := k.Rotate(time.Now(), 0, 0); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+/*
+Ключи из существующего каталога dir без создания каталога и первого ключа, для команд, которые только читают ключи
+*/
+func OpenKeyring(dir string, algorithm string) (*Keyring, error) {
+	if algorithm != AlgorithmRS256 && algorithm != AlgorithmEdDSA {
+		return nil, fmt.Errorf("unsupported signing algorithm %q", algorithm)
+	}
+	k := &Keyring{dir: dir, algorithm: algorithm}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+/*
+Перечитывание каталога ключей (ключи могли добавить или удалить другие экземпляры сервера)
+Ключи другого алгоритма пропускаются, чтобы активным не стал ключ, не соответствующий jwt.algorithm
+*/
+func (k *Keyring) Reload() error {
+	entries, err := os.ReadDir(k.dir)
+	if err != nil {
+		return err
+	}
+	keys := []*SigningKey{}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".pem" {
+			continue
+		}
+		key, err := readSigningKey(filepath.Join(k.dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		if key.Algorithm != k.algorithm {
+			log.Printf("Skipping signing key %s: %s key, jwt.algorithm is %s", entry.Name(), key.Algorithm, k.algorithm)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].ID < keys[j].ID
+		}
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+
+	k.mu.Lock()
+	k.keys = keys
+	k.lastReload = time.Now()
+	k.mu.Unlock()
+	return nil
+}
+
+func readSigningKey(path string) (*SigningKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("expected PKCS#8 PEM block \"PRIVATE KEY\"")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &SigningKey{ID: strings.TrimSuffix(filepath.Base(path), ".pem")}
+	switch private := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm, key.Private = AlgorithmRS256, private
+	case ed25519.PrivateKey:
+		key.Algorithm, key.Private = AlgorithmEdDSA, private
+	default:
+		return nil, fmt.Errorf("unsupported key type %T, expected RSA or Ed25519", parsed)
+	}
+
+	if created, ok := block.Headers["Created"]; ok {
+		key.CreatedAt, err = time.Parse(time.RFC3339, created)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Created header: %w", err)
+		}
+	} else {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		key.CreatedAt = info.ModTime()
+	}
+	return key, nil
+}
+
+func generateSigningKey(algorithm string, now time.Time) (*SigningKey, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	key := &SigningKey{
+		ID:        now.UTC().Format("20060102T150405") + "-" + hex.EncodeToString(suffix),
+		Algorithm: algorithm,
+		CreatedAt: now.UTC().Truncate(time.Second),
+	}
+	var err error
+	if algorithm == AlgorithmRS256 {
+		key.Private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	} else {
+		_, key.Private, err = ed25519.GenerateKey(rand.Reader)
+	}
+	return key, err
+}
+
+func (k *Keyring) write(key *SigningKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.Private)
+	if err != nil {
+		return err
+	}
+	block := &pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: map[string]string{"Created": key.CreatedAt.Format(time.RFC3339)},
+		Bytes:   der,
+	}
+	path := filepath.Join(k.dir, key.ID+".pem")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(block), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+/*
+Активный ключ (nil, если ключей нет)
+*/
+func (k *Keyring) Active() *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if len(k.keys) == 0 {
+		return nil
+	}
+	return k.keys[len(k.keys)-1]
+}
+
+func (k *Keyring) Lookup(kid string) *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if key.ID == kid {
+			return key
+		}
+	}
+	return nil
+}
+
+/*
+Ключ по kid для проверки токена. Неизвестный kid мог появиться у другого экземпляра сервера с общим keys_dir
+или после keys rotate, поэтому каталог перечитывается, но не чаще раза в keyReloadInterval
+*/
+func (k *Keyring) Find(kid string) *SigningKey {
+	if key := k.Lookup(kid); key != nil {
+		return key
+	}
+	k.mu.Lock()
+	if time.Since(k.lastReload) < keyReloadInterval {
+		k.mu.Unlock()
+		return nil
+	}
+	k.lastReload = time.Now()
+	k.mu.Unlock()
+
+	if err := k.Reload(); err != nil {
+		log.Println("Error reloading signing keys:", err)
+		return nil
+	}
+	return k.Lookup(kid)
+}
+
+func (k *Keyring) Keys() []*SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]*SigningKey{}, k.keys...)
+}
+
+/*
+Создание нового активного ключа, если активный старше interval (0 - создать в любом случае),
+и удаление ключей, замененных следующим ключом больше retention назад. Возвращает true, если ключ создан
+*/
+func (k *Keyring) Rotate(now time.Time, interval time.Duration, retention time.Duration) (bool, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	rotated := false
+	if len(k.keys) == 0 || interval == 0 || !now.Before(k.keys[len(k.keys)-1].CreatedAt.Add(interval)) {
+		key, err := generateSigningKey(k.algorithm, now)
+		if err != nil {
+			return false, fmt.Errorf("generating key: %w", err)
+		}
+		if err := k.write(key); err != nil {
+			return false, fmt.Errorf("writing key: %w", err)
+		}
+		k.keys = append(k.keys, key)
+		rotated = true
+	}
+
+	kept := []*SigningKey{}
+	for i, key := range k.keys {
+		if i < len(k.keys)-1 && now.After(k.keys[i+1].CreatedAt.Add(retention)) {
+			if err := os.Remove(filepath.Join(k.dir, key.ID+".pem")); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return rotated, fmt.Errorf("removing retired key %s: %w", key.ID, err)
+			}
+			continue
+		}
+		kept = append(kept, key)
+	}
+	k.keys = kept
+	return rotated, nil
+}
+
+/*
+Ключи хранятся до истечения всех подписанных ими токенов
+*/
+func KeyRetention() time.Duration {
+	return max(config.JWT.AccessExpiration, config.JWT.RefreshExpiration) + config.JWT.Leeway
+}
+
+/*
+Ротация ключей по расписанию: каталог перечитывается, и при необходимости создается новый ключ
+Проверка выполняется раз в час (или чаще, если jwt.key_rotation_interval меньше часа), останавливается при отмене ctx
+*/
+func StartKeyRotation(ctx context.Context) {
+	if keyring == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(min(config.JWT.KeyRotationInterval, time.Hour))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := keyring.Reload(); err != nil {
+				log.Println("Error reloading signing keys:", err)
+				continue
+			}
+			rotated, err := keyring.Rotate(time.Now(), config.JWT.KeyRotationInterval, KeyRetention())
+			if err != nil {
+				log.Println("Error rotating signing keys:", err)
+			} else if rotated {
+				log.Println("Signing key rotated, new kid:", keyring.Active().ID)
+			}
+		}
+	}()
+}
+
+/*
+Открытый ключ в формате JWK (RFC 7517, RFC 8037 для Ed25519)
+*/
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (k *Keyring) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for _, key := range k.Keys() {
+		jwk := JWK{KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm}
+		switch public := key.Private.Public().(type) {
+		case *rsa.PublicKey:
+			jwk.KeyType = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.KeyType = "OKP"
+			jwk.Curve = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+/*
+docs(
+
+	name: JWKSHandler;
+	tag: auth;
+	path: /.well-known/jwks.json;
+	method: GET;
+	summary: Token verification keys;
+	description: Public keys (JWK Set) for verifying access and refresh tokens by kid. Includes the active key and retiring keys that may still have valid tokens. Not available when tokens are signed with HS256;
+	resp_content_type: application/json;
+	responsebody: {
+		"keys": [{
+			"kty": "string",
+			"kid": "string",
+			"use": "string",
+			"alg": "string",
+			"n": "string",
+			"e": "string",
+			"crv": "string",
+			"x": "string"
+		}]
+	};
+
+)docs
+*/
+func JWKSHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+	if keyring == nil {
+		resp := core.HTTP404.Copy()
+		resp.Body = `{"Message": "Tokens are signed with a shared secret, no public keys available"}`
+		return *resp
+	}
+
+	response := core.HTTP200.Copy()
+	err := response.Serialize(keyring.JWKS())
+	if err != nil {
+		log.Println("Error serializing JWKS:", err)
+		return *core.HTTP500.Copy()
+	}
+	response.SetHeader("Content-Type", "application/jwk-set+json")
+	response.SetHeader("Cache-Control", "public, max-age=300")
+	return *response
+}
@@ -1,13 +1,25 @@
 package user
 
 import (
-	"RestAPI/core"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"strconv"
 
 	"gopkg.in/gomail.v2"
 )
 
+/*
+Отправка письма через SMTP-сервер из настроек, в тестах подменяется
+*/
+var deliverMail = func(m *gomail.Message) error {
+	d := gomail.NewDialer(config.Mail.Host, config.Mail.Port, config.Mail.User, config.Mail.Password)
+	d.SSL = true
+	return d.DialAndSend(m)
+}
+
 type EmailData struct {
 	ActivationCode int
 	ResetCode      string
@@ -21,11 +33,8 @@ func SendActivationEmail(toEmail string, activationCode int) error {
 		return fmt.Errorf("Invalid activation code")
 	}
 
-	d := gomail.NewDialer(core.MAIL_HOST, core.MAIL_PORT, core.MAIL_USER, core.MAIL_PASSWORD)
-	d.SSL = true
-
 	m := gomail.NewMessage()
-	m.SetHeader("From", core.MAIL_USER)
+	m.SetHeader("From", config.Mail.User)
 	m.SetHeader("To", toEmail)
 	m.SetHeader("Subject", "Account Activation")
 
@@ -35,7 +44,7 @@ func SendActivationEmail(toEmail string, activationCode int) error {
 
 	var buf bytes.Buffer
 
-	if err := core.ACTIVATE_EMAIL_TEMPLATE.Execute(&buf, data); err != nil {
+	if err := activateEmailTemplate.Execute(&buf, data); err != nil {
 		return err
 	}
 
@@ -43,7 +52,7 @@ func SendActivationEmail(toEmail string, activationCode int) error {
 
 	m.SetBody("text/html", msgHTML)
 
-	return d.DialAndSend(m)
+	return deliverMail(m)
 }
 
 func SendResetPasswordEmail(toEmail, resetToken string) error {
@@ -54,11 +63,8 @@ func SendResetPasswordEmail(toEmail, resetToken string) error {
 		return fmt.Errorf("Invalid reset code")
 	}
 
-	d := gomail.NewDialer(core.MAIL_HOST, core.MAIL_PORT, core.MAIL_USER, core.MAIL_PASSWORD)
-	d.SSL = true
-
 	m := gomail.NewMessage()
-	m.SetHeader("From", core.MAIL_USER)
+	m.SetHeader("From", config.Mail.User)
 	m.SetHeader("To", toEmail)
 	m.SetHeader("Subject", "Reset Password")
 
@@ -68,7 +74,7 @@ func SendResetPasswordEmail(toEmail, resetToken string) error {
 
 	var buf bytes.Buffer
 
-	if err := core.RESET_PASSWORD_TEMPLATE.Execute(&buf, data); err != nil {
+	if err := resetPasswordTemplate.Execute(&buf, data); err != nil {
 		return err
 	}
 
@@ -76,5 +82,17 @@ func SendResetPasswordEmail(toEmail, resetToken string) error {
 
 	m.SetBody("text/html", msgHTML)
 
-	return d.DialAndSend(m)
+	return deliverMail(m)
+}
+
+/*
+Проверка доступности почтового сервера (TLS-соединение без авторизации)
+*/
+func CheckMailServer(ctx context.Context) error {
+	dialer := &tls.Dialer{Config: &tls.Config{ServerName: config.Mail.Host}}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(config.Mail.Host, strconv.Itoa(config.Mail.Port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
 }
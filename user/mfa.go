@@ -0,0 +1,544 @@
+package user
+
+/*
+	Двухфакторная аутентификация TOTP (RFC 6238, HMAC-SHA1, 6 цифр, шаг 30 секунд)
+	Подключение: POST /user/mfa/totp возвращает секрет и otpauth:// URI для приложения-аутентификатора,
+	POST /user/mfa/totp/confirm с кодом включает второй фактор и возвращает одноразовые коды восстановления
+	Коды восстановления показываются один раз, в БД хранятся SHA-256 хеши
+	Вход: /user/auth после проверки пароля возвращает mfa_token (живет auth.mfa_challenge_expiration),
+	/user/auth/mfa меняет его вместе с кодом TOTP или кодом восстановления на пару токенов
+	Неверные коды учитываются вместе с неверными паролями (AuthTries, AuthTimeout)
+*/
+
+import (
+	"RestAPI/core"
+	"RestAPI/db"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// Допустимое расхождение часов с приложением в шагах
+	totpSkew          = 1
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTotpSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+/*
+Код TOTP шага step (HOTP от номера шага, RFC 4226)
+*/
+func totpCode(secret []byte, step int64) string {
+	mac := hmac.New(sha1.New, secret)
+	binary.Write(mac, binary.BigEndian, step)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+/*
+Проверка кода с допуском totpSkew шагов. Возвращает шаг кода, шаги не позже lastStep не принимаются (повтор кода)
+*/
+func verifyTotp(secret string, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step > lastStep && subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpURI(secret string, account string) string {
+	label := url.PathEscape(config.Auth.TotpIssuer + ":" + account)
+	params := url.Values{
+		"secret":    {secret},
+		"issuer":    {config.Auth.TotpIssuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(totpDigits)},
+		"period":    {strconv.Itoa(totpPeriod)},
+	}
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+/*
+Коды восстановления вида xxxx-xxxx и их хеши для хранения
+*/
+func generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		codes = append(codes, code[:4]+"-"+code[4:])
+		hashes = append(hashes, HashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+/*
+Код восстановления без разделителей и регистра, в том виде, в котором хешируется
+*/
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+type mfaChallenge struct {
+	MfaRequired bool   `json:"mfa_required"`
+	MfaToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+/*
+Ответ на вход с правильным паролем, когда включен второй фактор
+*/
+func mfaChallengeResponse(request core.HttpRequest, user *db.User) core.HttpResponse {
+	token, err := GenerateMFAToken(user.ID)
+	if err != nil {
+		log.Println("Error generating MFA token:", err)
+		return *core.HTTP500.Copy()
+	}
+	audit(request, AuditMfaChallenge, AuditSuccess, user.ID, nil)
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(mfaChallenge{
+		MfaRequired: true,
+		MfaToken:    token,
+		ExpiresIn:   int64(config.Auth.MfaChallengeExpiration.Seconds()),
+	})
+	if err != nil {
+		log.Println("Error serializing MFA challenge:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+type mfaRequest struct {
+	MfaToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+	DeviceName   string `json:"device_name"`
+	Password     string `json:"password"`
+}
+
+/*
+docs(
+
+	name: VerifyMfaHandler;
+	tag: user;
+	path: /user/auth/mfa;
+	method: POST;
+	summary: Second authentication step;
+	description: Exchange the mfa_token from /user/auth and a TOTP code (or a one-time recovery code) for a token pair. Invalid codes count as failed logins;
+	req_content_type: application/json;
+	requestbody: {
+		"mfa_token*": "string",
+		"code": "string",
+		"recovery_code": "string",
+		"device_name": "string"
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"access_token": "string",
+		"refresh_token": "string"
+	};
+
+)docs
+*/
+func VerifyMfaHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "POST" {
+		return *core.HTTP405.Copy()
+	}
+	reqData := new(mfaRequest)
+	err := json.Unmarshal([]byte(request.Body), reqData)
+	if err != nil {
+		log.Println("Error unmarshaling request:", err)
+		return *core.HTTP400.Copy()
+	}
+	if reqData.MfaToken == "" || (reqData.Code == "") == (reqData.RecoveryCode == "") {
+		return messageResponse(core.HTTP400.Copy(), "mfa_token and either code or recovery_code are required")
+	}
+
+	claims, err := ValidateMFAToken(reqData.MfaToken)
+	if err != nil {
+		return messageResponse(core.HTTP401.Copy(), "Invalid or expired MFA token")
+	}
+	userID, _ := claims.UserID()
+	ctx := request.Context()
+	user, err := repos.Users.GetByID(ctx, userID)
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return messageResponse(core.HTTP401.Copy(), "Invalid or expired MFA token")
+		}
+		log.Println("Error finding user:", err)
+		return *core.HTTP500.Copy()
+	}
+	if !user.IsActive || user.BannedAt != nil || user.TotpEnabledAt == nil {
+		return messageResponse(core.HTTP401.Copy(), "Invalid or expired MFA token")
+	}
+	if user.AuthTimeout != nil && user.AuthTimeout.After(time.Now()) {
+		audit(request, AuditLogin, AuditFailure, user.ID, db.AuditMetadata{"reason": "timeout"})
+		resp := core.HTTP429.Copy()
+		resp.Body = fmt.Sprintf(`{"Message": "Too many requests, timeout:%d seconds"}`, int64(time.Until(*user.AuthTimeout).Seconds()))
+		return *resp
+	}
+
+	method, valid := "totp", false
+	if reqData.Code != "" {
+		var step int64
+		if step, valid = verifyTotp(user.TotpSecret, strings.TrimSpace(reqData.Code), time.Now(), user.TotpLastStep); valid {
+			user.TotpLastStep = step
+		}
+	} else {
+		method = "recovery_code"
+		err := repos.RecoveryCodes.Use(ctx, user.ID, HashToken(normalizeRecoveryCode(reqData.RecoveryCode)))
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			log.Println("Error using recovery code:", err)
+			return *core.HTTP500.Copy()
+		}
+		valid = err == nil
+	}
+	if !valid {
+		if lockout := authLockout(user.AuthTries); lockout > 0 {
+			timeout := time.Now().Add(lockout)
+			user.AuthTimeout = &timeout
+		}
+		user.AuthTries++
+		if err := repos.Users.Save(ctx, user); err != nil {
+			log.Println("Error saving user:", err)
+		}
+		audit(request, AuditLogin, AuditFailure, user.ID, db.AuditMetadata{"reason": "invalid_mfa_code", "mfa": method})
+		return messageResponse(core.HTTP401.Copy(), "Invalid code")
+	}
+
+	user.AuthTries = 0
+	user.AuthTimeout = nil
+	if err := repos.Users.Save(ctx, user); err != nil {
+		log.Println("Error saving user:", err)
+		return *core.HTTP500.Copy()
+	}
+	return loginResponse(request, user, reqData.DeviceName, db.AuditMetadata{"mfa": method})
+}
+
+/*
+docs(
+
+	name: MfaStatusHandler;
+	tag: user;
+	path: /user/mfa;
+	method: GET;
+	summary: Two-factor authentication status;
+	description: Whether TOTP is enabled and how many unused recovery codes are left;
+	resp_content_type: application/json;
+	responsebody: {
+		"totp_enabled": bool,
+		"recovery_codes_left": int
+	};
+
+)docs
+*/
+func MfaStatusHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	left, err := repos.RecoveryCodes.CountUnused(request.Context(), reqUser.ID)
+	if err != nil {
+		log.Println("Error counting recovery codes:", err)
+		return *core.HTTP500.Copy()
+	}
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(map[string]interface{}{
+		"totp_enabled":        reqUser.TotpEnabledAt != nil,
+		"recovery_codes_left": left,
+	})
+	if err != nil {
+		log.Println("Error serializing response:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+Роут /user/mfa/totp: POST - начало подключения TOTP, DELETE - отключение
+*/
+func TotpHandler(request core.HttpRequest) core.HttpResponse {
+	switch request.Method {
+	case "POST":
+		return EnrollTotpHandler(request)
+	case "DELETE":
+		return DisableTotpHandler(request)
+	}
+	return *core.HTTP405.Copy()
+}
+
+/*
+docs(
+
+	name: EnrollTotpHandler;
+	tag: user;
+	path: /user/mfa/totp;
+	method: POST;
+	summary: Start TOTP enrollment;
+	description: Generate a new TOTP secret. Add it to an authenticator app (otpauth_uri can be shown as a QR code) and confirm with a code at /user/mfa/totp/confirm. Calling again replaces an unconfirmed secret;
+	resp_content_type: application/json;
+	responsebody: {
+		"secret": "string",
+		"otpauth_uri": "string"
+	};
+
+)docs
+*/
+func EnrollTotpHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "POST" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+	if reqUser.TotpEnabledAt != nil {
+		return messageResponse(core.HTTP409.Copy(), "Two-factor authentication is already enabled")
+	}
+
+	secret, err := generateTotpSecret()
+	if err != nil {
+		log.Println("Error generating TOTP secret:", err)
+		return *core.HTTP500.Copy()
+	}
+	reqUser.TotpSecret = secret
+	reqUser.TotpLastStep = 0
+	if err := repos.Users.Save(request.Context(), reqUser); err != nil {
+		log.Println("Error saving user:", err)
+		return *core.HTTP500.Copy()
+	}
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(map[string]string{
+		"secret":      secret,
+		"otpauth_uri": totpURI(secret, reqUser.Email),
+	})
+	if err != nil {
+		log.Println("Error serializing response:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+Новые коды восстановления пользователя, старые перестают действовать
+*/
+func renewRecoveryCodes(ctx context.Context, user *db.User) ([]string, error) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("generating recovery codes: %w", err)
+	}
+	err = repos.Transaction(ctx, func(uow *db.UnitOfWork) error {
+		if err := uow.Repos.RecoveryCodes.Replace(ctx, user.ID, hashes); err != nil {
+			return fmt.Errorf("saving recovery codes: %w", err)
+		}
+		return uow.Repos.Users.Save(ctx, user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func recoveryCodesResponse(codes []string) core.HttpResponse {
+	response := core.HTTP200.Copy()
+	err := response.Serialize(map[string][]string{"recovery_codes": codes})
+	if err != nil {
+		log.Println("Error serializing recovery codes:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+docs(
+
+	name: ConfirmTotpHandler;
+	tag: user;
+	path: /user/mfa/totp/confirm;
+	method: POST;
+	summary: Confirm TOTP enrollment;
+	description: Enable two-factor authentication with a code from the authenticator app. Returns one-time recovery codes, they are shown only once;
+	req_content_type: application/json;
+	requestbody: {
+		"code*": "string"
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"recovery_codes": ["string"]
+	};
+
+)docs
+*/
+func ConfirmTotpHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "POST" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	reqData := new(mfaRequest)
+	if err := json.Unmarshal([]byte(request.Body), reqData); err != nil || reqData.Code == "" {
+		return *core.HTTP400.Copy()
+	}
+	if reqUser.TotpEnabledAt != nil {
+		return messageResponse(core.HTTP409.Copy(), "Two-factor authentication is already enabled")
+	}
+	if reqUser.TotpSecret == "" {
+		return messageResponse(core.HTTP409.Copy(), "TOTP enrollment is not started")
+	}
+	now := time.Now()
+	step, ok := verifyTotp(reqUser.TotpSecret, strings.TrimSpace(reqData.Code), now, reqUser.TotpLastStep)
+	if !ok {
+		return messageResponse(core.HTTP400.Copy(), "Invalid code")
+	}
+
+	reqUser.TotpEnabledAt = &now
+	reqUser.TotpLastStep = step
+	codes, err := renewRecoveryCodes(request.Context(), reqUser)
+	if err != nil {
+		log.Println("Error enabling TOTP:", err)
+		return *core.HTTP500.Copy()
+	}
+	audit(request, AuditMfaEnable, AuditSuccess, reqUser.ID, nil)
+	return recoveryCodesResponse(codes)
+}
+
+/*
+docs(
+
+	name: RenewRecoveryCodesHandler;
+	tag: user;
+	path: /user/mfa/recovery_codes;
+	method: POST;
+	summary: New recovery codes;
+	description: Replace recovery codes with new ones, confirmed by a TOTP code. Previous codes stop working;
+	req_content_type: application/json;
+	requestbody: {
+		"code*": "string"
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"recovery_codes": ["string"]
+	};
+
+)docs
+*/
+func RenewRecoveryCodesHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "POST" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	reqData := new(mfaRequest)
+	if err := json.Unmarshal([]byte(request.Body), reqData); err != nil || reqData.Code == "" {
+		return *core.HTTP400.Copy()
+	}
+	if reqUser.TotpEnabledAt == nil {
+		return messageResponse(core.HTTP409.Copy(), "Two-factor authentication is not enabled")
+	}
+	step, ok := verifyTotp(reqUser.TotpSecret, strings.TrimSpace(reqData.Code), time.Now(), reqUser.TotpLastStep)
+	if !ok {
+		return messageResponse(core.HTTP400.Copy(), "Invalid code")
+	}
+
+	reqUser.TotpLastStep = step
+	codes, err := renewRecoveryCodes(request.Context(), reqUser)
+	if err != nil {
+		log.Println("Error renewing recovery codes:", err)
+		return *core.HTTP500.Copy()
+	}
+	audit(request, AuditRecoveryCodesRenew, AuditSuccess, reqUser.ID, nil)
+	return recoveryCodesResponse(codes)
+}
+
+/*
+docs(
+
+	name: DisableTotpHandler;
+	tag: user;
+	path: /user/mfa/totp;
+	method: DELETE;
+	summary: Disable two-factor authentication;
+	description: Disable TOTP and delete recovery codes, confirmed by the current password;
+	req_content_type: application/json;
+	requestbody: {
+		"password*": "string"
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string"
+	};
+
+)docs
+*/
+func DisableTotpHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "DELETE" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	reqData := new(mfaRequest)
+	if err := json.Unmarshal([]byte(request.Body), reqData); err != nil || reqData.Password == "" {
+		return *core.HTTP400.Copy()
+	}
+	if reqUser.TotpSecret == "" && reqUser.TotpEnabledAt == nil {
+		return messageResponse(core.HTTP409.Copy(), "Two-factor authentication is not enabled")
+	}
+	if !CheckPassword(reqUser.Password, reqData.Password) {
+		audit(request, AuditMfaDisable, AuditFailure, reqUser.ID, db.AuditMetadata{"reason": "invalid_password"})
+		return messageResponse(core.HTTP401.Copy(), "Invalid password")
+	}
+
+	reqUser.TotpSecret = ""
+	reqUser.TotpEnabledAt = nil
+	reqUser.TotpLastStep = 0
+	ctx := request.Context()
+	err := repos.Transaction(ctx, func(uow *db.UnitOfWork) error {
+		if _, err := uow.Repos.RecoveryCodes.DeleteByUser(ctx, reqUser.ID); err != nil {
+			return fmt.Errorf("deleting recovery codes: %w", err)
+		}
+		return uow.Repos.Users.Save(ctx, reqUser)
+	})
+	if err != nil {
+		log.Println("Error disabling TOTP:", err)
+		return *core.HTTP500.Copy()
+	}
+	audit(request, AuditMfaDisable, AuditSuccess, reqUser.ID, nil)
+	return messageResponse(core.HTTP200.Copy(), "Two-factor authentication disabled")
+}
@@ -0,0 +1,755 @@
+package user
+
+/*
+	Вход через внешних провайдеров OpenID Connect (authorization code flow с PKCE, RFC 7636)
+	1. /user/oidc/{provider}/start - клиент получает адрес страницы входа провайдера и state
+	2. провайдер возвращает пользователя на oidc.redirect_url с code и state, клиент передает их в /user/oidc/{provider}/callback
+	3. сервер обменивает code на id_token, проверяет его подпись (по JWKS провайдера), iss, aud, exp и nonce
+	и выдает пару токенов так же, как /user/auth (с вторым фактором, если он включен)
+	Внешний аккаунт (провайдер + sub) привязывается при первом входе к пользователю с тем же email,
+	если провайдер подтвердил email (email_verified), а если такого пользователя нет - создается новый активный пользователь
+	Email пользователя подтвержден кодом из письма (новый email до подтверждения хранится в PendingEmail и здесь не участвует),
+	но у неактивного пользователя email еще не подтвержден, к нему аккаунт не привязывается
+	Незавершенные входы (state, code_verifier, nonce) хранятся в памяти процесса, каждый state принимается один раз
+	Поэтому start и callback должны попасть в один экземпляр сервера: при нескольких экземплярах за балансировщиком
+	нужна привязка клиента к экземпляру (sticky sessions), иначе callback ответит "Invalid or expired state"
+*/
+
+import (
+	"RestAPI/core"
+	"RestAPI/db"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// Метаданные провайдера перечитываются не чаще раза в oidcDiscoveryTTL
+	oidcDiscoveryTTL = time.Hour
+	// JWKS перечитывается при неизвестном kid, но не чаще раза в oidcKeysRefreshInterval
+	oidcKeysRefreshInterval = time.Minute
+	oidcMaxPendingLogins    = 10000
+	oidcMaxResponseSize     = 1 << 20
+)
+
+var oidcDefaultScopes = []string{"openid", "email", "profile"}
+
+var (
+	// Клиент для запросов к провайдерам, в тестах заменяется клиентом фейкового провайдера
+	oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+	oidcMu      sync.Mutex
+	oidcIssuers = make(map[string]*oidcIssuer)
+	oidcLogins  = make(map[string]oidcLogin)
+
+	errOIDCEmailNotVerified    = errors.New("email is not verified by the provider")
+	errOIDCAccountDeleted      = errors.New("account with this email is deleted")
+	errOIDCAccountNotActivated = errors.New("account with this email is not activated")
+)
+
+func init() {
+	core.RegisterCache("oidc_logins", pendingOIDCLogins)
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+/*
+Ключ из JWKS провайдера. В отличие от JWK ключей сервера бывает и EC, у которого есть координата y
+*/
+type oidcJWK struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	Curve   string `json:"crv"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+/*
+Метаданные и ключи провайдера, кешируются по issuer
+*/
+type oidcIssuer struct {
+	discovery     oidcDiscovery
+	fetchedAt     time.Time
+	keys          map[string]crypto.PublicKey
+	keysFetchedAt time.Time
+}
+
+/*
+Незавершенный вход: провайдер, PKCE code_verifier и nonce, ожидаемый в id_token
+*/
+type oidcLogin struct {
+	provider string
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+type oidcClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string   `json:"nonce"`
+	AuthorizedParty   string   `json:"azp"`
+	Email             string   `json:"email"`
+	EmailVerified     oidcBool `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+/*
+Некоторые провайдеры передают email_verified строкой "true"
+*/
+type oidcBool bool
+
+func (b *oidcBool) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case bool:
+		*b = oidcBool(v)
+	case string:
+		*b = oidcBool(strings.EqualFold(v, "true"))
+	default:
+		*b = false
+	}
+	return nil
+}
+
+func pendingOIDCLogins() int {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	return len(oidcLogins)
+}
+
+func oidcRandomString() (string, error) {
+	bytes := make([]byte, 32)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(bytes), nil
+}
+
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+/*
+Новый вход через провайдера, возвращает state
+*/
+func beginOIDCLogin(provider string, now time.Time) (string, *oidcLogin, error) {
+	state, err := oidcRandomString()
+	if err != nil {
+		return "", nil, err
+	}
+	verifier, err := oidcRandomString()
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := oidcRandomString()
+	if err != nil {
+		return "", nil, err
+	}
+	login := oidcLogin{provider: provider, verifier: verifier, nonce: nonce, expires: now.Add(config.OIDC.StateExpiration)}
+
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	for key, pending := range oidcLogins {
+		if !pending.expires.After(now) {
+			delete(oidcLogins, key)
+		}
+	}
+	if len(oidcLogins) >= oidcMaxPendingLogins {
+		return "", nil, errors.New("too many pending OpenID Connect logins")
+	}
+	oidcLogins[state] = login
+	return state, &login, nil
+}
+
+/*
+Незавершенный вход по state, state удаляется при любом исходе
+*/
+func takeOIDCLogin(state string, provider string, now time.Time) (*oidcLogin, bool) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	login, ok := oidcLogins[state]
+	delete(oidcLogins, state)
+	if !ok || login.provider != provider || !login.expires.After(now) {
+		return nil, false
+	}
+	return &login, true
+}
+
+func oidcGetJSON(ctx context.Context, target string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", target, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseSize)).Decode(v)
+}
+
+/*
+Метаданные провайдера из <issuer>/.well-known/openid-configuration
+*/
+func discoverOIDC(ctx context.Context, issuer string) (*oidcIssuer, error) {
+	oidcMu.Lock()
+	cached, ok := oidcIssuers[issuer]
+	oidcMu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < oidcDiscoveryTTL {
+		return cached, nil
+	}
+
+	var discovery oidcDiscovery
+	if err := oidcGetJSON(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", &discovery); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if discovery.Issuer != issuer {
+		return nil, fmt.Errorf("discovery: issuer %q does not match %q", discovery.Issuer, issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("discovery: authorization_endpoint, token_endpoint and jwks_uri are required")
+	}
+
+	fetched := &oidcIssuer{discovery: discovery, fetchedAt: time.Now()}
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if ok && cached.discovery.JWKSURI == discovery.JWKSURI {
+		fetched.keys, fetched.keysFetchedAt = cached.keys, cached.keysFetchedAt
+	}
+	oidcIssuers[issuer] = fetched
+	return fetched, nil
+}
+
+/*
+Открытый ключ провайдера по kid, при неизвестном kid JWKS загружается заново (провайдер мог сменить ключи)
+Без kid подходит только единственный ключ
+*/
+func (i *oidcIssuer) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	oidcMu.Lock()
+	keys, fetchedAt := i.keys, i.keysFetchedAt
+	oidcMu.Unlock()
+
+	if key := lookupOIDCKey(keys, kid); key != nil {
+		return key, nil
+	}
+	if time.Since(fetchedAt) < oidcKeysRefreshInterval {
+		return nil, fmt.Errorf("unknown key %q", kid)
+	}
+
+	var set struct {
+		Keys []oidcJWK `json:"keys"`
+	}
+	if err := oidcGetJSON(ctx, i.discovery.JWKSURI, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	keys = make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseJWK(jwk)
+		if err != nil {
+			log.Printf("Skipping OpenID Connect key %q: %v", jwk.KeyID, err)
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+	oidcMu.Lock()
+	i.keys, i.keysFetchedAt = keys, time.Now()
+	oidcMu.Unlock()
+
+	if key := lookupOIDCKey(keys, kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", kid)
+}
+
+func lookupOIDCKey(keys map[string]crypto.PublicKey, kid string) crypto.PublicKey {
+	if kid == "" && len(keys) == 1 {
+		for _, key := range keys {
+			return key
+		}
+	}
+	return keys[kid]
+}
+
+func decodeJWKInt(value string) (*big.Int, error) {
+	bytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(bytes) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+/*
+Открытый ключ из JWK: RSA, EC (P-256, P-384, P-521) и Ed25519
+*/
+func parseJWK(jwk oidcJWK) (crypto.PublicKey, error) {
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeJWKInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJWKInt(jwk.E)
+		if err != nil || !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[jwk.Curve]
+		if !ok {
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Curve)
+		}
+		x, err := decodeJWKInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJWKInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if jwk.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.KeyType)
+}
+
+/*
+Адрес страницы входа провайдера для нового входа
+*/
+func oidcAuthorizationURL(issuer *oidcIssuer, provider core.OIDCProvider, state string, login *oidcLogin) string {
+	scopes := provider.Scopes
+	if len(scopes) == 0 {
+		scopes = oidcDefaultScopes
+	}
+	params := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.ClientID},
+		"redirect_uri":          {config.OIDC.RedirectURL},
+		"scope":                 {strings.Join(scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {login.nonce},
+		"code_challenge":        {pkceChallenge(login.verifier)},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(issuer.discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return issuer.discovery.AuthorizationEndpoint + separator + params.Encode()
+}
+
+/*
+Обмен кода на id_token, клиент аутентифицируется через client_secret_basic (публичный клиент без секрета - client_id в форме)
+*/
+func exchangeOIDCCode(ctx context.Context, issuer *oidcIssuer, provider core.OIDCProvider, code string, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {config.OIDC.RedirectURL},
+		"code_verifier": {verifier},
+	}
+	if provider.ClientSecret == "" {
+		form.Set("client_id", provider.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", issuer.discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if provider.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(provider.ClientID), url.QueryEscape(provider.ClientSecret))
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tokens struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, oidcMaxResponseSize)).Decode(&tokens); err != nil {
+		return "", fmt.Errorf("token endpoint: status %d: %w", resp.StatusCode, err)
+	}
+	if resp.StatusCode != http.StatusOK || tokens.Error != "" {
+		return "", fmt.Errorf("token endpoint: status %d: %s %s", resp.StatusCode, tokens.Error, tokens.ErrorDescription)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token endpoint: no id_token in response")
+	}
+	return tokens.IDToken, nil
+}
+
+/*
+Проверка id_token: подпись ключом провайдера, iss, aud (и azp при нескольких aud), exp и nonce
+*/
+func validateIDToken(ctx context.Context, issuer *oidcIssuer, provider core.OIDCProvider, idToken string, nonce string) (*oidcClaims, error) {
+	claims := new(oidcClaims)
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return issuer.key(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithIssuer(provider.Issuer),
+		jwt.WithAudience(provider.ClientID),
+		jwt.WithLeeway(config.JWT.Leeway),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != provider.ClientID {
+		return nil, errors.New("id_token azp does not match client_id")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("id_token nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("id_token has no subject")
+	}
+	return claims, nil
+}
+
+var oidcUsernameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+/*
+Имя нового пользователя из preferred_username, name или email, приведенное к правилам ValidateUsername
+*/
+func oidcUsername(claims *oidcClaims) string {
+	local, _, _ := strings.Cut(claims.Email, "@")
+	for _, candidate := range []string{claims.PreferredUsername, claims.Name, local} {
+		username := strings.Trim(oidcUsernameInvalid.ReplaceAllString(candidate, "_"), "_")
+		if len(username) > 64 {
+			username = username[:64]
+		}
+		if len(username) >= 4 {
+			return username
+		}
+	}
+	return "user_" + claims.Subject[:min(len(claims.Subject), 8)]
+}
+
+/*
+Пользователь внешнего аккаунта: уже привязанный, существующий с тем же подтвержденным email или новый
+Возвращает также, был ли аккаунт привязан сейчас и был ли создан пользователь
+*/
+func resolveOIDCUser(ctx context.Context, provider string, claims *oidcClaims) (*db.User, bool, bool, error) {
+	identity, err := repos.Identities.GetBySubject(ctx, provider, claims.Subject)
+	if err == nil {
+		user, err := repos.Users.GetByID(ctx, identity.UserID)
+		if errors.Is(err, db.ErrNotFound) {
+			return nil, false, false, errOIDCAccountDeleted
+		}
+		return user, false, false, err
+	}
+	if !errors.Is(err, db.ErrNotFound) {
+		return nil, false, false, err
+	}
+
+	email := strings.TrimSpace(claims.Email)
+	if email == "" || !bool(claims.EmailVerified) {
+		return nil, false, false, errOIDCEmailNotVerified
+	}
+
+	var user *db.User
+	created := false
+	err = repos.Transaction(ctx, func(uow *db.UnitOfWork) error {
+		existing, err := uow.Repos.Users.GetByEmail(ctx, email)
+		switch {
+		case err == nil:
+			user = existing
+			if !user.IsActive {
+				return errOIDCAccountNotActivated
+			}
+		case errors.Is(err, db.ErrNotFound):
+			// Пароль случайный, задать свой можно через сброс пароля
+			password, err := oidcRandomString()
+			if err != nil {
+				return err
+			}
+			hash, err := HashPassword(password)
+			if err != nil {
+				return err
+			}
+			user = &db.User{Username: oidcUsername(claims), Email: email, Password: hash, IsActive: true}
+			if err := uow.Repos.Users.Create(ctx, user); err != nil {
+				if errors.Is(err, db.ErrDuplicateEmail) {
+					return errOIDCAccountDeleted
+				}
+				return err
+			}
+			created = true
+		default:
+			return err
+		}
+		return uow.Repos.Identities.Create(ctx, &db.UserIdentity{UserID: user.ID, Provider: provider, Subject: claims.Subject, Email: email})
+	})
+	if err != nil {
+		return nil, false, false, err
+	}
+	return user, true, created, nil
+}
+
+/*
+docs(
+
+	name: OIDCProvidersHandler;
+	tag: user;
+	path: /user/oidc/providers;
+	method: GET;
+	summary: OpenID Connect providers;
+	description: Names of the configured providers for social login;
+	resp_content_type: application/json;
+	responsebody: ["string"];
+
+)docs
+*/
+func OIDCProvidersHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+	names := make([]string, 0, len(config.OIDC.Providers))
+	for name := range config.OIDC.Providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	response := core.HTTP200.Copy()
+	err := response.Serialize(names)
+	if err != nil {
+		log.Println("Error serializing providers:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+Имя провайдера из /user/oidc/{provider}/<action>
+*/
+func oidcProvider(request core.HttpRequest, action string) (string, core.OIDCProvider, bool) {
+	name := strings.TrimSuffix(strings.TrimPrefix(request.Url, "/user/oidc/"), "/"+action)
+	provider, ok := config.OIDC.Providers[name]
+	return name, provider, ok
+}
+
+type oidcStartResponse struct {
+	AuthorizationURL string `json:"authorization_url"`
+	State            string `json:"state"`
+	ExpiresIn        int64  `json:"expires_in"`
+}
+
+/*
+docs(
+
+	name: OIDCStartHandler;
+	tag: user;
+	path: /user/oidc/{string:provider}/start;
+	method: POST;
+	summary: Start social login;
+	description: Start login with an OpenID Connect provider. Redirect the user to authorization_url, the provider returns them to the configured redirect URL with code and state for /user/oidc/{provider}/callback;
+	resp_content_type: application/json;
+	responsebody: {
+		"authorization_url": "string",
+		"state": "string",
+		"expires_in": int
+	};
+
+)docs
+*/
+func OIDCStartHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "POST" {
+		return *core.HTTP405.Copy()
+	}
+	name, provider, ok := oidcProvider(request, "start")
+	if !ok {
+		return messageResponse(core.HTTP404.Copy(), "Unknown provider")
+	}
+
+	issuer, err := discoverOIDC(request.Context(), provider.Issuer)
+	if err != nil {
+		log.Printf("Error discovering OpenID Connect provider %s: %v", name, err)
+		return messageResponse(core.HTTP503.Copy(), "Provider is unavailable")
+	}
+	state, login, err := beginOIDCLogin(name, time.Now())
+	if err != nil {
+		log.Println("Error starting OpenID Connect login:", err)
+		return messageResponse(core.HTTP503.Copy(), "Too many pending logins, try again later")
+	}
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(oidcStartResponse{
+		AuthorizationURL: oidcAuthorizationURL(issuer, provider, state, login),
+		State:            state,
+		ExpiresIn:        int64(config.OIDC.StateExpiration.Seconds()),
+	})
+	if err != nil {
+		log.Println("Error serializing OpenID Connect login:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+type oidcCallbackRequest struct {
+	Code       string `json:"code"`
+	State      string `json:"state"`
+	DeviceName string `json:"device_name"`
+}
+
+/*
+docs(
+
+	name: OIDCCallbackHandler;
+	tag: user;
+	path: /user/oidc/{string:provider}/callback;
+	method: POST;
+	summary: Finish social login;
+	description: Exchange the code and state returned by the provider for a token pair. The provider account is linked to the user with the same email if the provider has verified it, otherwise a new activated user is created. A user who has not activated the account is not linked, the response is 409. Returns an MFA challenge like /user/auth when two-factor authentication is enabled;
+	req_content_type: application/json;
+	requestbody: {
+		"code*": "string",
+		"state*": "string",
+		"device_name": "string"
+	};
+	resp_content_type: application/json;
+	responsebody: {
+		"access_token": "string",
+		"refresh_token": "string"
+	};
+
+)docs
+*/
+func OIDCCallbackHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "POST" {
+		return *core.HTTP405.Copy()
+	}
+	name, provider, ok := oidcProvider(request, "callback")
+	if !ok {
+		return messageResponse(core.HTTP404.Copy(), "Unknown provider")
+	}
+	reqData := new(oidcCallbackRequest)
+	err := json.Unmarshal([]byte(request.Body), reqData)
+	if err != nil {
+		log.Println("Error unmarshaling request:", err)
+		return *core.HTTP400.Copy()
+	}
+	if reqData.Code == "" || reqData.State == "" {
+		return messageResponse(core.HTTP400.Copy(), "code and state are required")
+	}
+
+	login, ok := takeOIDCLogin(reqData.State, name, time.Now())
+	if !ok {
+		audit(request, AuditLogin, AuditFailure, 0, db.AuditMetadata{"reason": "invalid_state", "oidc": name})
+		return messageResponse(core.HTTP401.Copy(), "Invalid or expired state")
+	}
+
+	ctx := request.Context()
+	issuer, err := discoverOIDC(ctx, provider.Issuer)
+	if err != nil {
+		log.Printf("Error discovering OpenID Connect provider %s: %v", name, err)
+		return messageResponse(core.HTTP503.Copy(), "Provider is unavailable")
+	}
+	idToken, err := exchangeOIDCCode(ctx, issuer, provider, reqData.Code, login.verifier)
+	if err == nil {
+		var claims *oidcClaims
+		if claims, err = validateIDToken(ctx, issuer, provider, idToken, login.nonce); err == nil {
+			return oidcLoginResponse(request, name, claims, reqData.DeviceName)
+		}
+	}
+	log.Printf("Error finishing OpenID Connect login with %s: %v", name, err)
+	audit(request, AuditLogin, AuditFailure, 0, db.AuditMetadata{"reason": "invalid_id_token", "oidc": name})
+	return messageResponse(core.HTTP401.Copy(), "Login with the provider failed")
+}
+
+/*
+Вход пользователя, которого подтвердил провайдер
+*/
+func oidcLoginResponse(request core.HttpRequest, provider string, claims *oidcClaims, device string) core.HttpResponse {
+	user, linked, created, err := resolveOIDCUser(request.Context(), provider, claims)
+	switch {
+	case errors.Is(err, errOIDCEmailNotVerified):
+		audit(request, AuditLogin, AuditFailure, 0, db.AuditMetadata{"reason": "email_not_verified", "oidc": provider})
+		return messageResponse(core.HTTP403.Copy(), "Email is not verified by the provider")
+	case errors.Is(err, errOIDCAccountDeleted):
+		audit(request, AuditLogin, AuditFailure, 0, db.AuditMetadata{"reason": "account_deleted", "oidc": provider})
+		return messageResponse(core.HTTP409.Copy(), "Account is deleted, restore it to log in")
+	case errors.Is(err, errOIDCAccountNotActivated):
+		audit(request, AuditIdentityLink, AuditFailure, 0, db.AuditMetadata{"reason": "not_activated", "oidc": provider})
+		return messageResponse(core.HTTP409.Copy(), "Account with this email is not activated, activate it to log in with the provider")
+	case errors.Is(err, db.ErrDuplicateIdentity):
+		return messageResponse(core.HTTP409.Copy(), "Provider account is being linked, try again")
+	case err != nil:
+		log.Println("Error resolving OpenID Connect user:", err)
+		return *core.HTTP500.Copy()
+	}
+	if created {
+		audit(request, AuditRegister, AuditSuccess, user.ID, db.AuditMetadata{"oidc": provider})
+	}
+	if linked {
+		audit(request, AuditIdentityLink, AuditSuccess, user.ID, db.AuditMetadata{"oidc": provider})
+	}
+
+	if user.BannedAt != nil {
+		audit(request, AuditLogin, AuditFailure, user.ID, db.AuditMetadata{"reason": "banned", "oidc": provider})
+		return messageResponse(core.HTTP403.Copy(), "User is banned")
+	}
+	if !user.IsActive {
+		audit(request, AuditLogin, AuditFailure, user.ID, db.AuditMetadata{"reason": "not_activated", "oidc": provider})
+		return messageResponse(core.HTTP401.Copy(), "User is not activated")
+	}
+	if user.TotpEnabledAt != nil {
+		return mfaChallengeResponse(request, user)
+	}
+	return loginResponse(request, user, device, db.AuditMetadata{"oidc": provider})
+}
@@ -0,0 +1,81 @@
+package user
+
+/*
+	Роли и права: роль - набор прав, хранится в БД (таблицы roles и user_roles, см. миграцию 0007_roles)
+	Роль user есть у всех пользователей, роль admin (право "*") назначается командой user create-admin
+	Права запроса (core.Principal) загружаются при авторизации, роуты объявляют нужные права при регистрации (см. app.registerHandler)
+	Клиентский сертификат, подписанный admin_client_ca (mTLS), дает права роли admin
+*/
+
+import (
+	"RestAPI/core"
+	"RestAPI/db"
+	"context"
+)
+
+const (
+	PermissionImagesGenerate   = "images:generate"
+	PermissionImagesRead       = "images:read"
+	PermissionAuditRead        = "audit:read"
+	PermissionDiagnosticsRead  = "diagnostics:read"
+	PermissionUsersRead        = "users:read"
+	PermissionUsersManage      = "users:manage"
+	PermissionUsersImpersonate = "users:impersonate"
+)
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+/*
+Права пользователя из его ролей. scopes - права API ключа (nil для входа по токену сессии)
+*/
+func LoadPrincipal(ctx context.Context, user *db.User, scopes []string) (*core.Principal, error) {
+	roles, err := repos.Roles.ListByUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	principal := &core.Principal{UserID: user.ID, Username: user.Username, Roles: []string{}, Permissions: []string{}}
+	if scopes != nil {
+		principal.Scopes = append([]string{}, scopes...)
+	}
+	seen := make(map[string]bool)
+	for _, role := range roles {
+		principal.Roles = append(principal.Roles, role.Name)
+		for _, permission := range role.Permissions {
+			if !seen[permission] {
+				seen[permission] = true
+				principal.Permissions = append(principal.Permissions, permission)
+			}
+		}
+	}
+	return principal, nil
+}
+
+/*
+Пользователь запроса. На роутах authRequired() он всегда есть, на остальных - nil для анонимного запроса
+и запроса по клиентскому сертификату администратора
+*/
+func RequestUser(request core.HttpRequest) *db.User {
+	user, _ := request.User.(*db.User)
+	return user
+}
+
+/*
+Права по клиентскому сертификату admin_client_ca: nil, если сертификат не настроен или не предъявлен
+*/
+func CertificatePrincipal(ctx context.Context, request core.HttpRequest) (*core.Principal, error) {
+	if config.Server.AdminClientCA == "" || request.TLS == nil || len(request.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	role, err := repos.Roles.GetByName(ctx, RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	principal := &core.Principal{Roles: []string{role.Name}, Permissions: append([]string{}, role.Permissions...)}
+	if chain := request.TLS.VerifiedChains[0]; len(chain) > 0 {
+		principal.Username = chain[0].Subject.CommonName
+	}
+	return principal, nil
+}
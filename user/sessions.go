@@ -0,0 +1,532 @@
+package user
+
+/*
+	Сессии: каждый вход создает отдельную сессию устройства со своей парой токенов
+	В БД хранятся только SHA-256 хеши токенов, сами токены возвращаются клиенту один раз
+	Сессия - семейство токенов: refresh токен одноразовый, обновление заменяет пару внутри той же сессии,
+	а повторное предъявление уже использованного refresh токена отзывает всю сессию (токен считается украденным)
+	Обновление продлевает сессию на jwt.refresh_expiration, но не дольше jwt.session_lifetime с момента входа
+	Сессии отзываются при выходе (/user/logout, /user/logout_all), смене и сбросе пароля, удалении аккаунта,
+	а также при блокировке и деактивации пользователя администратором
+*/
+
+import (
+	"RestAPI/core"
+	"RestAPI/db"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Не чаще одного раза в sessionTouchInterval обновляется время последнего использования сессии
+*/
+const sessionTouchInterval = time.Minute
+
+const deviceNameMaxLength = 128
+
+var (
+	ErrRefreshTokenReused  = errors.New("Refresh token has already been used")
+	ErrInvalidRefreshToken = errors.New("Invalid refresh token")
+	ErrUserNotActivated    = errors.New("User is not activated")
+)
+
+type TokenPair struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type sessionContextKey struct{}
+
+func ContextWithSession(ctx context.Context, session *db.Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, session)
+}
+
+/*
+Текущая сессия запроса (nil, если запрос не авторизован токеном)
+*/
+func SessionFromContext(ctx context.Context) *db.Session {
+	session, _ := ctx.Value(sessionContextKey{}).(*db.Session)
+	return session
+}
+
+/*
+Имя устройства: из запроса, иначе User-Agent, иначе "unknown"
+*/
+func deviceName(request core.HttpRequest, requested string) string {
+	name := strings.TrimSpace(requested)
+	if name == "" {
+		name = strings.TrimSpace(request.Header("User-Agent"))
+	}
+	if name == "" {
+		name = "unknown"
+	}
+	if len(name) > deviceNameMaxLength {
+		name = name[:deviceNameMaxLength]
+	}
+	return name
+}
+
+func generateTokenPair(user *db.User) (*TokenPair, error) {
+	accessToken, err := GenerateAccessToken(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("generating access token: %w", err)
+	}
+	refreshToken, err := GenerateRefreshToken(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("generating refresh token: %w", err)
+	}
+	return &TokenPair{AccessToken: accessToken, RefreshToken: refreshToken}, nil
+}
+
+/*
+Создание сессии нового входа, возвращает токены для клиента
+*/
+func createSession(request core.HttpRequest, user *db.User, requestedDevice string) (*TokenPair, *db.Session, error) {
+	return startSession(request, user, deviceName(request, requestedDevice), nil)
+}
+
+/*
+Успешный вход: новая сессия, событие входа (metadata дополняется ID сессии) и пара токенов в ответе
+*/
+func loginResponse(request core.HttpRequest, user *db.User, requestedDevice string, metadata db.AuditMetadata) core.HttpResponse {
+	tokens, session, err := createSession(request, user, requestedDevice)
+	if err != nil {
+		log.Println("Error creating session:", err)
+		return *core.HTTP500.Copy()
+	}
+	if metadata == nil {
+		metadata = db.AuditMetadata{}
+	}
+	metadata["session_id"] = strconv.FormatUint(uint64(session.ID), 10)
+	audit(request, AuditLogin, AuditSuccess, user.ID, metadata)
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(tokens)
+	if err != nil {
+		log.Println("Error serializing tokens:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+Создание сессии пользователя user, impersonatorID - администратор, входящий под пользователем (nil - обычный вход)
+*/
+func startSession(request core.HttpRequest, user *db.User, device string, impersonatorID *uint) (*TokenPair, *db.Session, error) {
+	tokens, err := generateTokenPair(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	session := &db.Session{
+		UserID:           user.ID,
+		DeviceName:       device,
+		UserAgent:        request.Header("User-Agent"),
+		IP:               request.RemoteAddr,
+		AccessTokenHash:  HashToken(tokens.AccessToken),
+		RefreshTokenHash: HashToken(tokens.RefreshToken),
+		LastUsedAt:       now,
+		ImpersonatorID:   impersonatorID,
+	}
+	session.CreatedAt = now
+	session.ExpiresAt = sessionExpiry(session, now)
+	if err := repos.Sessions.Create(request.Context(), session); err != nil {
+		return nil, nil, fmt.Errorf("creating session: %w", err)
+	}
+	return tokens, session, nil
+}
+
+/*
+Срок действия сессии после входа или обновления: refresh_expiration от now, но не позже session_lifetime от входа
+(impersonationLifetime для сессии администратора, вошедшего под пользователем)
+*/
+func sessionExpiry(session *db.Session, now time.Time) time.Time {
+	expires := now.Add(config.JWT.RefreshExpiration)
+	lifetime := config.JWT.SessionLifetime
+	if session.ImpersonatorID != nil {
+		lifetime = min(lifetime, impersonationLifetime)
+	}
+	if limit := session.CreatedAt.Add(lifetime); limit.Before(expires) {
+		return limit
+	}
+	return expires
+}
+
+/*
+Обновление пары токенов по refresh токену. Возвращает db.ErrNotFound, если токен неизвестен или сессия неактивна,
+ErrRefreshTokenReused, если токен уже был использован (сессия при этом отзывается), ErrInvalidRefreshToken, если JWT не прошел проверку,
+ErrUserNotActivated и ErrUserBanned, если пользователь деактивирован или заблокирован (как при проверке access токена в Authenticate)
+Сессия возвращается и вместе с ошибкой, если ее удалось определить
+*/
+func RefreshTokens(request core.HttpRequest, refreshToken string) (*TokenPair, *db.Session, error) {
+	ctx := request.Context()
+	usedHash := HashToken(refreshToken)
+	session, err := repos.Sessions.GetByRefreshHash(ctx, usedHash)
+	if errors.Is(err, db.ErrNotFound) {
+		reused, err := revokeReusedSession(ctx, usedHash)
+		return nil, reused, err
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	claims, err := ValidateRefreshToken(refreshToken)
+	if err != nil {
+		return nil, session, fmt.Errorf("%w: %v", ErrInvalidRefreshToken, err)
+	}
+	if userID, _ := claims.UserID(); userID != session.UserID {
+		return nil, session, fmt.Errorf("%w: subject does not match session", ErrInvalidRefreshToken)
+	}
+	now := time.Now()
+	if !sessionExpiry(session, now).After(now) {
+		return nil, session, db.ErrNotFound
+	}
+	user, err := repos.Users.GetByID(ctx, session.UserID)
+	if err != nil {
+		return nil, session, err
+	}
+	if !user.IsActive {
+		return nil, session, ErrUserNotActivated
+	}
+	if user.BannedAt != nil {
+		return nil, session, ErrUserBanned
+	}
+	tokens, err := generateTokenPair(user)
+	if err != nil {
+		return nil, session, err
+	}
+
+	session.AccessTokenHash = HashToken(tokens.AccessToken)
+	session.RefreshTokenHash = HashToken(tokens.RefreshToken)
+	session.LastUsedAt = now
+	session.ExpiresAt = sessionExpiry(session, now)
+	session.IP = request.RemoteAddr
+	session.UserAgent = request.Header("User-Agent")
+	err = repos.Sessions.Rotate(ctx, session, usedHash)
+	if errors.Is(err, db.ErrNotFound) {
+		/*
+			Параллельный запрос успел обновить сессию этим же токеном
+		*/
+		reused, err := revokeReusedSession(ctx, usedHash)
+		return nil, reused, err
+	}
+	if err != nil {
+		return nil, session, fmt.Errorf("rotating session: %w", err)
+	}
+	return tokens, session, nil
+}
+
+/*
+Если refresh токен с хешем hash уже использовался, его сессия отзывается и возвращается вместе с ErrRefreshTokenReused
+*/
+func revokeReusedSession(ctx context.Context, hash string) (*db.Session, error) {
+	session, err := repos.Sessions.GetByUsedRefreshHash(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	err = repos.Sessions.Revoke(ctx, session.UserID, session.ID)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return session, fmt.Errorf("revoking session: %w", err)
+	}
+	return session, ErrRefreshTokenReused
+}
+
+/*
+Проверка access токена: сначала JWT (без обращения к БД), затем активный пользователь из sub
+и активная сессия этого пользователя с таким хешем токена (отозванный токен не принимается)
+*/
+func Authenticate(ctx context.Context, token string) (*db.User, *db.Session, error) {
+	claims, err := ValidateAccessToken(token)
+	if err != nil {
+		return nil, nil, fmt.Errorf("validating token: %w", err)
+	}
+	userID, err := claims.UserID()
+	if err != nil {
+		return nil, nil, fmt.Errorf("validating token: %w", err)
+	}
+	user, err := repos.Users.GetByID(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !user.IsActive {
+		return nil, nil, ErrUserNotActivated
+	}
+	if user.BannedAt != nil {
+		return nil, nil, ErrUserBanned
+	}
+	session, err := repos.Sessions.GetByAccessHash(ctx, HashToken(token))
+	if err != nil {
+		return nil, nil, err
+	}
+	if session.UserID != user.ID {
+		return nil, nil, errors.New("Token subject does not match session")
+	}
+
+	now := time.Now()
+	if now.Sub(session.LastUsedAt) > sessionTouchInterval {
+		if err := repos.Sessions.Touch(ctx, session.ID); err != nil {
+			log.Println("Error updating session last use:", err)
+		}
+		session.LastUsedAt = now
+	}
+	return user, session, nil
+}
+
+type sessionView struct {
+	db.Session
+	Current bool `json:"current"`
+}
+
+/*
+Роут /user/sessions: GET - список активных сессий, DELETE - выход на всех устройствах, кроме текущего
+*/
+func SessionsHandler(request core.HttpRequest) core.HttpResponse {
+	switch request.Method {
+	case "GET":
+		return ListSessionsHandler(request)
+	case "DELETE":
+		return RevokeOtherSessionsHandler(request)
+	}
+	return *core.HTTP405.Copy()
+}
+
+/*
+docs(
+
+	name: ListSessionsHandler;
+	tag: user;
+	path: /user/sessions;
+	method: GET;
+	summary: Active sessions;
+	description: Active sessions (devices) of the current user, the session of this request is marked as current;
+	resp_content_type: application/json;
+	responsebody: [{
+		"id": int,
+		"created_at": "time",
+		"device_name": "string",
+		"user_agent": "string",
+		"ip": "string",
+		"last_used_at": "time",
+		"expires_at": "time",
+		"current": bool
+	}];
+
+)docs
+*/
+func ListSessionsHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "GET" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	sessions, err := repos.Sessions.ListByUser(request.Context(), reqUser.ID)
+	if err != nil {
+		log.Println("Error getting sessions:", err)
+		return *core.HTTP500.Copy()
+	}
+	current := SessionFromContext(request.Context())
+	views := make([]sessionView, 0, len(sessions))
+	for _, session := range sessions {
+		views = append(views, sessionView{Session: session, Current: current != nil && current.ID == session.ID})
+	}
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(views)
+	if err != nil {
+		log.Println("Error serializing sessions:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+docs(
+
+	name: RevokeOtherSessionsHandler;
+	tag: user;
+	path: /user/sessions;
+	method: DELETE;
+	summary: Revoke other sessions;
+	description: Log out on all devices except the current one;
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string",
+		"revoked": int
+	};
+
+)docs
+*/
+func RevokeOtherSessionsHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "DELETE" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	var exceptID uint
+	if current := SessionFromContext(request.Context()); current != nil {
+		exceptID = current.ID
+	}
+	revoked, err := repos.Sessions.RevokeByUser(request.Context(), reqUser.ID, exceptID)
+	if err != nil {
+		log.Println("Error revoking sessions:", err)
+		return *core.HTTP500.Copy()
+	}
+	audit(request, AuditSessionRevoke, AuditSuccess, reqUser.ID, db.AuditMetadata{"scope": "others", "revoked": strconv.FormatInt(revoked, 10)})
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(map[string]interface{}{
+		"Message": "Sessions revoked",
+		"revoked": revoked,
+	})
+	if err != nil {
+		log.Println("Error serializing response:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+docs(
+
+	name: RevokeSessionHandler;
+	tag: user;
+	path: /user/sessions/{int:ID};
+	method: DELETE;
+	summary: Revoke session;
+	description: Log out on one device. Revoking the current session logs out this client;
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string"
+	};
+
+)docs
+*/
+func RevokeSessionHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "DELETE" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	id, err := strconv.ParseUint(strings.TrimPrefix(request.Url, "/user/sessions/"), 10, 64)
+	if err != nil {
+		log.Println("Error converting id:", err)
+		return *core.HTTP400.Copy()
+	}
+
+	err = repos.Sessions.Revoke(request.Context(), reqUser.ID, uint(id))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			resp := core.HTTP404.Copy()
+			resp.Body = `{"Message": "Session not found"}`
+			return *resp
+		}
+		log.Println("Error revoking session:", err)
+		return *core.HTTP500.Copy()
+	}
+	audit(request, AuditSessionRevoke, AuditSuccess, reqUser.ID, db.AuditMetadata{"session_id": strconv.FormatUint(id, 10)})
+
+	response := core.HTTP200.Copy()
+	response.Body = `{"Message": "Session revoked"}`
+	return *response
+}
+
+/*
+docs(
+
+	name: LogoutHandler;
+	tag: user;
+	path: /user/logout;
+	method: POST;
+	summary: Log out;
+	description: Revoke the session of this request. Its access and refresh tokens stop working immediately;
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string"
+	};
+
+)docs
+*/
+func LogoutHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "POST" {
+		return *core.HTTP405.Copy()
+	}
+	session := SessionFromContext(request.Context())
+	if session == nil {
+		return *core.HTTP401.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	err := repos.Sessions.Revoke(request.Context(), reqUser.ID, session.ID)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		log.Println("Error revoking session:", err)
+		return *core.HTTP500.Copy()
+	}
+	audit(request, AuditLogout, AuditSuccess, reqUser.ID, db.AuditMetadata{"session_id": strconv.FormatUint(uint64(session.ID), 10)})
+
+	response := core.HTTP200.Copy()
+	response.Body = `{"Message": "Logged out"}`
+	return *response
+}
+
+/*
+docs(
+
+	name: LogoutAllHandler;
+	tag: user;
+	path: /user/logout_all;
+	method: POST;
+	summary: Log out everywhere;
+	description: Revoke all sessions of the current user including this one;
+	resp_content_type: application/json;
+	responsebody: {
+		"Message": "string",
+		"revoked": int
+	};
+
+)docs
+*/
+func LogoutAllHandler(request core.HttpRequest) core.HttpResponse {
+	if request.Method != "POST" {
+		return *core.HTTP405.Copy()
+	}
+	reqUser := RequestUser(request)
+
+	revoked, err := repos.Sessions.RevokeByUser(request.Context(), reqUser.ID, 0)
+	if err != nil {
+		log.Println("Error revoking sessions:", err)
+		return *core.HTTP500.Copy()
+	}
+	audit(request, AuditLogout, AuditSuccess, reqUser.ID, db.AuditMetadata{"scope": "all", "revoked": strconv.FormatInt(revoked, 10)})
+
+	response := core.HTTP200.Copy()
+	err = response.Serialize(map[string]interface{}{
+		"Message": "Logged out from all sessions",
+		"revoked": revoked,
+	})
+	if err != nil {
+		log.Println("Error serializing response:", err)
+		return *core.HTTP500.Copy()
+	}
+	return *response
+}
+
+/*
+Тело запроса входа: кроме email и пароля можно передать имя устройства
+*/
+type loginDevice struct {
+	DeviceName string `json:"device_name"`
+}
+
+func parseDeviceName(body string) string {
+	device := new(loginDevice)
+	if err := json.Unmarshal([]byte(body), device); err != nil {
+		return ""
+	}
+	return device.DeviceName
+}
@@ -0,0 +1,87 @@
+package user
+
+import (
+	"RestAPI/core"
+	"RestAPI/db"
+	"fmt"
+	"log"
+	"path/filepath"
+	"text/template"
+	"time"
+)
+
+/*
+Настройки и репозитории пакета user, устанавливаются функцией Init() при запуске сервера
+*/
+var (
+	config                = core.DefaultConfig()
+	repos                 *db.Repositories
+	activateEmailTemplate *template.Template
+	resetPasswordTemplate *template.Template
+	// Ключи подписи токенов, nil при jwt.algorithm HS256
+	keyring *Keyring
+)
+
+const (
+	ActivateEmailTemplateFile = "Activate.html"
+	ResetPasswordTemplateFile = "ResetPass.html"
+)
+
+func Init(cfg *core.Config, repositories *db.Repositories) error {
+	activate, reset, err := ParseMailTemplates(cfg.Mail.TemplatesPath)
+	if err != nil {
+		return err
+	}
+	Configure(cfg, repositories)
+	if err := InitKeyring(cfg.JWT); err != nil {
+		return err
+	}
+	activateEmailTemplate = activate
+	resetPasswordTemplate = reset
+	return nil
+}
+
+/*
+Настройки и репозитории без шаблонов писем, для команд, которые не отправляют письма
+*/
+func Configure(cfg *core.Config, repositories *db.Repositories) {
+	config = cfg
+	repos = repositories
+}
+
+/*
+Загрузка ключей подписи для RS256/EdDSA, устаревший активный ключ сразу заменяется
+*/
+func InitKeyring(cfg core.JWTConfig) error {
+	if cfg.Algorithm == AlgorithmHS256 {
+		keyring = nil
+		return nil
+	}
+	loaded, err := LoadKeyring(cfg.KeysDir, cfg.Algorithm)
+	if err != nil {
+		return fmt.Errorf("loading signing keys: %w", err)
+	}
+	keyring = loaded
+	if cfg.AccessSecretKey != "" || cfg.RefreshSecretKey != "" {
+		log.Println("JWT secrets are set: HS256 tokens issued before switching to", cfg.Algorithm, "are still accepted, remove the secrets after jwt.refresh_expiration")
+	}
+	if _, err := keyring.Rotate(time.Now(), cfg.KeyRotationInterval, KeyRetention()); err != nil {
+		return fmt.Errorf("rotating signing keys: %w", err)
+	}
+	return nil
+}
+
+/*
+Разбор шаблонов писем из каталога path, ошибка любого из шаблонов возвращается
+*/
+func ParseMailTemplates(path string) (*template.Template, *template.Template, error) {
+	activate, err := template.ParseFiles(filepath.Join(path, ActivateEmailTemplateFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing mail template %s: %w", ActivateEmailTemplateFile, err)
+	}
+	reset, err := template.ParseFiles(filepath.Join(path, ResetPasswordTemplateFile))
+	if err != nil {
+		return nil, nil, fmt.Errorf("parsing mail template %s: %w", ResetPasswordTemplateFile, err)
+	}
+	return activate, reset, nil
+}
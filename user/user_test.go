@@ -3,34 +3,69 @@ package user
 import (
 	"RestAPI/core"
 	"RestAPI/db"
+	"RestAPI/media"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"gopkg.in/gomail.v2"
 )
 
 /*
 Test jwtOuth.go
 */
 func initSecrets() {
-	core.JWT_ACCESS_SECRET_KEY = "testAccessSecretKey"
-	core.JWT_REFRESH_SECRET_KEY = "testRefreshSecretKey"
-	core.JWT_ACCESS_EXPIRATION_TIME = time.Minute * 5
-	core.JWT_REFRESH_EXPIRATION_TIME = time.Minute * 10
+	config.JWT.AccessSecretKey = "testAccessSecretKey"
+	config.JWT.RefreshSecretKey = "testRefreshSecretKey"
+	config.JWT.AccessExpiration = time.Minute * 5
+	config.JWT.RefreshExpiration = time.Minute * 10
 }
 
 func TestJWTFunctions(t *testing.T) {
+	initSecrets()
+	sign := func(claims jwt.Claims, secret string) string {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		return token
+	}
+	validClaims := func() *Claims {
+		now := time.Now()
+		return &Claims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   "1",
+				ID:        "jti",
+				Issuer:    config.JWT.Issuer,
+				Audience:  jwt.ClaimStrings{config.JWT.Audience},
+				IssuedAt:  jwt.NewNumericDate(now),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+			},
+			TokenType: TokenTypeAccess,
+		}
+	}
+
 	testCases := []struct {
 		name        string
-		username    string
-		email       string
 		expectedErr error
 		testFunc    func() error
 	}{
 		{
 			name:        "Generate Secret Key",
-			email:       "",
-			username:    "",
 			expectedErr: nil,
 			testFunc: func() error {
 				_, err := GenerateSecretKey(32)
@@ -39,96 +74,159 @@ func TestJWTFunctions(t *testing.T) {
 		},
 		{
 			name:        "Generate Access Token",
-			email:       "test@example.com",
-			username:    "testuser",
 			expectedErr: nil,
 			testFunc: func() error {
-				_, err := GenerateAccessToken("testuser", "test@example.com")
+				_, err := GenerateAccessToken(1)
 				return err
 			},
 		},
 		{
 			name:        "Generate Refresh Token",
-			email:       "test@example.com",
-			username:    "testuser",
 			expectedErr: nil,
 			testFunc: func() error {
-				_, err := GenerateRefreshToken("testuser", "test@example.com")
+				_, err := GenerateRefreshToken(1)
 				return err
 			},
 		},
 		{
 			name:        "Validate Access Token",
-			username:    "testuser",
-			email:       "test@example.com",
 			expectedErr: nil,
 			testFunc: func() error {
-				token, err := GenerateAccessToken("testuser", "test@example.com")
+				token, err := GenerateAccessToken(42)
 				if err != nil {
 					return err
 				}
-				_, err = ValidateToken(token)
-				return err
+				claims, err := ValidateAccessToken(token)
+				if err != nil {
+					return err
+				}
+				if id, _ := claims.UserID(); id != 42 || claims.ID == "" || claims.IssuedAt == nil {
+					return errors.New("missing registered claims")
+				}
+				return nil
 			},
 		},
 		{
 			name:        "Invalid Access Token",
-			username:    "",
-			email:       "",
 			expectedErr: errors.New("error expected"),
 			testFunc: func() error {
-				_, err := ValidateToken("invalidToken")
+				_, err := ValidateAccessToken("invalidToken")
 				return err
 			},
 		},
 		{
-			name:        "Refresh Tokens",
-			username:    "testuser",
-			email:       "test@example.com",
+			name:        "Validate Refresh Token",
 			expectedErr: nil,
 			testFunc: func() error {
-				refreshToken, err := GenerateRefreshToken("testuser", "test@example.com")
+				refreshToken, err := GenerateRefreshToken(1)
 				if err != nil {
 					return err
 				}
-				_, _, err = RefreshTokens(refreshToken)
+				_, err = ValidateRefreshToken(refreshToken)
+				return err
+			},
+		},
+		{
+			name:        "Refresh Token Used As Access Token",
+			expectedErr: errors.New("error expected"),
+			testFunc: func() error {
+				refreshToken, _ := GenerateRefreshToken(1)
+				_, err := ValidateAccessToken(refreshToken)
+				return err
+			},
+		},
+		{
+			name:        "Access Token Used As Refresh Token",
+			expectedErr: errors.New("error expected"),
+			testFunc: func() error {
+				accessToken, _ := GenerateAccessToken(1)
+				_, err := ValidateRefreshToken(accessToken)
 				return err
 			},
 		},
 		{
 			name:        "Expired Access Token",
-			username:    "testuser",
-			email:       "test@example.com",
 			expectedErr: errors.New("error expected"),
 			testFunc: func() error {
-				core.JWT_ACCESS_EXPIRATION_TIME = time.Millisecond * 100
-				token, err := GenerateAccessToken("testuser", "test@example.com")
-				if err != nil {
-					return err
-				}
-				time.Sleep(time.Millisecond * 200)
-				_, err = ValidateToken(token)
-				core.JWT_ACCESS_EXPIRATION_TIME = time.Minute * 5
+				claims := validClaims()
+				claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-config.JWT.Leeway - time.Second))
+				_, err := ValidateAccessToken(sign(claims, config.JWT.AccessSecretKey))
+				return err
+			},
+		},
+		{
+			name:        "Expired Within Leeway",
+			expectedErr: nil,
+			testFunc: func() error {
+				claims := validClaims()
+				claims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Second))
+				_, err := ValidateAccessToken(sign(claims, config.JWT.AccessSecretKey))
 				return err
 			},
 		},
 		{
-			name:        "Generate Access Token with Empty Username",
-			username:    "",
-			email:       "test@example.com",
-			expectedErr: errors.New("username is empty"),
+			name:        "Wrong Issuer",
+			expectedErr: errors.New("error expected"),
+			testFunc: func() error {
+				claims := validClaims()
+				claims.Issuer = "other"
+				_, err := ValidateAccessToken(sign(claims, config.JWT.AccessSecretKey))
+				return err
+			},
+		},
+		{
+			name:        "Wrong Audience",
+			expectedErr: errors.New("error expected"),
+			testFunc: func() error {
+				claims := validClaims()
+				claims.Audience = jwt.ClaimStrings{"other"}
+				_, err := ValidateAccessToken(sign(claims, config.JWT.AccessSecretKey))
+				return err
+			},
+		},
+		{
+			name:        "Missing Subject",
+			expectedErr: errors.New("error expected"),
+			testFunc: func() error {
+				claims := validClaims()
+				claims.Subject = ""
+				_, err := ValidateAccessToken(sign(claims, config.JWT.AccessSecretKey))
+				return err
+			},
+		},
+		{
+			name:        "Missing Expiration",
+			expectedErr: errors.New("error expected"),
+			testFunc: func() error {
+				claims := validClaims()
+				claims.ExpiresAt = nil
+				_, err := ValidateAccessToken(sign(claims, config.JWT.AccessSecretKey))
+				return err
+			},
+		},
+		{
+			name:        "Issued In The Future",
+			expectedErr: errors.New("error expected"),
+			testFunc: func() error {
+				claims := validClaims()
+				claims.IssuedAt = jwt.NewNumericDate(time.Now().Add(config.JWT.Leeway + time.Minute))
+				_, err := ValidateAccessToken(sign(claims, config.JWT.AccessSecretKey))
+				return err
+			},
+		},
+		{
+			name:        "Signed With Refresh Key",
+			expectedErr: errors.New("error expected"),
 			testFunc: func() error {
-				_, err := GenerateAccessToken("", "test@example.com")
+				_, err := ValidateAccessToken(sign(validClaims(), config.JWT.RefreshSecretKey))
 				return err
 			},
 		},
 		{
-			name:        "Generate Refresh Token with Empty Email",
-			username:    "testuser",
-			email:       "",
-			expectedErr: errors.New("email is empty"),
+			name:        "Generate Token Without User ID",
+			expectedErr: errors.New("user ID is empty"),
 			testFunc: func() error {
-				_, err := GenerateRefreshToken("testuser", "")
+				_, err := GenerateAccessToken(0)
 				return err
 			},
 		},
@@ -177,9 +275,12 @@ func TestSendActivationEmail(t *testing.T) {
 		},
 	}
 
-	err := core.InitEnv("../.env")
+	cfg, err := core.LoadConfig([]string{"-env-file", "../.env"})
 	if err != nil {
-		t.Errorf("Error env load %v", err)
+		t.Fatalf("Error loading config %v", err)
+	}
+	if err = Init(cfg, db.NewMemoryRepositories()); err != nil {
+		t.Fatalf("Error initializing user package %v", err)
 	}
 
 	for _, tc := range testCases {
@@ -387,3 +488,1691 @@ func TestFilterFields(t *testing.T) {
 		})
 	}
 }
+
+/*
+Test roles.go
+*/
+func TestPrincipal(t *testing.T) {
+	repositories, _ := setupHandlers(t)
+	ctx := context.Background()
+
+	member := &db.User{Username: "member", Email: "member@example.com", IsActive: true}
+	admin := &db.User{Username: "admin", Email: "admin@example.com", IsActive: true}
+	for _, u := range []*db.User{member, admin} {
+		if err := repositories.Users.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	adminRole, err := repositories.Roles.GetByName(ctx, RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repositories.Roles.Assign(ctx, admin.ID, adminRole.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	memberPrincipal, _ := LoadPrincipal(ctx, member, nil)
+	adminPrincipal, _ := LoadPrincipal(ctx, admin, nil)
+	keyPrincipal, _ := LoadPrincipal(ctx, admin, []string{PermissionImagesRead})
+	verifiedTLS := &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{}}}
+
+	testCases := []struct {
+		name        string
+		request     core.HttpRequest
+		clientCA    string
+		permission  string
+		expectedRes bool
+	}{
+		{"Anonymous", core.HttpRequest{}, "", PermissionImagesRead, false},
+		{"Default role", core.HttpRequest{Principal: memberPrincipal}, "", PermissionImagesGenerate, true},
+		{"Regular user admin permission", core.HttpRequest{Principal: memberPrincipal}, "", PermissionAuditRead, false},
+		{"Admin wildcard", core.HttpRequest{Principal: adminPrincipal}, "", PermissionAuditRead, true},
+		{"API key scope", core.HttpRequest{Principal: keyPrincipal}, "", PermissionImagesRead, true},
+		{"API key outside scope", core.HttpRequest{Principal: keyPrincipal}, "", PermissionAuditRead, false},
+		{"Client certificate without CA", core.HttpRequest{TLS: verifiedTLS}, "", PermissionDiagnosticsRead, false},
+		{"Verified client certificate", core.HttpRequest{TLS: verifiedTLS}, "admin-ca.pem", PermissionDiagnosticsRead, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config.Server.AdminClientCA = tc.clientCA
+			defer func() { config.Server.AdminClientCA = "" }()
+			if tc.request.TLS != nil {
+				principal, err := CertificatePrincipal(ctx, tc.request)
+				if err != nil {
+					t.Fatal(err)
+				}
+				tc.request.Principal = principal
+			}
+			if res := tc.request.Can(tc.permission); res != tc.expectedRes {
+				t.Errorf("Expected %v, got %v", tc.expectedRes, res)
+			}
+		})
+	}
+
+	if !reflect.DeepEqual(memberPrincipal.Roles, []string{RoleUser}) || !reflect.DeepEqual(adminPrincipal.Roles, []string{RoleAdmin, RoleUser}) {
+		t.Errorf("Unexpected roles %v and %v", memberPrincipal.Roles, adminPrincipal.Roles)
+	}
+	if !keyPrincipal.IsAPIKey() || memberPrincipal.IsAPIKey() {
+		t.Error("API key principal is not marked")
+	}
+}
+
+/*
+Test handlers.go
+Обработчики работают с репозиториями в памяти, письма и проверка домена подменяются
+*/
+func setupHandlers(t *testing.T) (*db.Repositories, *[]*gomail.Message) {
+	t.Helper()
+	initSecrets()
+	activate, reset, err := ParseMailTemplates("templates/mail")
+	if err != nil {
+		t.Fatalf("Error parsing mail templates: %v", err)
+	}
+	activateEmailTemplate, resetPasswordTemplate = activate, reset
+
+	sent := []*gomail.Message{}
+	prevDeliver, prevCheckDomain, prevRepos := deliverMail, checkDomain, repos
+	deliverMail = func(m *gomail.Message) error {
+		sent = append(sent, m)
+		return nil
+	}
+	checkDomain = func(email string) bool { return true }
+	repos = db.NewMemoryRepositories()
+	t.Cleanup(func() {
+		deliverMail, checkDomain, repos = prevDeliver, prevCheckDomain, prevRepos
+	})
+	return repos, &sent
+}
+
+/*
+Активный пользователь с паролем testPassword
+*/
+const testPassword = "Str0ng!Pass"
+
+func createTestUser(t *testing.T, repositories *db.Repositories, username string, email string) *db.User {
+	t.Helper()
+	hash, err := HashPassword(testPassword)
+	if err != nil {
+		t.Fatalf("Error hashing password: %v", err)
+	}
+	user := &db.User{Username: username, Email: email, Password: hash, IsActive: true}
+	if err := repositories.Users.Create(context.Background(), user); err != nil {
+		t.Fatalf("Error creating user %s: %v", username, err)
+	}
+	return user
+}
+
+func loginAs(t *testing.T, email string, password string) TokenPair {
+	t.Helper()
+	response := AuthUserHandler(core.HttpRequest{
+		Method:  "POST",
+		Headers: map[string]string{"User-Agent": "test-agent"},
+		Body:    `{"email": "` + email + `", "password": "` + password + `"}`,
+	})
+	var tokens TokenPair
+	if response.Status != 200 || json.Unmarshal([]byte(response.Body), &tokens) != nil || tokens.AccessToken == "" {
+		t.Fatalf("Login as %s failed: %d %s", email, response.Status, response.Body)
+	}
+	return tokens
+}
+
+func TestUserHandlers(t *testing.T) {
+	repositories, sent := setupHandlers(t)
+	ctx := context.Background()
+	const email = "handler@example.com"
+	const password = "Str0ng!Pass"
+
+	var tokens TokenPair
+	steps := []struct {
+		name           string
+		handler        func(core.HttpRequest) core.HttpResponse
+		request        func() core.HttpRequest
+		expectedStatus int
+		check          func(t *testing.T, response core.HttpResponse)
+	}{
+		{
+			name:    "Create user",
+			handler: CreateUserHandler,
+			request: func() core.HttpRequest {
+				return core.HttpRequest{Method: "POST", Body: `{"username": "handler", "email": "` + email + `", "password": "` + password + `"}`}
+			},
+			expectedStatus: 201,
+			check: func(t *testing.T, response core.HttpResponse) {
+				if strings.Contains(response.Body, password) {
+					t.Error("Password returned in response")
+				}
+			},
+		},
+		{
+			name:    "Create duplicate user",
+			handler: CreateUserHandler,
+			request: func() core.HttpRequest {
+				return core.HttpRequest{Method: "POST", Body: `{"username": "handler2", "email": "` + email + `", "password": "` + password + `"}`}
+			},
+			expectedStatus: 409,
+		},
+		{
+			name:    "Create user with weak password",
+			handler: CreateUserHandler,
+			request: func() core.HttpRequest {
+				return core.HttpRequest{Method: "POST", Body: `{"username": "weakuser", "email": "weak@example.com", "password": "weak"}`}
+			},
+			expectedStatus: 400,
+		},
+		{
+			name:    "Auth before activation",
+			handler: AuthUserHandler,
+			request: func() core.HttpRequest {
+				return core.HttpRequest{Method: "POST", Body: `{"email": "` + email + `", "password": "` + password + `"}`}
+			},
+			expectedStatus: 401,
+		},
+		{
+			name:    "Send activation code",
+			handler: SendOtpHandler,
+			request: func() core.HttpRequest {
+				return core.HttpRequest{Method: "POST", Body: `{"email": "` + email + `"}`}
+			},
+			expectedStatus: 200,
+			check: func(t *testing.T, response core.HttpResponse) {
+				if len(*sent) != 1 || (*sent)[0].GetHeader("To")[0] != email {
+					t.Errorf("Expected one activation email to %s", email)
+				}
+			},
+		},
+		{
+			name:    "Activate with wrong code",
+			handler: ActivateAccountHandler,
+			request: func() core.HttpRequest {
+				return core.HttpRequest{Method: "POST", Body: `{"email": "` + email + `", "otp": 1}`}
+			},
+			expectedStatus: 409,
+		},
+		{
+			name:    "Activate account",
+			handler: ActivateAccountHandler,
+			request: func() core.HttpRequest {
+				user, _ := repositories.Users.GetByEmail(ctx, email)
+				return core.HttpRequest{Method: "POST", Body: fmt.Sprintf(`{"email": "%s", "otp": %d}`, email, user.Otp)}
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:    "Auth with wrong password",
+			handler: AuthUserHandler,
+			request: func() core.HttpRequest {
+				return core.HttpRequest{Method: "POST", Body: `{"email": "` + email + `", "password": "Wr0ng!Pass"}`}
+			},
+			expectedStatus: 401,
+		},
+		{
+			name:    "Auth",
+			handler: AuthUserHandler,
+			request: func() core.HttpRequest {
+				return core.HttpRequest{Method: "POST", Body: `{"email": "` + email + `", "password": "` + password + `"}`}
+			},
+			expectedStatus: 200,
+			check: func(t *testing.T, response core.HttpResponse) {
+				if err := json.Unmarshal([]byte(response.Body), &tokens); err != nil || tokens.RefreshToken == "" {
+					t.Errorf("Expected tokens in response, got %s", response.Body)
+				}
+			},
+		},
+		{
+			name:    "Refresh tokens",
+			handler: RefreshTokenHandler,
+			request: func() core.HttpRequest {
+				return core.HttpRequest{Method: "POST", Body: `{"refresh_token": "` + tokens.RefreshToken + `"}`}
+			},
+			expectedStatus: 200,
+		},
+		{
+			name:    "Refresh with unknown token",
+			handler: RefreshTokenHandler,
+			request: func() core.HttpRequest {
+				return core.HttpRequest{Method: "POST", Body: `{"refresh_token": "unknown"}`}
+			},
+			expectedStatus: 404,
+		},
+		{
+			name:    "Get user",
+			handler: GetUserHandler,
+			request: func() core.HttpRequest {
+				user, _ := repositories.Users.GetByEmail(ctx, email)
+				return core.HttpRequest{Method: "GET", Url: fmt.Sprintf("/user/get/%d", user.ID)}
+			},
+			expectedStatus: 200,
+			check: func(t *testing.T, response core.HttpResponse) {
+				if strings.Contains(response.Body, email) {
+					t.Error("Email returned for public profile")
+				}
+			},
+		},
+		{
+			name:    "Get missing user",
+			handler: GetUserHandler,
+			request: func() core.HttpRequest {
+				return core.HttpRequest{Method: "GET", Url: "/user/get/999"}
+			},
+			expectedStatus: 404,
+		},
+	}
+
+	for _, step := range steps {
+		t.Run(step.name, func(t *testing.T) {
+			response := step.handler(step.request())
+			if response.Status != step.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", step.expectedStatus, response.Status, response.Body)
+			}
+			if step.check != nil {
+				step.check(t, response)
+			}
+		})
+	}
+}
+
+/*
+Аватары сохраняются во временный каталог внутри рабочего каталога, возвращается полный путь к нему
+*/
+func setupAvatarsDir(t *testing.T) string {
+	t.Helper()
+	currentDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	const testAvatarsDir = "/.test_avatars"
+	media.Init(core.MediaConfig{AvatarsDir: testAvatarsDir})
+	t.Cleanup(func() {
+		media.Init(core.DefaultConfig().Media)
+		os.RemoveAll(currentDir + testAvatarsDir)
+	})
+	return currentDir + testAvatarsDir
+}
+
+/*
+Новый аватар не должен оставаться на диске, если сохранить пользователя не удалось,
+а старый удаляется только после успешного сохранения
+*/
+func TestUpdateUserAvatar(t *testing.T) {
+	repositories, _ := setupHandlers(t)
+	ctx := context.Background()
+	avatarsDir := setupAvatarsDir(t)
+
+	owner := &db.User{Username: "owner", Email: "owner@example.com", IsActive: true}
+	other := &db.User{Username: "other", Email: "other@example.com", IsActive: true}
+	for _, u := range []*db.User{owner, other} {
+		if err := repositories.Users.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldAvatar, err := media.SaveFile([]byte("old"), owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner.Avatar = "/images/" + oldAvatar
+	if err := repositories.Users.Save(ctx, owner); err != nil {
+		t.Fatal(err)
+	}
+
+	avatarFiles := func() []string {
+		entries, _ := os.ReadDir(avatarsDir)
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+	updateRequest := func(fields map[string]string) core.HttpRequest {
+		u, _ := repositories.Users.GetByID(ctx, owner.ID)
+		return core.HttpRequest{
+			Method: "PATCH",
+			User:   u,
+			FormData: &core.FormData{
+				Fields: fields,
+				Files: map[string][]struct {
+					FileName string
+					FileData []byte
+				}{"avatar": {{FileName: "avatar.jpg", FileData: []byte("new")}}},
+			},
+		}
+	}
+
+	response := UpdateUserHandler(updateRequest(map[string]string{"email": other.Email}))
+	if response.Status != 409 {
+		t.Fatalf("Expected status 409, got %d: %s", response.Status, response.Body)
+	}
+	if files := avatarFiles(); !reflect.DeepEqual(files, []string{oldAvatar}) {
+		t.Errorf("Expected only old avatar after failed update, got %v", files)
+	}
+	if stored, _ := repositories.Users.GetByID(ctx, owner.ID); stored.Avatar != "/images/"+oldAvatar {
+		t.Errorf("Expected avatar to stay %s, got %s", oldAvatar, stored.Avatar)
+	}
+
+	response = UpdateUserHandler(updateRequest(map[string]string{}))
+	if response.Status != 200 {
+		t.Fatalf("Expected status 200, got %d: %s", response.Status, response.Body)
+	}
+	stored, _ := repositories.Users.GetByID(ctx, owner.ID)
+	if files := avatarFiles(); len(files) != 1 || "/images/"+files[0] != stored.Avatar || files[0] == oldAvatar {
+		t.Errorf("Expected only new avatar %s after update, got %v", stored.Avatar, files)
+	}
+}
+
+func TestUpdateUserEmail(t *testing.T) {
+	repositories, sent := setupHandlers(t)
+	ctx := context.Background()
+
+	user := &db.User{Username: "owner", Email: "owner@example.com", IsActive: true}
+	other := &db.User{Username: "other", Email: "other@example.com", IsActive: true}
+	for _, u := range []*db.User{user, other} {
+		if err := repositories.Users.Create(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := func() *db.User {
+		u, _ := repositories.Users.GetByID(ctx, user.ID)
+		return u
+	}
+	update := func(email string) core.HttpResponse {
+		return UpdateUserHandler(core.HttpRequest{Method: "PATCH", User: current(), FormData: &core.FormData{Fields: map[string]string{"email": email}}})
+	}
+	confirm := func(otp int) core.HttpResponse {
+		return ConfirmEmailHandler(core.HttpRequest{Method: "POST", User: current(), Body: fmt.Sprintf(`{"otp": %d}`, otp)})
+	}
+
+	if response := update("owner@example.com"); response.Status != 200 || len(*sent) != 0 {
+		t.Fatalf("Same email: expected 200 without mail, got %d, %d mails", response.Status, len(*sent))
+	}
+	if response := update("other@example.com"); response.Status != 409 {
+		t.Errorf("Taken email: expected 409, got %d", response.Status)
+	}
+	if response := confirm(123456); response.Status != 409 {
+		t.Errorf("Nothing to confirm: expected 409, got %d", response.Status)
+	}
+
+	// Адрес с опечаткой: аккаунт остается активным со старым email, изменение можно повторить
+	for _, email := range []string{"chnaged@example.com", "changed@example.com"} {
+		if response := update(email); response.Status != 200 {
+			t.Fatalf("Expected 200, got %d %s", response.Status, response.Body)
+		}
+		stored := current()
+		if !stored.IsActive || stored.Email != "owner@example.com" || stored.PendingEmail != email {
+			t.Fatalf("Expected active user with pending %s, got %+v", email, stored)
+		}
+		if last := (*sent)[len(*sent)-1]; last.GetHeader("To")[0] != email {
+			t.Errorf("Expected code sent to %s, got %v", email, last.GetHeader("To"))
+		}
+	}
+
+	otp := current().Otp
+	if response := confirm(otp + 1); response.Status != 409 || current().Email != "owner@example.com" {
+		t.Errorf("Wrong code: expected 409 and unchanged email, got %d", response.Status)
+	}
+	if response := confirm(otp); response.Status != 200 {
+		t.Fatalf("Expected 200, got %d %s", response.Status, response.Body)
+	}
+	if stored := current(); stored.Email != "changed@example.com" || stored.PendingEmail != "" || !stored.IsActive || stored.Otp != 0 {
+		t.Errorf("Expected confirmed email, got %+v", stored)
+	}
+}
+
+/*
+Test audit.go
+*/
+func TestOtpLockout(t *testing.T) {
+	repositories, _ := setupHandlers(t)
+	ctx := context.Background()
+	config.Auth.OtpTimeout = time.Minute
+
+	schedule := map[int]time.Duration{0: 0, 4: 0, 5: time.Minute, 6: 0, 7: 5 * time.Minute, 10: 10 * time.Minute, 11: 0, 15: 30 * time.Minute, 20: 30 * time.Minute}
+	for tries, expected := range schedule {
+		if lockout := otpLockout(tries); lockout != expected {
+			t.Errorf("otpLockout(%d): expected %v, got %v", tries, expected, lockout)
+		}
+	}
+
+	expires := time.Now().Add(time.Hour)
+	user := &db.User{Username: "locked", Email: "locked@example.com", Password: "x", Otp: 123456, OtpExpires: &expires, ResetToken: "token", ResetExpires: &expires}
+	if err := repositories.Users.Create(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name    string
+		handler func(core.HttpRequest) core.HttpResponse
+		body    string
+	}{
+		{"Activation code", ActivateAccountHandler, `{"email": "locked@example.com", "otp": 1}`},
+		{"Reset code", ResetPasswordHandler, `{"email": "locked@example.com", "reset_token": "wrong", "password": "Str0ng!Pass"}`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for attempt := 1; attempt <= 6; attempt++ {
+				if response := tc.handler(core.HttpRequest{Method: "POST", Body: tc.body}); response.Status != 409 {
+					t.Fatalf("Attempt %d: expected 409, got %d %s", attempt, response.Status, response.Body)
+				}
+			}
+			if response := tc.handler(core.HttpRequest{Method: "POST", Body: tc.body}); response.Status != 429 {
+				t.Errorf("Expected lockout after 6 wrong codes, got %d %s", response.Status, response.Body)
+			}
+		})
+	}
+}
+
+func TestAuthLockout(t *testing.T) {
+	repositories, _ := setupHandlers(t)
+	config.Auth.AuthTimeout = time.Minute
+
+	schedule := map[int]time.Duration{0: 0, 2: 0, 3: time.Minute, 4: 0, 5: 5 * time.Minute, 8: 10 * time.Minute, 10: 0, 15: 30 * time.Minute}
+	for tries, expected := range schedule {
+		if lockout := authLockout(tries); lockout != expected {
+			t.Errorf("authLockout(%d): expected %v, got %v", tries, expected, lockout)
+		}
+	}
+
+	createTestUser(t, repositories, "locked", "locked@example.com")
+	body := `{"email": "locked@example.com", "password": "Wr0ng!Pass"}`
+	for attempt := 1; attempt <= 4; attempt++ {
+		if response := AuthUserHandler(core.HttpRequest{Method: "POST", Body: body}); response.Status != 401 {
+			t.Fatalf("Attempt %d: expected 401, got %d %s", attempt, response.Status, response.Body)
+		}
+	}
+	if response := AuthUserHandler(core.HttpRequest{Method: "POST", Body: body}); response.Status != 429 {
+		t.Errorf("Expected lockout after 4 wrong passwords, got %d %s", response.Status, response.Body)
+	}
+}
+
+func TestAuditHandlers(t *testing.T) {
+	repositories, _ := setupHandlers(t)
+	ctx := context.Background()
+
+	owner := createTestUser(t, repositories, "owner", "owner@example.com")
+	admin := createTestUser(t, repositories, "admin", "admin@example.com")
+	adminRole, _ := repositories.Roles.GetByName(ctx, RoleAdmin)
+	if err := repositories.Roles.Assign(ctx, admin.ID, adminRole.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(email, password string) {
+		AuthUserHandler(core.HttpRequest{
+			Method:     "POST",
+			Body:       `{"email": "` + email + `", "password": "` + password + `"}`,
+			Headers:    map[string]string{"User-Agent": "audit-test"},
+			RemoteAddr: "192.0.2.10",
+		})
+	}
+	login(owner.Email, "Wr0ng!Pass")
+	login(owner.Email, testPassword)
+	login("missing@example.com", testPassword)
+
+	testCases := []struct {
+		name           string
+		handler        func(core.HttpRequest) core.HttpResponse
+		user           *db.User
+		query          map[string]string
+		expectedStatus int
+		expectedTotal  int64
+	}{
+		{"Own events", GetMyAuditHandler, owner, nil, 200, 2},
+		{"Own events paginated", GetMyAuditHandler, owner, map[string]string{"limit": "1", "page": "2"}, 200, 2},
+		{"Admin query all", AdminAuditHandler, admin, nil, 200, 3},
+		{"Admin query failed logins", AdminAuditHandler, admin, map[string]string{"action": AuditLogin, "result": AuditFailure}, 200, 2},
+		{"Admin query by user and ip", AdminAuditHandler, admin, map[string]string{"user_id": fmt.Sprint(owner.ID), "ip": "192.0.2.10"}, 200, 2},
+		{"Admin query since", AdminAuditHandler, admin, map[string]string{"since": time.Now().Add(time.Hour).Format(time.RFC3339)}, 200, 0},
+		{"Admin query invalid user_id", AdminAuditHandler, admin, map[string]string{"user_id": "abc"}, 400, 0},
+		{"Admin query invalid until", AdminAuditHandler, admin, map[string]string{"until": "yesterday"}, 400, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			request := core.HttpRequest{Method: "GET", Query: tc.query}
+			if tc.user != nil {
+				request.User = tc.user
+				request.Principal, _ = LoadPrincipal(ctx, tc.user, nil)
+			}
+			response := tc.handler(request)
+			if response.Status != tc.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", tc.expectedStatus, response.Status, response.Body)
+			}
+			if response.Status != 200 {
+				return
+			}
+			var page struct {
+				Total int64           `json:"total"`
+				Items []db.AuditEvent `json:"items"`
+			}
+			if err := json.Unmarshal([]byte(response.Body), &page); err != nil {
+				t.Fatal(err)
+			}
+			if page.Total != tc.expectedTotal {
+				t.Errorf("Expected %d events, got %d", tc.expectedTotal, page.Total)
+			}
+			for _, event := range page.Items {
+				if event.IP != "192.0.2.10" || event.UserAgent != "audit-test" {
+					t.Errorf("Expected request IP and user agent in event, got %+v", event)
+				}
+			}
+		})
+	}
+}
+
+/*
+Test account.go
+*/
+func TestAccountDeletion(t *testing.T) {
+	repositories, _ := setupHandlers(t)
+	ctx := context.Background()
+	avatarsDir := setupAvatarsDir(t)
+
+	owner := createTestUser(t, repositories, "owner", "owner@example.com")
+	avatar, err := media.SaveFile([]byte("avatar"), owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner.Avatar = "/images/" + avatar
+	repositories.Users.Save(ctx, owner)
+	repositories.Images.CreateBatch(ctx, []db.Image{{UserID: owner.ID, Url: "https://example.com/1.jpg"}})
+	repositories.Sessions.Create(ctx, &db.Session{UserID: owner.ID, AccessTokenHash: HashToken("access"), RefreshTokenHash: HashToken("refresh"), ExpiresAt: time.Now().Add(time.Hour)})
+
+	currentUser := func() *db.User {
+		u, _ := repositories.Users.GetByID(ctx, owner.ID)
+		return u
+	}
+	steps := []struct {
+		name           string
+		handler        func(core.HttpRequest) core.HttpResponse
+		request        func() core.HttpRequest
+		expectedStatus int
+	}{
+		{"Unsupported method", MeHandler, func() core.HttpRequest {
+			return core.HttpRequest{Method: "POST", User: currentUser()}
+		}, 405},
+		{"Get me", MeHandler, func() core.HttpRequest {
+			return core.HttpRequest{Method: "GET", User: currentUser()}
+		}, 200},
+		{"Delete without password", MeHandler, func() core.HttpRequest {
+			return core.HttpRequest{Method: "DELETE", User: currentUser(), Body: `{}`}
+		}, 400},
+		{"Delete with wrong password", MeHandler, func() core.HttpRequest {
+			return core.HttpRequest{Method: "DELETE", User: currentUser(), Body: `{"password": "Wr0ng!Pass"}`}
+		}, 401},
+		{"Delete", MeHandler, func() core.HttpRequest {
+			return core.HttpRequest{Method: "DELETE", User: currentUser(), Body: `{"password": "` + testPassword + `"}`}
+		}, 200},
+		{"Restore with wrong password", RestoreAccountHandler, func() core.HttpRequest {
+			return core.HttpRequest{Method: "POST", Body: `{"email": "owner@example.com", "password": "Wr0ng!Pass"}`}
+		}, 401},
+		{"Restore unknown account", RestoreAccountHandler, func() core.HttpRequest {
+			return core.HttpRequest{Method: "POST", Body: `{"email": "missing@example.com", "password": "` + testPassword + `"}`}
+		}, 404},
+		{"Restore", RestoreAccountHandler, func() core.HttpRequest {
+			return core.HttpRequest{Method: "POST", Body: `{"email": "owner@example.com", "password": "` + testPassword + `"}`}
+		}, 200},
+		{"Restore active account", RestoreAccountHandler, func() core.HttpRequest {
+			return core.HttpRequest{Method: "POST", Body: `{"email": "owner@example.com", "password": "` + testPassword + `"}`}
+		}, 404},
+		{"Delete again", MeHandler, func() core.HttpRequest {
+			return core.HttpRequest{Method: "DELETE", User: currentUser(), Body: `{"password": "` + testPassword + `"}`}
+		}, 200},
+	}
+	for _, step := range steps {
+		response := step.handler(step.request())
+		if response.Status != step.expectedStatus {
+			t.Fatalf("%s: expected status %d, got %d: %s", step.name, step.expectedStatus, response.Status, response.Body)
+		}
+		if step.name == "Delete" {
+			if currentUser() != nil {
+				t.Error("Deleted user is still returned by GetByID")
+			}
+			if _, err := repositories.Sessions.GetByAccessHash(ctx, HashToken("access")); !errors.Is(err, db.ErrNotFound) {
+				t.Error("Sessions were not revoked on deletion")
+			}
+		}
+	}
+
+	purged, err := PurgeDeletedAccounts(ctx, time.Now())
+	if err != nil || purged != 0 {
+		t.Fatalf("Expected nothing purged within grace period, got %d, %v", purged, err)
+	}
+	if _, err := os.Stat(avatarsDir + "/" + avatar); err != nil {
+		t.Errorf("Avatar removed before grace period expired: %v", err)
+	}
+
+	purged, err = PurgeDeletedAccounts(ctx, time.Now().Add(config.Account.DeletionGracePeriod+time.Hour))
+	if err != nil || purged != 1 {
+		t.Fatalf("Expected 1 account purged, got %d, %v", purged, err)
+	}
+	if _, err := repositories.Users.GetDeletedByEmail(ctx, "owner@example.com"); !errors.Is(err, db.ErrNotFound) {
+		t.Error("Purged user still exists")
+	}
+	if total, _ := repositories.Images.CountByUser(ctx, owner.ID); total != 0 {
+		t.Errorf("Expected images to be purged, %d left", total)
+	}
+	if _, err := os.Stat(avatarsDir + "/" + avatar); !os.IsNotExist(err) {
+		t.Error("Avatar file was not removed on purge")
+	}
+
+	expired := createTestUser(t, repositories, "expired", "expired@example.com")
+	repositories.Users.Delete(ctx, expired.ID)
+	gracePeriod := config.Account.DeletionGracePeriod
+	config.Account.DeletionGracePeriod = time.Nanosecond
+	t.Cleanup(func() { config.Account.DeletionGracePeriod = gracePeriod })
+	response := RestoreAccountHandler(core.HttpRequest{Method: "POST", Body: `{"email": "expired@example.com", "password": "` + testPassword + `"}`})
+	if response.Status != 410 {
+		t.Errorf("Expected status 410 after grace period, got %d: %s", response.Status, response.Body)
+	}
+}
+
+/*
+Test sessions.go
+*/
+func TestSessionHandlers(t *testing.T) {
+	repositories, _ := setupHandlers(t)
+	ctx := context.Background()
+
+	createTestUser(t, repositories, "owner", "owner@example.com")
+	authRequest := func(method string, url string, token string) core.HttpRequest {
+		t.Helper()
+		user, session, err := Authenticate(ctx, token)
+		if err != nil {
+			t.Fatalf("Error authenticating %s %s: %v", method, url, err)
+		}
+		request := core.HttpRequest{Method: method, Url: url, User: user}
+		request.SetContext(ContextWithSession(ctx, session))
+		return request
+	}
+
+	// Имя устройства из запроса, у остальных сессий берётся User-Agent
+	response := AuthUserHandler(core.HttpRequest{
+		Method:  "POST",
+		Headers: map[string]string{"User-Agent": "test-agent"},
+		Body:    `{"email": "owner@example.com", "password": "` + testPassword + `", "device_name": "laptop"}`,
+	})
+	var laptop TokenPair
+	if response.Status != 200 || json.Unmarshal([]byte(response.Body), &laptop) != nil {
+		t.Fatalf("Login failed: %d %s", response.Status, response.Body)
+	}
+	phone := loginAs(t, "owner@example.com", testPassword)
+	tablet := loginAs(t, "owner@example.com", testPassword)
+
+	stored, err := repositories.Sessions.GetByAccessHash(ctx, HashToken(laptop.AccessToken))
+	if err != nil || stored.DeviceName != "laptop" {
+		t.Fatalf("Session is not stored by token hash: %v", err)
+	}
+	if stored.AccessTokenHash == laptop.AccessToken || stored.RefreshTokenHash == laptop.RefreshToken {
+		t.Error("Plain tokens stored in session")
+	}
+
+	response = ListSessionsHandler(authRequest("GET", "/user/sessions", laptop.AccessToken))
+	var sessions []struct {
+		ID         uint   `json:"id"`
+		DeviceName string `json:"device_name"`
+		Current    bool   `json:"current"`
+	}
+	if err := json.Unmarshal([]byte(response.Body), &sessions); err != nil || len(sessions) != 3 {
+		t.Fatalf("Expected 3 sessions, got %s", response.Body)
+	}
+	for _, session := range sessions {
+		if session.Current != (session.ID == stored.ID) {
+			t.Errorf("Session %d: wrong current flag %v", session.ID, session.Current)
+		}
+		if session.ID != stored.ID && session.DeviceName != "test-agent" {
+			t.Errorf("Unexpected device name %q", session.DeviceName)
+		}
+	}
+
+	tabletSession, _ := repositories.Sessions.GetByAccessHash(ctx, HashToken(tablet.AccessToken))
+	testCases := []struct {
+		name           string
+		request        func() core.HttpRequest
+		expectedStatus int
+	}{
+		{"Revoke invalid id", func() core.HttpRequest {
+			return authRequest("DELETE", "/user/sessions/abc", laptop.AccessToken)
+		}, 400},
+		{"Revoke missing session", func() core.HttpRequest {
+			return authRequest("DELETE", "/user/sessions/999", laptop.AccessToken)
+		}, 404},
+		{"Revoke tablet", func() core.HttpRequest {
+			return authRequest("DELETE", fmt.Sprintf("/user/sessions/%d", tabletSession.ID), laptop.AccessToken)
+		}, 200},
+		{"Revoke tablet again", func() core.HttpRequest {
+			return authRequest("DELETE", fmt.Sprintf("/user/sessions/%d", tabletSession.ID), laptop.AccessToken)
+		}, 404},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response := RevokeSessionHandler(tc.request())
+			if response.Status != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, response.Status, response.Body)
+			}
+		})
+	}
+	if _, _, err := Authenticate(ctx, tablet.AccessToken); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Revoked session still authenticates: %v", err)
+	}
+	if response := RefreshTokenHandler(core.HttpRequest{Method: "POST", Body: `{"refresh_token": "` + tablet.RefreshToken + `"}`}); response.Status != 404 {
+		t.Errorf("Revoked session refreshed: %d", response.Status)
+	}
+
+	response = RefreshTokenHandler(core.HttpRequest{Method: "POST", Body: `{"refresh_token": "` + phone.RefreshToken + `"}`})
+	var refreshed TokenPair
+	if response.Status != 200 || json.Unmarshal([]byte(response.Body), &refreshed) != nil {
+		t.Fatalf("Refresh failed: %d %s", response.Status, response.Body)
+	}
+	if _, _, err := Authenticate(ctx, phone.AccessToken); err == nil {
+		t.Error("Old access token still valid after refresh")
+	}
+	phoneRequest := authRequest("GET", "/user/sessions", refreshed.AccessToken)
+	if SessionFromContext(phoneRequest.Context()).DeviceName != "test-agent" {
+		t.Error("Refresh created a new session instead of updating the existing one")
+	}
+
+	response = SessionsHandler(authRequest("DELETE", "/user/sessions", laptop.AccessToken))
+	if response.Status != 200 || !strings.Contains(response.Body, `"revoked":1`) {
+		t.Fatalf("Expected 1 session revoked, got %d %s", response.Status, response.Body)
+	}
+	if _, _, err := Authenticate(ctx, refreshed.AccessToken); err == nil {
+		t.Error("Other session still valid after revoking others")
+	}
+	if _, _, err := Authenticate(ctx, laptop.AccessToken); err != nil {
+		t.Errorf("Current session revoked: %v", err)
+	}
+}
+
+func TestLogoutHandlers(t *testing.T) {
+	repositories, _ := setupHandlers(t)
+	ctx := context.Background()
+	const newPassword = "N3w!Passwd"
+
+	owner := createTestUser(t, repositories, "owner", "owner@example.com")
+	authRequest := func(method string, token string) core.HttpRequest {
+		t.Helper()
+		user, session, err := Authenticate(ctx, token)
+		if err != nil {
+			t.Fatalf("Error authenticating: %v", err)
+		}
+		request := core.HttpRequest{Method: method, User: user}
+		request.SetContext(ContextWithSession(ctx, session))
+		return request
+	}
+	valid := func(tokens TokenPair) bool {
+		_, _, err := Authenticate(ctx, tokens.AccessToken)
+		return err == nil
+	}
+
+	first, second := loginAs(t, owner.Email, testPassword), loginAs(t, owner.Email, testPassword)
+	testCases := []struct {
+		name           string
+		handler        func(core.HttpRequest) core.HttpResponse
+		request        func() core.HttpRequest
+		expectedStatus int
+	}{
+		{"Logout wrong method", LogoutHandler, func() core.HttpRequest { return authRequest("GET", first.AccessToken) }, 405},
+		{"Logout without session", LogoutHandler, func() core.HttpRequest { return core.HttpRequest{Method: "POST", User: owner} }, 401},
+		{"Logout", LogoutHandler, func() core.HttpRequest { return authRequest("POST", first.AccessToken) }, 200},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response := tc.handler(tc.request())
+			if response.Status != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, response.Status, response.Body)
+			}
+		})
+	}
+	if valid(first) || !valid(second) {
+		t.Fatal("Logout must revoke only the current session")
+	}
+	if response := RefreshTokenHandler(core.HttpRequest{Method: "POST", Body: `{"refresh_token": "` + first.RefreshToken + `"}`}); response.Status != 404 {
+		t.Errorf("Refresh token of logged out session accepted: %d", response.Status)
+	}
+
+	third := loginAs(t, owner.Email, testPassword)
+	response := LogoutAllHandler(authRequest("POST", second.AccessToken))
+	if response.Status != 200 || !strings.Contains(response.Body, `"revoked":2`) {
+		t.Fatalf("Logout all: expected 2 sessions revoked, got %d %s", response.Status, response.Body)
+	}
+	if valid(second) || valid(third) {
+		t.Error("Sessions still valid after logout all")
+	}
+
+	current, other := loginAs(t, owner.Email, testPassword), loginAs(t, owner.Email, testPassword)
+	request := authRequest("PATCH", current.AccessToken)
+	request.FormData = &core.FormData{Fields: map[string]string{"old_password": testPassword, "new_password": newPassword}}
+	if response := UpdateUserHandler(request); response.Status != 200 {
+		t.Fatalf("Password change failed: %d %s", response.Status, response.Body)
+	}
+	if valid(current) || valid(other) {
+		t.Error("Sessions still valid after password change")
+	}
+
+	session := loginAs(t, owner.Email, newPassword)
+	user, _ := repositories.Users.GetByID(ctx, owner.ID)
+	user.ResetToken = "123456"
+	repositories.Users.Save(ctx, user)
+	response = ResetPasswordHandler(core.HttpRequest{Method: "POST", Body: `{"email": "owner@example.com", "reset_token": "123456", "password": "` + testPassword + `"}`})
+	if response.Status != 200 {
+		t.Fatalf("Password reset failed: %d %s", response.Status, response.Body)
+	}
+	if valid(session) {
+		t.Error("Session still valid after password reset")
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	repositories, _ := setupHandlers(t)
+	ctx := context.Background()
+
+	owner := createTestUser(t, repositories, "owner", "owner@example.com")
+	refresh := func(token string) (core.HttpResponse, TokenPair) {
+		response := RefreshTokenHandler(core.HttpRequest{Method: "POST", Body: `{"refresh_token": "` + token + `"}`})
+		var tokens TokenPair
+		json.Unmarshal([]byte(response.Body), &tokens)
+		return response, tokens
+	}
+
+	stolen := loginAs(t, owner.Email, testPassword)
+	other := loginAs(t, owner.Email, testPassword)
+	response, rotated := refresh(stolen.RefreshToken)
+	if response.Status != 200 {
+		t.Fatalf("Refresh failed: %d %s", response.Status, response.Body)
+	}
+	response, _ = refresh(stolen.RefreshToken)
+	if response.Status != 401 {
+		t.Fatalf("Reused refresh token: expected 401, got %d %s", response.Status, response.Body)
+	}
+	if _, _, err := Authenticate(ctx, rotated.AccessToken); err == nil {
+		t.Error("Session was not revoked after refresh token reuse")
+	}
+	if response, _ := refresh(rotated.RefreshToken); response.Status != 404 {
+		t.Errorf("Refresh in revoked family: expected 404, got %d", response.Status)
+	}
+	if _, _, err := Authenticate(ctx, other.AccessToken); err != nil {
+		t.Errorf("Reuse revoked an unrelated session: %v", err)
+	}
+	events, _, _ := repositories.Audit.List(ctx, db.AuditFilter{Action: AuditTokenReuse, Limit: -1})
+	if len(events) != 1 || events[0].UserID == nil || *events[0].UserID != owner.ID {
+		t.Errorf("Expected one token_reuse audit event, got %+v", events)
+	}
+
+	if response, _ := refresh("unknown"); response.Status != 404 {
+		t.Errorf("Unknown refresh token: expected 404, got %d", response.Status)
+	}
+
+	prevLifetime := config.JWT.SessionLifetime
+	t.Cleanup(func() { config.JWT.SessionLifetime = prevLifetime })
+	config.JWT.SessionLifetime = time.Minute
+	short := loginAs(t, owner.Email, testPassword)
+	session, _ := repositories.Sessions.GetByAccessHash(ctx, HashToken(short.AccessToken))
+	if session.ExpiresAt.Sub(session.CreatedAt) > time.Minute {
+		t.Errorf("Session expiry %v is not capped by session lifetime", session.ExpiresAt)
+	}
+	session.CreatedAt = time.Now().Add(-time.Hour)
+	session.ExpiresAt = time.Now().Add(time.Hour)
+	repositories.Sessions.Save(ctx, session)
+	if response, _ := refresh(short.RefreshToken); response.Status != 404 {
+		t.Errorf("Refresh after session lifetime: expected 404, got %d", response.Status)
+	}
+	config.JWT.SessionLifetime = prevLifetime
+
+	// Деактивированный и заблокированный пользователь не обновляет токены
+	deactivated, banned := loginAs(t, owner.Email, testPassword), loginAs(t, owner.Email, testPassword)
+	owner.IsActive = false
+	repositories.Users.Save(ctx, owner)
+	if response, _ := refresh(deactivated.RefreshToken); response.Status != 401 {
+		t.Errorf("Refresh by deactivated user: expected 401, got %d %s", response.Status, response.Body)
+	}
+	owner.IsActive = true
+	owner.BannedAt = new(time.Time)
+	repositories.Users.Save(ctx, owner)
+	if response, _ := refresh(banned.RefreshToken); response.Status != 403 {
+		t.Errorf("Refresh by banned user: expected 403, got %d %s", response.Status, response.Body)
+	}
+}
+
+/*
+Test apikeys.go
+*/
+func TestAPIKeyHandlers(t *testing.T) {
+	repositories, _ := setupHandlers(t)
+	ctx := context.Background()
+
+	owner := &db.User{Username: "owner", Email: "owner@example.com", IsActive: true}
+	if err := repositories.Users.Create(ctx, owner); err != nil {
+		t.Fatal(err)
+	}
+	authRequest := func(method string, url string, body string) core.HttpRequest {
+		return core.HttpRequest{Method: method, Url: url, Body: body, User: owner}
+	}
+
+	testCases := []struct {
+		name           string
+		request        core.HttpRequest
+		expectedStatus int
+	}{
+		{"Wrong method", authRequest("PUT", "/user/api_keys", ""), 405},
+		{"Invalid json", authRequest("POST", "/user/api_keys", `{"name": `), 400},
+		{"Missing name", authRequest("POST", "/user/api_keys", `{"scopes": ["images:read"]}`), 400},
+		{"Missing scopes", authRequest("POST", "/user/api_keys", `{"name": "ci"}`), 400},
+		{"Unknown scope", authRequest("POST", "/user/api_keys", `{"name": "ci", "scopes": ["users:admin"]}`), 400},
+		{"Expired", authRequest("POST", "/user/api_keys", `{"name": "ci", "scopes": ["images:read"], "expires_at": "2020-01-01T00:00:00Z"}`), 400},
+		{"Valid", authRequest("POST", "/user/api_keys", `{"name": "ci", "scopes": ["images:read", "images:generate", "images:read"]}`), 201},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response := APIKeysHandler(tc.request)
+			if response.Status != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, response.Status, response.Body)
+			}
+		})
+	}
+
+	response := APIKeysHandler(authRequest("POST", "/user/api_keys", `{"name": "script", "scopes": ["images:generate"]}`))
+	var created struct {
+		ID     uint     `json:"id"`
+		Key    string   `json:"key"`
+		Prefix string   `json:"prefix"`
+		Scopes []string `json:"scopes"`
+	}
+	if response.Status != 201 || json.Unmarshal([]byte(response.Body), &created) != nil {
+		t.Fatalf("Create failed: %d %s", response.Status, response.Body)
+	}
+	if !IsAPIKey(created.Key) || !strings.HasPrefix(created.Key, created.Prefix) || len(created.Scopes) != 1 {
+		t.Errorf("Unexpected created key %+v", created)
+	}
+	stored, err := repositories.APIKeys.GetByHash(ctx, HashToken(created.Key))
+	if err != nil || stored.KeyHash == created.Key {
+		t.Fatalf("Key is not stored by hash: %v", err)
+	}
+
+	response = APIKeysHandler(authRequest("GET", "/user/api_keys", ""))
+	if response.Status != 200 || strings.Contains(response.Body, created.Key) || strings.Count(response.Body, `"prefix"`) != 2 {
+		t.Errorf("Unexpected key list: %d %s", response.Status, response.Body)
+	}
+
+	user, key, err := AuthenticateAPIKey(ctx, created.Key, "10.0.0.1")
+	if err != nil || user.ID != owner.ID || len(key.Scopes) != 1 || key.Scopes[0] != PermissionImagesGenerate {
+		t.Fatalf("AuthenticateAPIKey: unexpected result %v, %v", key, err)
+	}
+	if stored, _ := repositories.APIKeys.GetByHash(ctx, HashToken(created.Key)); stored.LastUsedAt == nil || stored.LastUsedIP != "10.0.0.1" {
+		t.Error("Last use of the key was not tracked")
+	}
+	if _, _, err := AuthenticateAPIKey(ctx, created.Key+"x", ""); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Unknown key authenticated: %v", err)
+	}
+
+	if response := RevokeAPIKeyHandler(authRequest("DELETE", "/user/api_keys/999", "")); response.Status != 404 {
+		t.Errorf("Revoke missing key: expected 404, got %d", response.Status)
+	}
+	other := core.HttpRequest{Method: "DELETE", Url: fmt.Sprintf("/user/api_keys/%d", created.ID), User: &db.User{}}
+	other.User.(*db.User).ID = owner.ID + 1
+	if response := RevokeAPIKeyHandler(other); response.Status != 404 {
+		t.Errorf("Revoke another user's key: expected 404, got %d", response.Status)
+	}
+	if response := RevokeAPIKeyHandler(authRequest("DELETE", fmt.Sprintf("/user/api_keys/%d", created.ID), "")); response.Status != 200 {
+		t.Errorf("Revoke: expected 200, got %d %s", response.Status, response.Body)
+	}
+	if _, _, err := AuthenticateAPIKey(ctx, created.Key, ""); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Revoked key still authenticates: %v", err)
+	}
+	events, _, _ := repositories.Audit.List(ctx, db.AuditFilter{UserID: &owner.ID, Limit: -1})
+	actions := map[string]int{}
+	for _, event := range events {
+		actions[event.Action]++
+	}
+	if actions[AuditAPIKeyCreate] != 2 || actions[AuditAPIKeyRevoke] != 1 {
+		t.Errorf("Unexpected audit events %v", actions)
+	}
+}
+
+/*
+Test adminUsers.go
+*/
+func TestAdminUserHandlers(t *testing.T) {
+	repositories, sent := setupHandlers(t)
+	ctx := context.Background()
+
+	admin := createTestUser(t, repositories, "admin", "admin@example.com")
+	support := createTestUser(t, repositories, "support", "support@example.com")
+	target := createTestUser(t, repositories, "target", "target@example.com")
+	adminRole, _ := repositories.Roles.GetByName(ctx, RoleAdmin)
+	for _, u := range []*db.User{admin, support} {
+		if err := repositories.Roles.Assign(ctx, u.ID, adminRole.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	requestAs := func(u *db.User, method string, url string, body string) core.HttpRequest {
+		request := core.HttpRequest{Method: method, Url: url, Body: body, Query: map[string]string{}}
+		if u != nil {
+			request.User = u
+			request.Principal, _ = LoadPrincipal(ctx, u, nil)
+		}
+		return request
+	}
+	userUrl := func(u *db.User, action string) string {
+		return fmt.Sprintf("/admin/users/%d%s", u.ID, action)
+	}
+	loginAs(t, target.Email, testPassword)
+
+	search := requestAs(admin, "GET", "/admin/users", "")
+	search.Query["q"] = "target%40example"
+	badStatus := requestAs(admin, "GET", "/admin/users", "")
+	badStatus.Query["status"] = "sleeping"
+
+	testCases := []struct {
+		name           string
+		handler        func(core.HttpRequest) core.HttpResponse
+		request        core.HttpRequest
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"List invalid status", AdminListUsersHandler, badStatus, 400, "Unknown status"},
+		{"List all", AdminListUsersHandler, requestAs(admin, "GET", "/admin/users", ""), 200, `"total":3`},
+		{"Search by email", AdminListUsersHandler, search, 200, `"total":1`},
+		{"Get missing user", AdminGetUserHandler, requestAs(admin, "GET", "/admin/users/999", ""), 404, ""},
+		{"Get user", AdminGetUserHandler, requestAs(admin, "GET", userUrl(support, ""), ""), 200, `"roles":["admin","user"]`},
+		{"User images", AdminUserImagesHandler, requestAs(admin, "GET", userUrl(target, "/images"), ""), 200, `"total":0`},
+		{"User sessions", AdminUserSessionsHandler, requestAs(admin, "GET", userUrl(target, "/sessions"), ""), 200, `"device_name"`},
+		{"Action wrong method", AdminActivateUserHandler, requestAs(admin, "GET", userUrl(target, "/activate"), ""), 405, ""},
+		{"Ban yourself", AdminBanUserHandler, requestAs(admin, "POST", userUrl(admin, "/ban"), ""), 409, ""},
+		{"Deactivate yourself", AdminDeactivateUserHandler, requestAs(admin, "POST", userUrl(admin, "/deactivate"), ""), 409, ""},
+		{"Ban reason too long", AdminBanUserHandler, requestAs(admin, "POST", userUrl(target, "/ban"), `{"reason": "`+strings.Repeat("a", 300)+`"}`), 400, ""},
+		{"Unban not banned", AdminUnbanUserHandler, requestAs(admin, "POST", userUrl(target, "/unban"), ""), 409, ""},
+		{"Impersonate yourself", AdminImpersonateHandler, requestAs(admin, "POST", userUrl(admin, "/impersonate"), ""), 409, ""},
+		{"Impersonate admin", AdminImpersonateHandler, requestAs(admin, "POST", userUrl(support, "/impersonate"), ""), 409, ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response := tc.handler(tc.request)
+			if response.Status != tc.expectedStatus || !strings.Contains(response.Body, tc.expectedBody) {
+				t.Errorf("Expected status %d with %q, got %d: %s", tc.expectedStatus, tc.expectedBody, response.Status, response.Body)
+			}
+		})
+	}
+
+	response := AdminBanUserHandler(requestAs(admin, "POST", userUrl(target, "/ban"), `{"reason": "spam"}`))
+	if response.Status != 200 {
+		t.Fatalf("Ban failed: %d %s", response.Status, response.Body)
+	}
+	if sessions, _ := repositories.Sessions.ListByUser(ctx, target.ID); len(sessions) != 0 {
+		t.Errorf("Expected sessions of the banned user to be revoked, got %d", len(sessions))
+	}
+	if response := AuthUserHandler(core.HttpRequest{Method: "POST", Body: `{"email": "target@example.com", "password": "` + testPassword + `"}`}); response.Status != 403 {
+		t.Errorf("Banned user login: expected 403, got %d", response.Status)
+	}
+	banned := requestAs(admin, "GET", "/admin/users", "")
+	banned.Query["status"] = db.UserStatusBanned
+	if response := AdminListUsersHandler(banned); !strings.Contains(response.Body, `"ban_reason":"spam"`) {
+		t.Errorf("Expected banned user in the list, got %s", response.Body)
+	}
+	if response := AdminUnbanUserHandler(requestAs(admin, "POST", userUrl(target, "/unban"), "")); response.Status != 200 {
+		t.Errorf("Unban: expected 200, got %d", response.Status)
+	}
+	loginAs(t, target.Email, testPassword)
+
+	lockedUntil := time.Now().Add(time.Hour)
+	target.AuthTries, target.AuthTimeout = 5, &lockedUntil
+	repositories.Users.Save(ctx, target)
+	if response := AdminClearLockoutHandler(requestAs(admin, "POST", userUrl(target, "/clear_lockout"), "")); response.Status != 200 {
+		t.Errorf("Clear lockout: expected 200, got %d", response.Status)
+	}
+	if stored, _ := repositories.Users.GetByID(ctx, target.ID); stored.AuthTries != 0 || stored.AuthTimeout != nil {
+		t.Errorf("Expected lockout to be cleared, got %d tries until %v", stored.AuthTries, stored.AuthTimeout)
+	}
+
+	mails := len(*sent)
+	if response := AdminResetPasswordHandler(requestAs(admin, "POST", userUrl(target, "/reset_password"), "")); response.Status != 200 {
+		t.Errorf("Reset password: expected 200, got %d %s", response.Status, response.Body)
+	}
+	if stored, _ := repositories.Users.GetByID(ctx, target.ID); stored.ResetToken == "" || CheckPassword(stored.Password, testPassword) {
+		t.Error("Expected password to be replaced and reset code to be issued")
+	}
+	if len(*sent) != mails+1 {
+		t.Error("Expected reset code to be sent to the user")
+	}
+
+	response = AdminImpersonateHandler(requestAs(admin, "POST", userUrl(target, "/impersonate"), ""))
+	var impersonation impersonationResponse
+	if response.Status != 200 || json.Unmarshal([]byte(response.Body), &impersonation) != nil {
+		t.Fatalf("Impersonate failed: %d %s", response.Status, response.Body)
+	}
+	if impersonation.ExpiresAt.After(time.Now().Add(impersonationLifetime)) {
+		t.Errorf("Impersonation session expires too late: %v", impersonation.ExpiresAt)
+	}
+	user, session, err := Authenticate(ctx, impersonation.AccessToken)
+	if err != nil || user.ID != target.ID || session.ImpersonatorID == nil || *session.ImpersonatorID != admin.ID {
+		t.Fatalf("Authenticate impersonated session: unexpected result %v, %v", session, err)
+	}
+	impersonated := core.HttpRequest{Method: "POST", User: user}
+	impersonated.SetContext(ContextWithSession(ctx, session))
+	if response := LogoutHandler(impersonated); response.Status != 200 {
+		t.Errorf("Logout of impersonated session: expected 200, got %d", response.Status)
+	}
+
+	events, _, _ := repositories.Audit.List(ctx, db.AuditFilter{UserID: &target.ID, ActorID: &admin.ID, Limit: -1})
+	actions := map[string]int{}
+	for _, event := range events {
+		actions[event.Action]++
+		if event.Action == AuditLogout && event.Metadata["impersonated"] != "true" {
+			t.Errorf("Expected impersonated mark in %+v", event)
+		}
+	}
+	expected := map[string]int{AuditUserBan: 1, AuditUserUnban: 1, AuditUserClearLockout: 1, AuditUserPasswordReset: 1, AuditImpersonate: 1, AuditLogout: 1}
+	if !reflect.DeepEqual(actions, expected) {
+		t.Errorf("Expected audit events %v, got %v", expected, actions)
+	}
+}
+
+/*
+Test mfa.go
+*/
+func TestTotp(t *testing.T) {
+	// Тестовые векторы RFC 6238 (SHA1), последние 6 цифр
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	testCases := []struct {
+		unix     int64
+		expected string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.expected, func(t *testing.T) {
+			step, ok := verifyTotp(secret, tc.expected, time.Unix(tc.unix, 0), 0)
+			if !ok || step != tc.unix/totpPeriod {
+				t.Errorf("Expected code %s to be valid at %d", tc.expected, tc.unix)
+			}
+			if _, ok := verifyTotp(secret, tc.expected, time.Unix(tc.unix, 0), tc.unix/totpPeriod); ok {
+				t.Error("Expected reused code to be rejected")
+			}
+			if _, ok := verifyTotp(secret, tc.expected, time.Unix(tc.unix+totpPeriod*3, 0), 0); ok {
+				t.Error("Expected outdated code to be rejected")
+			}
+		})
+	}
+
+	config.Auth.TotpIssuer = "Test App"
+	uri := totpURI("ABC", "user@example.com")
+	if !strings.HasPrefix(uri, "otpauth://totp/Test%20App:user@example.com?") || !strings.Contains(uri, "secret=ABC") || !strings.Contains(uri, "issuer=Test+App") {
+		t.Errorf("Unexpected otpauth URI %s", uri)
+	}
+}
+
+func TestMfaHandlers(t *testing.T) {
+	repositories, _ := setupHandlers(t)
+	ctx := context.Background()
+	config.Auth.MfaChallengeExpiration = time.Minute
+
+	owner := createTestUser(t, repositories, "owner", "owner@example.com")
+	authRequest := func(method string, url string, body string) core.HttpRequest {
+		stored, _ := repositories.Users.GetByID(ctx, owner.ID)
+		return core.HttpRequest{Method: method, Url: url, Body: body, User: stored}
+	}
+	currentCode := func(secret string, offset int64) string {
+		key, _ := totpEncoding.DecodeString(secret)
+		return totpCode(key, time.Now().Unix()/totpPeriod+offset)
+	}
+
+	if response := ConfirmTotpHandler(authRequest("POST", "/user/mfa/totp/confirm", `{"code": "123456"}`)); response.Status != 409 {
+		t.Errorf("Confirm without enrollment: expected 409, got %d", response.Status)
+	}
+	response := TotpHandler(authRequest("POST", "/user/mfa/totp", ""))
+	var enrollment struct {
+		Secret string `json:"secret"`
+		URI    string `json:"otpauth_uri"`
+	}
+	if response.Status != 200 || json.Unmarshal([]byte(response.Body), &enrollment) != nil || !strings.Contains(enrollment.URI, enrollment.Secret) {
+		t.Fatalf("Enroll failed: %d %s", response.Status, response.Body)
+	}
+	// Неподтверждённый TOTP не требуется при входе
+	loginAs(t, owner.Email, testPassword)
+	if response := ConfirmTotpHandler(authRequest("POST", "/user/mfa/totp/confirm", `{"code": "000000x"}`)); response.Status != 400 {
+		t.Errorf("Confirm with invalid code: expected 400, got %d", response.Status)
+	}
+	response = ConfirmTotpHandler(authRequest("POST", "/user/mfa/totp/confirm", `{"code": "`+currentCode(enrollment.Secret, -1)+`"}`))
+	var recovery struct {
+		Codes []string `json:"recovery_codes"`
+	}
+	if response.Status != 200 || json.Unmarshal([]byte(response.Body), &recovery) != nil || len(recovery.Codes) != recoveryCodeCount {
+		t.Fatalf("Confirm failed: %d %s", response.Status, response.Body)
+	}
+	if response := TotpHandler(authRequest("POST", "/user/mfa/totp", "")); response.Status != 409 {
+		t.Errorf("Enroll when enabled: expected 409, got %d", response.Status)
+	}
+
+	challenge := func() string {
+		t.Helper()
+		response := AuthUserHandler(core.HttpRequest{Method: "POST", Body: `{"email": "owner@example.com", "password": "` + testPassword + `"}`})
+		var challenge mfaChallenge
+		if response.Status != 200 || json.Unmarshal([]byte(response.Body), &challenge) != nil || !challenge.MfaRequired || strings.Contains(response.Body, "access_token") {
+			t.Fatalf("Expected MFA challenge, got %d %s", response.Status, response.Body)
+		}
+		return challenge.MfaToken
+	}
+	verify := func(body string) core.HttpResponse {
+		return VerifyMfaHandler(core.HttpRequest{Method: "POST", Body: body})
+	}
+	token := challenge()
+	if _, err := ValidateAccessToken(token); err == nil {
+		t.Error("Expected MFA token not to be accepted as access token")
+	}
+
+	testCases := []struct {
+		name           string
+		body           string
+		expectedStatus int
+	}{
+		{"Missing code", `{"mfa_token": "` + token + `"}`, 400},
+		{"Both codes", `{"mfa_token": "` + token + `", "code": "123456", "recovery_code": "abcd-efgh"}`, 400},
+		{"Invalid token", `{"mfa_token": "invalid", "code": "123456"}`, 401},
+		{"Reused confirmation code", `{"mfa_token": "` + token + `", "code": "` + currentCode(enrollment.Secret, -1) + `"}`, 401},
+		{"Invalid recovery code", `{"mfa_token": "` + token + `", "recovery_code": "aaaa-aaaa"}`, 401},
+		{"Valid code", `{"mfa_token": "` + token + `", "code": "` + currentCode(enrollment.Secret, 0) + `", "device_name": "phone"}`, 200},
+		{"Replayed code", `{"mfa_token": "` + token + `", "code": "` + currentCode(enrollment.Secret, 0) + `"}`, 401},
+		{"Recovery code", `{"mfa_token": "` + token + `", "recovery_code": "` + strings.ToUpper(recovery.Codes[0]) + `"}`, 200},
+		{"Used recovery code", `{"mfa_token": "` + token + `", "recovery_code": "` + recovery.Codes[0] + `"}`, 401},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			response := verify(tc.body)
+			if response.Status != tc.expectedStatus {
+				t.Errorf("Expected status %d, got %d: %s", tc.expectedStatus, response.Status, response.Body)
+			}
+			if response.Status == 200 && !strings.Contains(response.Body, "refresh_token") {
+				t.Errorf("Expected token pair, got %s", response.Body)
+			}
+		})
+	}
+	if stored, _ := repositories.Users.GetByID(ctx, owner.ID); stored.AuthTries != 1 {
+		t.Errorf("Expected only the failed attempt after the last login to be counted, got %d", stored.AuthTries)
+	}
+	if response := MfaStatusHandler(authRequest("GET", "/user/mfa", "")); !strings.Contains(response.Body, fmt.Sprintf(`"recovery_codes_left":%d`, recoveryCodeCount-1)) {
+		t.Errorf("Unexpected MFA status %s", response.Body)
+	}
+
+	if response := TotpHandler(authRequest("DELETE", "/user/mfa/totp", `{"password": "Wr0ng!Pass"}`)); response.Status != 401 {
+		t.Errorf("Disable with wrong password: expected 401, got %d", response.Status)
+	}
+	if response := TotpHandler(authRequest("DELETE", "/user/mfa/totp", `{"password": "`+testPassword+`"}`)); response.Status != 200 {
+		t.Errorf("Disable: expected 200, got %d %s", response.Status, response.Body)
+	}
+	// После отключения вход снова без MFA
+	loginAs(t, owner.Email, testPassword)
+	if left, _ := repositories.RecoveryCodes.CountUnused(ctx, owner.ID); left != 0 {
+		t.Errorf("Expected recovery codes to be deleted, %d left", left)
+	}
+}
+
+/*
+Test keyring.go
+*/
+func TestKeyring(t *testing.T) {
+	initSecrets()
+	t.Cleanup(func() { keyring = nil })
+
+	for _, algorithm := range []string{AlgorithmEdDSA, AlgorithmRS256} {
+		t.Run(algorithm, func(t *testing.T) {
+			dir := t.TempDir()
+			loaded, err := LoadKeyring(dir, algorithm)
+			if err != nil {
+				t.Fatalf("Error loading keyring: %v", err)
+			}
+			keyring = loaded
+			first := keyring.Active()
+			if first == nil || first.Algorithm != algorithm {
+				t.Fatalf("Expected initial %s key, got %+v", algorithm, first)
+			}
+
+			token, err := GenerateAccessToken(7)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed, _, _ := jwt.NewParser().ParseUnverified(token, &Claims{})
+			if parsed.Header["kid"] != first.ID || parsed.Method.Alg() != algorithm {
+				t.Errorf("Unexpected token header %v", parsed.Header)
+			}
+			if _, err := ValidateAccessToken(token); err != nil {
+				t.Errorf("Error validating token: %v", err)
+			}
+
+			response := JWKSHandler(core.HttpRequest{Method: "GET"})
+			var set JWKSet
+			if response.Status != 200 || json.Unmarshal([]byte(response.Body), &set) != nil || len(set.Keys) != 1 {
+				t.Fatalf("Unexpected JWKS response: %d %s", response.Status, response.Body)
+			}
+			if jwk := set.Keys[0]; jwk.KeyID != first.ID || jwk.Algorithm != algorithm || strings.Contains(response.Body, `"d"`) {
+				t.Errorf("Unexpected JWK %+v", jwk)
+			}
+
+			reloaded, err := LoadKeyring(dir, algorithm)
+			if err != nil || reloaded.Active().ID != first.ID || !reloaded.Active().CreatedAt.Equal(first.CreatedAt) {
+				t.Fatalf("Key was not persisted: %v", err)
+			}
+
+			now := time.Now()
+			if rotated, err := keyring.Rotate(now, time.Hour, time.Hour); err != nil || rotated {
+				t.Errorf("Fresh key must not be rotated: %v, %v", rotated, err)
+			}
+			if rotated, err := keyring.Rotate(now.Add(2*time.Hour), time.Hour, time.Hour); err != nil || !rotated {
+				t.Fatalf("Expected rotation: %v, %v", rotated, err)
+			}
+			if keyring.Active().ID == first.ID || len(keyring.Keys()) != 2 {
+				t.Fatalf("Expected new active key and retiring key, got %d keys", len(keyring.Keys()))
+			}
+			if _, err := ValidateAccessToken(token); err != nil {
+				t.Errorf("Token signed with retiring key rejected: %v", err)
+			}
+
+			if _, err := keyring.Rotate(now.Add(4*time.Hour), 24*time.Hour, time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			if len(keyring.Keys()) != 1 || keyring.Lookup(first.ID) != nil {
+				t.Errorf("Retired key was not removed, %d keys left", len(keyring.Keys()))
+			}
+			if _, err := os.Stat(dir + "/" + first.ID + ".pem"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Retired key file was not removed: %v", err)
+			}
+			if _, err := ValidateAccessToken(token); err == nil {
+				t.Error("Token signed with removed key accepted")
+			}
+
+			// Ключ, созданный другим экземпляром сервера, находится после перечитывания каталога
+			local := keyring
+			other, err := LoadKeyring(dir, algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := other.Rotate(now.Add(6*time.Hour), time.Hour, 24*time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			keyring = other
+			token, _ = GenerateAccessToken(7)
+			keyring = local
+			if _, err := ValidateAccessToken(token); err == nil {
+				t.Error("Keys directory reloaded before keyReloadInterval passed")
+			}
+			local.mu.Lock()
+			local.lastReload = time.Time{}
+			local.mu.Unlock()
+			if _, err := ValidateAccessToken(token); err != nil {
+				t.Errorf("Token signed with key of another instance rejected: %v", err)
+			}
+		})
+	}
+
+	// Ключ другого алгоритма в каталоге пропускается
+	dir := t.TempDir()
+	if _, err := LoadKeyring(dir, AlgorithmRS256); err != nil {
+		t.Fatal(err)
+	}
+	mixed, err := OpenKeyring(dir, AlgorithmEdDSA)
+	if err != nil || len(mixed.Keys()) != 0 {
+		t.Errorf("RS256 key loaded into EdDSA keyring: %v", err)
+	}
+
+	// OpenKeyring не создает ключей в пустом каталоге
+	dir = t.TempDir()
+	if opened, err := OpenKeyring(dir, AlgorithmEdDSA); err != nil || opened.Active() != nil {
+		t.Errorf("Unexpected key in empty keyring: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("OpenKeyring wrote %d files", len(entries))
+	}
+
+	keyring = nil
+	if response := JWKSHandler(core.HttpRequest{Method: "GET"}); response.Status != 404 {
+		t.Errorf("Expected 404 without keyring, got %d", response.Status)
+	}
+	hsToken, _ := GenerateAccessToken(7)
+	loaded, _ := LoadKeyring(t.TempDir(), AlgorithmEdDSA)
+	keyring = loaded
+	if _, err := ValidateAccessToken(hsToken); err != nil {
+		t.Errorf("HS256 token issued before switching to keys rejected: %v", err)
+	}
+	config.JWT.AccessSecretKey = ""
+	defer initSecrets()
+	if _, err := ValidateAccessToken(hsToken); err == nil {
+		t.Error("HS256 token accepted without the secret")
+	}
+}
+
+/*
+Фейковый провайдер OpenID Connect для TestOIDCLogin: discovery, JWKS и token endpoint с проверкой PKCE
+*/
+type fakeOIDCProvider struct {
+	*httptest.Server
+	key    *rsa.PrivateKey
+	mu     sync.Mutex
+	grants map[string]fakeOIDCGrant
+}
+
+type fakeOIDCGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := &fakeOIDCProvider{key: key, grants: make(map[string]fakeOIDCGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                provider.URL,
+			AuthorizationEndpoint: provider.URL + "/authorize",
+			TokenEndpoint:         provider.URL + "/token",
+			JWKSURI:               provider.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]oidcJWK{"keys": {{
+			KeyType: "RSA", KeyID: "k1", Use: "sig",
+			N: base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		clientID, secret, _ := r.BasicAuth()
+		provider.mu.Lock()
+		grant, ok := provider.grants[r.Form.Get("code")]
+		delete(provider.grants, r.Form.Get("code"))
+		provider.mu.Unlock()
+		if clientID != "client" || secret != "secret" || r.Form.Get("grant_type") != "authorization_code" ||
+			r.Form.Get("redirect_uri") != "https://app.example.com/oidc" || !ok || pkceChallenge(r.Form.Get("code_verifier")) != grant.challenge {
+			w.WriteHeader(400)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, grant.claims)
+		token.Header["kid"] = "k1"
+		signed, _ := token.SignedString(key)
+		json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": signed})
+	})
+	provider.Server = httptest.NewServer(mux)
+	t.Cleanup(provider.Close)
+	return provider
+}
+
+/*
+Вход пользователя на странице провайдера: проверка параметров запроса и выдача кода с claims поверх стандартных
+*/
+func (p *fakeOIDCProvider) authorize(t *testing.T, authorizationURL string, claims jwt.MapClaims) string {
+	t.Helper()
+	parsed, err := url.Parse(authorizationURL)
+	if err != nil || !strings.HasPrefix(authorizationURL, p.URL+"/authorize?") {
+		t.Fatalf("Unexpected authorization URL %q", authorizationURL)
+	}
+	query := parsed.Query()
+	if query.Get("client_id") != "client" || query.Get("response_type") != "code" || query.Get("code_challenge_method") != "S256" ||
+		!strings.Contains(query.Get("scope"), "openid") || query.Get("redirect_uri") != "https://app.example.com/oidc" {
+		t.Fatalf("Unexpected authorization request %v", query)
+	}
+	granted := jwt.MapClaims{
+		"iss":   p.URL,
+		"aud":   "client",
+		"exp":   time.Now().Add(5 * time.Minute).Unix(),
+		"iat":   time.Now().Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for name, value := range claims {
+		granted[name] = value
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	code := fmt.Sprintf("code-%d", len(p.grants)+1) + query.Get("state")[:8]
+	p.grants[code] = fakeOIDCGrant{challenge: query.Get("code_challenge"), claims: granted}
+	return code
+}
+
+func TestOIDCLogin(t *testing.T) {
+	repositories, _ := setupHandlers(t)
+	ctx := context.Background()
+	provider := newFakeOIDCProvider(t)
+	prevOIDC := config.OIDC
+	config.OIDC = core.OIDCConfig{
+		RedirectURL:     "https://app.example.com/oidc",
+		StateExpiration: time.Minute,
+		Providers:       map[string]core.OIDCProvider{"fake": {Issuer: provider.URL, ClientID: "client", ClientSecret: "secret"}},
+	}
+	t.Cleanup(func() { config.OIDC = prevOIDC })
+
+	hash, _ := HashPassword("Str0ng!Pass")
+	owner := &db.User{Username: "owner", Email: "owner@example.com", Password: hash, IsActive: true}
+	banned := &db.User{Username: "banned", Email: "banned@example.com", Password: hash, IsActive: true, BannedAt: new(time.Time)}
+	secured := &db.User{Username: "secured", Email: "secured@example.com", Password: hash, IsActive: true, TotpSecret: "JBSWY3DPEHPK3PXP", TotpEnabledAt: new(time.Time)}
+	pending := &db.User{Username: "pending", Email: "pending@example.com", Password: hash}
+	for _, user := range []*db.User{owner, banned, secured, pending} {
+		if err := repositories.Users.Create(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	start := func() oidcStartResponse {
+		t.Helper()
+		response := OIDCStartHandler(core.HttpRequest{Method: "POST", Url: "/user/oidc/fake/start"})
+		var started oidcStartResponse
+		if response.Status != 200 || json.Unmarshal([]byte(response.Body), &started) != nil || started.State == "" {
+			t.Fatalf("Start failed: %d %s", response.Status, response.Body)
+		}
+		return started
+	}
+	callback := func(code string, state string) core.HttpResponse {
+		return OIDCCallbackHandler(core.HttpRequest{Method: "POST", Url: "/user/oidc/fake/callback", Body: fmt.Sprintf(`{"code": %q, "state": %q}`, code, state)})
+	}
+	loggedInAs := func(response core.HttpResponse) uint {
+		var tokens TokenPair
+		if response.Status != 200 || json.Unmarshal([]byte(response.Body), &tokens) != nil {
+			return 0
+		}
+		claims, err := ValidateAccessToken(tokens.AccessToken)
+		if err != nil {
+			return 0
+		}
+		userID, _ := claims.UserID()
+		return userID
+	}
+
+	if response := OIDCProvidersHandler(core.HttpRequest{Method: "GET"}); response.Status != 200 || response.Body != `["fake"]` {
+		t.Errorf("Providers: expected [\"fake\"], got %d %s", response.Status, response.Body)
+	}
+	if response := OIDCStartHandler(core.HttpRequest{Method: "POST", Url: "/user/oidc/other/start"}); response.Status != 404 {
+		t.Errorf("Unknown provider: expected 404, got %d", response.Status)
+	}
+
+	cases := []struct {
+		name   string
+		claims jwt.MapClaims
+		status int
+	}{
+		{"Unverified email", jwt.MapClaims{"sub": "u1", "email": "new@example.com", "email_verified": false}, 403},
+		{"Wrong nonce", jwt.MapClaims{"sub": "u1", "email": "new@example.com", "email_verified": true, "nonce": "other"}, 401},
+		{"Wrong audience", jwt.MapClaims{"sub": "u1", "email": "new@example.com", "email_verified": true, "aud": "other"}, 401},
+		{"Wrong issuer", jwt.MapClaims{"sub": "u1", "email": "new@example.com", "email_verified": true, "iss": "https://evil.example.com"}, 401},
+		{"Expired token", jwt.MapClaims{"sub": "u1", "email": "new@example.com", "email_verified": true, "exp": time.Now().Add(-time.Hour).Unix()}, 401},
+		{"Banned user", jwt.MapClaims{"sub": "u2", "email": "banned@example.com", "email_verified": true}, 403},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			started := start()
+			if response := callback(provider.authorize(t, started.AuthorizationURL, tc.claims), started.State); response.Status != tc.status {
+				t.Errorf("Expected %d, got %d %s", tc.status, response.Status, response.Body)
+			}
+		})
+	}
+	if _, err := repositories.Users.GetByEmail(ctx, "new@example.com"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Rejected logins must not create users: %v", err)
+	}
+
+	started := start()
+	code := provider.authorize(t, started.AuthorizationURL, jwt.MapClaims{"sub": "u1", "email": "new@example.com", "email_verified": true, "preferred_username": "New User!"})
+	if response := callback(code, "unknown"); response.Status != 401 {
+		t.Errorf("Unknown state: expected 401, got %d", response.Status)
+	}
+	response := callback(code, started.State)
+	created, err := repositories.Users.GetByEmail(ctx, "new@example.com")
+	if err != nil || !created.IsActive || created.Username != "New_User" || loggedInAs(response) != created.ID {
+		t.Fatalf("Expected new active user to be logged in, got %d %s, %+v, %v", response.Status, response.Body, created, err)
+	}
+	if response := callback(code, started.State); response.Status != 401 {
+		t.Errorf("Reused state: expected 401, got %d", response.Status)
+	}
+
+	started = start()
+	response = callback(provider.authorize(t, started.AuthorizationURL, jwt.MapClaims{"sub": "u1", "email": "changed@example.com"}), started.State)
+	if loggedInAs(response) != created.ID {
+		t.Errorf("Linked identity: expected login as user %d, got %d %s", created.ID, response.Status, response.Body)
+	}
+
+	started = start()
+	response = callback(provider.authorize(t, started.AuthorizationURL, jwt.MapClaims{"sub": "u3", "email": "owner@example.com", "email_verified": "true"}), started.State)
+	if loggedInAs(response) != owner.ID {
+		t.Errorf("Verified email: expected link to user %d, got %d %s", owner.ID, response.Status, response.Body)
+	}
+	if identities, _ := repositories.Identities.ListByUser(ctx, owner.ID); len(identities) != 1 || identities[0].Provider != "fake" {
+		t.Errorf("Expected one linked identity, got %+v", identities)
+	}
+
+	// Неактивный пользователь не подтвердил email, его аккаунт не привязывается и не активируется
+	started = start()
+	if response := callback(provider.authorize(t, started.AuthorizationURL, jwt.MapClaims{"sub": "u6", "email": "pending@example.com", "email_verified": true}), started.State); response.Status != 409 {
+		t.Errorf("Not activated user: expected 409, got %d %s", response.Status, response.Body)
+	}
+	if identities, _ := repositories.Identities.ListByUser(ctx, pending.ID); len(identities) != 0 {
+		t.Errorf("Identity linked to not activated user: %+v", identities)
+	}
+	if stored, _ := repositories.Users.GetByID(ctx, pending.ID); stored.IsActive {
+		t.Error("Provider login activated the user")
+	}
+
+	// Неподтвержденный новый email не используется для привязки
+	owner.PendingEmail = "claimed@example.com"
+	repositories.Users.Save(ctx, owner)
+	started = start()
+	response = callback(provider.authorize(t, started.AuthorizationURL, jwt.MapClaims{"sub": "u7", "email": "claimed@example.com", "email_verified": true}), started.State)
+	if userID := loggedInAs(response); userID == 0 || userID == owner.ID {
+		t.Errorf("Pending email: expected a new user, got %d %s", response.Status, response.Body)
+	}
+
+	started = start()
+	response = callback(provider.authorize(t, started.AuthorizationURL, jwt.MapClaims{"sub": "u4", "email": "secured@example.com", "email_verified": true}), started.State)
+	if response.Status != 200 || !strings.Contains(response.Body, "mfa_token") || strings.Contains(response.Body, "access_token") {
+		t.Errorf("Expected MFA challenge, got %d %s", response.Status, response.Body)
+	}
+
+	started = start()
+	code = provider.authorize(t, started.AuthorizationURL, jwt.MapClaims{"sub": "u5", "email": "other@example.com", "email_verified": true})
+	provider.mu.Lock()
+	provider.grants[code] = fakeOIDCGrant{challenge: pkceChallenge("stolen"), claims: provider.grants[code].claims}
+	provider.mu.Unlock()
+	if response := callback(code, started.State); response.Status != 401 {
+		t.Errorf("PKCE mismatch: expected 401, got %d", response.Status)
+	}
+}
@@ -1,17 +1,20 @@
 package user
 
 import (
+	"crypto/rand"
 	"encoding/hex"
 	"io"
 	"log"
+	"math/big"
 	"net/http"
 	"sort"
 	"strings"
 	"time"
-
-	"golang.org/x/exp/rand"
 )
 
+// Проверка домена при валидации email, в тестах подменяется, чтобы не ходить в сеть
+var checkDomain = CheckDomain
+
 func CheckDomain(email string) bool {
 	emailDomain := strings.Split(email, "@")[1]
 
@@ -38,13 +41,54 @@ func CheckDomain(email string) bool {
 	return true
 }
 
+/*
+Коды и токены - секреты, поэтому берутся из crypto/rand: math/rand с сидом от текущего времени угадывается по времени запроса
+*/
 func generateActivationCode() int {
-	rand.Seed(uint64(time.Now().UnixNano()))
-	return rand.Intn(99999) + 100000
+	n, err := rand.Int(rand.Reader, big.NewInt(900000))
+	if err != nil {
+		// crypto/rand не возвращает ошибок на поддерживаемых платформах
+		panic(err)
+	}
+	return int(n.Int64()) + 100000
+}
+
+/*
+Блокировка после tries неверных кодов активации или сброса пароля: на 5, 7 и 10 попытке, затем на каждой пятой
+До 5 попыток блокировки нет (в том числе при tries == 0, хотя 0 делится на 5)
+*/
+func otpLockout(tries int) time.Duration {
+	switch {
+	case tries == 5:
+		return config.Auth.OtpTimeout
+	case tries == 7:
+		return config.Auth.OtpTimeout * 5
+	case tries == 10:
+		return config.Auth.OtpTimeout * 10
+	case tries%5 == 0 && tries > 10:
+		return config.Auth.OtpTimeout * 30
+	}
+	return 0
+}
+
+/*
+Блокировка входа после tries неверных паролей или кодов второго фактора: на 3, 5 и 8 попытке, затем на каждой пятой после 10
+*/
+func authLockout(tries int) time.Duration {
+	switch {
+	case tries == 3:
+		return config.Auth.AuthTimeout
+	case tries == 5:
+		return config.Auth.AuthTimeout * 5
+	case tries == 8:
+		return config.Auth.AuthTimeout * 10
+	case tries%5 == 0 && tries > 10:
+		return config.Auth.AuthTimeout * 30
+	}
+	return 0
 }
 
 func generateSecureToken() (string, error) {
-	rand.Seed(uint64(time.Now().UnixNano()))
 	bytes := make([]byte, 16)
 	_, err := rand.Read(bytes)
 	if err != nil {
@@ -108,7 +108,7 @@ func ValidateEmail(email string, rules *ValidationRules) *ValidationError {
 		}
 	}
 
-	if !CheckDomain(email) {
+	if !checkDomain(email) {
 		return &ValidationError{
 			Field:   "email",
 			Message: "email domain is not allowed",